@@ -1,53 +1,146 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/kaitolucifer/user-balance-management/config"
+	"github.com/kaitolucifer/user-balance-management/domain"
 	"github.com/kaitolucifer/user-balance-management/infrastructure"
 	"github.com/kaitolucifer/user-balance-management/injector"
 	GrpcHandler "github.com/kaitolucifer/user-balance-management/presentation/grpc"
 	RestfulHandler "github.com/kaitolucifer/user-balance-management/presentation/restful"
+	"github.com/kaitolucifer/user-balance-management/usecase"
 )
 
-var useGrpc = flag.Bool("use_grpc", true, "true to use gRPC API and false to use normal RESTful API")
-
-// DB設定
-var dbHost = flag.String("dbhost", "localhost", "database host")
-var dbName = flag.String("dbname", "user_balance", "database name")
-var dbUser = flag.String("dbuser", "admin", "database user name")
-var dbPassword = flag.String("dbpass", "password", "database password")
-var dbPort = flag.String("dbport", "5432", "database port number")
-var dbSSL = flag.String("dbssl", "disable", "use database ssl tunnel or not")
-
+var cfg config.Config
+var logger domain.Logger
 var db infrastructure.DB
+var authenticator domain.Authenticator
+var clientRateLimiter domain.RateLimiter
+var userRateLimiter domain.RateLimiter
+var metrics *infrastructure.PrometheusMetrics
+var tracerProvider *infrastructure.TracerProvider
 var restfulHandler *RestfulHandler.RestfulUserBalanceHandler
 var grpcHandler *GrpcHandler.GrpcUserBalanceHander
 var grpcHealthCheckHandler *GrpcHandler.HealthCheckHandler
+var eventBroker *RestfulHandler.BalanceEventBroker
+var aggregateRefresher *usecase.AggregateRefresher
+var hotAccountCompactor *infrastructure.HotAccountCompactor
 var mux http.Handler
 
 func configApp() {
-	flag.Parse()
+	var err error
+	cfg, err = config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger = injector.InjectLogger(cfg.Log.Format, cfg.Log.Level)
+	logger.Info("effective configuration", "config", cfg.Redacted())
+
+	var repo domain.UserBalanceRepository
+	if cfg.DB.Driver == config.DBDriver_Memory {
+		// DBに接続しないため、dbはゼロ値のまま(メトリクスの接続プール統計も記録しない)
+		logger.Warn("using in-memory repository: data will be lost on exit", "seed_file", cfg.DB.SeedFile)
+		repo = injector.InjectMemoryRepository(cfg.DB.SeedFile)
+	} else {
+		db = injector.InjectDatabase(cfg.DatabaseDSN(), infrastructure.DBPoolConfig{
+			MaxOpenConns:    cfg.DB.MaxOpenConns,
+			MaxIdleConns:    cfg.DB.MaxIdleConns,
+			ConnMaxLifetime: time.Duration(cfg.DB.ConnMaxLifetime),
+		}, infrastructure.ReplicaConfig{
+			DSNs:          cfg.DB.ReplicaDSNs,
+			MaxStaleness:  time.Duration(cfg.DB.ReplicaMaxStaleness),
+			CheckInterval: time.Duration(cfg.DB.ReplicaCheckInterval),
+			Logger:        logger,
+		})
+		checkSchemaVersion()
+		repo = injector.InjectRepository(db)
+	}
+	tracerProvider = injector.InjectTracerProvider(cfg.Tracing.Exporter, cfg.Tracing.Target, cfg.Tracing.SampleRatio)
+	if tracerProvider != nil {
+		repo = injector.InjectTracedRepository(repo)
+	}
+	if cfg.Features.Metrics {
+		metrics = injector.InjectMetrics(db)
+	}
+	if balanceCache := injector.InjectBalanceCache(cfg.Cache.BalanceSize, time.Duration(cfg.Cache.BalanceTTL)); balanceCache != nil {
+		var recorder domain.MetricsRecorder
+		if metrics != nil {
+			recorder = metrics
+		}
+		repo = injector.InjectCachedRepository(repo, balanceCache, recorder, time.Duration(cfg.DB.OperationTimeout))
+	}
+	if interval := time.Duration(cfg.DB.AggregateRefreshInterval); interval > 0 {
+		aggregateRefresher = injector.InjectAggregateRefresher(repo, interval, logger)
+	}
+	// ホットアカウントはDBのリポジトリのみが対応するため、メモリ上のリポジトリでは圧縮しない
+	if interval := time.Duration(cfg.DB.HotAccountCompactInterval); interval > 0 && db.DB != nil {
+		hotAccountCompactor = injector.InjectHotAccountCompactor(db, interval, logger)
+	}
+	authenticator = injector.InjectAuthenticator(cfg.Auth.APIKeysFile, cfg.Auth.JWKSFile, cfg.Auth.JWTIssuer, cfg.Auth.JWTAudience)
+	clientRateLimiter = injector.InjectRateLimiter(cfg.RateLimit.Client, cfg.RateLimit.ClientBurst)
+	userRateLimiter = injector.InjectRateLimiter(cfg.RateLimit.User, cfg.RateLimit.UserBurst)
 
-	dsn := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s",
-		*dbHost, *dbPort, *dbName, *dbUser, *dbPassword, *dbSSL)
-	db = injector.InjectDatabase(dsn)
-	repo := injector.InjectRepository(db)
-	usecase := injector.InjectUsecase(repo)
+	var hooks []domain.AfterCommitHook
+	if cfg.ServeRestful() && cfg.Features.BalanceEvents {
+		eventBroker = injector.InjectBalanceEventBroker()
+		hooks = append(hooks, eventBroker.Publish)
+	}
+	usecase := injector.InjectUsecase(repo, time.Duration(cfg.DB.OperationTimeout), cfg.Auth.Disabled, hooks...)
+	if metrics != nil {
+		usecase = injector.InjectInstrumentedUsecase(usecase, metrics)
+	}
+	if tracerProvider != nil {
+		usecase = injector.InjectTracedUsecase(usecase)
+	}
 
-	if *useGrpc {
+	if cfg.Auth.Disabled {
+		logger.Warn("authentication is disabled: all requests are allowed")
+	} else if authenticator == nil {
+		logger.Error("authentication is not configured: all requests except health checks are denied, set auth.api_keys_file or auth.jwks_file")
+	}
+	// RESTfulとgRPCのハンドラは同じusecaseを共有する
+	if cfg.ServeGrpc() {
 		app := new(GrpcHandler.App)
-		app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-		app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+		app.Logger = logger
 		grpcHandler = injector.InjectGrpcHandler(usecase, app)
-	} else {
+		grpcHealthCheckHandler = injector.InjectGrpcHealthCheckHandler()
+	}
+	if cfg.ServeRestful() {
 		app := new(RestfulHandler.App)
-		app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-		app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+		app.Logger = logger
+		app.EventBroker = eventBroker
+		app.Authenticator = authenticator
+		app.ClientRateLimiter = clientRateLimiter
+		app.UserRateLimiter = userRateLimiter
+		if metrics != nil {
+			app.Metrics = metrics
+		}
+		app.Tracing = tracerProvider != nil
+		if cfg.ServeGateway() {
+			app.Gateway = injector.InjectGateway(cfg.GatewayEndpoint())
+		}
 		restfulHandler = injector.InjectRestfulHandler(usecase, app)
 		mux = RestfulHandler.Routes(restfulHandler)
 	}
 }
+
+// checkSchemaVersion DBのスキーマがバイナリに埋め込んだマイグレーションの最新バージョンでなければ終了
+func checkSchemaVersion() {
+	migrator := injector.InjectMigrator(db)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DB.OperationTimeout))
+	defer cancel()
+	if err := migrator.CheckVersion(ctx); err != nil {
+		logger.Error("refusing to serve: database schema is not up to date", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("database schema is up to date", "version", migrator.Latest())
+}
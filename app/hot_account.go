@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/injector"
+)
+
+// hotAccountUsage hot-accountサブコマンドの使い方
+const hotAccountUsage = `usage: %[1]s hot-account <command> [flags]
+
+commands:
+  enable USER_ID N   split the balance of the user into N slots (1-%[2]d)
+  disable USER_ID    merge the slots of the user back into a single balance
+  compact            move the slot balances of all hot accounts back to their main row (the server also runs this every -db_hot_account_compact_interval)
+  list               show hot accounts and their balances
+
+flags are the same as the server (e.g. -dsn, -dbhost, -config)
+`
+
+// runHotAccount ホットアカウントの残高の分割、分割の解除、圧縮または一覧の表示を行い、終了コードを返す
+func runHotAccount(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, hotAccountUsage, os.Args[0], infrastructure.MaxBalanceSlots)
+		return 2
+	}
+	command, args := popArg(args)
+
+	var userID string
+	var slots int
+	switch command {
+	case "enable":
+		var arg string
+		userID, args = popArg(args)
+		arg, args = popArg(args)
+		v, err := strconv.Atoi(arg)
+		if userID == "" || err != nil {
+			return usage()
+		}
+		slots = v
+	case "disable":
+		userID, args = popArg(args)
+		if userID == "" {
+			return usage()
+		}
+	case "compact", "list":
+	default:
+		return usage()
+	}
+	if extra, _ := popArg(args); extra != "" {
+		return usage()
+	}
+
+	db, err := commandDatabase(os.Args[0]+" hot-account "+command, args)
+	if err != nil {
+		return configErrorCode(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	if err := injector.InjectMigrator(db).CheckVersion(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	manager := injector.InjectHotAccountManager(db)
+
+	switch command {
+	case "enable", "disable":
+		if command == "enable" {
+			err = manager.Enable(ctx, userID, slots)
+		} else {
+			err = manager.Disable(ctx, userID)
+		}
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "user %s does not exist\n", userID)
+			return 1
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s has %d balance slots\n", userID, slots)
+	case "compact":
+		compacted, err := manager.Compact(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%d hot accounts compacted\n", compacted)
+	case "list":
+		accounts, err := manager.List(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%-36s %5s %12s %12s\n", "USER_ID", "SLOTS", "BALANCE", "IN_SLOTS")
+		for _, account := range accounts {
+			fmt.Printf("%-36s %5d %12d %12d\n", account.UserID, account.Slots, account.Balance+account.SlotBalance, account.SlotBalance)
+		}
+	}
+	return 0
+}
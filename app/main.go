@@ -1,36 +1,329 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	GrpcHandler "github.com/kaitolucifer/user-balance-management/presentation/grpc"
 	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"github.com/soheilhy/cmux"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 )
 
-const restfulPortNumber = ":8080"
-const grpcPortNumber = ":50051"
+// flushTimeout シャットダウン時にトレースなどの送信待ちのデータを送り出す時間
+const flushTimeout = 5 * time.Second
+
+// fatal エラーログを出力して終了
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newAdminServer 管理用ポートで/metricsを提供するサーバーを作成
+func newAdminServer() *http.Server {
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", metrics.Handler())
+	return &http.Server{
+		Addr:              cfg.Server.AdminAddr,
+		Handler:           adminMux,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+	}
+}
+
+// newGrpcServer インターセプタとハンドラを登録したgRPCサーバーを作成
+func newGrpcServer() *grpc.Server {
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	var streamInterceptors []grpc.StreamServerInterceptor
+	if tracerProvider != nil {
+		unaryInterceptors = append(unaryInterceptors, GrpcHandler.TracingUnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, GrpcHandler.TracingStreamInterceptor())
+	}
+	unaryInterceptors = append(unaryInterceptors, GrpcHandler.RequestIDUnaryInterceptor(logger))
+	streamInterceptors = append(streamInterceptors, GrpcHandler.RequestIDStreamInterceptor(logger))
+	if metrics != nil {
+		unaryInterceptors = append(unaryInterceptors, GrpcHandler.MetricsUnaryInterceptor(metrics))
+		streamInterceptors = append(streamInterceptors, GrpcHandler.MetricsStreamInterceptor(metrics))
+	}
+	if authenticator != nil {
+		unaryInterceptors = append(unaryInterceptors, GrpcHandler.AuthUnaryInterceptor(authenticator))
+		streamInterceptors = append(streamInterceptors, GrpcHandler.AuthStreamInterceptor(authenticator))
+	}
+	if clientRateLimiter != nil || userRateLimiter != nil {
+		unaryInterceptors = append(unaryInterceptors, GrpcHandler.RateLimitUnaryInterceptor(clientRateLimiter, userRateLimiter))
+		streamInterceptors = append(streamInterceptors, GrpcHandler.RateLimitStreamInterceptor(clientRateLimiter, userRateLimiter))
+	}
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
+	proto.RegisterUserBalanceServer(s, grpcHandler)
+	proto.RegisterHealthServer(s, grpcHealthCheckHandler)
+	if cfg.Features.GrpcReflection {
+		reflection.Register(s)
+	}
+	return s
+}
+
+// gracefulStopGrpc 処理中のRPCの完了を待ってgRPCサーバーを停止し、期限を過ぎた場合は強制的に停止
+func gracefulStopGrpc(ctx context.Context, s *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// shutdownHTTP 処理中のリクエストの完了を待ってHTTPサーバーを停止し、期限を過ぎた場合は強制的に停止
+func shutdownHTTP(ctx context.Context, srv *http.Server) error {
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// server 起動と停止の処理をまとめたサーバー
+type server struct {
+	name  string
+	serve func() error                // 正常に停止した場合はnilを返す
+	drain func(context.Context) error // 処理中のリクエストの完了を待って停止
+}
+
+// newRestfulServer RESTful APIを提供するHTTPサーバーを作成
+func newRestfulServer() *http.Server {
+	srv := &http.Server{
+		Addr:              cfg.Server.RestfulAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+	}
+	if eventBroker != nil {
+		// Server-Sent Eventsの接続は終了しないため、シャットダウン開始時に配信を終了させる
+		srv.RegisterOnShutdown(eventBroker.Close)
+	}
+	return srv
+}
+
+// httpServer リスナーで待ち受けるHTTPサーバー
+func httpServer(name string, srv *http.Server, l net.Listener) server {
+	return server{
+		name: name,
+		serve: func() error {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+		drain: func(ctx context.Context) error {
+			return shutdownHTTP(ctx, srv)
+		},
+	}
+}
+
+// grpcServer リスナーで待ち受けるgRPCサーバー
+func grpcServer(s *grpc.Server, l net.Listener) server {
+	return server{
+		name: "gRPC",
+		// GracefulStopまたはStopで停止した場合はnilを返す
+		serve: func() error { return s.Serve(l) },
+		drain: func(ctx context.Context) error {
+			return gracefulStopGrpc(ctx, s)
+		},
+	}
+}
+
+// listen 設定に従ってAPIのリスナーとサーバーを作成
+// 1つのポートで提供する場合、HTTP/2でContent-Typeがapplication/grpcの接続をgRPCに、それ以外をRESTfulに振り分ける
+func listen() ([]server, error) {
+	if cfg.Multiplexed() {
+		l, err := net.Listen("tcp", cfg.Server.RestfulAddr)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("starting RESTful and gRPC application on single port", "addr", cfg.Server.RestfulAddr)
+		m := cmux.New(l)
+		grpcL := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+		restfulL := m.Match(cmux.Any())
+		return []server{
+			grpcServer(newGrpcServer(), grpcL),
+			httpServer("RESTful", newRestfulServer(), restfulL),
+			{
+				name: "multiplexer",
+				// 各サーバーの停止時にリスナーが閉じられるとエラーを返すが、その時点で既にシャットダウン中である
+				serve: m.Serve,
+				drain: func(context.Context) error {
+					m.Close()
+					return nil
+				},
+			},
+		}, nil
+	}
+
+	var servers []server
+	if cfg.ServeGrpc() {
+		l, err := net.Listen("tcp", cfg.Server.GrpcAddr)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("starting gRPC application", "addr", cfg.Server.GrpcAddr)
+		servers = append(servers, grpcServer(newGrpcServer(), l))
+	}
+	if cfg.ServeRestful() {
+		l, err := net.Listen("tcp", cfg.Server.RestfulAddr)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("starting RESTful application", "addr", cfg.Server.RestfulAddr)
+		servers = append(servers, httpServer("RESTful", newRestfulServer(), l))
+	}
+	return servers, nil
+}
+
+// setDraining 全てのヘルスチェックを停止中にする
+func setDraining() {
+	if grpcHealthCheckHandler != nil {
+		grpcHealthCheckHandler.SetDraining()
+	}
+	if restfulHandler != nil {
+		restfulHandler.SetDraining()
+	}
+}
+
+// drainAll 全てのサーバーを並行して停止し、処理中のリクエストの完了を待つ
+func drainAll(ctx context.Context, servers []server) bool {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := true
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s server) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				logger.Error("failed to drain in-flight requests", "server", s.name, "error", err)
+				mu.Lock()
+				ok = false
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return ok
+}
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "dev-seed":
+			os.Exit(runDevSeed(os.Args[2:]))
+		case "hot-account":
+			os.Exit(runHotAccount(os.Args[2:]))
+		}
+	}
 	configApp()
-	defer db.Close()
-	if *useGrpc {
-		listener, err := net.Listen("tcp", "0.0.0.0"+grpcPortNumber)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	servers, err := listen()
+	if err != nil {
+		fatal("failed to listen", err)
+	}
+	if metrics != nil {
+		l, err := net.Listen("tcp", cfg.Server.AdminAddr)
 		if err != nil {
-			grpcHandler.App.ErrorLog.Fatalf("failed to listen: %s", err)
+			fatal("failed to listen", err)
 		}
-		grpcHandler.App.InfoLog.Printf("starting gRPC application on port %s\n", grpcPortNumber)
-		s := grpc.NewServer()
-		proto.RegisterUserBalanceServer(s, grpcHandler)
-		proto.RegisterHealthServer(s, grpcHealthCheckHandler)
-		grpcHandler.App.ErrorLog.Fatal(s.Serve(listener))
-	} else {
-		restfulHandler.App.InfoLog.Printf("starting RESTful application on port %s\n", restfulPortNumber)
-		srv := &http.Server{
-			Addr:    restfulPortNumber,
-			Handler: mux,
+		logger.Info("serving metrics", "addr", cfg.Server.AdminAddr, "path", "/metrics")
+		servers = append(servers, httpServer("admin", newAdminServer(), l))
+	}
+
+	// バックグラウンドのジョブはシグナルを受信した時点で中断する(コミット済みの日の集計やユーザーの圧縮は次回に引き継がれる)
+	var jobs sync.WaitGroup
+	if aggregateRefresher != nil {
+		logger.Info("refreshing daily transaction aggregates in background", "interval", time.Duration(cfg.DB.AggregateRefreshInterval).String())
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			aggregateRefresher.Run(ctx)
+		}()
+	}
+	if hotAccountCompactor != nil {
+		logger.Info("compacting hot accounts in background", "interval", time.Duration(cfg.DB.HotAccountCompactInterval).String())
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			hotAccountCompactor.Run(ctx)
+		}()
+	}
+
+	serverErr := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) {
+			if err := s.serve(); err != nil {
+				serverErr <- fmt.Errorf("%s server stopped: %w", s.name, err)
+			}
+		}(s)
+	}
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		logger.Info("shutdown signal received")
+	case err := <-serverErr:
+		logger.Error("server failed", "error", err)
+		exitCode = 1
+	}
+	// 2回目のシグナルではデフォルトの動作で即時終了させる
+	stop()
+
+	setDraining()
+	if delay := time.Duration(cfg.Server.ShutdownDelay); delay > 0 {
+		logger.Info("reporting not serving before draining", "delay", delay.String())
+		time.Sleep(delay)
+	}
+
+	logger.Info("draining in-flight requests", "timeout", time.Duration(cfg.Server.ShutdownTimeout).String())
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+	defer cancelDrain()
+	if !drainAll(drainCtx, servers) {
+		exitCode = 1
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(flushCtx); err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}
+	jobs.Wait()
+	if db.DB != nil {
+		if err := db.Close(); err != nil {
+			logger.Error("failed to close database", "error", err)
 		}
+	}
+	logger.Info("shutdown completed")
 
-		restfulHandler.App.ErrorLog.Fatal(srv.ListenAndServe())
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/config"
+	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/injector"
+	"github.com/kaitolucifer/user-balance-management/migrations"
+)
+
+// migrateUsage migrateサブコマンドの使い方
+const migrateUsage = `usage: %[1]s migrate <command> [flags]
+
+commands:
+  up [N]          apply all or N pending migrations
+  down [N]        revert N applied migrations (default 1)
+  status          show applied and pending migrations
+  force VERSION   set schema version without running migrations and clear dirty state (0 for none)
+
+flags are the same as the server (e.g. -dsn, -dbhost, -config)
+`
+
+// devSeedUsage dev-seedサブコマンドの使い方
+const devSeedUsage = `usage: %[1]s dev-seed [up|down] [flags]
+
+insert (up, default) or delete (down) test users for local development
+flags are the same as the server (e.g. -dsn, -dbhost, -config)
+`
+
+// commandTimeout サブコマンドのDB操作のタイムアウト(マイグレーションは時間がかかる場合がある)
+const commandTimeout = 10 * time.Minute
+
+// commandDatabase サブコマンドの引数から設定を読み込み、DBに接続する
+func commandDatabase(name string, args []string) (infrastructure.DB, error) {
+	cfg, err := config.Load(name, args, os.Getenv)
+	if err != nil {
+		return infrastructure.DB{}, err
+	}
+	if cfg.DB.Driver != config.DBDriver_Postgres {
+		return infrastructure.DB{}, fmt.Errorf("%s requires %s driver", name, config.DBDriver_Postgres)
+	}
+	db := injector.InjectDatabase(cfg.DatabaseDSN(), infrastructure.DBPoolConfig{MaxOpenConns: 1, MaxIdleConns: 1}, infrastructure.ReplicaConfig{})
+	return db, nil
+}
+
+// configErrorCode 設定の読み込みに失敗した場合の終了コード(ヘルプを表示した場合は0)
+func configErrorCode(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return 2
+}
+
+// popArg 先頭がフラグでなければ位置引数として取り出す
+func popArg(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+// runMigrate マイグレーションを適用、取り消し、または状況を表示し、終了コードを返す
+func runMigrate(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+	command, args := popArg(args)
+	arg, args := popArg(args)
+	if extra, _ := popArg(args); extra != "" {
+		return usage()
+	}
+
+	var n int
+	switch command {
+	case "up", "down", "force":
+		if arg == "" {
+			if command == "force" {
+				return usage()
+			}
+			break
+		}
+		v, err := strconv.Atoi(arg)
+		if err != nil || v < 0 || (command != "force" && v == 0) {
+			fmt.Fprintf(os.Stderr, "invalid number: %q\n", arg)
+			return usage()
+		}
+		n = v
+	case "status":
+		if arg != "" {
+			return usage()
+		}
+	default:
+		return usage()
+	}
+	if command == "down" && n == 0 {
+		n = 1
+	}
+
+	db, err := commandDatabase(os.Args[0]+" migrate "+command, args)
+	if err != nil {
+		return configErrorCode(err)
+	}
+	defer db.Close()
+	migrator := injector.InjectMigrator(db)
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx, n)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("no change")
+		}
+	case "down":
+		reverted, err := migrator.Down(ctx, n)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no change")
+		}
+	case "force":
+		if err := migrator.Force(ctx, uint(n)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("forced version %d\n", n)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		version, dirty, err := migrator.Version(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("version: %d (expected: %d, dirty: %t)\n", version, migrator.Latest(), dirty)
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%-8s %d_%s\n", state, s.Version, s.Name)
+		}
+	}
+	return 0
+}
+
+// runDevSeed 開発用のテストユーザーを挿入または削除し、終了コードを返す
+func runDevSeed(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, devSeedUsage, os.Args[0])
+		return 2
+	}
+	command, args := popArg(args)
+	if extra, _ := popArg(args); extra != "" {
+		return usage()
+	}
+
+	var query string
+	switch command {
+	case "", "up":
+		query = migrations.SeedUp
+	case "down":
+		query = migrations.SeedDown
+	default:
+		return usage()
+	}
+
+	db, err := commandDatabase(os.Args[0]+" dev-seed", args)
+	if err != nil {
+		return configErrorCode(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	if err := injector.InjectMigrator(db).CheckVersion(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	res, err := db.ExecContext(ctx, query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	rows, _ := res.RowsAffected()
+	fmt.Printf("%d test users affected\n", rows)
+	return 0
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/balanceexport"
+	"github.com/kaitolucifer/user-balance-management/presentation/balanceimport"
+	"github.com/kaitolucifer/user-balance-management/presentation/balancestatement"
+)
+
+// errUsage 引数が誤っている場合のエラー(使い方は表示済み)
+var errUsage = errors.New("usage error")
+
+// cli コマンドの実行に必要なusecaseと入出力、共通の設定を格納
+type cli struct {
+	usecase     domain.UserBalanceUsecase
+	in          io.Reader
+	out         io.Writer
+	errOut      io.Writer
+	format      string
+	actor       string
+	timeout     time.Duration
+	interactive bool
+}
+
+// commands コマンド名と処理の対応
+var commands = map[string]func(c *cli, name string, args []string) error{
+	"get":       (*cli).get,
+	"list":      (*cli).list,
+	"add":       (*cli).change,
+	"reduce":    (*cli).change,
+	"add-all":   (*cli).addAll,
+	"transfer":  (*cli).transfer,
+	"history":   (*cli).history,
+	"statement": (*cli).statement,
+	"report":    (*cli).report,
+	"export":    (*cli).export,
+	"import":    (*cli).importFile,
+	"dump":      (*cli).dump,
+	"create":    (*cli).create,
+	"user":      (*cli).user,
+	"freeze":    (*cli).changeStatus,
+	"unfreeze":  (*cli).changeStatus,
+	"close":     (*cli).changeStatus,
+}
+
+// context コマンド1回分のタイムアウトを設定したコンテキストを作成
+func (c *cli) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// newFlagSet コマンドのフラグを作成
+func (c *cli) newFlagSet(name string, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet("balancectl "+name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(c.errOut, "usage: balancectl %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs フラグと位置引数を順不同で解析し、位置引数の数が想定と異なる場合は使い方を表示する
+// maxArgsが負の場合は上限なし
+func parseArgs(fs *flag.FlagSet, args []string, minArgs int, maxArgs int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// parseAmount 金額の引数を解析(正の値のみ)
+func parseAmount(fs *flag.FlagSet, s string) (int, error) {
+	amount, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || amount <= 0 {
+		fmt.Fprintf(fs.Output(), "invalid amount: %q (must be a positive integer)\n", s)
+		fs.Usage()
+		return 0, errUsage
+	}
+	return int(amount), nil
+}
+
+// metadataFlag key=value形式で繰り返し指定できるメタデータのフラグ
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m metadataFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("metadata must be key=value")
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
+// changeFlags 残高を変更するコマンドに共通のフラグ
+type changeFlags struct {
+	transactionID string
+	reasonCode    string
+	note          string
+	metadata      metadataFlag
+	dryRun        bool
+}
+
+// bindChangeFlags 残高を変更するコマンドに共通のフラグを登録
+func bindChangeFlags(fs *flag.FlagSet) *changeFlags {
+	f := &changeFlags{metadata: metadataFlag{}}
+	fs.StringVar(&f.transactionID, "transaction-id", "", "transaction ID for idempotency (generated if empty)")
+	fs.StringVar(&f.reasonCode, "reason", "", "reason code recorded in transaction history")
+	fs.StringVar(&f.note, "note", "", "note recorded in transaction history")
+	fs.Var(f.metadata, "meta", "metadata recorded in transaction history as key=value (repeatable)")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "show what would change without changing balances")
+	return f
+}
+
+// audit 取引履歴に記録する監査情報を作成し、取引IDが未指定の場合は生成する
+func (f *changeFlags) audit(c *cli) domain.AuditInfo {
+	if f.transactionID == "" {
+		f.transactionID = newTransactionID()
+	}
+	audit := domain.AuditInfo{
+		Actor:      c.actor,
+		ReasonCode: f.reasonCode,
+		Note:       f.note,
+		Source:     domain.RequestSource_CLI,
+	}
+	if len(f.metadata) > 0 {
+		audit.Metadata = f.metadata
+	}
+	return audit
+}
+
+// newTransactionID UUID(バージョン4)形式の取引IDを生成
+func newTransactionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// get ユーザーの残高を表示
+func (c *cli) get(name string, args []string) error {
+	fs := c.newFlagSet(name, "USER_ID...")
+	userIDs, err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	rows := make([]balanceRow, 0, len(userIDs))
+	for start := 0; start < len(userIDs); start += domain.MaxBatchGetBalancesSize {
+		end := start + domain.MaxBatchGetBalancesSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		results, err := c.usecase.BatchGetBalances(ctx, userIDs[start:end])
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if !result.Found {
+				return fmt.Errorf("%s: user not found", result.UserID)
+			}
+			rows = append(rows, balanceRow{UserID: result.UserID, Balance: result.Balance})
+		}
+	}
+	return c.writeBalances(rows)
+}
+
+// change ユーザーの残高を加算(add)または減算(reduce)
+func (c *cli) change(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] USER_ID AMOUNT")
+	flags := bindChangeFlags(fs)
+	positional, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	userID := positional[0]
+	amount, err := parseAmount(fs, positional[1])
+	if err != nil {
+		return err
+	}
+	audit := flags.audit(c)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	before, err := c.usecase.GetBalance(ctx, userID)
+	if err != nil {
+		return err
+	}
+	delta := amount
+	if name == "reduce" {
+		delta = -amount
+	}
+	result := changeResult{
+		Operation:     name,
+		TransactionID: flags.transactionID,
+		Amount:        amount,
+		DryRun:        flags.dryRun,
+		Balances:      []balanceChange{{UserID: userID, Before: before, After: before + delta}},
+	}
+
+	if flags.dryRun {
+		if before+delta < 0 {
+			return errors.New("balance insufficient")
+		}
+		return c.writeChange(result)
+	}
+	if name == "reduce" {
+		err = c.usecase.ReduceBalance(ctx, userID, amount, flags.transactionID, audit)
+	} else {
+		err = c.usecase.AddBalance(ctx, userID, amount, flags.transactionID, audit)
+	}
+	if err != nil {
+		return err
+	}
+	if result.Balances[0].After, err = c.usecase.GetBalance(ctx, userID); err != nil {
+		return err
+	}
+	return c.writeChange(result)
+}
+
+// addAll 全てのユーザーの残高を一斉に加算
+// 影響が大きいため、-yesを指定しない場合は確認を求める
+func (c *cli) addAll(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] AMOUNT")
+	flags := bindChangeFlags(fs)
+	yes := fs.Bool("yes", false, "skip confirmation")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	amount, err := parseAmount(fs, positional[0])
+	if err != nil {
+		return err
+	}
+	audit := flags.audit(c)
+	result := changeResult{
+		Operation:     name,
+		TransactionID: flags.transactionID,
+		Amount:        amount,
+		DryRun:        flags.dryRun,
+	}
+	if flags.dryRun {
+		return c.writeChange(result)
+	}
+	if !*yes {
+		if err := c.confirm(fmt.Sprintf("add %d to the balance of ALL users (transaction_id %s)", amount, flags.transactionID)); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.usecase.AddAllUserBalance(ctx, amount, flags.transactionID, audit); err != nil {
+		return err
+	}
+	return c.writeChange(result)
+}
+
+// confirm 操作の内容を表示し、yesと入力された場合のみ続行する
+// 端末から実行されていない場合は確認できないため、-yesの指定を求める
+func (c *cli) confirm(operation string) error {
+	if !c.interactive {
+		return fmt.Errorf("refusing to %s without confirmation: rerun with -yes", operation)
+	}
+	fmt.Fprintf(c.errOut, "About to %s.\nType \"yes\" to continue: ", operation)
+	answer, err := bufio.NewReader(c.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("aborted")
+	}
+	return nil
+}
+
+// transfer ユーザー間で残高を振り替える
+func (c *cli) transfer(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] FROM_USER_ID TO_USER_ID AMOUNT")
+	flags := bindChangeFlags(fs)
+	positional, err := parseArgs(fs, args, 3, 3)
+	if err != nil {
+		return err
+	}
+	fromUserID, toUserID := positional[0], positional[1]
+	amount, err := parseAmount(fs, positional[2])
+	if err != nil {
+		return err
+	}
+	if fromUserID == toUserID {
+		return errors.New("can't transfer to the same user")
+	}
+	audit := flags.audit(c)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	result := changeResult{
+		Operation:     name,
+		TransactionID: flags.transactionID,
+		Amount:        amount,
+		DryRun:        flags.dryRun,
+	}
+	for _, userID := range []string{fromUserID, toUserID} {
+		before, err := c.usecase.GetBalance(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", userID, err)
+		}
+		result.Balances = append(result.Balances, balanceChange{UserID: userID, Before: before})
+	}
+	result.Balances[0].After = result.Balances[0].Before - amount
+	result.Balances[1].After = result.Balances[1].Before + amount
+
+	if flags.dryRun {
+		if result.Balances[0].After < 0 {
+			return errors.New("balance insufficient")
+		}
+		return c.writeChange(result)
+	}
+	if err := c.usecase.TransferBalance(ctx, fromUserID, toUserID, amount, flags.transactionID, audit); err != nil {
+		return err
+	}
+	for i := range result.Balances {
+		if result.Balances[i].After, err = c.usecase.GetBalance(ctx, result.Balances[i].UserID); err != nil {
+			return err
+		}
+	}
+	return c.writeChange(result)
+}
+
+// history ユーザーの取引履歴を表示
+func (c *cli) history(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] USER_ID")
+	after := fs.String("after", "", "show transactions after this transaction ID")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	histories, err := c.usecase.GetTransactionHistory(ctx, positional[0], *after)
+	if err != nil {
+		return err
+	}
+	return c.writeHistories(histories)
+}
+
+// statement ユーザーの期間内の取引明細を出力(-csvを指定した場合はCSV)
+func (c *cli) statement(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] USER_ID")
+	month := fs.String("month", "", "statement month in UTC (YYYY-MM)")
+	from := fs.String("from", "", "start of the statement period (RFC3339, used with -to instead of -month)")
+	to := fs.String("to", "", "end of the statement period, exclusive (RFC3339)")
+	asCSV := fs.Bool("csv", false, "write the statement as CSV")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	start, end, err := balancestatement.ParsePeriod(*month, *from, *to)
+	if err != nil {
+		fmt.Fprintf(c.errOut, "invalid statement period: %s\n", err)
+		fs.Usage()
+		return errUsage
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	statement, err := c.usecase.GetStatement(ctx, positional[0], start, end)
+	if err != nil {
+		return err
+	}
+	if *asCSV {
+		return balancestatement.WriteCSV(c.out, statement)
+	}
+	return c.writeStatement(statement)
+}
+
+// report 期間内の取引量と全ユーザーの残高の集計レポートを出力
+func (c *cli) report(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags]")
+	from := fs.String("from", "", "start of the report period (RFC3339)")
+	to := fs.String("to", "", "end of the report period, exclusive (RFC3339)")
+	granularity := fs.String("granularity", string(domain.ReportGranularity_Day), "report period granularity: day, week or month")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	q := domain.ReportQuery{Granularity: domain.ReportGranularity(*granularity)}
+	for _, v := range []struct {
+		name  string
+		value string
+		t     *time.Time
+	}{{"from", *from, &q.From}, {"to", *to, &q.To}} {
+		t, err := time.Parse(time.RFC3339, v.value)
+		if err != nil {
+			fmt.Fprintf(c.errOut, "invalid -%s: %q (must be RFC3339)\n", v.name, v.value)
+			fs.Usage()
+			return errUsage
+		}
+		*v.t = t
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	report, err := c.usecase.GetReport(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.writeReport(report)
+}
+
+// export ユーザーの取引履歴をCSVまたはNDJSONで出力
+func (c *cli) export(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] USER_ID...")
+	format := fs.String("format", exportFormat_CSV, "export format: csv or ndjson")
+	after := fs.String("after", "", "export transactions after this transaction ID")
+	out := fs.String("out", "", "output file (default stdout)")
+	userIDs, err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	if *format != exportFormat_CSV && *format != exportFormat_NDJSON {
+		fmt.Fprintf(c.errOut, "invalid export format: %q\n", *format)
+		fs.Usage()
+		return errUsage
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	var histories []domain.TransactionHistoryModel
+	// 一斉加算の取引履歴は全てのユーザーの履歴に含まれるため、重複して出力しない
+	exported := make(map[string]bool)
+	for _, userID := range userIDs {
+		userHistories, err := c.usecase.GetTransactionHistory(ctx, userID, *after)
+		if err != nil {
+			return fmt.Errorf("%s: %w", userID, err)
+		}
+		for _, history := range userHistories {
+			if !exported[history.TransactionID] {
+				exported[history.TransactionID] = true
+				histories = append(histories, history)
+			}
+		}
+	}
+
+	if *out == "" {
+		return writeExport(c.out, *format, histories)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(f, *format, histories); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "exported %d transactions to %s\n", len(histories), *out)
+	return nil
+}
+
+// create ユーザーを作成し、初期残高を指定した場合は取引履歴に記録する
+func (c *cli) create(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] USER_ID")
+	flags := bindChangeFlags(fs)
+	merchantID := fs.String("merchant", "", "merchant the user belongs to")
+	openingBalance := fs.Int("opening-balance", 0, "opening balance recorded as a transaction")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *openingBalance < 0 {
+		fmt.Fprintf(c.errOut, "invalid opening balance: %d (must not be negative)\n", *openingBalance)
+		fs.Usage()
+		return errUsage
+	}
+	audit := flags.audit(c)
+	if flags.dryRun {
+		fmt.Fprintf(c.out, "dry run: user %s would be created with balance %d\n", positional[0], *openingBalance)
+		return nil
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.usecase.CreateUser(ctx, positional[0], *merchantID, *openingBalance, flags.transactionID, audit); err != nil {
+		return err
+	}
+	user, err := c.usecase.GetUser(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.writeUsers([]domain.UserBalanceModel{user})
+}
+
+// user ユーザーの状態を含む情報を表示
+func (c *cli) user(name string, args []string) error {
+	fs := c.newFlagSet(name, "USER_ID")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	user, err := c.usecase.GetUser(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.writeUsers([]domain.UserBalanceModel{user})
+}
+
+// changeStatus ユーザーを凍結(freeze)、凍結解除(unfreeze)または解約(close)する
+func (c *cli) changeStatus(name string, args []string) error {
+	synopsis := "[flags] USER_ID"
+	if name == "freeze" {
+		synopsis = "[flags] USER_ID debit|all"
+	}
+	fs := c.newFlagSet(name, synopsis)
+	reasonCode := fs.String("reason", "", "reason code recorded in status history")
+	note := fs.String("note", "", "note recorded in status history")
+	nArgs := 1
+	if name == "freeze" {
+		nArgs = 2
+	}
+	positional, err := parseArgs(fs, args, nArgs, nArgs)
+	if err != nil {
+		return err
+	}
+	userID := positional[0]
+	audit := domain.AuditInfo{Actor: c.actor, ReasonCode: *reasonCode, Note: *note, Source: domain.RequestSource_CLI}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	switch name {
+	case "freeze":
+		scope := domain.FreezeScope(positional[1])
+		if _, ok := scope.Status(); !ok {
+			fmt.Fprintf(c.errOut, "invalid freeze scope: %q (must be debit or all)\n", positional[1])
+			fs.Usage()
+			return errUsage
+		}
+		err = c.usecase.FreezeUser(ctx, userID, scope, audit)
+	case "unfreeze":
+		err = c.usecase.UnfreezeUser(ctx, userID, audit)
+	default:
+		err = c.usecase.CloseUser(ctx, userID, audit)
+	}
+	if err != nil {
+		return err
+	}
+	user, err := c.usecase.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return c.writeUsers([]domain.UserBalanceModel{user})
+}
+
+// list 条件で絞り込んだユーザーを並び替えて表示
+// -allを指定しない場合は1ページのみ表示し、次のページのトークンをエラー出力に表示する
+func (c *cli) list(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags]")
+	minBalance := fs.String("min-balance", "", "minimum balance (inclusive)")
+	maxBalance := fs.String("max-balance", "", "maximum balance (inclusive)")
+	statuses := fs.String("status", "", "comma separated statuses: active, debit_frozen, frozen or closed")
+	merchantID := fs.String("merchant", "", "merchant the users belong to")
+	createdAfter := fs.String("created-after", "", "show users created at or after this time (RFC3339)")
+	createdBefore := fs.String("created-before", "", "show users created before this time (RFC3339)")
+	sortBy := fs.String("sort", string(domain.AccountSortField_UserID), "sort by user_id, balance or created_at")
+	desc := fs.Bool("desc", false, "sort in descending order")
+	pageSize := fs.Int("page-size", domain.DefaultListAccountsPageSize, "number of users per page")
+	pageToken := fs.String("page-token", "", "page token printed by the previous page")
+	all := fs.Bool("all", false, "show all pages")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	q := domain.ListAccountsQuery{
+		MerchantID:  *merchantID,
+		SortBy:      domain.AccountSortField(*sortBy),
+		Descending:  *desc,
+		PageSize:    *pageSize,
+		AfterUserID: *pageToken,
+	}
+	for _, f := range []struct {
+		value string
+		dest  **int
+	}{{*minBalance, &q.MinBalance}, {*maxBalance, &q.MaxBalance}} {
+		if f.value == "" {
+			continue
+		}
+		i, err := strconv.Atoi(f.value)
+		if err != nil {
+			fmt.Fprintf(c.errOut, "invalid balance: %q\n", f.value)
+			fs.Usage()
+			return errUsage
+		}
+		*f.dest = &i
+	}
+	for _, f := range []struct {
+		value string
+		dest  *time.Time
+	}{{*createdAfter, &q.CreatedAfter}, {*createdBefore, &q.CreatedBefore}} {
+		if f.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, f.value)
+		if err != nil {
+			fmt.Fprintf(c.errOut, "invalid time: %q (must be RFC3339)\n", f.value)
+			fs.Usage()
+			return errUsage
+		}
+		*f.dest = t
+	}
+	if *statuses != "" {
+		for _, status := range strings.Split(*statuses, ",") {
+			q.Statuses = append(q.Statuses, domain.UserStatus(status))
+		}
+	}
+
+	var users []domain.UserBalanceModel
+	for {
+		ctx, cancel := c.context()
+		page, nextPageToken, err := c.usecase.ListAccounts(ctx, q)
+		cancel()
+		if err != nil {
+			return err
+		}
+		users = append(users, page...)
+		if nextPageToken == "" {
+			break
+		}
+		if !*all {
+			fmt.Fprintf(c.errOut, "next page: -page-token %s\n", nextPageToken)
+			break
+		}
+		q.AfterUserID = nextPageToken
+	}
+	return c.writeUsers(users)
+}
+
+// importFile CSVまたはNDJSONの残高操作を適用し、行毎の結果を出力
+// FILEに-を指定した場合は標準入力から読み込む。失敗した行がある場合はエラーとする
+// 影響が大きいため、-yesを指定しない場合は操作の件数と金額の合計を表示して確認を求める
+func (c *cli) importFile(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags] FILE")
+	format := fs.String("format", "", "file format: csv or ndjson (default by file extension)")
+	mode := fs.String("mode", string(domain.ImportMode_Atomic), "import mode: atomic (all or nothing) or best_effort")
+	reasonCode := fs.String("reason", "", "reason code recorded in transaction history (overridden by reason_code column)")
+	note := fs.String("note", "", "note recorded in transaction history (overridden by note column)")
+	dryRun := fs.Bool("dry-run", false, "parse the file and show the operations without changing balances")
+	yes := fs.Bool("yes", false, "skip confirmation")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *mode != string(domain.ImportMode_Atomic) && *mode != string(domain.ImportMode_BestEffort) {
+		fmt.Fprintf(c.errOut, "invalid import mode: %q\n", *mode)
+		fs.Usage()
+		return errUsage
+	}
+	if *format == "" {
+		*format = balanceimport.FormatFromFilename(positional[0])
+	}
+	if *format != balanceimport.Format_CSV && *format != balanceimport.Format_NDJSON {
+		fmt.Fprintf(c.errOut, "invalid import format: %q (use -format csv or ndjson)\n", *format)
+		fs.Usage()
+		return errUsage
+	}
+
+	in := c.in
+	if positional[0] != "-" {
+		f, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	ops, failed, err := balanceimport.Parse(in, *format)
+	if err != nil {
+		return err
+	}
+	added, reduced := balanceimport.Totals(ops)
+	operation := fmt.Sprintf("apply %d balance operations (add %d, reduce %d in total) from %s", len(ops), added, reduced, positional[0])
+	willApply := balanceimport.WillApply(ops, failed, domain.ImportMode(*mode))
+	if *dryRun {
+		results := balanceimport.DryRun(ops, failed)
+		if err := c.writeImport(results, true); err != nil {
+			return err
+		}
+		if c.format != outputFormat_JSON {
+			if willApply {
+				fmt.Fprintf(c.out, "dry run: would %s\n", operation)
+			} else {
+				fmt.Fprintln(c.out, "dry run: no operations would be applied")
+			}
+		}
+		return importError(results)
+	}
+	if willApply && !*yes {
+		// 標準入力から読み込んだ場合は確認の入力を読み込めないため、-yesの指定を求める
+		if positional[0] == "-" {
+			return fmt.Errorf("refusing to %s without confirmation: rerun with -yes", operation)
+		}
+		if err := c.confirm(operation); err != nil {
+			return err
+		}
+	}
+
+	audit := domain.AuditInfo{
+		Actor:      c.actor,
+		ReasonCode: *reasonCode,
+		Note:       *note,
+		Source:     domain.RequestSource_CLI,
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	results, err := balanceimport.Apply(ctx, c.usecase, ops, failed, domain.ImportMode(*mode), audit)
+	if err != nil {
+		return err
+	}
+	if err := c.writeImport(results, false); err != nil {
+		return err
+	}
+	return importError(results)
+}
+
+// importError 失敗した行がある場合はその行数のエラー
+func importError(results []domain.ImportLineResult) error {
+	if n := balanceimport.Summary(results)[domain.ImportLineStatus_Failed]; n > 0 {
+		return fmt.Errorf("%d of %d lines failed", n, len(results))
+	}
+	return nil
+}
+
+// dump ユーザー残高と取引履歴を1つのスナップショットから読み取り、CSVまたはNDJSONで出力
+// 件数が多いと時間がかかるため-timeoutは適用せず、出力先のファイルは失敗した場合に削除する
+func (c *cli) dump(name string, args []string) error {
+	fs := c.newFlagSet(name, "[flags]")
+	format := fs.String("format", balanceexport.Format_CSV, "export format: csv or ndjson")
+	compress := fs.Bool("gzip", false, "compress the output with gzip")
+	datasets := fs.String("datasets", "", "comma separated datasets to export: balances, history (default all)")
+	from := fs.String("from", "", "export rows updated (balances) or created (history) at or after this time (RFC3339)")
+	to := fs.String("to", "", "export rows updated (balances) or created (history) before this time (RFC3339)")
+	types := fs.String("types", "", "comma separated transaction types to export: add, reduce, add-all (default all)")
+	out := fs.String("out", "", "output file (default stdout)")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	q := domain.ExportQuery{Datasets: balanceexport.ParseDatasets(*datasets)}
+	for _, v := range []struct {
+		name  string
+		value string
+		t     *time.Time
+	}{{"from", *from, &q.From}, {"to", *to, &q.To}} {
+		if v.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v.value)
+		if err != nil {
+			fmt.Fprintf(c.errOut, "invalid -%s: %q (must be RFC3339)\n", v.name, v.value)
+			fs.Usage()
+			return errUsage
+		}
+		*v.t = t
+	}
+	transactionTypes, err := balanceexport.ParseTransactionTypes(*types)
+	if err != nil {
+		fmt.Fprintf(c.errOut, "invalid transaction types: %q\n", *types)
+		fs.Usage()
+		return errUsage
+	}
+	q.TransactionTypes = transactionTypes
+
+	dst := c.out
+	var f *os.File
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		dst = f
+	}
+	w, err := balanceexport.NewWriter(dst, *format, *compress)
+	if err != nil {
+		fmt.Fprintf(c.errOut, "invalid export format: %q\n", *format)
+		fs.Usage()
+		err = errUsage
+	}
+
+	var summary domain.ExportSummary
+	if err == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if summary, err = c.usecase.Export(ctx, q, w); err == nil {
+			err = w.Close()
+		}
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*out)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "exported %d balances and %d transactions (total balance %d)\n",
+		summary.Balances, summary.Transactions, summary.TotalBalance)
+	return nil
+}
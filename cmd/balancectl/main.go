@@ -0,0 +1,175 @@
+// balancectl ユーザー残高を参照、修正するための運用者向けCLI
+// 通常はgRPCでサーバーを呼び出し、-offlineを指定した場合はサーバーの設定でDBに直接接続してusecaseを呼び出す
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/config"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/injector"
+	GrpcHandler "github.com/kaitolucifer/user-balance-management/presentation/grpc"
+)
+
+// usage balancectlの使い方
+const usage = `usage: balancectl [flags] <command> [args]
+
+commands:
+  get USER_ID...                        show balances
+  list                                  list users filtered by balance, status and created_at
+  add USER_ID AMOUNT                    add to a user balance
+  reduce USER_ID AMOUNT                 reduce a user balance
+  add-all AMOUNT                        add to the balance of all users (asks for confirmation)
+  transfer FROM_USER_ID TO_USER_ID AMOUNT
+                                        move balance between users
+  history USER_ID                       show transaction history of a user
+  statement USER_ID                     show opening and closing balance and transactions of a user for a month
+  report                                show total balances and transaction volume per day, week or month
+  export USER_ID...                     write transaction history of users as CSV or NDJSON
+  import FILE                           apply add/reduce lines from a CSV or NDJSON file (- for stdin)
+  dump                                  write balances and transaction history from one snapshot as CSV or NDJSON
+  create USER_ID                        create a user with an optional opening balance
+  user USER_ID                          show a user including its status
+  freeze USER_ID debit|all              block debits or all balance changes of a user
+  unfreeze USER_ID                      unblock a frozen user
+  close USER_ID                         close a user whose balance is zero
+
+run "balancectl <command> -h" for command flags
+
+flags:
+`
+
+// defaultAddr 接続先のgRPCサーバーの既定値
+const defaultAddr = "localhost:50051"
+
+// offlineSetupTimeout オフラインモードでスキーマのバージョンを確認する際のタイムアウト
+const offlineSetupTimeout = 10 * time.Second
+
+func main() {
+	stat, _ := os.Stdin.Stat()
+	interactive := stat != nil && stat.Mode()&os.ModeCharDevice != 0
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, interactive))
+}
+
+// envOr 環境変数が空の場合は既定値を返す
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// run 引数を解析してコマンドを実行し、終了コードを返す(0: 成功、1: 実行時のエラー、2: 引数の誤り)
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, interactive bool) int {
+	fs := flag.NewFlagSet("balancectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", envOr("BALANCECTL_ADDR", defaultAddr), "gRPC server address (env BALANCECTL_ADDR)")
+	apiKey := fs.String("api-key", os.Getenv("BALANCECTL_API_KEY"), "API key to authenticate with the server (env BALANCECTL_API_KEY)")
+	token := fs.String("token", os.Getenv("BALANCECTL_TOKEN"), "JWT to authenticate with the server (env BALANCECTL_TOKEN)")
+	offline := fs.Bool("offline", false, "connect to the database directly instead of the gRPC server")
+	configFile := fs.String("config", "", "server config file used in offline mode (env USER_BALANCE_CONFIG)")
+	dsn := fs.String("dsn", "", "database DSN used in offline mode (env USER_BALANCE_DB_DSN)")
+	actor := fs.String("actor", os.Getenv("USER"), "operator recorded in transaction history")
+	output := fs.String("output", outputFormat_Table, "output format: table or json")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *output != outputFormat_Table && *output != outputFormat_JSON {
+		fmt.Fprintf(stderr, "invalid output format: %q\n", *output)
+		return 2
+	}
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command: %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	var uc domain.UserBalanceUsecase
+	if *offline {
+		offlineUsecase, closeDB, err := newOfflineUsecase(*configFile, *dsn)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer closeDB()
+		uc = offlineUsecase
+	} else {
+		client := injector.InjectGrpcClient(*addr, GrpcHandler.ClientCredentials{APIKey: *apiKey, Token: *token})
+		defer client.Close()
+		uc = client
+	}
+
+	c := &cli{
+		usecase:     uc,
+		in:          stdin,
+		out:         stdout,
+		errOut:      stderr,
+		format:      *output,
+		actor:       *actor,
+		timeout:     *timeout,
+		interactive: interactive,
+	}
+	if err := command(c, fs.Arg(0), fs.Args()[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		} else if err == errUsage {
+			return 2
+		}
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// newOfflineUsecase サーバーと同じ設定でDBに接続し、usecaseを作成する
+// スキーマが最新でない場合は誤った更新を防ぐためエラーにする
+func newOfflineUsecase(configFile string, dsn string) (domain.UserBalanceUsecase, func(), error) {
+	var args []string
+	if configFile != "" {
+		args = append(args, "-config", configFile)
+	}
+	if dsn != "" {
+		args = append(args, "-dsn", dsn)
+	}
+	cfg, err := config.Load("balancectl", args, os.Getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.DB.Driver != config.DBDriver_Postgres {
+		return nil, nil, errors.New("offline mode requires " + config.DBDriver_Postgres + " driver")
+	}
+
+	// 修正した直後の確認で古い値を読まないよう、リードレプリカは使用しない
+	db := injector.InjectDatabase(cfg.DatabaseDSN(), infrastructure.DBPoolConfig{MaxOpenConns: 2, MaxIdleConns: 1}, infrastructure.ReplicaConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), offlineSetupTimeout)
+	defer cancel()
+	if err := injector.InjectMigrator(db).CheckVersion(ctx); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	// DBの認証情報で接続できる利用者は全ての操作を実行できるため、usecaseでは主体を要求しない
+	repo := injector.InjectRepository(db)
+	uc := injector.InjectUsecase(repo, time.Duration(cfg.DB.OperationTimeout), true)
+	return uc, func() { db.Close() }, nil
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/usecase"
+)
+
+// newTestCLI インメモリrepositoryのusecaseを呼び出すcliを作成
+func newTestCLI(format string, input string) (*cli, *bytes.Buffer, *bytes.Buffer) {
+	return newTestCLIWithRepository(newTestRepository(), format, input)
+}
+
+// newTestRepository テスト用の2ユーザーを格納したインメモリrepositoryを作成
+func newTestRepository() domain.UserBalanceRepository {
+	return infrastructure.NewMemoryUserBalanceRepository([]domain.UserBalanceModel{
+		{UserID: "test_user1", Balance: 10000},
+		{UserID: "test_user2", Balance: 20000},
+	}, nil)
+}
+
+// newTestCLIWithRepository 指定したrepositoryのusecaseを呼び出すcliを作成
+func newTestCLIWithRepository(repo domain.UserBalanceRepository, format string, input string) (*cli, *bytes.Buffer, *bytes.Buffer) {
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	return &cli{
+		usecase:     usecase.NewUserBalanceUsecase(repo, 3*time.Second, true),
+		in:          strings.NewReader(input),
+		out:         out,
+		errOut:      errOut,
+		format:      format,
+		actor:       "operator1",
+		timeout:     3 * time.Second,
+		interactive: true,
+	}, out, errOut
+}
+
+// runCommand コマンド名と引数でcliのコマンドを実行
+func runCommand(c *cli, args ...string) error {
+	return commands[args[0]](c, args[0], args[1:])
+}
+
+func TestCommands(t *testing.T) {
+	cases := []struct {
+		Name             string
+		Args             []string
+		Input            string
+		ExpectedErr      string
+		ExpectedOutput   []string
+		ExpectedBalance1 int
+	}{
+		{"get", []string{"get", "test_user1", "test_user2"}, "", "", []string{"USER_ID", "test_user1  10000", "test_user2  20000"}, 10000},
+		{"get nonexistent user", []string{"get", "unknown"}, "", "unknown: user not found", nil, 10000},
+		{"add", []string{"add", "test_user1", "500", "-reason", "refund"}, "", "", []string{"add 500 applied", "test_user1  10000   10500"}, 10500},
+		{"add with flags after arguments", []string{"add", "-transaction-id", "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "test_user1", "500"}, "", "", []string{"transaction_id 917cd5c0-0bfc-4283-bc88-b5de8ad13635"}, 10500},
+		{"add dry run", []string{"add", "--dry-run", "test_user1", "500"}, "", "", []string{"dry run: add 500 would be applied", "test_user1  10000   10500"}, 10000},
+		{"reduce", []string{"reduce", "test_user1", "1000"}, "", "", []string{"test_user1  10000   9000"}, 9000},
+		{"reduce insufficient", []string{"reduce", "test_user1", "100000"}, "", "balance insufficient", nil, 10000},
+		{"reduce dry run insufficient", []string{"reduce", "-dry-run", "test_user1", "100000"}, "", "balance insufficient", nil, 10000},
+		{"invalid amount", []string{"add", "test_user1", "-1"}, "", "usage error", nil, 10000},
+		{"missing argument", []string{"add", "test_user1"}, "", "usage error", nil, 10000},
+		{"transfer", []string{"transfer", "test_user1", "test_user2", "3000"}, "", "", []string{"test_user1  10000   7000", "test_user2  20000   23000"}, 7000},
+		{"transfer dry run", []string{"transfer", "-dry-run", "test_user1", "test_user2", "3000"}, "", "", []string{"dry run", "test_user2  20000   23000"}, 10000},
+		{"transfer to the same user", []string{"transfer", "test_user1", "test_user1", "3000"}, "", "can't transfer to the same user", nil, 10000},
+		{"add-all confirmed", []string{"add-all", "100"}, "yes\n", "", []string{"add-all 100 applied"}, 10100},
+		{"add-all aborted", []string{"add-all", "100"}, "no\n", "aborted", nil, 10000},
+		{"add-all with yes", []string{"add-all", "-yes", "100"}, "", "", []string{"add-all 100 applied"}, 10100},
+		{"add-all dry run", []string{"add-all", "-dry-run", "100"}, "", "", []string{"dry run: add-all 100 would be applied"}, 10000},
+		{"history", []string{"history", "test_user1"}, "", "", []string{"CREATED_AT", "TRANSACTION_ID"}, 10000},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctl, out, _ := newTestCLI(outputFormat_Table, c.Input)
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+			ctx, cancel := ctl.context()
+			defer cancel()
+			if balance, _ := ctl.usecase.GetBalance(ctx, "test_user1"); balance != c.ExpectedBalance1 {
+				t.Errorf("expect balance of test_user1 [%d] but got [%d]", c.ExpectedBalance1, balance)
+			}
+		})
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Args           [][]string
+		ExpectedErr    string
+		ExpectedOutput []string
+	}{
+		{"create", [][]string{{"create", "-opening-balance", "500", "-merchant", "shop1", "new_user"}}, "", []string{"new_user  shop1        500      active"}},
+		{"create existing user", [][]string{{"create", "test_user1"}}, "user already exists", nil},
+		{"create negative opening balance", [][]string{{"create", "-opening-balance", "-1", "new_user"}}, "usage error", nil},
+		{"user", [][]string{{"user", "test_user2"}}, "", []string{"test_user2", "20000", "active"}},
+		{"freeze debit", [][]string{{"freeze", "-reason", "fraud", "test_user1", "debit"}}, "", []string{"debit_frozen"}},
+		{"freeze invalid scope", [][]string{{"freeze", "test_user1", "credit"}}, "usage error", nil},
+		{"reduce frozen user", [][]string{{"freeze", "test_user1", "all"}, {"reduce", "test_user1", "100"}}, "user is frozen", nil},
+		{"unfreeze", [][]string{{"freeze", "test_user1", "all"}, {"unfreeze", "test_user1"}}, "", []string{"active"}},
+		{"unfreeze active user", [][]string{{"unfreeze", "test_user1"}}, "user is not frozen", nil},
+		{"close user with balance", [][]string{{"close", "test_user1"}}, "balance is not zero", nil},
+		{"close", [][]string{{"create", "new_user"}, {"close", "new_user"}}, "", []string{"closed"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctl, out, _ := newTestCLI(outputFormat_Table, "")
+			var err error
+			for _, args := range c.Args {
+				out.Reset()
+				if err = runCommand(ctl, args...); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Args           []string
+		ExpectedErr    string
+		ExpectedOutput []string
+		ExpectedNext   string
+	}{
+		{"list", []string{"list"}, "", []string{"test_user1", "test_user2"}, ""},
+		{"filter by balance", []string{"list", "-min-balance", "15000"}, "", []string{"test_user2"}, ""},
+		{"sort by balance descending", []string{"list", "-sort", "balance", "-desc", "-page-size", "1"}, "", []string{"test_user2"}, "-page-token test_user2"},
+		{"all pages", []string{"list", "-page-size", "1", "-all"}, "", []string{"test_user1", "test_user2"}, ""},
+		{"invalid status", []string{"list", "-status", "deleted"}, "invalid user status", nil, ""},
+		{"invalid created after", []string{"list", "-created-after", "2021-05-29"}, "usage error", nil, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctl, out, errOut := newTestCLI(outputFormat_Table, "")
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+			if lines := strings.Count(out.String(), "\n"); err == nil && lines != len(c.ExpectedOutput)+1 {
+				t.Errorf("expect [%d] users but got [%s]", len(c.ExpectedOutput), out.String())
+			}
+			if c.ExpectedNext != "" && !strings.Contains(errOut.String(), c.ExpectedNext) {
+				t.Errorf("expect next page token [%s] but got [%s]", c.ExpectedNext, errOut.String())
+			}
+		})
+	}
+}
+
+func TestAddAllRequiresConfirmation(t *testing.T) {
+	ctl, _, _ := newTestCLI(outputFormat_Table, "")
+	ctl.interactive = false
+	err := runCommand(ctl, "add-all", "100")
+	if err == nil || !strings.Contains(err.Error(), "rerun with -yes") {
+		t.Errorf("expect confirmation error but got [%v]", err)
+	}
+}
+
+func TestHistoryJSON(t *testing.T) {
+	ctl, out, _ := newTestCLI(outputFormat_JSON, "")
+	if err := runCommand(ctl, "transfer", "-transaction-id", "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "-meta", "ticket=OPS-1", "test_user1", "test_user2", "3000"); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	out.Reset()
+	if err := runCommand(ctl, "history", "test_user2"); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	var rows []historyRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatalf("expect json output but got [%s]", out.String())
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expect [1] history but got [%d]", len(rows))
+	}
+	row := rows[0]
+	if row.TransactionID != domain.TransferCreditTransactionID("917cd5c0-0bfc-4283-bc88-b5de8ad13635") || row.Amount != 3000 || row.TransactionType != int(domain.TransactionType_AddUserBalance) {
+		t.Errorf("unexpected history %+v", row)
+	}
+	if row.Actor != "operator1" || row.Source != string(domain.RequestSource_CLI) || row.Metadata["ticket"] != "OPS-1" || row.Metadata[domain.MetadataKey_TransferFrom] != "test_user1" {
+		t.Errorf("unexpected audit info %+v", row)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctl, _, errOut := newTestCLI(outputFormat_Table, "")
+	runCommand(ctl, "add", "-transaction-id", "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "-note", "line1, \"quoted\"", "test_user1", "500")
+	runCommand(ctl, "add-all", "-yes", "-transaction-id", "5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b", "100")
+
+	cases := []struct {
+		Name          string
+		Format        string
+		ExpectedLines int
+		ExpectedText  string
+	}{
+		{"csv", exportFormat_CSV, 3, `"line1, ""quoted"""`},
+		{"ndjson", exportFormat_NDJSON, 2, `"transaction_id":"5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "export."+c.Format)
+			// 一斉加算の取引履歴は両方のユーザーに含まれるが1件のみ出力する
+			if err := runCommand(ctl, "export", "-format", c.Format, "-out", path, "test_user1", "test_user2"); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if lines := strings.Count(string(b), "\n"); lines != c.ExpectedLines {
+				t.Errorf("expect [%d] lines but got [%d]: %s", c.ExpectedLines, lines, b)
+			}
+			if !strings.Contains(string(b), c.ExpectedText) {
+				t.Errorf("expect export containing [%s] but got [%s]", c.ExpectedText, b)
+			}
+			if !strings.Contains(errOut.String(), "exported 2 transactions") {
+				t.Errorf("expect summary but got [%s]", errOut.String())
+			}
+		})
+	}
+}
+
+func TestStatement(t *testing.T) {
+	ctl, out, _ := newTestCLI(outputFormat_Table, "")
+	runCommand(ctl, "add", "-transaction-id", "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "-reason", "refund", "test_user1", "500")
+	runCommand(ctl, "add-all", "-yes", "-transaction-id", "5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b", "100")
+	now := time.Now().UTC()
+	from, to := now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339)
+
+	cases := []struct {
+		Name           string
+		Args           []string
+		ExpectedErr    string
+		ExpectedOutput []string
+	}{
+		{"table", []string{"statement", "-from", from, "-to", to, "test_user1"}, "", []string{
+			"opening balance 10000 at " + from,
+			"917cd5c0-0bfc-4283-bc88-b5de8ad13635  add      500     10500          refund",
+			"5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b  add-all  100     10600",
+			"closing balance 10600 at " + to,
+			"add-all  1      100",
+		}},
+		{"csv", []string{"statement", "-csv", "-from", from, "-to", to, "test_user1"}, "", []string{
+			"opening,,", ",0,500,10500,,operator1,refund,", "closing,," + to + ",,,10600,", "total,,,1,0,,0,,,",
+		}},
+		{"month without transactions", []string{"statement", "-month", "2021-06", "test_user2"}, "", []string{
+			"opening balance 20000 at 2021-06-01T00:00:00Z", "closing balance 20000 at 2021-07-01T00:00:00Z",
+		}},
+		{"missing period", []string{"statement", "test_user1"}, "usage error", nil},
+		{"unknown user", []string{"statement", "-month", "2021-06", "unknown"}, "user not found", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			out.Reset()
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo := newTestRepository()
+	ctl, out, _ := newTestCLIWithRepository(repo, outputFormat_Table, "")
+	runCommand(ctl, "add", "test_user1", "500")
+	runCommand(ctl, "reduce", "test_user2", "300")
+	// 集計はサーバーのバックグラウンドジョブが更新するため、テストではrepositoryで直接更新する
+	if _, err := repo.RefreshDailyTransactionAggregates(context.Background()); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to := today.Format(time.RFC3339), today.AddDate(0, 0, 1).Format(time.RFC3339)
+
+	cases := []struct {
+		Name           string
+		Args           []string
+		ExpectedErr    string
+		ExpectedOutput []string
+	}{
+		{"daily", []string{"report", "-from", from, "-to", to}, "", []string{
+			"total balance 30200 of 2 users", "active  2      30200", from + "  500     300", "add      1      500", "reduce   1      300",
+		}},
+		{"missing period", []string{"report", "-from", from}, "usage error", nil},
+		{"invalid granularity", []string{"report", "-from", from, "-to", to, "-granularity", "year"}, "invalid report granularity", nil},
+		{"invalid period", []string{"report", "-from", to, "-to", from}, "invalid report period", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			out.Reset()
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	ctl, out, errOut := newTestCLI(outputFormat_Table, "")
+	runCommand(ctl, "add", "-transaction-id", "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "test_user1", "500")
+	runCommand(ctl, "reduce", "-transaction-id", "5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b", "test_user2", "100")
+
+	cases := []struct {
+		Name            string
+		Args            []string
+		ExpectedErr     string
+		ExpectedLines   int
+		ExpectedText    string
+		ExpectedSummary string
+	}{
+		{"csv", []string{"dump"}, "", 5, "balance,test_user2,19900,", "exported 2 balances and 2 transactions (total balance 30400)"},
+		{"ndjson history of type", []string{"dump", "-format", "ndjson", "-datasets", "history", "-types", "reduce"}, "", 1,
+			`"transaction_id":"5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b"`, "exported 0 balances and 1 transactions"},
+		{"future period", []string{"dump", "-from", "2099-01-01T00:00:00Z"}, "", 1, "record,user_id,balance", "exported 0 balances and 0 transactions"},
+		{"invalid dataset", []string{"dump", "-datasets", "users"}, "invalid export dataset", 0, "", ""},
+		{"invalid format", []string{"dump", "-format", "xlsx"}, "usage error", 0, "", ""},
+		{"invalid time", []string{"dump", "-to", "2021-06-01"}, "usage error", 0, "", ""},
+		{"invalid type", []string{"dump", "-types", "refund"}, "usage error", 0, "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			out.Reset()
+			errOut.Reset()
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+				return
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			if lines := strings.Count(out.String(), "\n"); lines != c.ExpectedLines {
+				t.Errorf("expect [%d] lines but got [%d]: %s", c.ExpectedLines, lines, out.String())
+			}
+			if !strings.Contains(out.String(), c.ExpectedText) {
+				t.Errorf("expect output containing [%s] but got [%s]", c.ExpectedText, out.String())
+			}
+			if !strings.Contains(errOut.String(), c.ExpectedSummary) {
+				t.Errorf("expect summary [%s] but got [%s]", c.ExpectedSummary, errOut.String())
+			}
+		})
+	}
+
+	t.Run("remove file on failure", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.csv")
+		if err := runCommand(ctl, "dump", "-datasets", "users", "-out", path); err == nil {
+			t.Fatalf("expect error but got no one")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expect output file to be removed but got [%v]", err)
+		}
+	})
+}
+
+func TestImport(t *testing.T) {
+	ctl, out, _ := newTestCLI(outputFormat_Table, `{"user_id": "test_user1", "type": "add", "amount": 100, "transaction_id": "tx3"}`+"\n"+
+		`{"user_id": "unknown", "type": "add", "amount": 100, "transaction_id": "tx4"}`+"\n")
+	path := filepath.Join(t.TempDir(), "credits.csv")
+	if err := os.WriteFile(path, []byte("user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user2,reduce,500,tx2\n"), 0o600); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	cases := []struct {
+		Name             string
+		Args             []string
+		ExpectedErr      string
+		ExpectedOutput   []string
+		ExpectedBalance1 int
+	}{
+		{"csv", []string{"import", "-yes", "-reason", "campaign", path}, "", []string{"2     applied  test_user1  tx1", "2 applied, 0 skipped, 0 failed, 0 not applied"}, 11000},
+		{"reimport", []string{"import", "-yes", path}, "", []string{"2     skipped  test_user1  tx1", "0 applied, 2 skipped"}, 11000},
+		{"stdin best effort", []string{"import", "-yes", "-format", "ndjson", "-mode", "best_effort", "-"}, "1 of 2 lines failed",
+			[]string{"2     failed   unknown     tx4             user not found", "1 applied, 0 skipped, 1 failed"}, 11100},
+		{"invalid mode", []string{"import", "-mode", "all", path}, "usage error", nil, 11100},
+		{"unknown format", []string{"import", "credits.xlsx"}, "usage error", nil, 11100},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			out.Reset()
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+			if balance, _ := ctl.usecase.GetBalance(context.Background(), "test_user1"); balance != c.ExpectedBalance1 {
+				t.Errorf("expect balance of test_user1 [%d] but got [%d]", c.ExpectedBalance1, balance)
+			}
+		})
+	}
+}
+
+func TestImportConfirmation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credits.csv")
+	if err := os.WriteFile(path, []byte("user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user1,reduce,300,tx2\n"), 0o600); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	invalid := filepath.Join(dir, "invalid.csv")
+	if err := os.WriteFile(invalid, []byte("user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user1,move,300,tx2\n"), 0o600); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	cases := []struct {
+		Name             string
+		Args             []string
+		Input            string
+		Interactive      bool
+		ExpectedErr      string
+		ExpectedOutput   []string
+		ExpectedBalance1 int
+	}{
+		{"dry run", []string{"import", "-dry-run", path}, "", true, "",
+			[]string{"3     not_applied  test_user1  tx2", "dry run: would apply 2 balance operations (add 1000, reduce 300 in total)"}, 10000},
+		{"dry run with failed line", []string{"import", "-dry-run", invalid}, "", true, "1 of 2 lines failed",
+			[]string{"3     failed       test_user1  tx2             type must be add or reduce", "dry run: no operations would be applied"}, 10000},
+		{"confirmed", []string{"import", path}, "yes\n", true, "", []string{"2 applied, 0 skipped"}, 10700},
+		{"aborted", []string{"import", path}, "no\n", true, "aborted", nil, 10000},
+		{"not interactive", []string{"import", path}, "", false,
+			"refusing to apply 2 balance operations (add 1000, reduce 300 in total) from " + path + " without confirmation: rerun with -yes", nil, 10000},
+		{"stdin without yes", []string{"import", "-format", "csv", "-"}, "user_id,type,amount,transaction_id\ntest_user1,add,100,tx3\n", true,
+			"refusing to apply 1 balance operations (add 100, reduce 0 in total) from - without confirmation: rerun with -yes", nil, 10000},
+		{"nothing to apply", []string{"import", invalid}, "", false, "1 of 2 lines failed", []string{"0 applied, 0 skipped, 1 failed, 1 not applied"}, 10000},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctl, out, _ := newTestCLI(outputFormat_Table, c.Input)
+			ctl.interactive = c.Interactive
+			err := runCommand(ctl, c.Args...)
+			if err != nil {
+				if c.ExpectedErr == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErr {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErr, err)
+				}
+			} else if c.ExpectedErr != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErr)
+			}
+			for _, expected := range c.ExpectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expect output containing [%s] but got [%s]", expected, out.String())
+				}
+			}
+			if balance, _ := ctl.usecase.GetBalance(context.Background(), "test_user1"); balance != c.ExpectedBalance1 {
+				t.Errorf("expect balance of test_user1 [%d] but got [%d]", c.ExpectedBalance1, balance)
+			}
+		})
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Args         []string
+		ExpectedCode int
+		ExpectedErr  string
+	}{
+		{"no command", []string{}, 2, "usage: balancectl"},
+		{"unknown command", []string{"delete", "test_user1"}, 2, `unknown command: "delete"`},
+		{"invalid output", []string{"-output", "xml", "get", "test_user1"}, 2, `invalid output format: "xml"`},
+		{"help", []string{"-h"}, 0, "commands:"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := run(c.Args, strings.NewReader(""), stdout, stderr, false)
+			if code != c.ExpectedCode {
+				t.Errorf("expect exit code [%d] but got [%d]", c.ExpectedCode, code)
+			}
+			if !strings.Contains(stderr.String(), c.ExpectedErr) {
+				t.Errorf("expect stderr containing [%s] but got [%s]", c.ExpectedErr, stderr.String())
+			}
+		})
+	}
+}
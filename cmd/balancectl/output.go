@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/balanceimport"
+)
+
+// 出力形式
+const (
+	outputFormat_Table = "table"
+	outputFormat_JSON  = "json"
+)
+
+// exportコマンドの出力形式
+const (
+	exportFormat_CSV    = "csv"
+	exportFormat_NDJSON = "ndjson"
+)
+
+// transactionTypeNames 表形式で表示する取引種類の名前
+var transactionTypeNames = map[domain.TransactionType]string{
+	domain.TransactionType_AddUserBalance:    "add",
+	domain.TransactionType_ReduceUserBalance: "reduce",
+	domain.TransactionType_AddAllUserBalance: "add-all",
+}
+
+// balanceRow getコマンドで出力するユーザーの残高
+type balanceRow struct {
+	UserID  string `json:"user_id"`
+	Balance int    `json:"balance"`
+}
+
+// balanceChange 残高を変更したユーザーの変更前後の残高(dry-runの場合、変更後は予測値)
+type balanceChange struct {
+	UserID string `json:"user_id"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+}
+
+// changeResult 残高を変更するコマンドの結果
+type changeResult struct {
+	Operation     string          `json:"operation"`
+	TransactionID string          `json:"transaction_id"`
+	Amount        int             `json:"amount"`
+	DryRun        bool            `json:"dry_run"`
+	Balances      []balanceChange `json:"balances,omitempty"`
+}
+
+// userRow userコマンドとlistコマンドで出力するユーザーの情報
+type userRow struct {
+	UserID     string    `json:"user_id"`
+	MerchantID string    `json:"merchant_id,omitempty"`
+	Balance    int       `json:"balance"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// importResult importコマンドの結果(状態毎の行数と行毎の結果)
+type importResult struct {
+	Summary map[domain.ImportLineStatus]int `json:"summary"`
+	Results []importRow                     `json:"results"`
+	DryRun  bool                            `json:"dry_run,omitempty"` // 適用せずに解析のみ行った
+}
+
+// importRow インポートの行毎の結果
+type importRow struct {
+	Line          int    `json:"line"`
+	UserID        string `json:"user_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+// historyRow 取引履歴の出力フォーマット(取引種類は残高変更イベントと同じ数値)
+type historyRow struct {
+	TransactionID   string            `json:"transaction_id"`
+	UserID          string            `json:"user_id,omitempty"`
+	TransactionType int               `json:"transaction_type"`
+	Amount          int               `json:"amount"`
+	BalanceAfter    *int              `json:"balance_after,omitempty"`
+	Actor           string            `json:"actor,omitempty"`
+	ReasonCode      string            `json:"reason_code,omitempty"`
+	Note            string            `json:"note,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// statementTotalRow 取引明細の取引種類毎の合計
+type statementTotalRow struct {
+	TransactionType int   `json:"transaction_type"`
+	Count           int   `json:"count"`
+	Amount          int64 `json:"amount"`
+}
+
+// statementResult statementコマンドで出力する取引明細
+type statementResult struct {
+	UserID         string              `json:"user_id"`
+	From           time.Time           `json:"from"`
+	To             time.Time           `json:"to"`
+	OpeningBalance int                 `json:"opening_balance"`
+	ClosingBalance int                 `json:"closing_balance"`
+	Transactions   []historyRow        `json:"transactions"`
+	Totals         []statementTotalRow `json:"totals"`
+}
+
+// reportVolumeRow 集計レポートの取引種類毎の件数と金額の合計
+type reportVolumeRow struct {
+	TransactionType int   `json:"transaction_type"`
+	Count           int64 `json:"count"`
+	Amount          int64 `json:"amount"`
+}
+
+// reportBalanceRow 集計レポートの状態毎のユーザー数と残高の合計
+type reportBalanceRow struct {
+	Status  string `json:"status"`
+	Users   int64  `json:"users"`
+	Balance int64  `json:"balance"`
+}
+
+// reportPeriodRow 集計レポートの期間毎の集計
+type reportPeriodRow struct {
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	Credit  int64             `json:"credit"`
+	Debit   int64             `json:"debit"`
+	Volumes []reportVolumeRow `json:"volumes"`
+}
+
+// reportResult reportコマンドで出力する集計レポート
+type reportResult struct {
+	From            time.Time          `json:"from"`
+	To              time.Time          `json:"to"`
+	Granularity     string             `json:"granularity"`
+	TotalBalance    int64              `json:"total_balance"`
+	TotalUsers      int64              `json:"total_users"`
+	Balances        []reportBalanceRow `json:"balances"`
+	Periods         []reportPeriodRow  `json:"periods"`
+	Totals          []reportVolumeRow  `json:"totals"`
+	AggregatedUntil time.Time          `json:"aggregated_until"`
+}
+
+// toReportVolumeRows 取引種類毎の集計を出力フォーマットに変換
+func toReportVolumeRows(volumes []domain.ReportVolume) []reportVolumeRow {
+	rows := make([]reportVolumeRow, 0, len(volumes))
+	for _, v := range volumes {
+		rows = append(rows, reportVolumeRow{TransactionType: int(v.TransactionType), Count: v.Count, Amount: v.Amount})
+	}
+	return rows
+}
+
+// toHistoryRow 取引履歴を出力フォーマットに変換
+func toHistoryRow(history domain.TransactionHistoryModel) historyRow {
+	return historyRow{
+		TransactionID:   history.TransactionID,
+		UserID:          history.UserID,
+		TransactionType: int(history.TransactionType),
+		Amount:          history.Amount,
+		BalanceAfter:    history.BalanceAfter,
+		Actor:           history.Actor,
+		ReasonCode:      history.ReasonCode,
+		Note:            history.Note,
+		Source:          string(history.Source),
+		Metadata:        history.Metadata,
+		CreatedAt:       history.CreatedAt,
+	}
+}
+
+// writeJSON インデントしたJSONを出力
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// newTable 列を揃えて表を出力するwriterを作成
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+}
+
+// writeBalances ユーザーの残高を出力
+func (c *cli) writeBalances(rows []balanceRow) error {
+	if c.format == outputFormat_JSON {
+		return writeJSON(c.out, rows)
+	}
+	table := newTable(c.out)
+	fmt.Fprintln(table, "USER_ID\tBALANCE")
+	for _, row := range rows {
+		fmt.Fprintf(table, "%s\t%d\n", row.UserID, row.Balance)
+	}
+	return table.Flush()
+}
+
+// writeUsers ユーザーの情報を出力
+func (c *cli) writeUsers(users []domain.UserBalanceModel) error {
+	rows := make([]userRow, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, userRow{
+			UserID:     user.UserID,
+			MerchantID: user.MerchantID,
+			Balance:    user.Balance,
+			Status:     string(user.Status),
+			CreatedAt:  user.CreatedAt,
+			UpdatedAt:  user.UpdatedAt,
+		})
+	}
+	if c.format == outputFormat_JSON {
+		return writeJSON(c.out, rows)
+	}
+	table := newTable(c.out)
+	fmt.Fprintln(table, "USER_ID\tMERCHANT_ID\tBALANCE\tSTATUS\tCREATED_AT")
+	for _, row := range rows {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", row.UserID, row.MerchantID, row.Balance, row.Status, row.CreatedAt.Format(time.RFC3339))
+	}
+	return table.Flush()
+}
+
+// writeChange 残高を変更するコマンドの結果を出力
+func (c *cli) writeChange(result changeResult) error {
+	if c.format == outputFormat_JSON {
+		return writeJSON(c.out, result)
+	}
+	if result.DryRun {
+		fmt.Fprintf(c.out, "dry run: %s %d would be applied (transaction_id %s)\n", result.Operation, result.Amount, result.TransactionID)
+	} else {
+		fmt.Fprintf(c.out, "%s %d applied (transaction_id %s)\n", result.Operation, result.Amount, result.TransactionID)
+	}
+	if len(result.Balances) == 0 {
+		return nil
+	}
+	table := newTable(c.out)
+	fmt.Fprintln(table, "USER_ID\tBEFORE\tAFTER")
+	for _, balance := range result.Balances {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", balance.UserID, balance.Before, balance.After)
+	}
+	return table.Flush()
+}
+
+// writeImport インポートの行毎の結果と状態毎の行数を出力(dryRunの場合は適用せずに解析のみ行った結果)
+func (c *cli) writeImport(results []domain.ImportLineResult, dryRun bool) error {
+	result := importResult{Summary: balanceimport.Summary(results), Results: make([]importRow, 0, len(results)), DryRun: dryRun}
+	for _, r := range results {
+		result.Results = append(result.Results, importRow{
+			Line:          r.Line,
+			UserID:        r.UserID,
+			TransactionID: r.TransactionID,
+			Status:        string(r.Status),
+			Error:         r.Error,
+		})
+	}
+	if c.format == outputFormat_JSON {
+		return writeJSON(c.out, result)
+	}
+	table := newTable(c.out)
+	fmt.Fprintln(table, "LINE\tSTATUS\tUSER_ID\tTRANSACTION_ID\tERROR")
+	for _, row := range result.Results {
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\n", row.Line, row.Status, row.UserID, row.TransactionID, row.Error)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%d applied, %d skipped, %d failed, %d not applied\n",
+		result.Summary[domain.ImportLineStatus_Applied], result.Summary[domain.ImportLineStatus_Skipped],
+		result.Summary[domain.ImportLineStatus_Failed], result.Summary[domain.ImportLineStatus_NotApplied])
+	return nil
+}
+
+// writeHistories 取引履歴を出力
+func (c *cli) writeHistories(histories []domain.TransactionHistoryModel) error {
+	if c.format == outputFormat_JSON {
+		rows := make([]historyRow, 0, len(histories))
+		for _, history := range histories {
+			rows = append(rows, toHistoryRow(history))
+		}
+		return writeJSON(c.out, rows)
+	}
+	table := newTable(c.out)
+	fmt.Fprintln(table, "CREATED_AT\tTRANSACTION_ID\tUSER_ID\tTYPE\tAMOUNT\tACTOR\tREASON_CODE\tSOURCE")
+	for _, history := range histories {
+		userID := history.UserID
+		if userID == "" {
+			userID = "*"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			history.CreatedAt.Format(time.RFC3339), history.TransactionID, userID, transactionTypeNames[history.TransactionType],
+			history.Amount, history.Actor, history.ReasonCode, history.Source)
+	}
+	return table.Flush()
+}
+
+// writeStatement 取引明細を出力
+func (c *cli) writeStatement(statement domain.Statement) error {
+	if c.format == outputFormat_JSON {
+		result := statementResult{
+			UserID:         statement.UserID,
+			From:           statement.From,
+			To:             statement.To,
+			OpeningBalance: statement.OpeningBalance,
+			ClosingBalance: statement.ClosingBalance,
+			Transactions:   make([]historyRow, 0, len(statement.Transactions)),
+			Totals:         make([]statementTotalRow, 0, len(statement.Totals)),
+		}
+		for _, history := range statement.Transactions {
+			result.Transactions = append(result.Transactions, toHistoryRow(history))
+		}
+		for _, total := range statement.Totals {
+			result.Totals = append(result.Totals, statementTotalRow{TransactionType: int(total.TransactionType), Count: total.Count, Amount: total.Amount})
+		}
+		return writeJSON(c.out, result)
+	}
+
+	fmt.Fprintf(c.out, "opening balance %d at %s\n", statement.OpeningBalance, statement.From.Format(time.RFC3339))
+	table := newTable(c.out)
+	fmt.Fprintln(table, "CREATED_AT\tTRANSACTION_ID\tTYPE\tAMOUNT\tBALANCE_AFTER\tREASON_CODE\tNOTE")
+	for _, history := range statement.Transactions {
+		var balanceAfter int
+		if history.BalanceAfter != nil {
+			balanceAfter = *history.BalanceAfter
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			history.CreatedAt.Format(time.RFC3339), history.TransactionID, transactionTypeNames[history.TransactionType],
+			history.Amount, balanceAfter, history.ReasonCode, history.Note)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "closing balance %d at %s\n", statement.ClosingBalance, statement.To.Format(time.RFC3339))
+	table = newTable(c.out)
+	fmt.Fprintln(table, "TYPE\tCOUNT\tAMOUNT")
+	for _, total := range statement.Totals {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", transactionTypeNames[total.TransactionType], total.Count, total.Amount)
+	}
+	return table.Flush()
+}
+
+// writeReport 集計レポートを出力
+func (c *cli) writeReport(report domain.Report) error {
+	if c.format == outputFormat_JSON {
+		result := reportResult{
+			From:            report.From,
+			To:              report.To,
+			Granularity:     string(report.Granularity),
+			TotalBalance:    report.TotalBalance,
+			TotalUsers:      report.TotalUsers,
+			Balances:        make([]reportBalanceRow, 0, len(report.Balances)),
+			Periods:         make([]reportPeriodRow, 0, len(report.Periods)),
+			Totals:          toReportVolumeRows(report.Totals),
+			AggregatedUntil: report.AggregatedUntil,
+		}
+		for _, b := range report.Balances {
+			result.Balances = append(result.Balances, reportBalanceRow{Status: string(b.Status), Users: b.Users, Balance: b.Balance})
+		}
+		for _, p := range report.Periods {
+			result.Periods = append(result.Periods, reportPeriodRow{Start: p.Start, End: p.End, Credit: p.Credit, Debit: p.Debit, Volumes: toReportVolumeRows(p.Volumes)})
+		}
+		return writeJSON(c.out, result)
+	}
+
+	fmt.Fprintf(c.out, "total balance %d of %d users (aggregated until %s)\n",
+		report.TotalBalance, report.TotalUsers, report.AggregatedUntil.Format(time.RFC3339))
+	table := newTable(c.out)
+	fmt.Fprintln(table, "STATUS\tUSERS\tBALANCE")
+	for _, b := range report.Balances {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", b.Status, b.Users, b.Balance)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out)
+	table = newTable(c.out)
+	fmt.Fprintln(table, "PERIOD\tCREDIT\tDEBIT")
+	for _, p := range report.Periods {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", p.Start.Format(time.RFC3339), p.Credit, p.Debit)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out)
+	table = newTable(c.out)
+	fmt.Fprintln(table, "TYPE\tCOUNT\tAMOUNT")
+	for _, total := range report.Totals {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", transactionTypeNames[total.TransactionType], total.Count, total.Amount)
+	}
+	return table.Flush()
+}
+
+// exportHeader CSVで出力する取引履歴の列
+var exportHeader = []string{"transaction_id", "user_id", "transaction_type", "amount", "actor", "reason_code", "note", "source", "metadata", "created_at"}
+
+// writeExport 取引履歴をCSVまたはNDJSON(1行に1件のJSON)で出力
+// CSVのメタデータの列はJSONで出力する
+func writeExport(w io.Writer, format string, histories []domain.TransactionHistoryModel) error {
+	if format == exportFormat_NDJSON {
+		encoder := json.NewEncoder(w)
+		for _, history := range histories {
+			if err := encoder.Encode(toHistoryRow(history)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(exportHeader)
+	for _, history := range histories {
+		var metadata string
+		if len(history.Metadata) > 0 {
+			b, _ := json.Marshal(history.Metadata)
+			metadata = string(b)
+		}
+		writer.Write([]string{
+			history.TransactionID,
+			history.UserID,
+			strconv.Itoa(int(history.TransactionType)),
+			strconv.Itoa(history.Amount),
+			history.Actor,
+			history.ReasonCode,
+			history.Note,
+			string(history.Source),
+			metadata,
+			history.CreatedAt.Format(time.RFC3339Nano),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,407 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Duration 設定ファイルで"3s"、"5m"のような文字列で指定できる時間
+type Duration time.Duration
+
+// UnmarshalText 文字列から時間に変換(TOML、環境変数、フラグ用)
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML 文字列から時間に変換(YAML用)
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// MarshalText 時間を文字列に変換
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Set 文字列から時間に変換(flag.Value用)
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+// String 時間を文字列に変換(flag.Value用)
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// 提供するAPI
+const (
+	API_Grpc    = "grpc"
+	API_Restful = "restful"
+	API_Both    = "both"
+)
+
+// DBのドライバー
+const (
+	DBDriver_Postgres = "postgres"
+	DBDriver_Memory   = "memory"
+)
+
+// Config アプリケーションの設定
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server" json:"server"`
+	DB        DBConfig        `yaml:"db" toml:"db" json:"db"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth" json:"auth"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit" json:"rate_limit"`
+	Cache     CacheConfig     `yaml:"cache" toml:"cache" json:"cache"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing" json:"tracing"`
+	Log       LogConfig       `yaml:"log" toml:"log" json:"log"`
+	Features  FeaturesConfig  `yaml:"features" toml:"features" json:"features"`
+}
+
+// ServerConfig 提供するAPI、待ち受けアドレスとHTTPサーバーのタイムアウトの設定
+type ServerConfig struct {
+	// API grpc、restfulまたはboth(同じusecaseで両方を提供する)
+	API string `yaml:"api" toml:"api" json:"api"`
+	// RestfulAddr APIがbothでGrpcAddrと同じアドレスを指定した場合、1つのポートでContent-Typeにより振り分ける
+	RestfulAddr       string   `yaml:"restful_addr" toml:"restful_addr" json:"restful_addr"`
+	GrpcAddr          string   `yaml:"grpc_addr" toml:"grpc_addr" json:"grpc_addr"`
+	AdminAddr         string   `yaml:"admin_addr" toml:"admin_addr" json:"admin_addr"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout" json:"read_header_timeout"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout" json:"read_timeout"`
+	// WriteTimeout Server-Sent Eventsの接続も切断されるため、0(無制限)以外を指定する場合は注意
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout" json:"write_timeout"`
+	IdleTimeout  Duration `yaml:"idle_timeout" toml:"idle_timeout" json:"idle_timeout"`
+	// ShutdownDelay シャットダウン開始後、ヘルスチェックで停止中を返しつつ新しいリクエストを受け付け続ける時間
+	// ロードバランサーが振り分け対象から外すまでの猶予として使用する
+	ShutdownDelay Duration `yaml:"shutdown_delay" toml:"shutdown_delay" json:"shutdown_delay"`
+	// ShutdownTimeout 処理中のリクエストの完了を待つ時間(超過した場合は強制的に終了する)
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" json:"shutdown_timeout"`
+}
+
+// DBConfig DB接続と接続プールの設定
+type DBConfig struct {
+	// Driver postgresまたはmemory(ローカル開発用にデータをメモリ上に保持し、接続の設定は使用しない)
+	Driver string `yaml:"driver" toml:"driver" json:"driver"`
+	// SeedFile Driverがmemoryの場合に起動時に読み込む初期データのJSONファイル(省略した場合は空の状態で起動する)
+	SeedFile string `yaml:"seed_file" toml:"seed_file" json:"seed_file"`
+	// DSN 指定した場合、Host、Port、Name、User、Password、SSLModeより優先する
+	DSN              string   `yaml:"dsn" toml:"dsn" json:"dsn"`
+	Host             string   `yaml:"host" toml:"host" json:"host"`
+	Port             string   `yaml:"port" toml:"port" json:"port"`
+	Name             string   `yaml:"name" toml:"name" json:"name"`
+	User             string   `yaml:"user" toml:"user" json:"user"`
+	Password         string   `yaml:"password" toml:"password" json:"password"`
+	SSLMode          string   `yaml:"sslmode" toml:"sslmode" json:"sslmode"`
+	MaxOpenConns     int      `yaml:"max_open_conns" toml:"max_open_conns" json:"max_open_conns"`
+	MaxIdleConns     int      `yaml:"max_idle_conns" toml:"max_idle_conns" json:"max_idle_conns"`
+	ConnMaxLifetime  Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" json:"conn_max_lifetime"`
+	OperationTimeout Duration `yaml:"operation_timeout" toml:"operation_timeout" json:"operation_timeout"`
+	// ReplicaDSNs 読み取りに使用するリードレプリカのDSN(レプリカ毎にMaxOpenConnsなどと同じ設定の接続プールを作成する)
+	ReplicaDSNs []string `yaml:"replica_dsns" toml:"replica_dsns" json:"replica_dsns"`
+	// ReplicaMaxStaleness 読み取りに使用するリードレプリカの複製の遅延の上限(超過したレプリカはプライマリで代替する)
+	ReplicaMaxStaleness Duration `yaml:"replica_max_staleness" toml:"replica_max_staleness" json:"replica_max_staleness"`
+	// ReplicaCheckInterval リードレプリカの接続と複製の遅延を確認する間隔
+	ReplicaCheckInterval Duration `yaml:"replica_check_interval" toml:"replica_check_interval" json:"replica_check_interval"`
+	// AggregateRefreshInterval 集計レポートが読み取る取引履歴の日毎の集計をバックグラウンドで更新する間隔(0の場合はこのインスタンスでは更新しない)
+	AggregateRefreshInterval Duration `yaml:"aggregate_refresh_interval" toml:"aggregate_refresh_interval" json:"aggregate_refresh_interval"`
+	// HotAccountCompactInterval ホットアカウントのスロットの残高をバックグラウンドでユーザー残高の行に戻す間隔(0の場合はこのインスタンスでは圧縮しない)
+	HotAccountCompactInterval Duration `yaml:"hot_account_compact_interval" toml:"hot_account_compact_interval" json:"hot_account_compact_interval"`
+}
+
+// AuthConfig 認証の設定
+type AuthConfig struct {
+	// Disabled 認証と権限の検証を無効にする(開発用)。無効にしない場合、認証情報のないリクエストは全て拒否する
+	Disabled    bool   `yaml:"disabled" toml:"disabled" json:"disabled"`
+	APIKeysFile string `yaml:"api_keys_file" toml:"api_keys_file" json:"api_keys_file"`
+	JWKSFile    string `yaml:"jwks_file" toml:"jwks_file" json:"jwks_file"`
+	JWTIssuer   string `yaml:"jwt_issuer" toml:"jwt_issuer" json:"jwt_issuer"`
+	JWTAudience string `yaml:"jwt_audience" toml:"jwt_audience" json:"jwt_audience"`
+}
+
+// RateLimitConfig レート制限の設定
+type RateLimitConfig struct {
+	Client      float64 `yaml:"client" toml:"client" json:"client"`
+	ClientBurst int     `yaml:"client_burst" toml:"client_burst" json:"client_burst"`
+	User        float64 `yaml:"user" toml:"user" json:"user"`
+	UserBurst   int     `yaml:"user_burst" toml:"user_burst" json:"user_burst"`
+}
+
+// CacheConfig キャッシュの設定
+type CacheConfig struct {
+	// BalanceSize ユーザー残高をキャッシュする最大のユーザー数(0の場合はキャッシュしない)
+	BalanceSize int `yaml:"balance_size" toml:"balance_size" json:"balance_size"`
+	// BalanceTTL ユーザー残高をキャッシュする時間(他のインスタンスでの変更はこの時間だけ遅れて反映される)
+	BalanceTTL Duration `yaml:"balance_ttl" toml:"balance_ttl" json:"balance_ttl"`
+}
+
+// TracingConfig トレースの設定
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter" json:"exporter"`
+	Target      string  `yaml:"target" toml:"target" json:"target"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" json:"sample_ratio"`
+}
+
+// LogConfig ログの設定
+type LogConfig struct {
+	Format string `yaml:"format" toml:"format" json:"format"`
+	Level  string `yaml:"level" toml:"level" json:"level"`
+}
+
+// FeaturesConfig 機能の有効/無効の設定
+type FeaturesConfig struct {
+	// Metrics 管理用ポートで/metricsを提供する
+	Metrics bool `yaml:"metrics" toml:"metrics" json:"metrics"`
+	// BalanceEvents RESTfulで残高変更イベントのServer-Sent Eventsを提供する
+	BalanceEvents bool `yaml:"balance_events" toml:"balance_events" json:"balance_events"`
+	// Gateway RESTfulの/v1以下でgRPCに変換するゲートウェイとOpenAPIのドキュメントを提供する(APIがbothの場合のみ)
+	Gateway bool `yaml:"gateway" toml:"gateway" json:"gateway"`
+	// GrpcReflection grpcurlなどのデバッグ用にgRPCのサーバーリフレクションを提供する
+	GrpcReflection bool `yaml:"grpc_reflection" toml:"grpc_reflection" json:"grpc_reflection"`
+}
+
+// Default デフォルトの設定を作成
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			API:               API_Both,
+			RestfulAddr:       ":8080",
+			GrpcAddr:          ":50051",
+			AdminAddr:         ":9090",
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			ReadTimeout:       Duration(10 * time.Second),
+			WriteTimeout:      0,
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownDelay:     0,
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		DB: DBConfig{
+			Driver:           DBDriver_Postgres,
+			Host:             "localhost",
+			Port:             "5432",
+			Name:             "user_balance",
+			User:             "admin",
+			Password:         "password",
+			SSLMode:          "disable",
+			MaxOpenConns:     10,
+			MaxIdleConns:     5,
+			ConnMaxLifetime:  Duration(5 * time.Minute),
+			OperationTimeout: Duration(3 * time.Second),
+
+			ReplicaMaxStaleness:  Duration(5 * time.Second),
+			ReplicaCheckInterval: Duration(2 * time.Second),
+
+			AggregateRefreshInterval:  Duration(time.Minute),
+			HotAccountCompactInterval: Duration(time.Minute),
+		},
+		RateLimit: RateLimitConfig{
+			ClientBurst: 20,
+			UserBurst:   10,
+		},
+		Cache: CacheConfig{
+			BalanceTTL: Duration(time.Second),
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Format: "json",
+			Level:  "info",
+		},
+		Features: FeaturesConfig{
+			Metrics:       true,
+			BalanceEvents: true,
+			Gateway:       true,
+		},
+	}
+}
+
+// ServeRestful RESTful APIを提供するか
+func (c Config) ServeRestful() bool {
+	return c.Server.API == API_Restful || c.Server.API == API_Both
+}
+
+// ServeGrpc gRPC APIを提供するか
+func (c Config) ServeGrpc() bool {
+	return c.Server.API == API_Grpc || c.Server.API == API_Both
+}
+
+// Multiplexed RESTful APIとgRPC APIを1つのポートで提供するか
+func (c Config) Multiplexed() bool {
+	return c.Server.API == API_Both && c.Server.RestfulAddr == c.Server.GrpcAddr
+}
+
+// ServeGateway gRPCに変換するゲートウェイを提供するか
+func (c Config) ServeGateway() bool {
+	return c.Features.Gateway && c.Server.API == API_Both
+}
+
+// GatewayEndpoint ゲートウェイが接続するgRPCサーバーのアドレス(ホストを省略した場合はlocalhost)
+func (c Config) GatewayEndpoint() string {
+	host, port, err := net.SplitHostPort(c.Server.GrpcAddr)
+	if err != nil {
+		return c.Server.GrpcAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// DatabaseDSN DB接続に使用するDSNを取得
+func (c Config) DatabaseDSN() string {
+	if c.DB.DSN != "" {
+		return c.DB.DSN
+	}
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s",
+		c.DB.Host, c.DB.Port, c.DB.Name, c.DB.User, c.DB.Password, c.DB.SSLMode)
+}
+
+// Validate 設定値を検証し、全ての問題をまとめたエラーを返す
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	switch c.Server.API {
+	case API_Grpc, API_Restful, API_Both:
+	default:
+		problems = append(problems, fmt.Sprintf("server.api is invalid: %q", c.Server.API))
+	}
+	check(!c.ServeRestful() || validAddr(c.Server.RestfulAddr), "server.restful_addr is invalid: %q", c.Server.RestfulAddr)
+	check(!c.ServeGrpc() || validAddr(c.Server.GrpcAddr), "server.grpc_addr is invalid: %q", c.Server.GrpcAddr)
+	if c.Features.Metrics {
+		check(validAddr(c.Server.AdminAddr), "server.admin_addr is invalid: %q", c.Server.AdminAddr)
+		check(!(c.ServeRestful() && c.Server.AdminAddr == c.Server.RestfulAddr) &&
+			!(c.ServeGrpc() && c.Server.AdminAddr == c.Server.GrpcAddr),
+			"server.admin_addr must differ from API addresses")
+	}
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout must not be negative")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout must not be negative")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	switch c.DB.Driver {
+	case DBDriver_Postgres, DBDriver_Memory:
+	default:
+		problems = append(problems, fmt.Sprintf("db.driver is invalid: %q", c.DB.Driver))
+	}
+	check(c.DB.SeedFile == "" || c.DB.Driver == DBDriver_Memory, "db.seed_file is only supported by memory driver")
+	if c.DB.Driver == DBDriver_Postgres && c.DB.DSN == "" {
+		check(c.DB.Host != "", "db.host is required")
+		check(c.DB.Port != "", "db.port is required")
+		check(c.DB.Name != "", "db.name is required")
+		check(c.DB.User != "", "db.user is required")
+	}
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns must be positive")
+	check(c.DB.MaxIdleConns >= 0 && c.DB.MaxIdleConns <= c.DB.MaxOpenConns,
+		"db.max_idle_conns must be between 0 and db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.DB.OperationTimeout > 0, "db.operation_timeout must be positive")
+	check(len(c.DB.ReplicaDSNs) == 0 || c.DB.Driver == DBDriver_Postgres, "db.replica_dsns is only supported by postgres driver")
+	check(c.DB.ReplicaMaxStaleness >= 0, "db.replica_max_staleness must not be negative")
+	check(c.DB.ReplicaCheckInterval > 0, "db.replica_check_interval must be positive")
+	check(c.DB.AggregateRefreshInterval >= 0, "db.aggregate_refresh_interval must not be negative")
+	check(c.DB.HotAccountCompactInterval >= 0, "db.hot_account_compact_interval must not be negative")
+
+	check(!c.Auth.Disabled || (c.Auth.APIKeysFile == "" && c.Auth.JWKSFile == ""),
+		"auth.disabled must not be set with auth.api_keys_file or auth.jwks_file")
+
+	check(c.RateLimit.Client >= 0, "rate_limit.client must not be negative")
+	check(c.RateLimit.Client == 0 || c.RateLimit.ClientBurst > 0, "rate_limit.client_burst must be positive")
+	check(c.RateLimit.User >= 0, "rate_limit.user must not be negative")
+	check(c.RateLimit.User == 0 || c.RateLimit.UserBurst > 0, "rate_limit.user_burst must be positive")
+
+	check(c.Cache.BalanceSize >= 0, "cache.balance_size must not be negative")
+	check(c.Cache.BalanceSize == 0 || c.Cache.BalanceTTL > 0, "cache.balance_ttl must be positive")
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file", "otlp":
+		check(c.Tracing.Target != "", "tracing.target is required for %s exporter", c.Tracing.Exporter)
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter is invalid: %q", c.Tracing.Exporter))
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	check(c.Log.Format == "json" || c.Log.Format == "console", "log.format is invalid: %q", c.Log.Format)
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log.level is invalid: %q", c.Log.Level))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validAddr host:port形式のアドレスかを判定
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
+
+// redactedValue 秘匿情報を置き換える文字列
+const redactedValue = "REDACTED"
+
+// Redacted 秘匿情報を伏せた設定を作成(ログ出力用)
+func (c Config) Redacted() Config {
+	if c.DB.Password != "" {
+		c.DB.Password = redactedValue
+	}
+	c.DB.DSN = redactDSN(c.DB.DSN)
+	if len(c.DB.ReplicaDSNs) > 0 {
+		replicaDSNs := make([]string, 0, len(c.DB.ReplicaDSNs))
+		for _, dsn := range c.DB.ReplicaDSNs {
+			replicaDSNs = append(replicaDSNs, redactDSN(dsn))
+		}
+		c.DB.ReplicaDSNs = replicaDSNs
+	}
+	return c
+}
+
+// redactDSN DSNのパスワードを伏せる(URL形式とkey=value形式に対応)
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return dsn
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+		}
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", redactedValue)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+
+	fields := strings.Fields(dsn)
+	for i, field := range fields {
+		if strings.HasPrefix(field, "password=") {
+			fields[i] = "password=" + redactedValue
+		}
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,288 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile テスト用の設定ファイルを作成
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	return path
+}
+
+// mapEnv mapから環境変数を取得する関数を作成
+func mapEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	yamlFile := writeConfigFile(t, "config.yaml", `
+db:
+  host: file-host
+  user: file-user
+  max_open_conns: 20
+  operation_timeout: 5s
+server:
+  restful_addr: ":18080"
+`)
+
+	cases := []struct {
+		Name             string
+		Args             []string
+		Env              map[string]string
+		ExpectedHost     string
+		ExpectedUser     string
+		ExpectedOpen     int
+		ExpectedAddr     string
+		ExpectedTimeout  time.Duration
+		ExpectedPassword string
+	}{
+		{"defaults", nil, nil, "localhost", "admin", 10, ":8080", 3 * time.Second, "password"},
+		{"file overrides defaults", []string{"-config", yamlFile}, nil, "file-host", "file-user", 20, ":18080", 5 * time.Second, "password"},
+		{"config file from env", nil, map[string]string{"USER_BALANCE_CONFIG": yamlFile}, "file-host", "file-user", 20, ":18080", 5 * time.Second, "password"},
+		{"env overrides file", []string{"-config", yamlFile}, map[string]string{
+			"USER_BALANCE_DB_HOST":     "env-host",
+			"USER_BALANCE_DB_PASSWORD": "env-secret",
+		}, "env-host", "file-user", 20, ":18080", 5 * time.Second, "env-secret"},
+		{"flag overrides env", []string{"-config", yamlFile, "-dbhost", "flag-host", "-db_operation_timeout", "1s"}, map[string]string{
+			"USER_BALANCE_DB_HOST": "env-host",
+		}, "flag-host", "file-user", 20, ":18080", time.Second, "password"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg, err := Load("test", c.Args, mapEnv(c.Env))
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if cfg.DB.Host != c.ExpectedHost || cfg.DB.User != c.ExpectedUser || cfg.DB.Password != c.ExpectedPassword {
+				t.Errorf("expect db [%s %s %s] but got [%s %s %s]", c.ExpectedHost, c.ExpectedUser, c.ExpectedPassword,
+					cfg.DB.Host, cfg.DB.User, cfg.DB.Password)
+			}
+			if cfg.DB.MaxOpenConns != c.ExpectedOpen {
+				t.Errorf("expect max_open_conns [%d] but got [%d]", c.ExpectedOpen, cfg.DB.MaxOpenConns)
+			}
+			if cfg.Server.RestfulAddr != c.ExpectedAddr {
+				t.Errorf("expect restful_addr [%s] but got [%s]", c.ExpectedAddr, cfg.Server.RestfulAddr)
+			}
+			if time.Duration(cfg.DB.OperationTimeout) != c.ExpectedTimeout {
+				t.Errorf("expect operation_timeout [%s] but got [%s]", c.ExpectedTimeout, time.Duration(cfg.DB.OperationTimeout))
+			}
+		})
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	tomlFile := writeConfigFile(t, "config.toml", `
+[server]
+api = "restful"
+
+[db]
+dsn = "postgres://admin:secret@db:5432/user_balance?sslmode=disable"
+
+[features]
+balance_events = false
+`)
+	cfg, err := Load("test", []string{"-config", tomlFile}, mapEnv(nil))
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if cfg.ServeGrpc() || !cfg.ServeRestful() || cfg.Features.BalanceEvents || !cfg.Features.Metrics {
+		t.Errorf("expect toggles to be loaded from toml but got [%s %+v]", cfg.Server.API, cfg.Features)
+	}
+	if cfg.DatabaseDSN() != "postgres://admin:secret@db:5432/user_balance?sslmode=disable" {
+		t.Errorf("expect dsn to override connection settings but got [%s]", cfg.DatabaseDSN())
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Args           []string
+		Env            map[string]string
+		ExpectedErrMsg string
+	}{
+		{"unknown yaml key", []string{"-config", writeConfigFile(t, "unknown.yaml", "db:\n  hostname: x\n")}, nil, "field hostname not found"},
+		{"unknown toml key", []string{"-config", writeConfigFile(t, "unknown.toml", "[db]\nhostname = \"x\"\n")}, nil, "unknown keys"},
+		{"unsupported extension", []string{"-config", writeConfigFile(t, "config.ini", "")}, nil, "unsupported config file extension"},
+		{"invalid env", nil, map[string]string{"USER_BALANCE_DB_MAX_OPEN_CONNS": "ten"}, "USER_BALANCE_DB_MAX_OPEN_CONNS"},
+		{"invalid flag", []string{"-db_conn_max_lifetime", "forever"}, nil, "invalid value"},
+		{"invalid address", []string{"-grpc_addr", "50051"}, nil, "server.grpc_addr is invalid"},
+		{"invalid api", []string{"-api", "soap"}, nil, "server.api is invalid"},
+		{"admin address conflicts", []string{"-admin_addr", ":8080"}, nil, "server.admin_addr must differ from API addresses"},
+		{"zero shutdown timeout", []string{"-shutdown_timeout", "0s"}, nil, "server.shutdown_timeout must be positive"},
+		{"invalid db driver", []string{"-db_driver", "mysql"}, nil, "db.driver is invalid"},
+		{"seed file with postgres", []string{"-db_seed_file", "seed.json"}, nil, "db.seed_file is only supported by memory driver"},
+		{"replicas with memory driver", []string{"-db_driver", "memory", "-db_replica_dsns", "host=replica1"}, nil, "db.replica_dsns is only supported by postgres driver"},
+		{"zero replica check interval", []string{"-db_replica_check_interval", "0s"}, nil, "db.replica_check_interval must be positive"},
+		{"negative aggregate refresh interval", []string{"-db_aggregate_refresh_interval", "-1s"}, nil, "db.aggregate_refresh_interval must not be negative"},
+		{"negative hot account compact interval", []string{"-db_hot_account_compact_interval", "-1s"}, nil, "db.hot_account_compact_interval must not be negative"},
+		{"negative balance cache size", []string{"-balance_cache_size", "-1"}, nil, "cache.balance_size must not be negative"},
+		{"balance cache without ttl", []string{"-balance_cache_size", "1000", "-balance_cache_ttl", "0s"}, nil, "cache.balance_ttl must be positive"},
+		{"idle more than open", []string{"-db_max_idle_conns", "20"}, nil, "db.max_idle_conns must be between 0 and db.max_open_conns"},
+		{"auth disabled with api keys", []string{"-auth_disabled", "-api_keys_file", "keys.json"}, nil, "auth.disabled must not be set with auth.api_keys_file or auth.jwks_file"},
+		{"file exporter without target", []string{"-trace_exporter", "file"}, nil, "tracing.target is required"},
+		{"invalid log level", nil, map[string]string{"USER_BALANCE_LOG_LEVEL": "verbose"}, "log.level is invalid"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, err := Load("test", c.Args, mapEnv(c.Env))
+			if err == nil {
+				t.Fatalf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if !strings.Contains(err.Error(), c.ExpectedErrMsg) {
+				t.Errorf("expect error containing [%s], got [%s]", c.ExpectedErrMsg, err)
+			}
+		})
+	}
+}
+
+func TestLoadMemoryDriver(t *testing.T) {
+	// memoryドライバーではDB接続の設定は不要
+	cfg, err := Load("test", []string{"-db_driver", "memory", "-db_seed_file", "seed.json", "-dbhost", ""}, mapEnv(nil))
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if cfg.DB.Driver != DBDriver_Memory || cfg.DB.SeedFile != "seed.json" {
+		t.Errorf("expect memory driver with seed file but got [%s %s]", cfg.DB.Driver, cfg.DB.SeedFile)
+	}
+}
+
+func TestLoadReplicas(t *testing.T) {
+	yamlFile := writeConfigFile(t, "replicas.yaml", `
+db:
+  replica_dsns:
+    - host=file-replica1
+    - host=file-replica2
+  replica_max_staleness: 10s
+`)
+
+	cases := []struct {
+		Name              string
+		Args              []string
+		Env               map[string]string
+		ExpectedDSNs      string
+		ExpectedStaleness time.Duration
+	}{
+		{"defaults", nil, nil, "", 5 * time.Second},
+		{"file", []string{"-config", yamlFile}, nil, "host=file-replica1,host=file-replica2", 10 * time.Second},
+		{"env overrides file", []string{"-config", yamlFile}, map[string]string{
+			"USER_BALANCE_DB_REPLICA_DSNS": "host=env-replica1, host=env-replica2,",
+		}, "host=env-replica1,host=env-replica2", 10 * time.Second},
+		{"flag", []string{"-db_replica_dsns", "host=flag-replica1", "-db_replica_max_staleness", "1s"}, nil, "host=flag-replica1", time.Second},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg, err := Load("test", c.Args, mapEnv(c.Env))
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if dsns := strings.Join(cfg.DB.ReplicaDSNs, ","); dsns != c.ExpectedDSNs {
+				t.Errorf("expect replica_dsns [%s] but got [%s]", c.ExpectedDSNs, dsns)
+			}
+			if time.Duration(cfg.DB.ReplicaMaxStaleness) != c.ExpectedStaleness {
+				t.Errorf("expect replica_max_staleness [%s] but got [%s]", c.ExpectedStaleness, time.Duration(cfg.DB.ReplicaMaxStaleness))
+			}
+		})
+	}
+}
+
+func TestLoadAPI(t *testing.T) {
+	cases := []struct {
+		Name                string
+		Args                []string
+		Env                 map[string]string
+		ExpectedRestful     bool
+		ExpectedGrpc        bool
+		ExpectedMultiplexed bool
+	}{
+		{"defaults", nil, nil, true, true, false},
+		{"legacy grpc flag", []string{"-use_grpc"}, nil, false, true, false},
+		{"legacy restful flag", []string{"-use_grpc=false"}, nil, true, false, false},
+		{"legacy env", nil, map[string]string{"USER_BALANCE_USE_GRPC": "false"}, true, false, false},
+		{"api overrides legacy flag", []string{"-use_grpc", "-api", "both"}, nil, true, true, false},
+		{"single port", []string{"-restful_addr", ":8080", "-grpc_addr", ":8080"}, nil, true, true, true},
+		{"same address but single api", []string{"-api", "grpc", "-restful_addr", ":8080", "-grpc_addr", ":8080"}, nil, false, true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg, err := Load("test", c.Args, mapEnv(c.Env))
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if cfg.ServeRestful() != c.ExpectedRestful || cfg.ServeGrpc() != c.ExpectedGrpc || cfg.Multiplexed() != c.ExpectedMultiplexed {
+				t.Errorf("expect restful [%t] grpc [%t] multiplexed [%t] but got [%t %t %t]",
+					c.ExpectedRestful, c.ExpectedGrpc, c.ExpectedMultiplexed, cfg.ServeRestful(), cfg.ServeGrpc(), cfg.Multiplexed())
+			}
+		})
+	}
+}
+
+func TestGatewayEndpoint(t *testing.T) {
+	cases := []struct {
+		Name             string
+		GrpcAddr         string
+		ExpectedEndpoint string
+	}{
+		{"empty host", ":50051", "localhost:50051"},
+		{"unspecified ipv4", "0.0.0.0:50051", "localhost:50051"},
+		{"unspecified ipv6", "[::]:50051", "localhost:50051"},
+		{"specific host", "127.0.0.2:50051", "127.0.0.2:50051"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Server.GrpcAddr = c.GrpcAddr
+			if endpoint := cfg.GatewayEndpoint(); endpoint != c.ExpectedEndpoint {
+				t.Errorf("expect endpoint [%s] but got [%s]", c.ExpectedEndpoint, endpoint)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cases := []struct {
+		Name        string
+		DSN         string
+		ExpectedDSN string
+	}{
+		{"no dsn", "", ""},
+		{"url dsn", "postgres://admin:secret@db:5432/user_balance", "postgres://admin:REDACTED@db:5432/user_balance"},
+		{"url dsn password in query", "postgres://db/user_balance?password=secret", "postgres://db/user_balance?password=REDACTED"},
+		{"key value dsn", "host=db user=admin password=secret sslmode=disable", "host=db user=admin password=REDACTED sslmode=disable"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg := Default()
+			cfg.DB.DSN = c.DSN
+			cfg.DB.ReplicaDSNs = []string{c.DSN}
+			redacted := cfg.Redacted()
+			if redacted.DB.DSN != c.ExpectedDSN {
+				t.Errorf("expect dsn [%s] but got [%s]", c.ExpectedDSN, redacted.DB.DSN)
+			}
+			if redacted.DB.ReplicaDSNs[0] != c.ExpectedDSN || cfg.DB.ReplicaDSNs[0] != c.DSN {
+				t.Errorf("expect replica dsn [%s] but got [%s]", c.ExpectedDSN, redacted.DB.ReplicaDSNs[0])
+			}
+			if redacted.DB.Password != "REDACTED" {
+				t.Errorf("expect password to be redacted but got [%s]", redacted.DB.Password)
+			}
+			if cfg.DB.Password != "password" {
+				t.Errorf("expect original config to be unchanged but got [%s]", cfg.DB.Password)
+			}
+		})
+	}
+}
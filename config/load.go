@@ -0,0 +1,244 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix 設定を指定する環境変数の接頭辞
+const envPrefix = "USER_BALANCE_"
+
+// configFileEnv 設定ファイルのパスを指定する環境変数
+const configFileEnv = envPrefix + "CONFIG"
+
+// setting 設定ファイルのキー、環境変数、フラグと設定値の対応
+type setting struct {
+	key   string // 設定ファイルのキー(環境変数名はこれから生成する)
+	flag  string
+	usage string
+	value flag.Value
+}
+
+// env 設定に対応する環境変数名(例: db.password -> USER_BALANCE_DB_PASSWORD)
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+// settings 環境変数とフラグで指定できる設定の一覧
+// フラグ名は既存の起動オプションとの互換性を保つ
+func settings(c *Config) []setting {
+	return []setting{
+		{"use_grpc", "use_grpc", "deprecated: true is the same as -api grpc and false is the same as -api restful", (*useGrpcValue)(&c.Server.API)},
+
+		{"server.api", "api", "API to serve: grpc, restful or both", (*stringValue)(&c.Server.API)},
+		{"server.restful_addr", "restful_addr", "listen address of RESTful API", (*stringValue)(&c.Server.RestfulAddr)},
+		{"server.grpc_addr", "grpc_addr", "listen address of gRPC API", (*stringValue)(&c.Server.GrpcAddr)},
+		{"server.admin_addr", "admin_addr", "listen address of admin server serving /metrics", (*stringValue)(&c.Server.AdminAddr)},
+		{"server.read_header_timeout", "http_read_header_timeout", "timeout for reading RESTful request headers", &c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", "http_read_timeout", "timeout for reading entire RESTful request", &c.Server.ReadTimeout},
+		{"server.write_timeout", "http_write_timeout", "timeout for writing RESTful response (0 for no timeout)", &c.Server.WriteTimeout},
+		{"server.idle_timeout", "http_idle_timeout", "timeout for idle keep-alive RESTful connections", &c.Server.IdleTimeout},
+		{"server.shutdown_delay", "shutdown_delay", "time to keep accepting requests while health checks report not serving before draining", &c.Server.ShutdownDelay},
+		{"server.shutdown_timeout", "shutdown_timeout", "deadline for in-flight requests to finish on shutdown", &c.Server.ShutdownTimeout},
+
+		{"db.driver", "db_driver", "database driver: postgres or memory (in-memory storage for local development)", (*stringValue)(&c.DB.Driver)},
+		{"db.seed_file", "db_seed_file", "path to JSON file of initial users for memory driver", (*stringValue)(&c.DB.SeedFile)},
+		{"db.dsn", "dsn", "database DSN, overrides other database connection settings", (*stringValue)(&c.DB.DSN)},
+		{"db.host", "dbhost", "database host", (*stringValue)(&c.DB.Host)},
+		{"db.port", "dbport", "database port number", (*stringValue)(&c.DB.Port)},
+		{"db.name", "dbname", "database name", (*stringValue)(&c.DB.Name)},
+		{"db.user", "dbuser", "database user name", (*stringValue)(&c.DB.User)},
+		{"db.password", "dbpass", "database password (prefer " + envPrefix + "DB_PASSWORD)", (*stringValue)(&c.DB.Password)},
+		{"db.sslmode", "dbssl", "use database ssl tunnel or not", (*stringValue)(&c.DB.SSLMode)},
+		{"db.max_open_conns", "db_max_open_conns", "maximum number of open database connections", (*intValue)(&c.DB.MaxOpenConns)},
+		{"db.max_idle_conns", "db_max_idle_conns", "maximum number of idle database connections", (*intValue)(&c.DB.MaxIdleConns)},
+		{"db.conn_max_lifetime", "db_conn_max_lifetime", "maximum lifetime of a database connection", &c.DB.ConnMaxLifetime},
+		{"db.operation_timeout", "db_operation_timeout", "timeout of each balance operation including database access", &c.DB.OperationTimeout},
+		{"db.replica_dsns", "db_replica_dsns", "comma separated DSNs of read replicas used for reads outside transactions", (*stringListValue)(&c.DB.ReplicaDSNs)},
+		{"db.replica_max_staleness", "db_replica_max_staleness", "maximum replication lag of a read replica to serve reads", &c.DB.ReplicaMaxStaleness},
+		{"db.replica_check_interval", "db_replica_check_interval", "interval of checking connectivity and replication lag of read replicas", &c.DB.ReplicaCheckInterval},
+		{"db.aggregate_refresh_interval", "db_aggregate_refresh_interval", "interval of refreshing daily transaction aggregates read by reports in background (0 to disable on this instance)", &c.DB.AggregateRefreshInterval},
+		{"db.hot_account_compact_interval", "db_hot_account_compact_interval", "interval of moving slot balances of hot accounts back to their main row in background (0 to disable on this instance)", &c.DB.HotAccountCompactInterval},
+
+		{"auth.disabled", "auth_disabled", "disable authentication and authorization (development only)", (*boolValue)(&c.Auth.Disabled)},
+		{"auth.api_keys_file", "api_keys_file", "path to JSON file of hashed API keys", (*stringValue)(&c.Auth.APIKeysFile)},
+		{"auth.jwks_file", "jwks_file", "path to JWKS file used to verify JWTs", (*stringValue)(&c.Auth.JWKSFile)},
+		{"auth.jwt_issuer", "jwt_issuer", "expected JWT issuer (iss), not checked if empty", (*stringValue)(&c.Auth.JWTIssuer)},
+		{"auth.jwt_audience", "jwt_audience", "expected JWT audience (aud), not checked if empty", (*stringValue)(&c.Auth.JWTAudience)},
+
+		{"rate_limit.client", "rate_limit_client", "requests per second allowed for each client (0 to disable)", (*float64Value)(&c.RateLimit.Client)},
+		{"rate_limit.client_burst", "rate_limit_client_burst", "burst size of requests for each client", (*intValue)(&c.RateLimit.ClientBurst)},
+		{"rate_limit.user", "rate_limit_user", "requests per second allowed for each target user_id (0 to disable)", (*float64Value)(&c.RateLimit.User)},
+		{"rate_limit.user_burst", "rate_limit_user_burst", "burst size of requests for each target user_id", (*intValue)(&c.RateLimit.UserBurst)},
+
+		{"cache.balance_size", "balance_cache_size", "maximum number of users whose balance is cached (0 to disable)", (*intValue)(&c.Cache.BalanceSize)},
+		{"cache.balance_ttl", "balance_cache_ttl", "time to keep a cached balance, changes on other instances are visible after this delay", &c.Cache.BalanceTTL},
+
+		{"tracing.exporter", "trace_exporter", "trace exporter: none, stdout, file or otlp", (*stringValue)(&c.Tracing.Exporter)},
+		{"tracing.target", "trace_target", "output file path for file exporter or host:port of collector for otlp exporter", (*stringValue)(&c.Tracing.Target)},
+		{"tracing.sample_ratio", "trace_sample_ratio", "ratio of root spans to sample (0 to 1)", (*float64Value)(&c.Tracing.SampleRatio)},
+
+		{"log.format", "log_format", "log format: json or console", (*stringValue)(&c.Log.Format)},
+		{"log.level", "log_level", "minimum log level: debug, info, warn or error", (*stringValue)(&c.Log.Level)},
+
+		{"features.metrics", "metrics", "serve /metrics on admin server", (*boolValue)(&c.Features.Metrics)},
+		{"features.balance_events", "balance_events", "serve Server-Sent Events of balance changes on RESTful API", (*boolValue)(&c.Features.BalanceEvents)},
+		{"features.gateway", "gateway", "serve JSON/HTTP gateway to gRPC API and OpenAPI document under /v1 of RESTful API (api both only)", (*boolValue)(&c.Features.Gateway)},
+		{"features.grpc_reflection", "grpc_reflection", "register gRPC server reflection for debugging tools such as grpcurl", (*boolValue)(&c.Features.GrpcReflection)},
+	}
+}
+
+// Load デフォルト値、設定ファイル、環境変数、フラグの順に読み込み、後のものを優先した設定を作成して検証する
+// 設定ファイルのパスは-configフラグまたはUSER_BALANCE_CONFIG環境変数で指定する(拡張子.yaml、.yml、.toml)
+func Load(name string, args []string, getenv func(string) string) (Config, error) {
+	// フラグは既定値をヘルプに表示するためデフォルト設定に束縛し、指定されたフラグのみを後で適用する
+	defaults := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", getenv(configFileEnv), "path to YAML or TOML config file")
+	for _, s := range settings(&defaults) {
+		fs.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	c := Default()
+	if *configFile != "" {
+		if err := loadFile(*configFile, &c); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings(&c) {
+		if v := getenv(s.env()); v != "" {
+			if err := s.value.Set(v); err != nil {
+				return Config{}, fmt.Errorf("invalid value %q for %s: %w", v, s.env(), err)
+			}
+		}
+	}
+	for _, s := range settings(&c) {
+		if v, ok := flags[s.flag]; ok {
+			if err := s.value.Set(v); err != nil {
+				return Config{}, fmt.Errorf("invalid value %q for -%s: %w", v, s.flag, err)
+			}
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// loadFile 設定ファイルを読み込む(設定にないキーはエラーとする)
+func loadFile(path string, c *Config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(b), c)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("invalid config file %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension: %s", path)
+	}
+	return nil
+}
+
+// stringValue 文字列の設定値
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+// boolValue 真偽値の設定値
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// useGrpcValue 提供するAPIを真偽値で指定する従来の設定値(trueはgrpc、falseはrestful)
+type useGrpcValue string
+
+func (v *useGrpcValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if b {
+		*v = API_Grpc
+	} else {
+		*v = API_Restful
+	}
+	return nil
+}
+func (v *useGrpcValue) String() string   { return strconv.FormatBool(string(*v) == API_Grpc) }
+func (v *useGrpcValue) IsBoolFlag() bool { return true }
+
+// intValue 整数の設定値
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+// float64Value 浮動小数点数の設定値
+type float64Value float64
+
+func (v *float64Value) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = float64Value(f)
+	return nil
+}
+func (v *float64Value) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+
+// stringListValue カンマ区切りの文字列の一覧の設定値
+type stringListValue []string
+
+func (v *stringListValue) Set(s string) error {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	*v = values
+	return nil
+}
+func (v *stringListValue) String() string { return strings.Join(*v, ",") }
@@ -0,0 +1,17 @@
+package domain
+
+import "context"
+
+// BalanceCache ユーザーID毎のユーザー残高情報のキャッシュのインタフェース
+// 複数インスタンス間で共有する外部のキャッシュを使用する場合はこのインタフェースを実装する
+// 外部のキャッシュの障害は呼び出し側に返さず、Getはキャッシュにない場合と同じ扱いにする
+type BalanceCache interface {
+	// Get ユーザーIDでキャッシュしたユーザー残高情報を取得(ない、または有効期限切れの場合はfalse)
+	Get(context.Context, string) (UserBalanceModel, bool)
+	// Set ユーザー残高情報をキャッシュ
+	Set(context.Context, UserBalanceModel)
+	// Delete 指定したユーザーのキャッシュを削除
+	Delete(context.Context, ...string)
+	// Purge 全てのキャッシュを削除
+	Purge(context.Context)
+}
@@ -0,0 +1,58 @@
+package domain
+
+import "context"
+
+// Logger 構造化されたレベル付きログを出力するインタフェース
+// keysAndValuesはキーと値を交互に並べたもの("user_id", userID, ...)
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+	// With 指定したフィールドを全てのログに付与したLoggerを作成
+	With(keysAndValues ...interface{}) Logger
+}
+
+// nopLogger 何も出力しないLogger
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+func (l nopLogger) With(...interface{}) Logger { return l }
+
+// NewNopLogger 何も出力しないLoggerを作成
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+// requestIDContextKey コンテキストにリクエストIDを格納するためのキー
+type requestIDContextKey struct{}
+
+// loggerContextKey コンテキストにLoggerを格納するためのキー
+type loggerContextKey struct{}
+
+// ContextWithRequestID リクエストIDをコンテキストに格納
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestIDFromContext コンテキストからリクエストIDを取得
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// ContextWithLogger リクエスト毎のLoggerをコンテキストに格納
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext コンテキストからリクエスト毎のLoggerを取得(格納されていない場合は何も出力しないLogger)
+func LoggerFromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return logger
+	}
+	return nopLogger{}
+}
@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// MetricsRecorder 各層の計測値を記録するインタフェース
+type MetricsRecorder interface {
+	// ObserveOperation usecaseの操作の結果と処理時間を記録
+	ObserveOperation(string, string, time.Duration)
+	// ObserveHTTPRequest RESTfulリクエストのメソッド、ルート、ステータスコードと処理時間を記録
+	ObserveHTTPRequest(string, string, int, time.Duration)
+	// ObserveGRPCRequest gRPCリクエストのメソッド、ステータスコードと処理時間を記録
+	ObserveGRPCRequest(string, string, time.Duration)
+	// ObserveCacheLookup キャッシュの名前とヒットしたかを記録
+	ObserveCacheLookup(string, bool)
+}
@@ -0,0 +1,70 @@
+package domain
+
+import "strings"
+
+// Operation 権限管理の対象となるusecaseの操作
+type Operation string
+
+const (
+	Operation_GetBalance        Operation = "GetBalance"
+	Operation_AddBalance        Operation = "AddBalance"
+	Operation_ReduceBalance     Operation = "ReduceBalance"
+	Operation_AddAllUserBalance Operation = "AddAllUserBalance"
+	Operation_CreateUser        Operation = "CreateUser"
+	Operation_FreezeUser        Operation = "FreezeUser" // 凍結の解除を含む
+	Operation_CloseUser         Operation = "CloseUser"
+)
+
+// ロール
+const (
+	Role_Reader   = "reader"
+	Role_Operator = "operator"
+	Role_Admin    = "admin"
+	// Role_MerchantPrefix 加盟店スコープのロールの接頭辞("merchant:<merchant_id>")
+	// 自加盟店に所属するユーザーに対してのみ操作できる
+	Role_MerchantPrefix = "merchant:"
+)
+
+// rolePermissions ロール毎に許可される操作
+var rolePermissions = map[string][]Operation{
+	Role_Reader:   {Operation_GetBalance},
+	Role_Operator: {Operation_GetBalance, Operation_AddBalance, Operation_ReduceBalance, Operation_CreateUser, Operation_FreezeUser},
+	Role_Admin: {Operation_GetBalance, Operation_AddBalance, Operation_ReduceBalance, Operation_AddAllUserBalance,
+		Operation_CreateUser, Operation_FreezeUser, Operation_CloseUser},
+}
+
+// merchantPermissions 加盟店スコープのロールに許可される操作
+var merchantPermissions = []Operation{Operation_GetBalance, Operation_AddBalance, Operation_ReduceBalance}
+
+// Authorize 主体が操作を実行できるかを判定
+// merchantIDは操作対象ユーザーが所属する加盟店ID(不明または対象ユーザーがない場合は空文字)
+func Authorize(principal Principal, op Operation, merchantID string) bool {
+	for _, role := range principal.Roles {
+		if containsOperation(rolePermissions[role], op) {
+			return true
+		}
+		if merchantID != "" && role == Role_MerchantPrefix+merchantID && containsOperation(merchantPermissions, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMerchantRole 主体が加盟店スコープのロールを持つかを判定
+func (p Principal) HasMerchantRole() bool {
+	for _, role := range p.Roles {
+		if strings.HasPrefix(role, Role_MerchantPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOperation(ops []Operation, op Operation) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package domain
+
+import "context"
+
+// PrincipalKind 認証方式
+type PrincipalKind string
+
+const (
+	PrincipalKind_APIKey PrincipalKind = "api_key"
+	PrincipalKind_JWT    PrincipalKind = "jwt"
+)
+
+// Principal 認証された主体
+type Principal struct {
+	ID    string
+	Kind  PrincipalKind
+	Roles []string
+}
+
+// Authenticator 認証情報から主体を特定するインタフェース
+type Authenticator interface {
+	AuthenticateAPIKey(string) (Principal, error)
+	AuthenticateToken(string) (Principal, error)
+}
+
+// principalContextKey コンテキストに主体を格納するためのキー
+type principalContextKey struct{}
+
+// ContextWithPrincipal 認証された主体をコンテキストに格納
+func ContextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext コンテキストから認証された主体を取得
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
@@ -0,0 +1,10 @@
+package domain
+
+import "time"
+
+// RateLimiter キー毎のリクエスト頻度を制限するインタフェース
+// 複数インスタンス間で共有するストアを使用する場合はこのインタフェースを実装する
+type RateLimiter interface {
+	// Allow キーへのリクエストを許可するかを判定し、拒否する場合は再試行できるまでの待ち時間を返す
+	Allow(string) (bool, time.Duration)
+}
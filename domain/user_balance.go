@@ -2,15 +2,113 @@ package domain
 
 import (
 	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
 	"time"
 )
 
 // UserBalanceModel user_balanceテーブルのデータモデル
 type UserBalanceModel struct {
-	UserID    string
-	Balance   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	UserID     string
+	Balance    int
+	MerchantID string // 所属する加盟店ID(所属しない場合は空文字)
+	Status     UserStatus
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// UserStatus ユーザーの状態
+type UserStatus string
+
+const (
+	UserStatus_Active      UserStatus = "active"       // 全ての操作が可能
+	UserStatus_DebitFrozen UserStatus = "debit_frozen" // 減算のみ凍結
+	UserStatus_Frozen      UserStatus = "frozen"       // 全ての残高変更を凍結
+	UserStatus_Closed      UserStatus = "closed"       // 解約済み(再開できない)
+)
+
+// CanCredit 残高を加算できる状態かを判定
+func (s UserStatus) CanCredit() bool {
+	return s == UserStatus_Active || s == UserStatus_DebitFrozen
+}
+
+// CanDebit 残高を減算できる状態かを判定
+func (s UserStatus) CanDebit() bool {
+	return s == UserStatus_Active
+}
+
+// FreezeScope 凍結の範囲
+type FreezeScope string
+
+const (
+	FreezeScope_Debit FreezeScope = "debit" // 減算のみ凍結
+	FreezeScope_All   FreezeScope = "all"   // 全ての残高変更を凍結
+)
+
+// Status 凍結の範囲に対応するユーザーの状態
+func (s FreezeScope) Status() (UserStatus, bool) {
+	switch s {
+	case FreezeScope_Debit:
+		return UserStatus_DebitFrozen, true
+	case FreezeScope_All:
+		return UserStatus_Frozen, true
+	}
+	return "", false
+}
+
+// MaxUserIDLength ユーザーIDと加盟店IDの最大長
+const MaxUserIDLength = 36
+
+// MaxBatchGetBalancesSize 一括で残高を取得できるユーザー数の上限
+const MaxBatchGetBalancesSize = 100
+
+// BalanceResult 一括残高取得のユーザー毎の結果
+// ユーザーが存在しない、解約済みまたは参照する権限がない場合はFoundがfalseになる
+type BalanceResult struct {
+	UserID  string
+	Balance int
+	Found   bool
+}
+
+// 口座一覧のページサイズ
+const (
+	DefaultListAccountsPageSize = 50
+	MaxListAccountsPageSize     = 500
+)
+
+// AccountSortField 口座一覧の並び替えの項目
+type AccountSortField string
+
+const (
+	AccountSortField_UserID    AccountSortField = "user_id"
+	AccountSortField_Balance   AccountSortField = "balance"
+	AccountSortField_CreatedAt AccountSortField = "created_at"
+)
+
+// Valid 並び替えの項目として有効かを判定
+func (f AccountSortField) Valid() bool {
+	return f == AccountSortField_UserID || f == AccountSortField_Balance || f == AccountSortField_CreatedAt
+}
+
+// Valid ユーザーの状態として有効かを判定
+func (s UserStatus) Valid() bool {
+	return s == UserStatus_Active || s == UserStatus_DebitFrozen || s == UserStatus_Frozen || s == UserStatus_Closed
+}
+
+// ListAccountsQuery 口座一覧の絞り込み、並び替えとページングの条件
+// 同じ値の場合はユーザーIDの順に並び、AfterUserIDで指定したユーザーの次から取得する
+type ListAccountsQuery struct {
+	MinBalance    *int         // 残高の下限(含む)
+	MaxBalance    *int         // 残高の上限(含む)
+	Statuses      []UserStatus // 空の場合は全ての状態
+	MerchantID    string       // 空の場合は全ての加盟店
+	CreatedAfter  time.Time    // 作成日時の下限(含む、ゼロ値の場合は指定なし)
+	CreatedBefore time.Time    // 作成日時の上限(含まない、ゼロ値の場合は指定なし)
+	SortBy        AccountSortField
+	Descending    bool
+	PageSize      int
+	AfterUserID   string // 前のページの最後のユーザーID(空文字の場合は最初から)
 }
 
 // TransactionHistoryModel transaction_historyテーブルのデータモデル
@@ -19,8 +117,18 @@ type TransactionHistoryModel struct {
 	UserID          string
 	TransactionType TransactionType
 	Amount          int
-	CreatedAt       time.Time
-	UpdatedAt       time.Time
+	BalanceAfter    *int // 取引後のユーザー残高(一斉加算はnil。ホットアカウントの取引と記録を開始する前の取引履歴は記録されず、ユーザー毎の取引履歴の取得時に算出する)
+	AuditInfo
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SignedAmount 残高の増減を表す符号付きの金額(減算の場合は負)
+func (h TransactionHistoryModel) SignedAmount() int {
+	if h.TransactionType == TransactionType_ReduceUserBalance {
+		return -h.Amount
+	}
+	return h.Amount
 }
 
 // TransactionType 取引種類
@@ -32,23 +140,336 @@ const (
 	TransactionType_AddAllUserBalance
 )
 
+// MaxImportOperations 1回のインポートで適用できる残高操作の上限
+const MaxImportOperations = 10000
+
+// ImportMode インポートの適用方法
+type ImportMode string
+
+const (
+	ImportMode_Atomic     ImportMode = "atomic"      // 全ての行を1つのトランザクションで適用し、1行でも失敗した場合は全て適用しない
+	ImportMode_BestEffort ImportMode = "best_effort" // 行毎に適用し、失敗した行のみ適用しない
+)
+
+// BalanceOperation インポートする1行分の残高操作(取引種類は加算または減算)
+type BalanceOperation struct {
+	Line            int // ファイルの行番号
+	UserID          string
+	TransactionType TransactionType
+	Amount          int
+	TransactionID   string
+	ReasonCode      string // 空文字の場合はインポート全体の監査情報を使用
+	Note            string // 空文字の場合はインポート全体の監査情報を使用
+}
+
+// ImportLineStatus インポートの行毎の結果
+type ImportLineStatus string
+
+const (
+	ImportLineStatus_Applied    ImportLineStatus = "applied"     // 適用済み
+	ImportLineStatus_Skipped    ImportLineStatus = "skipped"     // 同じ取引IDが適用済みのため適用しない
+	ImportLineStatus_Failed     ImportLineStatus = "failed"      // 検証または適用に失敗
+	ImportLineStatus_NotApplied ImportLineStatus = "not_applied" // 一括適用で他の行が失敗したため適用しない
+)
+
+// ImportLineResult インポートの行毎の結果(失敗した場合はErrorに理由を格納)
+type ImportLineResult struct {
+	Line          int
+	UserID        string
+	TransactionID string
+	Status        ImportLineStatus
+	Error         string
+}
+
+// ExportDataset エクスポートする対象のデータ
+type ExportDataset string
+
+const (
+	ExportDataset_Balances ExportDataset = "balances" // ユーザー残高(user_balance)
+	ExportDataset_History  ExportDataset = "history"  // 取引履歴(transaction_history)
+)
+
+// Valid エクスポートする対象として有効かを判定
+func (d ExportDataset) Valid() bool {
+	return d == ExportDataset_Balances || d == ExportDataset_History
+}
+
+// ExportQuery エクスポートする対象と絞り込みの条件
+// 期間はユーザー残高の場合は更新日時、取引履歴の場合は作成日時で絞り込む
+type ExportQuery struct {
+	Datasets         []ExportDataset   // 空の場合は全て(ユーザー残高、取引履歴の順に出力する)
+	From             time.Time         // 期間の開始(含む、ゼロ値の場合は指定なし)
+	To               time.Time         // 期間の終了(含まない、ゼロ値の場合は指定なし)
+	TransactionTypes []TransactionType // 取引履歴の取引種類(空の場合は全て)
+}
+
+// Includes エクスポートする対象に含まれるかを判定
+func (q ExportQuery) Includes(dataset ExportDataset) bool {
+	if len(q.Datasets) == 0 {
+		return true
+	}
+	for _, d := range q.Datasets {
+		if d == dataset {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportWriter エクスポートする行を順に受け取るインタフェース
+// ユーザー残高はユーザーIDの順、取引履歴は作成日時と取引IDの順に渡される
+type ExportWriter interface {
+	WriteUserBalance(UserBalanceModel) error
+	WriteTransactionHistory(TransactionHistoryModel) error
+}
+
+// ExportSummary エクスポートした件数と残高の合計
+type ExportSummary struct {
+	Balances     int
+	Transactions int
+	TotalBalance int64 // エクスポートしたユーザー残高の合計
+}
+
+// MaxStatementPeriod 1回で作成できる取引明細の期間の上限
+const MaxStatementPeriod = 366 * 24 * time.Hour
+
+// StatementTotal 取引明細の取引種類毎の件数と金額の合計
+type StatementTotal struct {
+	TransactionType TransactionType
+	Count           int
+	Amount          int64
+}
+
+// Statement ユーザーの期間内の取引明細
+// 期間の開始時点と終了時点の残高、期間内の取引(一斉加算を含む)と取引種類毎の合計を格納する
+type Statement struct {
+	UserID         string
+	From           time.Time // 期間の開始(含む)
+	To             time.Time // 期間の終了(含まない)
+	OpeningBalance int
+	ClosingBalance int
+	Transactions   []TransactionHistoryModel // 古い順(BalanceAfterは全ての取引で設定される)
+	Totals         []StatementTotal          // 全ての取引種類の合計(取引種類の順)
+}
+
+// ReportGranularity 集計レポートの期間の単位
+type ReportGranularity string
+
+const (
+	ReportGranularity_Day   ReportGranularity = "day"
+	ReportGranularity_Week  ReportGranularity = "week" // 月曜日始まり
+	ReportGranularity_Month ReportGranularity = "month"
+)
+
+// Valid 集計レポートの期間の単位として有効かを判定
+func (g ReportGranularity) Valid() bool {
+	return g == ReportGranularity_Day || g == ReportGranularity_Week || g == ReportGranularity_Month
+}
+
+// Truncate 日時を含む期間の開始日時(UTC)
+func (g ReportGranularity) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch g {
+	case ReportGranularity_Week:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case ReportGranularity_Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// Next 期間の開始日時から次の期間の開始日時
+func (g ReportGranularity) Next(start time.Time) time.Time {
+	switch g {
+	case ReportGranularity_Week:
+		return start.AddDate(0, 0, 7)
+	case ReportGranularity_Month:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// MaxReportPeriods 1回の集計レポートに含められる期間の数の上限
+const MaxReportPeriods = 366
+
+// ReportQuery 集計レポートの期間と単位
+// 期間は単位の境界に広げて集計する(開始は含み、終了は含まない)
+type ReportQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity ReportGranularity
+}
+
+// DailyTransactionAggregate 日毎、取引種類毎の取引件数と金額の合計(daily_transaction_aggregateテーブルのデータモデル)
+// 一斉加算の金額は実行時点で加算できる状態だった全ユーザーへの加算額の合計(入金の合計が残高の総額の増減と一致する)
+type DailyTransactionAggregate struct {
+	Day             time.Time // 日の開始日時(UTC)
+	TransactionType TransactionType
+	Count           int64
+	Amount          int64
+}
+
+// BalanceStatusTotal ユーザーの状態毎のユーザー数と残高の合計
+type BalanceStatusTotal struct {
+	Status  UserStatus
+	Users   int64
+	Balance int64
+}
+
+// ReportVolume 取引種類毎の取引件数と金額の合計
+type ReportVolume struct {
+	TransactionType TransactionType
+	Count           int64
+	Amount          int64
+}
+
+// ReportPeriod 集計レポートの1期間分の取引量
+// 入金(Credit)は加算と一斉加算、出金(Debit)は減算の金額の合計
+type ReportPeriod struct {
+	Start   time.Time // 期間の開始(含む)
+	End     time.Time // 期間の終了(含まない)
+	Credit  int64
+	Debit   int64
+	Volumes []ReportVolume // 全ての取引種類(取引種類の順)
+}
+
+// Report 残高の総額(負債)と期間毎の取引量の集計レポート
+type Report struct {
+	From            time.Time
+	To              time.Time
+	Granularity     ReportGranularity
+	TotalBalance    int64                // 全ユーザーの残高の合計
+	TotalUsers      int64                // 全ユーザー数
+	Balances        []BalanceStatusTotal // 状態毎の内訳(ユーザーが存在する状態のみ、状態の名前の順)
+	Periods         []ReportPeriod       // 古い順
+	Totals          []ReportVolume       // 期間全体の取引種類毎の合計
+	AggregatedUntil time.Time            // 日毎の集計に反映済みの取引履歴の作成日時の上限(集計を一度も完了していない場合はゼロ値)
+}
+
+// RequestSource 取引を発生させたリクエストの経路
+type RequestSource string
+
+const (
+	RequestSource_RESTful RequestSource = "restful"
+	RequestSource_gRPC    RequestSource = "grpc"
+	RequestSource_Gateway RequestSource = "gateway" // JSON/HTTPゲートウェイを経由したgRPC
+	RequestSource_CLI     RequestSource = "cli"
+)
+
+const maxReasonCodeLength = 64
+const maxNoteLength = 1000
+
+// AuditInfo 取引履歴に記録する監査情報
+type AuditInfo struct {
+	Actor      string            // 取引を実行した主体
+	ReasonCode string            // 取引理由のコード
+	Note       string            // 自由記述のメモ
+	Source     RequestSource     // リクエスト経路
+	ClientAddr string            // クライアントのアドレス
+	Metadata   map[string]string // 任意のメタデータ(JSONで保存)
+}
+
+// Validate 監査情報の長さを検証
+func (a AuditInfo) Validate() error {
+	if len(a.ReasonCode) > maxReasonCodeLength {
+		return errors.New("reason_code is too long")
+	}
+	if len(a.Note) > maxNoteLength {
+		return errors.New("note is too long")
+	}
+	return nil
+}
+
+// 振替の取引履歴のメタデータのキー
+const (
+	MetadataKey_TransferID   = "transfer_id"   // 振替の取引ID
+	MetadataKey_TransferFrom = "transfer_from" // 振替元のユーザーID(入金側に記録)
+	MetadataKey_TransferTo   = "transfer_to"   // 振替先のユーザーID(出金側に記録)
+)
+
+// TransferCreditTransactionID 振替の入金側の取引履歴に使用する取引ID
+// 出金側は振替の取引IDをそのまま使用し、入金側はそこから決定的に生成したUUID形式のIDを使用するため、
+// 振替が再送された場合も取引IDの一意性違反として検出できる
+func TransferCreditTransactionID(transactionID string) string {
+	sum := sha1.Sum([]byte("transfer-credit:" + transactionID))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // バージョン5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122のバリアント
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// BalanceChangeEvent 残高変更のコミット成功後に通知されるイベント
+type BalanceChangeEvent struct {
+	TransactionID   string
+	UserID          string // 一斉加算の場合は空文字
+	TransactionType TransactionType
+	Amount          int
+	AuditInfo
+	CreatedAt time.Time
+}
+
+// AfterCommitHook 残高変更トランザクションのコミット成功後に呼び出されるフック
+type AfterCommitHook func(BalanceChangeEvent)
+
+// primaryReadContextKey コンテキストに読み取りをプライマリで行う指定を格納するためのキー
+type primaryReadContextKey struct{}
+
+// ContextWithPrimaryRead 残高を変更する操作の中の読み取りをリードレプリカやキャッシュではなくプライマリで行うよう指定
+func ContextWithPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadContextKey{}, true)
+}
+
+// PrimaryReadFromContext コンテキストで読み取りをプライマリで行うよう指定されているか
+func PrimaryReadFromContext(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadContextKey{}).(bool)
+	return primary
+}
+
 // UserBalanceRepository ユーザー残高管理repositoryのインタフェース
+// BeginTxはトランザクションを格納したコンテキスト(エラーの場合は渡したコンテキスト)を返し、トランザクション内の操作とCommit、Rollbackにはそのコンテキストを渡す
+// トランザクションはコンテキスト毎に独立するため、1つのrepositoryを複数のgoroutineで共有できる
 type UserBalanceRepository interface {
-	GetCtxWithTimeout(time.Duration) (context.Context, context.CancelFunc)
-	BeginTx(context.Context) error
-	Commit() error
-	Rollback() error
-	InsertTransactionHistory(context.Context, string, string, TransactionType, int) error
+	GetCtxWithTimeout(context.Context, time.Duration) (context.Context, context.CancelFunc)
+	BeginTx(context.Context) (context.Context, error)
+	Commit(context.Context) error
+	Rollback(context.Context) error
+	InsertTransactionHistory(context.Context, string, string, TransactionType, int, AuditInfo) error
 	QueryUserBalanceByUserID(context.Context, string) (UserBalanceModel, error)
-	AddUserBalanceByUserID(context.Context, string, int) error 
+	AddUserBalanceByUserID(context.Context, string, int) error
 	ReduceUserBalanceByUserID(context.Context, string, int) error
 	AddAllUserBalance(context.Context, int) error
+	QueryTransactionHistoryByUserID(context.Context, string, string) ([]TransactionHistoryModel, error)
+	QueryTransactionHistoryInPeriod(context.Context, string, time.Time, time.Time) (int, []TransactionHistoryModel, error)
+	InsertUser(context.Context, UserBalanceModel) error
+	UpdateUserStatusByUserID(context.Context, string, UserStatus) error
+	InsertUserStatusHistory(context.Context, string, UserStatus, AuditInfo) error
+	QueryUserBalancesByUserIDs(context.Context, []string) ([]UserBalanceModel, error)
+	QueryUserBalances(context.Context, ListAccountsQuery) ([]UserBalanceModel, error)
+	QueryExistingTransactionIDs(context.Context, []string) ([]string, error)
+	ExportSnapshot(context.Context, ExportQuery, ExportWriter) error
+	RefreshDailyTransactionAggregates(context.Context) (time.Time, error)
+	QueryDailyTransactionAggregates(context.Context, time.Time, time.Time) ([]DailyTransactionAggregate, time.Time, error)
+	QueryBalanceStatusTotals(context.Context) ([]BalanceStatusTotal, error)
 }
 
 // UserBalanceUsecase ユーザー残高管理usecaseのインタフェース
+// 各メソッドはコンテキストに格納された認証済みの主体の権限を検証する
 type UserBalanceUsecase interface {
-	AddBalance(string, int, string) error
-	ReduceBalance(string, int, string) error
-	AddAllUserBalance(int, string) error
-	GetBalance(string) (int, error)
+	AddBalance(context.Context, string, int, string, AuditInfo) error
+	ReduceBalance(context.Context, string, int, string, AuditInfo) error
+	AddAllUserBalance(context.Context, int, string, AuditInfo) error
+	GetBalance(context.Context, string) (int, error)
+	GetTransactionHistory(context.Context, string, string) ([]TransactionHistoryModel, error)
+	TransferBalance(context.Context, string, string, int, string, AuditInfo) error
+	CreateUser(context.Context, string, string, int, string, AuditInfo) error
+	GetUser(context.Context, string) (UserBalanceModel, error)
+	FreezeUser(context.Context, string, FreezeScope, AuditInfo) error
+	UnfreezeUser(context.Context, string, AuditInfo) error
+	CloseUser(context.Context, string, AuditInfo) error
+	BatchGetBalances(context.Context, []string) ([]BalanceResult, error)
+	ListAccounts(context.Context, ListAccountsQuery) ([]UserBalanceModel, string, error)
+	ImportBalanceOperations(context.Context, []BalanceOperation, ImportMode, AuditInfo) ([]ImportLineResult, error)
+	Export(context.Context, ExportQuery, ExportWriter) (ExportSummary, error)
+	GetStatement(context.Context, string, time.Time, time.Time) (Statement, error)
+	GetReport(context.Context, ReportQuery) (Report, error)
 }
@@ -0,0 +1,228 @@
+package infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// errUnauthenticated 認証失敗時のエラー(失敗理由は呼び出し側に返さない)
+var errUnauthenticated = errors.New("unauthenticated")
+
+// apiKeyEntry APIキー設定ファイルのエントリ
+type apiKeyEntry struct {
+	ID      string   `json:"id"`
+	KeyHash string   `json:"key_hash"` // APIキーのSHA-256ハッシュ(16進数)
+	Roles   []string `json:"roles"`
+}
+
+// jsonWebKey JWKSファイルの公開鍵
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// authenticator APIキーとJWKSの公開鍵を格納
+type authenticator struct {
+	apiKeys  map[string]domain.Principal
+	keys     map[string]interface{}
+	issuer   string
+	audience string
+}
+
+// NewAuthenticator APIキー設定ファイルとJWKSファイルから新しい認証器を作成
+// ファイルのパスが空の場合、その認証方式は無効になる
+func NewAuthenticator(apiKeysFile string, jwksFile string, issuer string, audience string) (domain.Authenticator, error) {
+	a := &authenticator{
+		apiKeys:  make(map[string]domain.Principal),
+		keys:     make(map[string]interface{}),
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	if apiKeysFile != "" {
+		b, err := ioutil.ReadFile(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var entries []apiKeyEntry
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("invalid api key file: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.ID == "" || entry.KeyHash == "" {
+				return nil, errors.New("invalid api key file: id and key_hash are required")
+			}
+			a.apiKeys[strings.ToLower(entry.KeyHash)] = domain.Principal{
+				ID:    entry.ID,
+				Kind:  domain.PrincipalKind_APIKey,
+				Roles: entry.Roles,
+			}
+		}
+	}
+
+	if jwksFile != "" {
+		b, err := ioutil.ReadFile(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := json.Unmarshal(b, &jwks); err != nil {
+			return nil, fmt.Errorf("invalid jwks file: %w", err)
+		}
+		for _, k := range jwks.Keys {
+			key, err := parseJSONWebKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwks file: %w", err)
+			}
+			a.keys[k.Kid] = key
+		}
+	}
+
+	return a, nil
+}
+
+// HashAPIKey APIキー設定ファイルに記載するハッシュ値を計算
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateAPIKey APIキーで認証
+func (a *authenticator) AuthenticateAPIKey(key string) (domain.Principal, error) {
+	if key == "" {
+		return domain.Principal{}, errUnauthenticated
+	}
+	principal, ok := a.apiKeys[HashAPIKey(key)]
+	if !ok {
+		return domain.Principal{}, errUnauthenticated
+	}
+	return principal, nil
+}
+
+// AuthenticateToken JWTを検証して認証
+func (a *authenticator) AuthenticateToken(tokenString string) (domain.Principal, error) {
+	if len(a.keys) == 0 {
+		return domain.Principal{}, errUnauthenticated
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %s", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := a.keys[kid]; ok {
+			return key, nil
+		}
+		// kidが指定されず鍵が1つのみの場合はその鍵で検証
+		if kid == "" && len(a.keys) == 1 {
+			for _, key := range a.keys {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	})
+	if err != nil || !token.Valid {
+		return domain.Principal{}, errUnauthenticated
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return domain.Principal{}, errUnauthenticated
+	}
+	// 有効期限のないトークンは漏洩した場合に失効しないため受け付けない
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return domain.Principal{}, errUnauthenticated
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return domain.Principal{}, errUnauthenticated
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return domain.Principal{}, errUnauthenticated
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return domain.Principal{}, errUnauthenticated
+	}
+
+	principal := domain.Principal{
+		ID:   sub,
+		Kind: domain.PrincipalKind_JWT,
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if r, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, r)
+			}
+		}
+	}
+	return principal, nil
+}
+
+// parseJSONWebKey JWKの公開鍵をcryptoパッケージの公開鍵に変換
+func parseJSONWebKey(k jsonWebKey) (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
@@ -0,0 +1,141 @@
+package infrastructure
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// newTestAuthenticator テスト用のAPIキー設定ファイルとJWKSファイルを作成して認証器を作成
+func newTestAuthenticator(t *testing.T) (domain.Authenticator, *rsa.PrivateKey) {
+	dir := t.TempDir()
+	apiKeysFile := filepath.Join(dir, "api_keys.json")
+	ioutil.WriteFile(apiKeysFile, []byte(fmt.Sprintf(`[{"id": "dashboard", "key_hash": "%s", "roles": ["reader"]}]`,
+		HashAPIKey("secret-key"))), 0600)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(jwksFile, []byte(fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "key1", "n": "%s", "e": "%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))), 0600)
+
+	authenticator, err := NewAuthenticator(apiKeysFile, jwksFile, "https://issuer.example.com", "user-balance")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	return authenticator, key
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	authenticator, _ := newTestAuthenticator(t)
+	cases := []struct {
+		Name           string
+		Key            string
+		ExpectedID     string
+		ExpectedErrMsg string
+	}{
+		{"valid key", "secret-key", "dashboard", ""},
+		{"invalid key", "wrong-key", "", "unauthenticated"},
+		{"empty key", "", "", "unauthenticated"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			principal, err := authenticator.AuthenticateAPIKey(c.Key)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+				return
+			}
+			if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if principal.ID != c.ExpectedID || principal.Kind != domain.PrincipalKind_APIKey {
+				t.Errorf("expect principal [%s] but got [%+v]", c.ExpectedID, principal)
+			}
+		})
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	authenticator, key := newTestAuthenticator(t)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	sign := func(claims jwt.MapClaims, signingKey *rsa.PrivateKey, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		s, _ := token.SignedString(signingKey)
+		return s
+	}
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "operator1",
+			"iss":   "https://issuer.example.com",
+			"aud":   "user-balance",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{"operator"},
+		}
+	}
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://other.example.com"
+	noSubject := validClaims()
+	delete(noSubject, "sub")
+	noExpiration := validClaims()
+	delete(noExpiration, "exp")
+
+	cases := []struct {
+		Name           string
+		Token          string
+		ExpectedID     string
+		ExpectedErrMsg string
+	}{
+		{"valid token", sign(validClaims(), key, "key1"), "operator1", ""},
+		{"expired token", sign(expired, key, "key1"), "", "unauthenticated"},
+		{"no expiration", sign(noExpiration, key, "key1"), "", "unauthenticated"},
+		{"wrong issuer", sign(wrongIssuer, key, "key1"), "", "unauthenticated"},
+		{"no subject", sign(noSubject, key, "key1"), "", "unauthenticated"},
+		{"unknown key id", sign(validClaims(), key, "key2"), "", "unauthenticated"},
+		{"invalid signature", sign(validClaims(), otherKey, "key1"), "", "unauthenticated"},
+		{"malformed token", "not-a-token", "", "unauthenticated"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			principal, err := authenticator.AuthenticateToken(c.Token)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+				return
+			}
+			if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if principal.ID != c.ExpectedID || principal.Kind != domain.PrincipalKind_JWT {
+				t.Errorf("expect principal [%s] but got [%+v]", c.ExpectedID, principal)
+			}
+			if len(principal.Roles) != 1 || principal.Roles[0] != "operator" {
+				t.Errorf("expect roles [operator] but got [%v]", principal.Roles)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package infrastructure
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// balanceCacheEntry キャッシュしたユーザー残高情報と有効期限
+type balanceCacheEntry struct {
+	userBalance domain.UserBalanceModel
+	expiresAt   time.Time
+}
+
+// memoryBalanceCache 件数の上限と有効期限を持つインメモリのLRUキャッシュ
+// 上限を超えた場合は最も長く参照されていないユーザーから削除する
+type memoryBalanceCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // 先頭が直近に参照したエントリ
+	now     func() time.Time
+}
+
+// NewMemoryBalanceCache 最大size件のユーザー残高情報をttlの間保持するインメモリのキャッシュを作成
+func NewMemoryBalanceCache(size int, ttl time.Duration) domain.BalanceCache {
+	return &memoryBalanceCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get ユーザーIDでキャッシュしたユーザー残高情報を取得し、直近に参照したエントリとする
+func (c *memoryBalanceCache) Get(ctx context.Context, userID string) (domain.UserBalanceModel, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[userID]
+	if !ok {
+		return domain.UserBalanceModel{}, false
+	}
+	entry := element.Value.(*balanceCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(element)
+		return domain.UserBalanceModel{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.userBalance, true
+}
+
+// Set ユーザー残高情報をキャッシュし、上限を超えた場合は最も長く参照されていないエントリを削除
+func (c *memoryBalanceCache) Set(ctx context.Context, userBalance domain.UserBalanceModel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &balanceCacheEntry{userBalance: userBalance, expiresAt: c.now().Add(c.ttl)}
+	if element, ok := c.entries[userBalance.UserID]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[userBalance.UserID] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete 指定したユーザーのキャッシュを削除
+func (c *memoryBalanceCache) Delete(ctx context.Context, userIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, userID := range userIDs {
+		if element, ok := c.entries[userID]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// Purge 全てのキャッシュを削除
+func (c *memoryBalanceCache) Purge(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// remove エントリを削除(ロックを取得してから呼び出す)
+func (c *memoryBalanceCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*balanceCacheEntry).userBalance.UserID)
+}
@@ -0,0 +1,64 @@
+package infrastructure
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+func TestMemoryBalanceCache(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Name     string
+		Run      func(c domain.BalanceCache, advance func(time.Duration))
+		Expected string // キャッシュに残っているユーザーID(user1〜user3の順)
+	}{
+		{"set and get", func(c domain.BalanceCache, advance func(time.Duration)) {}, "user1,user2"},
+		{"evict least recently used", func(c domain.BalanceCache, advance func(time.Duration)) {
+			c.Get(context.Background(), "user1")
+			c.Set(context.Background(), domain.UserBalanceModel{UserID: "user3"})
+		}, "user1,user3"},
+		{"update keeps size", func(c domain.BalanceCache, advance func(time.Duration)) {
+			c.Set(context.Background(), domain.UserBalanceModel{UserID: "user1", Balance: 1})
+		}, "user1,user2"},
+		{"expire after ttl", func(c domain.BalanceCache, advance func(time.Duration)) {
+			advance(time.Second)
+			c.Set(context.Background(), domain.UserBalanceModel{UserID: "user3"})
+		}, "user3"},
+		{"delete", func(c domain.BalanceCache, advance func(time.Duration)) {
+			c.Delete(context.Background(), "user2", "unknown")
+		}, "user1"},
+		{"purge", func(c domain.BalanceCache, advance func(time.Duration)) {
+			c.Purge(context.Background())
+			c.Set(context.Background(), domain.UserBalanceModel{UserID: "user2"})
+		}, "user2"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			current := now
+			cache := NewMemoryBalanceCache(2, time.Second)
+			cache.(*memoryBalanceCache).now = func() time.Time { return current }
+			cache.Set(context.Background(), domain.UserBalanceModel{UserID: "user1"})
+			cache.Set(context.Background(), domain.UserBalanceModel{UserID: "user2"})
+
+			c.Run(cache, func(d time.Duration) { current = current.Add(d) })
+
+			var cached []string
+			for _, userID := range []string{"user1", "user2", "user3"} {
+				if userBalance, ok := cache.Get(context.Background(), userID); ok {
+					if userBalance.UserID != userID {
+						t.Errorf("expect user [%s] but got [%s]", userID, userBalance.UserID)
+					}
+					cached = append(cached, userID)
+				}
+			}
+			if strings.Join(cached, ",") != c.Expected {
+				t.Errorf("expect cached users [%s] but got [%s]", c.Expected, strings.Join(cached, ","))
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// balanceCacheName メトリクスに記録するユーザー残高のキャッシュの名前
+const balanceCacheName = "balance"
+
+// cachedUserBalanceRepository ユーザーIDでのユーザー残高情報の取得をキャッシュするデコレータ
+// トランザクション中に変更したユーザーのキャッシュはそのトランザクションのコミット後に削除し、一斉加算の場合は全て削除する
+// キャッシュに関係しないメソッドはそのまま委譲する
+type cachedUserBalanceRepository struct {
+	domain.UserBalanceRepository
+	cache       domain.BalanceCache
+	metrics     domain.MetricsRecorder
+	loads       singleflight.Group
+	loadTimeout time.Duration // キャッシュにない場合の取得のタイムアウト
+
+	mu      sync.Mutex
+	loading map[string]bool // 取得中のユーザーと、取得中にそのユーザーのキャッシュが削除されたか
+}
+
+// cacheChanges 1つのトランザクション中に変更したユーザー
+type cacheChanges struct {
+	users map[string]struct{} // 変更したユーザー
+	all   bool                // 一斉加算した
+}
+
+// cacheChangesKey コンテキストにトランザクション中の変更を格納するキー
+type cacheChangesKey struct{}
+
+// cacheChangesFromContext BeginTxで格納したトランザクション中の変更をコンテキストから取得
+func cacheChangesFromContext(ctx context.Context) (*cacheChanges, bool) {
+	changes, ok := ctx.Value(cacheChangesKey{}).(*cacheChanges)
+	return changes, ok
+}
+
+// NewCachedUserBalanceRepository repositoryをユーザー残高のキャッシュ用のデコレータで包む
+// metricsがnilの場合はヒット率を記録しない
+// loadTimeoutはキャッシュにない場合の取得のタイムアウトで、取得は呼び出し元のコンテキストがキャンセルされても続ける
+func NewCachedUserBalanceRepository(next domain.UserBalanceRepository, cache domain.BalanceCache, metrics domain.MetricsRecorder, loadTimeout time.Duration) domain.UserBalanceRepository {
+	return &cachedUserBalanceRepository{
+		UserBalanceRepository: next,
+		cache:                 cache,
+		metrics:               metrics,
+		loadTimeout:           loadTimeout,
+		loading:               make(map[string]bool),
+	}
+}
+
+// QueryUserBalanceByUserID ユーザーIDでユーザー残高情報をキャッシュから取得し、ない場合はrepositoryから取得してキャッシュ
+// 残高を変更する操作の中(domain.ContextWithPrimaryRead)はキャッシュを使用しない
+// 同じユーザーの取得が同時に行われた場合は1回のクエリの結果を共有する
+// 取得は呼び出し元から切り離したコンテキストで行うため、最初の呼び出し元がキャンセルしても他の呼び出し元は結果を受け取れる
+func (repo *cachedUserBalanceRepository) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	if domain.PrimaryReadFromContext(ctx) {
+		return repo.UserBalanceRepository.QueryUserBalanceByUserID(ctx, userID)
+	}
+
+	userBalance, ok := repo.cache.Get(ctx, userID)
+	if repo.metrics != nil {
+		repo.metrics.ObserveCacheLookup(balanceCacheName, ok)
+	}
+	if ok {
+		return userBalance, nil
+	}
+
+	results := repo.loads.DoChan(userID, func() (interface{}, error) {
+		ctx, cancel := repo.detach(ctx)
+		defer cancel()
+		return repo.load(ctx, userID)
+	})
+	select {
+	case result := <-results:
+		return result.Val.(domain.UserBalanceModel), result.Err
+	case <-ctx.Done():
+		return domain.UserBalanceModel{}, ctx.Err()
+	}
+}
+
+// detach 呼び出し元のロガーとトレースを引き継ぎ、キャンセルを引き継がないloadTimeoutのコンテキストを作成
+// コミット直後に遅延したリードレプリカから変更前の値を読み取ってキャッシュしないよう、プライマリで読み取る
+func (repo *cachedUserBalanceRepository) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := domain.ContextWithPrimaryRead(domain.ContextWithLogger(context.Background(), domain.LoggerFromContext(ctx)))
+	detached = trace.ContextWithSpanContext(detached, trace.SpanContextFromContext(ctx))
+	return context.WithTimeout(detached, repo.loadTimeout)
+}
+
+// load repositoryからユーザー残高情報を取得してキャッシュ
+func (repo *cachedUserBalanceRepository) load(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	// 同じユーザーの取得はsingleflightで1つずつ行うため、ユーザーIDで取得中の状態を管理できる
+	repo.mu.Lock()
+	repo.loading[userID] = false
+	repo.mu.Unlock()
+
+	userBalance, err := repo.UserBalanceRepository.QueryUserBalanceByUserID(ctx, userID)
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	invalidated := repo.loading[userID]
+	delete(repo.loading, userID)
+	if err != nil {
+		return userBalance, err
+	}
+	// 取得中にこのユーザーのキャッシュが削除された場合は変更前の値の可能性があるためキャッシュしない
+	if !invalidated {
+		repo.cache.Set(ctx, userBalance)
+	}
+	return userBalance, nil
+}
+
+// BeginTx トランザクションを開始し、トランザクション中に変更したユーザーの記録をコンテキストに格納
+func (repo *cachedUserBalanceRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	ctx, err := repo.UserBalanceRepository.BeginTx(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, cacheChangesKey{}, &cacheChanges{users: make(map[string]struct{})}), nil
+}
+
+// markChanged トランザクション中に変更したユーザーを記録
+func (repo *cachedUserBalanceRepository) markChanged(ctx context.Context, userID string) {
+	if changes, ok := cacheChangesFromContext(ctx); ok {
+		changes.users[userID] = struct{}{}
+	}
+}
+
+// Commit トランザクションをコミットし、そのトランザクション中に変更したユーザーのキャッシュを削除
+// コミットに失敗した場合も変更が反映されたかが不明なため削除する
+func (repo *cachedUserBalanceRepository) Commit(ctx context.Context) error {
+	err := repo.UserBalanceRepository.Commit(ctx)
+
+	changes, ok := cacheChangesFromContext(ctx)
+	if !ok || (!changes.all && len(changes.users) == 0) {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	ctx = context.Background()
+	if changes.all {
+		for userID := range repo.loading {
+			repo.loading[userID] = true
+		}
+		repo.cache.Purge(ctx)
+		return err
+	}
+	userIDs := make([]string, 0, len(changes.users))
+	for userID := range changes.users {
+		if _, ok := repo.loading[userID]; ok {
+			repo.loading[userID] = true
+		}
+		userIDs = append(userIDs, userID)
+	}
+	repo.cache.Delete(ctx, userIDs...)
+	return err
+}
+
+// AddUserBalanceByUserID ユーザー残高を加算し、コミット後にキャッシュを削除するユーザーとして記録
+func (repo *cachedUserBalanceRepository) AddUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	repo.markChanged(ctx, userID)
+	return repo.UserBalanceRepository.AddUserBalanceByUserID(ctx, userID, amount)
+}
+
+// ReduceUserBalanceByUserID ユーザー残高を減算し、コミット後にキャッシュを削除するユーザーとして記録
+func (repo *cachedUserBalanceRepository) ReduceUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	repo.markChanged(ctx, userID)
+	return repo.UserBalanceRepository.ReduceUserBalanceByUserID(ctx, userID, amount)
+}
+
+// AddAllUserBalance ユーザー残高を一斉に加算し、コミット後に全てのキャッシュを削除するよう記録
+func (repo *cachedUserBalanceRepository) AddAllUserBalance(ctx context.Context, amount int) error {
+	if changes, ok := cacheChangesFromContext(ctx); ok {
+		changes.all = true
+	}
+	return repo.UserBalanceRepository.AddAllUserBalance(ctx, amount)
+}
+
+// UpdateUserStatusByUserID ユーザーの状態を更新し、コミット後にキャッシュを削除するユーザーとして記録
+func (repo *cachedUserBalanceRepository) UpdateUserStatusByUserID(ctx context.Context, userID string, status domain.UserStatus) error {
+	repo.markChanged(ctx, userID)
+	return repo.UserBalanceRepository.UpdateUserStatusByUserID(ctx, userID, status)
+}
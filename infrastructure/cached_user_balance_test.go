@@ -0,0 +1,327 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// countingRepository QueryUserBalanceByUserIDの呼び出し回数を数えるrepository
+// releaseを指定した場合、閉じられるまで取得を待つ
+type countingRepository struct {
+	domain.UserBalanceRepository
+	loads        int32
+	primaryReads int32 // プライマリで読み取るよう指定された取得の回数
+	release      chan struct{}
+}
+
+func (r *countingRepository) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	atomic.AddInt32(&r.loads, 1)
+	if domain.PrimaryReadFromContext(ctx) {
+		atomic.AddInt32(&r.primaryReads, 1)
+	}
+	if r.release != nil {
+		<-r.release
+	}
+	// DBと同じく、取得中にコンテキストが終了した場合はエラー
+	if err := ctx.Err(); err != nil {
+		return domain.UserBalanceModel{}, err
+	}
+	return r.UserBalanceRepository.QueryUserBalanceByUserID(ctx, userID)
+}
+
+// concurrentTxRepository トランザクションを並行して開始できるrepository(変更は記録しない)
+type concurrentTxRepository struct {
+	*countingRepository
+}
+
+func (r concurrentTxRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	return ctx, nil
+}
+
+func (r concurrentTxRepository) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (r concurrentTxRepository) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (r concurrentTxRepository) AddUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	return nil
+}
+
+// cacheLookupRecorder キャッシュのヒットとミスの回数を記録するMetricsRecorder
+type cacheLookupRecorder struct {
+	mockMetricsRecorder
+	hits   int32
+	misses int32
+}
+
+func (m *cacheLookupRecorder) ObserveCacheLookup(cache string, hit bool) {
+	if hit {
+		atomic.AddInt32(&m.hits, 1)
+	} else {
+		atomic.AddInt32(&m.misses, 1)
+	}
+}
+
+// mockMetricsRecorder キャッシュ以外の計測値を記録しないMetricsRecorder
+type mockMetricsRecorder struct{}
+
+func (mockMetricsRecorder) ObserveOperation(string, string, time.Duration)        {}
+func (mockMetricsRecorder) ObserveHTTPRequest(string, string, int, time.Duration) {}
+func (mockMetricsRecorder) ObserveGRPCRequest(string, string, time.Duration)      {}
+
+func TestCachedUserBalanceRepository(t *testing.T) {
+	// change トランザクションで残高を変更し、commitがfalseの場合はロールバック
+	change := func(repo domain.UserBalanceRepository, commit bool, fn func(ctx context.Context) error) error {
+		ctx, err := repo.BeginTx(context.Background())
+		if err != nil {
+			return err
+		}
+		if err := fn(ctx); err != nil {
+			repo.Rollback(ctx)
+			return err
+		}
+		if !commit {
+			return repo.Rollback(ctx)
+		}
+		return repo.Commit(ctx)
+	}
+
+	cases := []struct {
+		Name            string
+		Change          func(repo domain.UserBalanceRepository) error
+		PrimaryRead     bool
+		ExpectedBalance int
+		ExpectedStatus  domain.UserStatus
+		ExpectedLoads   int32
+		ExpectedHits    int32
+	}{
+		{"cached", nil, false, 10000, domain.UserStatus_Active, 1, 1},
+		{"invalidated after commit", func(repo domain.UserBalanceRepository) error {
+			return change(repo, true, func(ctx context.Context) error { return repo.AddUserBalanceByUserID(ctx, "test_user1", 500) })
+		}, false, 10500, domain.UserStatus_Active, 2, 0},
+		{"kept after rollback", func(repo domain.UserBalanceRepository) error {
+			return change(repo, false, func(ctx context.Context) error { return repo.ReduceUserBalanceByUserID(ctx, "test_user1", 500) })
+		}, false, 10000, domain.UserStatus_Active, 1, 1},
+		{"other user changed", func(repo domain.UserBalanceRepository) error {
+			return change(repo, true, func(ctx context.Context) error { return repo.AddUserBalanceByUserID(ctx, "test_user2", 500) })
+		}, false, 10000, domain.UserStatus_Active, 1, 1},
+		{"purged after add all", func(repo domain.UserBalanceRepository) error {
+			return change(repo, true, func(ctx context.Context) error { return repo.AddAllUserBalance(ctx, 100) })
+		}, false, 10100, domain.UserStatus_Active, 2, 0},
+		{"invalidated after status change", func(repo domain.UserBalanceRepository) error {
+			return change(repo, true, func(ctx context.Context) error {
+				return repo.UpdateUserStatusByUserID(ctx, "test_user1", domain.UserStatus_Frozen)
+			})
+		}, false, 10000, domain.UserStatus_Frozen, 2, 0},
+		{"primary read", nil, true, 10000, domain.UserStatus_Active, 2, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			next := &countingRepository{UserBalanceRepository: newMemoryConformanceRepository(t)}
+			metrics := &cacheLookupRecorder{}
+			repo := NewCachedUserBalanceRepository(next, NewMemoryBalanceCache(100, time.Minute), metrics, time.Second)
+			ctx := context.Background()
+			if c.PrimaryRead {
+				ctx = domain.ContextWithPrimaryRead(ctx)
+			}
+
+			if _, err := repo.QueryUserBalanceByUserID(ctx, "test_user1"); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if c.Change != nil {
+				if err := c.Change(repo); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			userBalance, err := repo.QueryUserBalanceByUserID(ctx, "test_user1")
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if userBalance.Balance != c.ExpectedBalance || userBalance.Status != c.ExpectedStatus {
+				t.Errorf("expect [%d %s] but got [%d %s]", c.ExpectedBalance, c.ExpectedStatus, userBalance.Balance, userBalance.Status)
+			}
+			if next.loads != c.ExpectedLoads {
+				t.Errorf("expect [%d] loads but got [%d]", c.ExpectedLoads, next.loads)
+			}
+			if metrics.hits != c.ExpectedHits {
+				t.Errorf("expect [%d] hits but got [%d]", c.ExpectedHits, metrics.hits)
+			}
+		})
+	}
+}
+
+func TestCachedUserBalanceRepositoryConcurrentMisses(t *testing.T) {
+	next := &countingRepository{UserBalanceRepository: newMemoryConformanceRepository(t), release: make(chan struct{})}
+	metrics := &cacheLookupRecorder{}
+	repo := NewCachedUserBalanceRepository(next, NewMemoryBalanceCache(100, time.Minute), metrics, time.Second)
+
+	const readers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+			if err != nil || userBalance.Balance != 10000 {
+				t.Errorf("expect balance [10000] but got [%d %v]", userBalance.Balance, err)
+			}
+		}()
+	}
+	// 全ての読み取りがキャッシュにないことを確認してから取得を完了させる
+	for atomic.LoadInt32(&metrics.misses) < readers {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(next.release)
+	wg.Wait()
+
+	if next.loads != 1 {
+		t.Errorf("expect [1] load but got [%d]", next.loads)
+	}
+	if _, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1"); err != nil || metrics.hits != 1 {
+		t.Errorf("expect cached balance but got [%d hits %v]", metrics.hits, err)
+	}
+}
+
+func TestCachedUserBalanceRepositoryConcurrentTransactions(t *testing.T) {
+	next := &countingRepository{UserBalanceRepository: newMemoryConformanceRepository(t)}
+	repo := NewCachedUserBalanceRepository(concurrentTxRepository{next}, NewMemoryBalanceCache(100, time.Minute), nil, time.Second)
+	ctx := context.Background()
+	for _, userID := range []string{"test_user1", "test_user2"} {
+		if _, err := repo.QueryUserBalanceByUserID(ctx, userID); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+	}
+
+	// トランザクションAがtest_user1、Bがtest_user2を変更し、Aのロールバック後にBをコミットする
+	txA, _ := repo.BeginTx(ctx)
+	txB, _ := repo.BeginTx(ctx)
+	repo.AddUserBalanceByUserID(txA, "test_user1", 500)
+	repo.AddUserBalanceByUserID(txB, "test_user2", 500)
+	if err := repo.Rollback(txA); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if err := repo.Commit(txB); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	// Bのコミットで削除されるのはBが変更したtest_user2のみ
+	cases := []struct {
+		Name          string
+		UserID        string
+		ExpectedLoads int32
+	}{
+		{"rolled back user is still cached", "test_user1", 2},
+		{"committed user is invalidated", "test_user2", 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if _, err := repo.QueryUserBalanceByUserID(ctx, c.UserID); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if loads := atomic.LoadInt32(&next.loads); loads != c.ExpectedLoads {
+				t.Errorf("expect [%d] loads but got [%d]", c.ExpectedLoads, loads)
+			}
+		})
+	}
+}
+
+func TestCachedUserBalanceRepositoryLoadOutlivesCaller(t *testing.T) {
+	next := &countingRepository{UserBalanceRepository: newMemoryConformanceRepository(t), release: make(chan struct{})}
+	metrics := &cacheLookupRecorder{}
+	repo := NewCachedUserBalanceRepository(next, NewMemoryBalanceCache(100, time.Minute), metrics, time.Second)
+
+	// 最初の呼び出し元は取得中にキャンセルする
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := repo.QueryUserBalanceByUserID(first, "test_user1")
+		firstErr <- err
+	}()
+	for atomic.LoadInt32(&next.loads) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan domain.UserBalanceModel)
+	go func() {
+		userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+		if err != nil {
+			t.Errorf("expect no error but got [%s]", err)
+		}
+		second <- userBalance
+	}()
+	for atomic.LoadInt32(&metrics.misses) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("expect error [%s] but got [%v]", context.Canceled, err)
+	}
+	close(next.release)
+	if userBalance := <-second; userBalance.Balance != 10000 {
+		t.Errorf("expect balance [10000] but got [%d]", userBalance.Balance)
+	}
+	if loads := atomic.LoadInt32(&next.loads); loads != 1 {
+		t.Errorf("expect [1] load but got [%d]", loads)
+	}
+}
+
+func TestCachedUserBalanceRepositoryInvalidationDuringLoad(t *testing.T) {
+	cases := []struct {
+		Name          string
+		ChangedUserID string
+		ExpectedLoads int32
+	}{
+		{"other user changed", "test_user2", 1},
+		{"loading user changed", "test_user1", 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			next := &countingRepository{UserBalanceRepository: newMemoryConformanceRepository(t), release: make(chan struct{})}
+			repo := NewCachedUserBalanceRepository(concurrentTxRepository{next}, NewMemoryBalanceCache(100, time.Minute), nil, time.Second)
+			ctx := context.Background()
+
+			// test_user1の取得中に他のトランザクションがコミットする
+			loaded := make(chan error)
+			go func() {
+				_, err := repo.QueryUserBalanceByUserID(ctx, "test_user1")
+				loaded <- err
+			}()
+			for atomic.LoadInt32(&next.loads) < 1 {
+				time.Sleep(time.Millisecond)
+			}
+			tx, _ := repo.BeginTx(ctx)
+			repo.AddUserBalanceByUserID(tx, c.ChangedUserID, 500)
+			if err := repo.Commit(tx); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			close(next.release)
+			if err := <-loaded; err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+
+			// 他のユーザーの変更では取得した値をキャッシュし、取得中のユーザーの変更ではキャッシュしない
+			if _, err := repo.QueryUserBalanceByUserID(ctx, "test_user1"); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if loads := atomic.LoadInt32(&next.loads); loads != c.ExpectedLoads {
+				t.Errorf("expect [%d] loads but got [%d]", c.ExpectedLoads, loads)
+			}
+			if primaryReads := atomic.LoadInt32(&next.primaryReads); primaryReads != c.ExpectedLoads {
+				t.Errorf("expect all [%d] loads to read the primary but got [%d]", c.ExpectedLoads, primaryReads)
+			}
+		})
+	}
+}
@@ -9,32 +9,75 @@ import (
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
+// DB プライマリの接続プールとリードレプリカ
 type DB struct {
 	*sql.DB
+	replicas *replicaSet
 }
 
 type TX struct {
 	*sql.Tx
 }
 
-const maxOpenDBConn = 10
-const maxIdleDBConn = 5
-const maxDBConnLifetime = 5 * time.Minute
+// DBPoolConfig 接続プールの設定
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
 
 // NewDatabase 新しいPostgresDBの接続プールを作成
-func NewDatabase(dsn string) *DB {
+// リードレプリカのDSNを指定した場合、レプリカ毎にpoolと同じ設定の接続プールを作成し、複製の遅延の確認を開始する
+// レプリカに接続できなくても起動は継続し、使用できるまでは読み取りもプライマリで行う
+func NewDatabase(dsn string, pool DBPoolConfig, replica ReplicaConfig) *DB {
+	conn := openDatabase(dsn, pool)
+	if err := conn.Ping(); err != nil {
+		panic(err)
+	}
+
+	if len(replica.DSNs) == 0 {
+		return &DB{DB: conn}
+	}
+	replicas := make([]*sql.DB, 0, len(replica.DSNs))
+	for _, replicaDSN := range replica.DSNs {
+		replicas = append(replicas, openDatabase(replicaDSN, pool))
+	}
+	return &DB{DB: conn, replicas: newReplicaSet(conn, replicas, replica, primaryWALPositionQuery, replicaStatusQuery)}
+}
+
+// openDatabase 接続プールを作成(接続は最初のクエリまで行わない)
+func openDatabase(dsn string, pool DBPoolConfig) *sql.DB {
 	conn, err := sql.Open("pgx", dsn)
 	if err != nil {
 		panic(err)
 	}
 
-	if err = conn.Ping(); err != nil {
-		panic(err)
+	conn.SetMaxOpenConns(pool.MaxOpenConns)
+	conn.SetMaxIdleConns(pool.MaxIdleConns)
+	conn.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	return conn
+}
+
+// Reader 読み取り専用のクエリに使用する接続プール
+// 使用できるリードレプリカがない場合はプライマリを返す
+func (db DB) Reader() *sql.DB {
+	if replica := db.replicas.pick(); replica != nil {
+		return replica
 	}
+	return db.DB
+}
 
-	conn.SetMaxOpenConns(maxOpenDBConn)
-	conn.SetMaxIdleConns(maxIdleDBConn)
-	conn.SetConnMaxLifetime(maxDBConnLifetime)
+// Replicas リードレプリカの接続プール(メトリクス用)
+func (db DB) Replicas() []*sql.DB {
+	return db.replicas.dbs()
+}
 
-	return &DB{conn}
+// Close 遅延の確認を停止し、リードレプリカとプライマリの接続プールを閉じる
+func (db DB) Close() error {
+	if err := db.replicas.close(); err != nil {
+		db.DB.Close()
+		return err
+	}
+	return db.DB.Close()
 }
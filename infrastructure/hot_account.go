@@ -0,0 +1,342 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// MaxBalanceSlots ホットアカウントの残高を分割するスロット数の上限
+const MaxBalanceSlots = 256
+
+// balanceTotalExpr user_balanceの行のホットアカウントのスロットを含めた残高の合計
+// ホットアカウントでない行(balance_slotsが0)はスロットを持たないため、スロットを集計しない
+const balanceTotalExpr = `(CASE WHEN user_balance.balance_slots = 0 THEN user_balance.balance
+		ELSE user_balance.balance + COALESCE((SELECT SUM(s.balance) FROM user_balance_slot s WHERE s.user_id = user_balance.user_id), 0) END)`
+
+// balanceSlots トランザクション内でユーザー残高の分割数を取得(ホットアカウントでない場合とユーザーが存在しない場合は0)
+func (repo *userBalanceRepository) balanceSlots(ctx context.Context, tx TX, userID string) (int, error) {
+	var slots int
+	err := tx.QueryRowContext(ctx, `SELECT balance_slots FROM user_balance WHERE user_id = $1`, userID).Scan(&slots)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return slots, err
+}
+
+// addToBalanceSlot ホットアカウントの場合は無作為に選んだスロットに加算し、加算したかを返す
+// user_balanceの行はロックしないため、同じユーザーへの加算が同時に行われても異なるスロットであれば待たない
+// 加算できない状態の場合と分割数の変更でスロットがなくなった場合は加算せず、user_balanceの行の更新で判定する
+func (repo *userBalanceRepository) addToBalanceSlot(ctx context.Context, tx TX, userID string, amount int) (bool, error) {
+	slots, err := repo.balanceSlots(ctx, tx, userID)
+	if err != nil || slots == 0 {
+		return false, err
+	}
+
+	query := `UPDATE user_balance_slot SET balance = balance + $1, updated_at = $2
+		WHERE user_id = $3 AND slot = $4
+			AND EXISTS (SELECT 1 FROM user_balance WHERE user_id = $3 AND status IN ('active', 'debit_frozen'))`
+	res, err := tx.ExecContext(ctx, query, amount, time.Now(), userID, rand.Intn(slots))
+	if err != nil {
+		return false, err
+	}
+	numRow, err := res.RowsAffected()
+	return numRow > 0, err
+}
+
+// reduceFromBalanceSlots ホットアカウントの場合はスロットから減算し、減算したかを返す
+// 無作為に選んだスロットから順に残高が足りるスロットを探し、ない場合は複数のスロットから減算する
+func (repo *userBalanceRepository) reduceFromBalanceSlots(ctx context.Context, tx TX, userID string, amount int) (bool, error) {
+	slots, err := repo.balanceSlots(ctx, tx, userID)
+	if err != nil || slots == 0 {
+		return false, err
+	}
+
+	query := `UPDATE user_balance_slot SET balance = balance - $1, updated_at = $2
+		WHERE user_id = $3 AND slot = $4 AND balance - $1 >= 0
+			AND EXISTS (SELECT 1 FROM user_balance WHERE user_id = $3 AND status = 'active')`
+	start := rand.Intn(slots)
+	for i := 0; i < slots; i++ {
+		res, err := tx.ExecContext(ctx, query, amount, time.Now(), userID, (start+i)%slots)
+		if err != nil {
+			return false, err
+		}
+		numRow, err := res.RowsAffected()
+		if err != nil || numRow > 0 {
+			return numRow > 0, err
+		}
+	}
+	return repo.reduceAcrossBalanceSlots(ctx, tx, userID, amount)
+}
+
+// reduceAcrossBalanceSlots user_balanceの行と全てのスロットをロックし、合計が足りる場合はuser_balanceの行、スロットの順に減算
+func (repo *userBalanceRepository) reduceAcrossBalanceSlots(ctx context.Context, tx TX, userID string, amount int) (bool, error) {
+	balance, status, err := lockBalanceSlots(ctx, tx.Tx, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	slotBalances, err := queryBalanceSlots(ctx, tx.Tx, userID)
+	if err != nil {
+		return false, err
+	}
+	total := balance
+	for _, slotBalance := range slotBalances {
+		total += slotBalance
+	}
+	if status != domain.UserStatus_Active || total < amount {
+		return false, nil
+	}
+
+	now := time.Now()
+	remaining := amount
+	if n := minInt(balance, remaining); n > 0 {
+		query := `UPDATE user_balance SET balance = balance - $1, updated_at = $2 WHERE user_id = $3`
+		if _, err := tx.ExecContext(ctx, query, n, now, userID); err != nil {
+			return false, err
+		}
+		remaining -= n
+	}
+	for slot := 0; slot < len(slotBalances) && remaining > 0; slot++ {
+		n := minInt(slotBalances[slot], remaining)
+		if n <= 0 {
+			continue
+		}
+		query := `UPDATE user_balance_slot SET balance = balance - $1, updated_at = $2 WHERE user_id = $3 AND slot = $4`
+		if _, err := tx.ExecContext(ctx, query, n, now, userID, slot); err != nil {
+			return false, err
+		}
+		remaining -= n
+	}
+	return true, nil
+}
+
+// minInt 小さい方の値
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// lockBalanceSlots user_balanceの行、全てのスロットの順にロックし、user_balanceの行の残高と状態を返す
+// SQLiteではSELECT ... FOR UPDATEを使用できないため、同じ値で更新してロックする
+func lockBalanceSlots(ctx context.Context, tx *sql.Tx, userID string) (int, domain.UserStatus, error) {
+	if _, err := tx.ExecContext(ctx, `UPDATE user_balance SET balance = balance WHERE user_id = $1`, userID); err != nil {
+		return 0, "", err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_balance_slot SET balance = balance WHERE user_id = $1`, userID); err != nil {
+		return 0, "", err
+	}
+	var balance int
+	var status domain.UserStatus
+	err := tx.QueryRowContext(ctx, `SELECT balance, status FROM user_balance WHERE user_id = $1`, userID).Scan(&balance, &status)
+	return balance, status, err
+}
+
+// queryBalanceSlots ユーザーのスロットの残高をスロットの番号順に取得
+func queryBalanceSlots(ctx context.Context, tx *sql.Tx, userID string) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT balance FROM user_balance_slot WHERE user_id = $1 ORDER BY slot`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []int{}
+	for rows.Next() {
+		var balance int
+		if err := rows.Scan(&balance); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
+}
+
+// HotAccount ホットアカウントの分割数と残高の内訳
+type HotAccount struct {
+	UserID      string
+	Slots       int
+	Balance     int // user_balanceの行の残高
+	SlotBalance int // スロットの残高の合計(圧縮でuser_balanceの行に戻す)
+}
+
+// HotAccountManager ホットアカウント(残高を複数のスロットに分割したユーザー)を管理する
+// 加算が集中するユーザーの残高を分割し、1つの行のロックで加算が直列化されるのを避ける
+type HotAccountManager struct {
+	db DB
+}
+
+// NewHotAccountManager DB接続からホットアカウントの管理を作成
+func NewHotAccountManager(db DB) *HotAccountManager {
+	return &HotAccountManager{db: db}
+}
+
+// Enable ユーザーの残高をslots個のスロットに分割する
+// 既に分割している場合はスロットの残高をuser_balanceの行に戻してから分割し直す
+func (m *HotAccountManager) Enable(ctx context.Context, userID string, slots int) error {
+	if slots < 1 || slots > MaxBalanceSlots {
+		return errors.New("invalid number of balance slots")
+	}
+	return m.setBalanceSlots(ctx, userID, slots)
+}
+
+// Disable スロットの残高をuser_balanceの行に戻し、残高の分割をやめる
+func (m *HotAccountManager) Disable(ctx context.Context, userID string) error {
+	return m.setBalanceSlots(ctx, userID, 0)
+}
+
+// setBalanceSlots スロットの残高をuser_balanceの行に戻し、slots個のスロットを作り直す
+func (m *HotAccountManager) setBalanceSlots(ctx context.Context, userID string, slots int) error {
+	tx, err := m.db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := foldBalanceSlots(ctx, tx, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_balance_slot WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	for slot := 0; slot < slots; slot++ {
+		query := `INSERT INTO user_balance_slot (user_id, slot, balance, updated_at) VALUES ($1, $2, 0, $3)`
+		if _, err := tx.ExecContext(ctx, query, userID, slot, now); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_balance SET balance_slots = $1 WHERE user_id = $2`, slots, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Compact 全てのホットアカウントのスロットの残高をuser_balanceの行に戻し、戻したユーザー数を返す
+// 減算は残高が足りる1つの行から行うため、加算でスロットに分散した残高を定期的にまとめて複数のスロットからの減算を減らす
+// ユーザー毎に別のトランザクションで実行し、スロットへの加算を待たせる時間を短くする
+func (m *HotAccountManager) Compact(ctx context.Context) (int, error) {
+	accounts, err := m.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, account := range accounts {
+		tx, err := m.db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return compacted, err
+		}
+		moved, err := foldBalanceSlots(ctx, tx, account.UserID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return compacted, err
+		}
+		if moved != 0 {
+			compacted++
+		}
+	}
+	return compacted, nil
+}
+
+// HotAccountCompactor ホットアカウントのスロットの残高を一定間隔でuser_balanceの行に戻すバックグラウンドジョブ
+type HotAccountCompactor struct {
+	manager  *HotAccountManager
+	interval time.Duration
+	logger   domain.Logger
+}
+
+// NewHotAccountCompactor スロットの残高を圧縮するジョブを作成
+func NewHotAccountCompactor(manager *HotAccountManager, interval time.Duration, logger domain.Logger) *HotAccountCompactor {
+	return &HotAccountCompactor{manager: manager, interval: interval, logger: logger}
+}
+
+// Run ctxがキャンセルされるまで、開始直後と一定間隔毎にスロットの残高を圧縮
+func (c *HotAccountCompactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.compact(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// compact スロットの残高を1回圧縮(タイムアウトは圧縮の間隔)
+// ユーザー毎にコミットされるため、タイムアウトした場合も圧縮済みのユーザーはそのまま残る
+func (c *HotAccountCompactor) compact(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+	start := time.Now()
+	compacted, err := c.manager.Compact(ctx)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		c.logger.Warn("failed to compact hot accounts", "compacted", compacted, "error", err)
+		return
+	}
+	c.logger.Debug("compacted hot accounts", "compacted", compacted, "duration", time.Since(start).String())
+}
+
+// List ホットアカウントをユーザーIDの順に取得
+func (m *HotAccountManager) List(ctx context.Context) ([]HotAccount, error) {
+	query := `SELECT user_id, balance_slots, balance,
+			COALESCE((SELECT SUM(s.balance) FROM user_balance_slot s WHERE s.user_id = user_balance.user_id), 0)
+		FROM user_balance WHERE balance_slots > 0 ORDER BY user_id`
+	rows, err := m.db.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []HotAccount{}
+	for rows.Next() {
+		var account HotAccount
+		if err := rows.Scan(&account.UserID, &account.Slots, &account.Balance, &account.SlotBalance); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// foldBalanceSlots user_balanceの行と全てのスロットをロックし、スロットの残高をuser_balanceの行に戻して戻した金額を返す
+// 合計の残高は変わらないが、スロットへの加算では更新されないuser_balanceの更新日時を更新する
+func foldBalanceSlots(ctx context.Context, tx *sql.Tx, userID string) (int, error) {
+	if _, _, err := lockBalanceSlots(ctx, tx, userID); err != nil {
+		return 0, err
+	}
+	slotBalances, err := queryBalanceSlots(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, slotBalance := range slotBalances {
+		moved += slotBalance
+	}
+	if moved == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, `UPDATE user_balance SET balance = balance + $1, updated_at = $2 WHERE user_id = $3`, moved, now, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_balance_slot SET balance = 0, updated_at = $1 WHERE user_id = $2 AND balance <> 0`, now, userID); err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
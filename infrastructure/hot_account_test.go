@@ -0,0 +1,413 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// expectHotAccounts ホットアカウントの一覧が期待通りかを確認
+func expectHotAccounts(t *testing.T, manager *HotAccountManager, expected []HotAccount) {
+	t.Helper()
+	accounts, err := manager.List(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if len(accounts) != len(expected) {
+		t.Fatalf("expect hot accounts %v, got %v", expected, accounts)
+	}
+	for i := range expected {
+		if accounts[i] != expected[i] {
+			t.Errorf("expect hot accounts %v, got %v", expected, accounts)
+		}
+	}
+}
+
+// expectBalance ユーザー残高の合計が期待通りかを確認
+func expectBalance(t *testing.T, repo domain.UserBalanceRepository, userID string, expected int) {
+	t.Helper()
+	userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if userBalance.Balance != expected {
+		t.Errorf("expect balance [%d], got [%d]", expected, userBalance.Balance)
+	}
+}
+
+// inTx トランザクション内でfnを実行し、成功した場合はコミット、失敗した場合はロールバック
+func inTx(repo domain.UserBalanceRepository, fn func(ctx context.Context) error) error {
+	ctx, err := repo.BeginTx(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := fn(ctx); err != nil {
+		repo.Rollback(ctx)
+		return err
+	}
+	return repo.Commit(ctx)
+}
+
+func TestEnableHotAccount(t *testing.T) {
+	cases := []struct {
+		Name           string
+		UserID         string
+		Slots          int
+		ExpectedErrMsg string
+	}{
+		{"enable", "test_user1", 4, ""},
+		{"max slots", "test_user1", MaxBalanceSlots, ""},
+		{"zero slots", "test_user1", 0, "invalid number of balance slots"},
+		{"too many slots", "test_user1", MaxBalanceSlots + 1, "invalid number of balance slots"},
+		{"user not exists", "test_user99", 4, sql.ErrNoRows.Error()},
+	}
+
+	for i, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			db := NewMockDatabase("enable-hot-account-" + strconv.Itoa(i))
+			defer db.Close()
+			manager := NewHotAccountManager(*db)
+			err := manager.Enable(context.Background(), c.UserID, c.Slots)
+			if c.ExpectedErrMsg != "" {
+				if err == nil || err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%v]", c.ExpectedErrMsg, err)
+				}
+				expectHotAccounts(t, manager, nil)
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			expectHotAccounts(t, manager, []HotAccount{{UserID: c.UserID, Slots: c.Slots, Balance: 10000}})
+		})
+	}
+}
+
+func TestHotAccountBalance(t *testing.T) {
+	db := NewMockDatabase("hot-account-balance")
+	defer db.Close()
+	repo := NewUserBalanceRepository(*db)
+	manager := NewHotAccountManager(*db)
+	ctx := context.Background()
+	if err := manager.Enable(ctx, "test_user1", 4); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	t.Run("add to slots", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			err := inTx(repo, func(ctx context.Context) error {
+				if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 500); err != nil {
+					return err
+				}
+				return repo.InsertTransactionHistory(ctx, "hot-add-"+strconv.Itoa(i), "test_user1", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{})
+			})
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+		}
+		expectBalance(t, repo, "test_user1", 12000)
+		expectHotAccounts(t, manager, []HotAccount{{UserID: "test_user1", Slots: 4, Balance: 10000, SlotBalance: 2000}})
+
+		histories, err := repo.QueryTransactionHistoryByUserID(ctx, "test_user1", conformanceAddAllTransactionID)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		// スロットへの加算は取引後の残高を記録しないため、現在の残高から算出する
+		for i, history := range histories {
+			if expected := 10000 + 500*(i+1); history.BalanceAfter == nil || *history.BalanceAfter != expected {
+				t.Errorf("expect balance_after [%d] for hot account, got %v", expected, history.BalanceAfter)
+			}
+		}
+
+		minBalance, maxBalance := 11000, 15000
+		listed, err := repo.QueryUserBalances(ctx, domain.ListAccountsQuery{
+			MinBalance: &minBalance, MaxBalance: &maxBalance, SortBy: domain.AccountSortField_Balance, PageSize: 10,
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(listed) != 1 || listed[0].UserID != "test_user1" || listed[0].Balance != 12000 {
+			t.Errorf("expect accounts filtered by total balance [test_user1 12000], got %v", listed)
+		}
+
+		totals, err := repo.QueryBalanceStatusTotals(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(totals) != 1 || totals[0].Balance != 152000 {
+			t.Errorf("expect total balance [152000], got %v", totals)
+		}
+		userBalances, err := repo.QueryUserBalancesByUserIDs(ctx, []string{"test_user1"})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(userBalances) != 1 || userBalances[0].Balance != 12000 {
+			t.Errorf("expect balance [12000], got %v", userBalances)
+		}
+	})
+
+	t.Run("reduce across slots", func(t *testing.T) {
+		err := inTx(repo, func(ctx context.Context) error {
+			return repo.ReduceUserBalanceByUserID(ctx, "test_user1", 10500)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		expectBalance(t, repo, "test_user1", 1500)
+		expectHotAccounts(t, manager, []HotAccount{{UserID: "test_user1", Slots: 4, Balance: 0, SlotBalance: 1500}})
+	})
+
+	t.Run("reduce more than total", func(t *testing.T) {
+		err := inTx(repo, func(ctx context.Context) error {
+			return repo.ReduceUserBalanceByUserID(ctx, "test_user1", 2000)
+		})
+		if err == nil || err.Error() != "update failed" {
+			t.Errorf("expect error [update failed], got [%v]", err)
+		}
+		expectBalance(t, repo, "test_user1", 1500)
+	})
+
+	t.Run("close with slot balance", func(t *testing.T) {
+		err := inTx(repo, func(ctx context.Context) error {
+			return repo.UpdateUserStatusByUserID(ctx, "test_user1", domain.UserStatus_Closed)
+		})
+		if err == nil || err.Error() != "update failed" {
+			t.Errorf("expect error [update failed], got [%v]", err)
+		}
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		err := inTx(repo, func(ctx context.Context) error {
+			return repo.UpdateUserStatusByUserID(ctx, "test_user1", domain.UserStatus_Frozen)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		err = inTx(repo, func(ctx context.Context) error {
+			return repo.AddUserBalanceByUserID(ctx, "test_user1", 500)
+		})
+		if err == nil || err.Error() != "update failed" {
+			t.Errorf("expect error [update failed], got [%v]", err)
+		}
+		err = inTx(repo, func(ctx context.Context) error {
+			return repo.ReduceUserBalanceByUserID(ctx, "test_user1", 100)
+		})
+		if err == nil || err.Error() != "update failed" {
+			t.Errorf("expect error [update failed], got [%v]", err)
+		}
+		expectBalance(t, repo, "test_user1", 1500)
+		err = inTx(repo, func(ctx context.Context) error {
+			return repo.UpdateUserStatusByUserID(ctx, "test_user1", domain.UserStatus_Active)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		compacted, err := manager.Compact(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if compacted != 1 {
+			t.Errorf("expect [1] compacted account, got [%d]", compacted)
+		}
+		expectBalance(t, repo, "test_user1", 1500)
+		expectHotAccounts(t, manager, []HotAccount{{UserID: "test_user1", Slots: 4, Balance: 1500}})
+
+		compacted, err = manager.Compact(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if compacted != 0 {
+			t.Errorf("expect no compacted account, got [%d]", compacted)
+		}
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		err := inTx(repo, func(ctx context.Context) error {
+			return repo.AddUserBalanceByUserID(ctx, "test_user1", 500)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := manager.Disable(ctx, "test_user1"); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		expectBalance(t, repo, "test_user1", 2000)
+		expectHotAccounts(t, manager, nil)
+
+		err = inTx(repo, func(ctx context.Context) error {
+			return repo.AddUserBalanceByUserID(ctx, "test_user1", 500)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		expectBalance(t, repo, "test_user1", 2500)
+	})
+}
+
+// TestHotAccountConcurrentAddBalance 1つのrepositoryを共有した並行する加算が全て反映されることを確認
+// SQLiteでは書き込みが並行できないため、接続を1つにしてトランザクションを順番に実行する
+func TestHotAccountConcurrentAddBalance(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Slots int
+	}{
+		{"without slots", 0},
+		{"with slots", 4},
+	}
+
+	for i, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			db := NewMockDatabase("hot-account-concurrent-" + strconv.Itoa(i))
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+			if c.Slots > 0 {
+				if err := NewHotAccountManager(*db).Enable(context.Background(), "test_user1", c.Slots); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			repo := NewUserBalanceRepository(*db)
+
+			const workers = 20
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					err := inTx(repo, func(ctx context.Context) error {
+						if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 100); err != nil {
+							return err
+						}
+						return repo.InsertTransactionHistory(ctx, "hot-concurrent-"+strconv.Itoa(w), "test_user1", domain.TransactionType_AddUserBalance, 100, domain.AuditInfo{})
+					})
+					if err != nil {
+						t.Errorf("expect no error but got [%s]", err)
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			expectBalance(t, repo, "test_user1", 10000+workers*100)
+		})
+	}
+}
+
+// BenchmarkHotAccountAddBalance 同じユーザーへの並行した加算のスループットを分割数毎に計測
+// 行のロックの競合はSQLiteでは再現しないため、postgresDSNEnvで指定したPostgresで実行する
+// サーバーと同じく1つのrepositoryを全ての並行する処理で共有する
+// (例: go test ./infrastructure -run '^$' -bench HotAccount -cpu 16)
+// BenchmarkHotAccountAddBalance 分割数毎の並行な加算のスループットを計測
+// USER_BALANCE_TEST_POSTGRES_DSNが指定されない場合はSQLiteで計測する
+// SQLiteは書き込みをDB全体で直列化するため分割の効果は現れず、スロットを選んで加算する処理のコストのみを比較できる
+func BenchmarkHotAccountAddBalance(b *testing.B) {
+	dsn := os.Getenv(postgresDSNEnv)
+
+	for _, slots := range []int{0, 4, 16} {
+		b.Run("slots="+strconv.Itoa(slots), func(b *testing.B) {
+			var db DB
+			if dsn != "" {
+				db = DB{DB: openPostgresFixtures(b, dsn)}
+			} else {
+				db = *NewMockDatabase("hot-account-bench-" + strconv.Itoa(slots))
+				db.SetMaxOpenConns(1)
+				defer db.Close()
+			}
+			if slots > 0 {
+				if err := NewHotAccountManager(db).Enable(context.Background(), "test_user1", slots); err != nil {
+					b.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			repo := NewUserBalanceRepository(db)
+			before, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+			if err != nil {
+				b.Fatalf("expect no error but got [%s]", err)
+			}
+			var seq int64
+			prefix := strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// 取引履歴の挿入を含め、加算の処理と同じ時間だけ行のロックを保持する
+					transactionID := prefix + strconv.FormatInt(atomic.AddInt64(&seq, 1), 10)
+					err := inTx(repo, func(ctx context.Context) error {
+						if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 1); err != nil {
+							return err
+						}
+						return repo.InsertTransactionHistory(ctx, transactionID, "test_user1", domain.TransactionType_AddUserBalance, 1, domain.AuditInfo{})
+					})
+					if err != nil {
+						b.Errorf("expect no error but got [%s]", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			// 共有したrepositoryでの加算が全て反映されたかを確認
+			if !b.Failed() {
+				after, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+				if err != nil {
+					b.Fatalf("expect no error but got [%s]", err)
+				}
+				if after.Balance-before.Balance != int(seq) {
+					b.Errorf("expect balance to increase by [%d] but got [%d]", seq, after.Balance-before.Balance)
+				}
+			}
+		})
+	}
+}
+
+func TestHotAccountCompactor(t *testing.T) {
+	db := NewMockDatabase("hot-account-compactor")
+	defer db.Close()
+	repo := NewUserBalanceRepository(*db)
+	manager := NewHotAccountManager(*db)
+	if err := manager.Enable(context.Background(), "test_user1", 4); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if err := inTx(repo, func(ctx context.Context) error {
+		return repo.AddUserBalanceByUserID(ctx, "test_user1", 500)
+	}); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	compactor := NewHotAccountCompactor(manager, 10*time.Millisecond, domain.NewNopLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		compactor.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		accounts, err := manager.List(context.Background())
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(accounts) == 1 && accounts[0].SlotBalance == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect slot balances to be compacted, got %v", accounts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expect compactor to stop after cancel")
+	}
+	expectHotAccounts(t, manager, []HotAccount{{UserID: "test_user1", Slots: 4, Balance: 10500}})
+	expectBalance(t, repo, "test_user1", 10500)
+}
@@ -0,0 +1,72 @@
+package infrastructure
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ログの出力形式
+const (
+	LogFormat_JSON    = "json"
+	LogFormat_Console = "console"
+)
+
+// zapLogger zapのSugaredLoggerを格納(domain.Loggerを実装)
+type zapLogger struct {
+	logger *zap.SugaredLogger
+}
+
+// NewLogger 指定した形式とレベルで構造化ログをwに出力する新しいLoggerを作成
+// levelはdebug、info、warn、errorのいずれか
+func NewLogger(w io.Writer, format string, level string) (domain.Logger, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unsupported log level: %s", level)
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case LogFormat_JSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case LogFormat_Console:
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("unsupported log format: %s", format)
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.AddSync(w), lvl)
+	logger := zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
+	return &zapLogger{logger: logger.Sugar()}, nil
+}
+
+// Debug デバッグレベルのログを出力
+func (l *zapLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Debugw(msg, keysAndValues...)
+}
+
+// Info 情報レベルのログを出力
+func (l *zapLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Infow(msg, keysAndValues...)
+}
+
+// Warn 警告レベルのログを出力
+func (l *zapLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Warnw(msg, keysAndValues...)
+}
+
+// Error エラーレベルのログを出力
+func (l *zapLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Errorw(msg, keysAndValues...)
+}
+
+// With 指定したフィールドを全てのログに付与したLoggerを作成
+func (l *zapLogger) With(keysAndValues ...interface{}) domain.Logger {
+	return &zapLogger{logger: l.logger.With(keysAndValues...)}
+}
@@ -0,0 +1,46 @@
+package infrastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogFormat_JSON, "info")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	reqLogger := logger.With("request_id", "req-1")
+	reqLogger.Debug("query executed", "query", "QueryUserBalanceByUserID")
+	reqLogger.Error("database error", "error", "connection refused")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expect debug log to be filtered out but got [%d] lines", len(lines))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expect json log but got [%s]", lines[0])
+	}
+	for key, expected := range map[string]string{
+		"level":      "error",
+		"msg":        "database error",
+		"request_id": "req-1",
+		"error":      "connection refused",
+	} {
+		if entry[key] != expected {
+			t.Errorf("expect [%s] to be [%s] but got [%v]", key, expected, entry[key])
+		}
+	}
+
+	if _, err := NewLogger(&buf, "xml", "info"); err == nil {
+		t.Errorf("expect error for unsupported format but got no one")
+	}
+	if _, err := NewLogger(&buf, LogFormat_JSON, "verbose"); err == nil {
+		t.Errorf("expect error for unsupported level but got no one")
+	}
+}
@@ -0,0 +1,811 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// memoryTx インメモリrepositoryのトランザクション
+// コミットまでの変更を保持し、コミット時に反映、ロールバック時に破棄する
+type memoryTx struct {
+	balances        map[string]domain.UserBalanceModel // 挿入または変更したユーザー残高
+	histories       []domain.TransactionHistoryModel   // 挿入した取引履歴
+	statusHistories []memoryStatusHistory              // 挿入した状態変更履歴
+	done            bool                               // コミットまたはロールバック済み
+}
+
+// memoryTxKey コンテキストにインメモリrepositoryのトランザクションを格納するキー
+type memoryTxKey struct{}
+
+// memoryTxFromContext BeginTxで開始した終了していないトランザクションをコンテキストから取得
+func memoryTxFromContext(ctx context.Context) (*memoryTx, bool) {
+	tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx)
+	return tx, ok && !tx.done
+}
+
+// memoryStatusHistory インメモリrepositoryのユーザーの状態変更履歴
+type memoryStatusHistory struct {
+	UserID string
+	Status domain.UserStatus
+	domain.AuditInfo
+	CreatedAt time.Time
+}
+
+// memoryUserBalanceRepository ユーザー残高と取引履歴をメモリ上に保持するrepository
+// ローカル開発とテスト用で、プロセスを終了するとデータは失われる
+type memoryUserBalanceRepository struct {
+	mu           sync.RWMutex // コミット済みのデータを保護
+	balances     map[string]domain.UserBalanceModel
+	histories    []domain.TransactionHistoryModel
+	historyIndex map[string]bool // 取引IDの一意性を検証するための索引
+	// statusHistories ユーザー毎の状態変更履歴(古い順)
+	statusHistories map[string][]memoryStatusHistory
+	// dailyAggregates 日毎、取引種類毎の取引履歴の集計(日と取引種類の順)
+	dailyAggregates []domain.DailyTransactionAggregate
+	aggregatedFrom  time.Time // 次回の集計を開始する日(ゼロ値の場合は全ての取引履歴を集計する)
+	aggregatedAt    time.Time // 最後に集計を完了した日時
+
+	txSem chan struct{} // トランザクションを1つずつ実行するためのセマフォ
+}
+
+// NewMemoryUserBalanceRepository 初期データを格納した新しいインメモリrepositoryを作成
+func NewMemoryUserBalanceRepository(users []domain.UserBalanceModel, histories []domain.TransactionHistoryModel) domain.UserBalanceRepository {
+	repo := &memoryUserBalanceRepository{
+		balances:        make(map[string]domain.UserBalanceModel, len(users)),
+		historyIndex:    make(map[string]bool, len(histories)),
+		statusHistories: make(map[string][]memoryStatusHistory),
+		txSem:           make(chan struct{}, 1),
+	}
+	for _, user := range users {
+		if user.Status == "" {
+			user.Status = domain.UserStatus_Active
+		}
+		repo.balances[user.UserID] = user
+	}
+	for _, history := range histories {
+		repo.histories = append(repo.histories, history)
+		repo.historyIndex[history.TransactionID] = true
+	}
+	sortHistories(repo.histories)
+	return repo
+}
+
+// memorySeedUser 初期データファイルのユーザーのフォーマット
+type memorySeedUser struct {
+	UserID     string `json:"user_id"`
+	Balance    int    `json:"balance"`
+	MerchantID string `json:"merchant_id"`
+}
+
+// LoadMemorySeed インメモリrepositoryの初期データをJSONファイルから読み込む
+// ファイルは{"users": [{"user_id": "...", "balance": 0, "merchant_id": "..."}]}の形式
+func LoadMemorySeed(path string) ([]domain.UserBalanceModel, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var seed struct {
+		Users []memorySeedUser `json:"users"`
+	}
+	if err := json.Unmarshal(b, &seed); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	users := make([]domain.UserBalanceModel, 0, len(seed.Users))
+	for _, u := range seed.Users {
+		if u.UserID == "" {
+			return nil, errors.New("user_id is empty in seed file")
+		}
+		users = append(users, domain.UserBalanceModel{
+			UserID:     u.UserID,
+			Balance:    u.Balance,
+			MerchantID: u.MerchantID,
+			Status:     domain.UserStatus_Active,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		})
+	}
+	return users, nil
+}
+
+// sortHistories 取引履歴をPostgresのrepositoryと同じ(作成日時, 取引ID)の順に並べる
+func sortHistories(histories []domain.TransactionHistoryModel) {
+	sort.SliceStable(histories, func(i, j int) bool {
+		if !histories[i].CreatedAt.Equal(histories[j].CreatedAt) {
+			return histories[i].CreatedAt.Before(histories[j].CreatedAt)
+		}
+		return histories[i].TransactionID < histories[j].TransactionID
+	})
+}
+
+// GetCtxWithTimeout タイムアウト付きのコンテキストを取得
+func (repo *memoryUserBalanceRepository) GetCtxWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeout)
+}
+
+// BeginTx トランザクションを開始し、トランザクションを格納したコンテキストを返す
+// 実行中のトランザクションがある場合、コミットまたはロールバックされるまで待つ
+func (repo *memoryUserBalanceRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	select {
+	case repo.txSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx, ctx.Err()
+	}
+	return context.WithValue(ctx, memoryTxKey{}, &memoryTx{balances: make(map[string]domain.UserBalanceModel)}), nil
+}
+
+// endTx トランザクションを終了してセマフォを解放
+func (repo *memoryUserBalanceRepository) endTx(tx *memoryTx) {
+	tx.done = true
+	<-repo.txSem
+}
+
+// Commit コンテキストに格納したトランザクションの変更を反映
+func (repo *memoryUserBalanceRepository) Commit(ctx context.Context) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return sql.ErrTxDone
+	}
+
+	repo.mu.Lock()
+	for userID, userBalance := range tx.balances {
+		repo.balances[userID] = userBalance
+	}
+	for _, history := range tx.histories {
+		repo.histories = append(repo.histories, history)
+		repo.historyIndex[history.TransactionID] = true
+	}
+	sortHistories(repo.histories)
+	for _, history := range tx.statusHistories {
+		repo.statusHistories[history.UserID] = append(repo.statusHistories[history.UserID], history)
+	}
+	repo.mu.Unlock()
+
+	repo.endTx(tx)
+	return nil
+}
+
+// Rollback コンテキストに格納したトランザクションの変更を破棄
+func (repo *memoryUserBalanceRepository) Rollback(ctx context.Context) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return sql.ErrTxDone
+	}
+	repo.endTx(tx)
+	return nil
+}
+
+// txUserBalance トランザクション内で変更されたユーザー残高、なければコミット済みのユーザー残高を取得
+func (repo *memoryUserBalanceRepository) txUserBalance(tx *memoryTx, userID string) (domain.UserBalanceModel, bool) {
+	if userBalance, ok := tx.balances[userID]; ok {
+		return userBalance, true
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	userBalance, ok := repo.balances[userID]
+	return userBalance, ok
+}
+
+// InsertTransactionHistory 取引履歴を監査情報と共に挿入
+// 一斉加算の場合はuserIDを空文字にする
+// 取引後の残高はトランザクション内で変更したユーザー残高から記録する(一斉加算の場合はnil)
+func (repo *memoryUserBalanceRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int, audit domain.AuditInfo) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	repo.mu.RLock()
+	duplicated := repo.historyIndex[transactionID]
+	repo.mu.RUnlock()
+	for _, history := range tx.histories {
+		duplicated = duplicated || history.TransactionID == transactionID
+	}
+	if duplicated {
+		// usecaseがPostgresと同様に一意性違反として扱えるエラーを返す
+		return &pgconn.PgError{
+			Code:           "23505",
+			Message:        "duplicate key value violates unique constraint \"transaction_history_pkey\"",
+			ConstraintName: "transaction_history_pkey",
+		}
+	}
+
+	// 呼び出し元が後からメタデータを変更しても履歴に影響しないように複製する
+	if audit.Metadata != nil {
+		metadata := make(map[string]string, len(audit.Metadata))
+		for k, v := range audit.Metadata {
+			metadata[k] = v
+		}
+		audit.Metadata = metadata
+	}
+
+	var balanceAfter *int
+	if userBalance, ok := repo.txUserBalance(tx, userID); ok && userID != "" {
+		balance := userBalance.Balance
+		balanceAfter = &balance
+	}
+
+	now := time.Now()
+	tx.histories = append(tx.histories, domain.TransactionHistoryModel{
+		TransactionID:   transactionID,
+		UserID:          userID,
+		TransactionType: transactionType,
+		Amount:          amount,
+		BalanceAfter:    balanceAfter,
+		AuditInfo:       audit,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	})
+	return nil
+}
+
+// QueryUserBalanceByUserID ユーザーIDでユーザー残高情報を取得(コミット済みのデータのみ参照する)
+func (repo *memoryUserBalanceRepository) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.UserBalanceModel{}, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	userBalance, ok := repo.balances[userID]
+	if !ok {
+		return domain.UserBalanceModel{}, sql.ErrNoRows
+	}
+	return userBalance, nil
+}
+
+// AddUserBalanceByUserID ユーザーIDでユーザー残高を加算
+func (repo *memoryUserBalanceRepository) AddUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	userBalance, ok := repo.txUserBalance(tx, userID)
+	if !ok {
+		// 更新する時点でユーザーが存在しない場合
+		return sql.ErrNoRows
+	}
+	if !userBalance.Status.CanCredit() {
+		// 更新する時点で加算できない状態の場合
+		domain.LoggerFromContext(ctx).Warn("conditional balance update affected no rows", "user_id", userID, "amount", amount)
+		return errors.New("update failed")
+	}
+	userBalance.Balance += amount
+	userBalance.UpdatedAt = time.Now()
+	tx.balances[userID] = userBalance
+	return nil
+}
+
+// ReduceUserBalanceByUserID ユーザーIDでユーザー残高を減算
+func (repo *memoryUserBalanceRepository) ReduceUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	userBalance, ok := repo.txUserBalance(tx, userID)
+	if !ok || userBalance.Balance-amount < 0 || !userBalance.Status.CanDebit() {
+		// 更新する時点でユーザーが存在しない、減算後残高が負または減算できない状態の場合
+		domain.LoggerFromContext(ctx).Warn("conditional balance update affected no rows", "user_id", userID, "amount", amount)
+		return errors.New("update failed")
+	}
+	userBalance.Balance -= amount
+	userBalance.UpdatedAt = time.Now()
+	tx.balances[userID] = userBalance
+	return nil
+}
+
+// AddAllUserBalance 加算できる状態のユーザー残高を一斉に加算
+func (repo *memoryUserBalanceRepository) AddAllUserBalance(ctx context.Context, amount int) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	repo.mu.RLock()
+	userIDs := make([]string, 0, len(repo.balances))
+	for userID := range repo.balances {
+		userIDs = append(userIDs, userID)
+	}
+	repo.mu.RUnlock()
+	// トランザクション内で挿入したユーザーも含める
+	for userID := range tx.balances {
+		userIDs = append(userIDs, userID)
+	}
+
+	now := time.Now()
+	updated := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		userBalance, _ := repo.txUserBalance(tx, userID)
+		if updated[userID] || !userBalance.Status.CanCredit() {
+			continue
+		}
+		updated[userID] = true
+		userBalance.Balance += amount
+		userBalance.UpdatedAt = now
+		tx.balances[userID] = userBalance
+	}
+	return nil
+}
+
+// QueryTransactionHistoryByUserID 指定した取引以降のユーザーに関わる取引履歴を古い順に取得
+// 一斉加算の履歴(user_idが空文字)はユーザーの作成後かつ加算できる状態だったもののみ含み、取引IDが空文字の場合は全ての履歴を取得する
+func (repo *memoryUserBalanceRepository) QueryTransactionHistoryByUserID(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	histories := []domain.TransactionHistoryModel{}
+	after := -1
+	if afterTransactionID != "" {
+		for i, history := range repo.histories {
+			if history.TransactionID == afterTransactionID {
+				after = i
+				break
+			}
+		}
+		if after < 0 {
+			return histories, nil
+		}
+	}
+	for _, history := range repo.histories[after+1:] {
+		if repo.isUserHistory(userID, history) {
+			histories = append(histories, history)
+		}
+	}
+	return histories, nil
+}
+
+// isUserHistory 取引履歴がユーザーに関わるか(ユーザーの取引と、ユーザーの作成後で加算できる状態だった時点の一斉加算)を判定
+// 呼び出し側でロックを取得すること
+func (repo *memoryUserBalanceRepository) isUserHistory(userID string, history domain.TransactionHistoryModel) bool {
+	if history.UserID != "" {
+		return history.UserID == userID
+	}
+	user, exists := repo.balances[userID]
+	return exists && !history.CreatedAt.Before(user.CreatedAt) && repo.statusAt(userID, history.CreatedAt).CanCredit()
+}
+
+// QueryTransactionHistoryInPeriod 期間の開始時点のユーザー残高と、期間内のユーザーに関わる取引履歴を古い順に取得
+// 開始時点の残高は期間の前の最後の取引後の残高に、その後の取引後の残高を持たない取引(一斉加算など)を加えて算出する
+// 期間の前に取引後の残高を持つ取引がない場合は、現在の残高から期間の開始以降の取引を差し引いて算出する
+func (repo *memoryUserBalanceRepository) QueryTransactionHistoryInPeriod(ctx context.Context, userID string, from time.Time, to time.Time) (int, []domain.TransactionHistoryModel, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	user, ok := repo.balances[userID]
+	if !ok {
+		return 0, nil, sql.ErrNoRows
+	}
+
+	anchored := false
+	opening := 0
+	sinceFrom := 0
+	histories := []domain.TransactionHistoryModel{}
+	for _, history := range repo.histories {
+		if !repo.isUserHistory(userID, history) {
+			continue
+		}
+		if !history.CreatedAt.Before(from) {
+			sinceFrom += history.SignedAmount()
+			if history.CreatedAt.Before(to) {
+				histories = append(histories, history)
+			}
+		} else if history.BalanceAfter != nil {
+			anchored = true
+			opening = *history.BalanceAfter
+		} else {
+			opening += history.SignedAmount()
+		}
+	}
+	if !anchored {
+		opening = user.Balance - sinceFrom
+	}
+	return opening, histories, nil
+}
+
+// statusAt 指定した日時の時点のユーザーの状態を直前の状態変更履歴から取得(状態変更履歴がない場合は有効)
+// 呼び出し側でロックを取得すること
+func (repo *memoryUserBalanceRepository) statusAt(userID string, at time.Time) domain.UserStatus {
+	status := domain.UserStatus_Active
+	for _, history := range repo.statusHistories[userID] {
+		if history.CreatedAt.After(at) {
+			break
+		}
+		status = history.Status
+	}
+	return status
+}
+
+// InsertUser ユーザーを挿入(既に存在する場合は一意性違反)
+func (repo *memoryUserBalanceRepository) InsertUser(ctx context.Context, user domain.UserBalanceModel) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := repo.txUserBalance(tx, user.UserID); ok {
+		// usecaseがPostgresと同様に一意性違反として扱えるエラーを返す
+		return &pgconn.PgError{
+			Code:           "23505",
+			Message:        "duplicate key value violates unique constraint \"user_balance_pkey\"",
+			ConstraintName: "user_balance_pkey",
+		}
+	}
+	tx.balances[user.UserID] = user
+	return nil
+}
+
+// UpdateUserStatusByUserID ユーザーIDでユーザーの状態を更新
+// 解約済みのユーザーと、残高が0でないユーザーの解約は更新しない
+func (repo *memoryUserBalanceRepository) UpdateUserStatusByUserID(ctx context.Context, userID string, status domain.UserStatus) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	userBalance, ok := repo.txUserBalance(tx, userID)
+	if !ok || userBalance.Status == domain.UserStatus_Closed || (status == domain.UserStatus_Closed && userBalance.Balance != 0) {
+		// 更新する時点でユーザーが存在しない、解約済みまたは残高が0でない場合
+		domain.LoggerFromContext(ctx).Warn("conditional status update affected no rows", "user_id", userID, "status", string(status))
+		return errors.New("update failed")
+	}
+	userBalance.Status = status
+	userBalance.UpdatedAt = time.Now()
+	tx.balances[userID] = userBalance
+	return nil
+}
+
+// InsertUserStatusHistory ユーザーの状態変更履歴を監査情報と共に挿入
+func (repo *memoryUserBalanceRepository) InsertUserStatusHistory(ctx context.Context, userID string, status domain.UserStatus, audit domain.AuditInfo) error {
+	tx, ok := memoryTxFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 状態変更履歴にメタデータは記録しない
+	audit.Metadata = nil
+	tx.statusHistories = append(tx.statusHistories, memoryStatusHistory{
+		UserID:    userID,
+		Status:    status,
+		AuditInfo: audit,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// QueryUserBalancesByUserIDs 複数のユーザーIDでユーザー残高情報を取得(コミット済みのデータのみ参照する)
+// 存在しないユーザーは結果に含まれない
+func (repo *memoryUserBalanceRepository) QueryUserBalancesByUserIDs(ctx context.Context, userIDs []string) ([]domain.UserBalanceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	userBalances := []domain.UserBalanceModel{}
+	found := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if userBalance, ok := repo.balances[userID]; ok && !found[userID] {
+			found[userID] = true
+			userBalances = append(userBalances, userBalance)
+		}
+	}
+	return userBalances, nil
+}
+
+// QueryExistingTransactionIDs 指定した取引IDのうち取引履歴に存在するものを取得(コミット済みのデータのみ参照する)
+func (repo *memoryUserBalanceRepository) QueryExistingTransactionIDs(ctx context.Context, transactionIDs []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	existing := []string{}
+	found := make(map[string]bool, len(transactionIDs))
+	for _, transactionID := range transactionIDs {
+		if repo.historyIndex[transactionID] && !found[transactionID] {
+			found[transactionID] = true
+			existing = append(existing, transactionID)
+		}
+	}
+	return existing, nil
+}
+
+// compareAccounts 並び替えの項目でユーザーを比較(同じ値の場合はユーザーIDで比較)
+func compareAccounts(a domain.UserBalanceModel, b domain.UserBalanceModel, field domain.AccountSortField) int {
+	switch field {
+	case domain.AccountSortField_Balance:
+		if a.Balance != b.Balance {
+			if a.Balance < b.Balance {
+				return -1
+			}
+			return 1
+		}
+	case domain.AccountSortField_CreatedAt:
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			if a.CreatedAt.Before(b.CreatedAt) {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a.UserID, b.UserID)
+}
+
+// matchAccount ユーザーが口座一覧の絞り込みの条件に一致するかを判定
+func matchAccount(user domain.UserBalanceModel, q domain.ListAccountsQuery) bool {
+	if q.MinBalance != nil && user.Balance < *q.MinBalance {
+		return false
+	}
+	if q.MaxBalance != nil && user.Balance > *q.MaxBalance {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		matched := false
+		for _, status := range q.Statuses {
+			matched = matched || user.Status == status
+		}
+		if !matched {
+			return false
+		}
+	}
+	if q.MerchantID != "" && user.MerchantID != q.MerchantID {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && user.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !user.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// QueryUserBalances 条件で絞り込んだユーザー残高情報を並び替えてPageSize件まで取得(コミット済みのデータのみ参照する)
+// AfterUserIDのユーザーの現在の値より後から取得し、ユーザーが存在しない場合は空になる
+func (repo *memoryUserBalanceRepository) QueryUserBalances(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	userBalances := []domain.UserBalanceModel{}
+	var cursor domain.UserBalanceModel
+	if q.AfterUserID != "" {
+		var ok bool
+		if cursor, ok = repo.balances[q.AfterUserID]; !ok {
+			return userBalances, nil
+		}
+	}
+	for _, user := range repo.balances {
+		if !matchAccount(user, q) {
+			continue
+		}
+		if q.AfterUserID != "" {
+			cmp := compareAccounts(user, cursor, q.SortBy)
+			if (!q.Descending && cmp <= 0) || (q.Descending && cmp >= 0) {
+				continue
+			}
+		}
+		userBalances = append(userBalances, user)
+	}
+	sort.Slice(userBalances, func(i, j int) bool {
+		cmp := compareAccounts(userBalances[i], userBalances[j], q.SortBy)
+		if q.Descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	if len(userBalances) > q.PageSize {
+		userBalances = userBalances[:q.PageSize]
+	}
+	return userBalances, nil
+}
+
+// inExportPeriod 日時がエクスポートの期間に含まれるかを判定
+func inExportPeriod(at time.Time, q domain.ExportQuery) bool {
+	return (q.From.IsZero() || !at.Before(q.From)) && (q.To.IsZero() || at.Before(q.To))
+}
+
+// ExportSnapshot コミット済みのユーザー残高と取引履歴を同じ時点で複製し、1行ずつwriterに渡す
+// 複製した後はロックを解放するため、writerの処理中も他の操作を妨げない
+func (repo *memoryUserBalanceRepository) ExportSnapshot(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var userBalances []domain.UserBalanceModel
+	var histories []domain.TransactionHistoryModel
+	repo.mu.RLock()
+	if q.Includes(domain.ExportDataset_Balances) {
+		for _, user := range repo.balances {
+			if inExportPeriod(user.UpdatedAt, q) {
+				userBalances = append(userBalances, user)
+			}
+		}
+	}
+	if q.Includes(domain.ExportDataset_History) {
+		for _, history := range repo.histories {
+			if !inExportPeriod(history.CreatedAt, q) {
+				continue
+			}
+			matched := len(q.TransactionTypes) == 0
+			for _, transactionType := range q.TransactionTypes {
+				matched = matched || history.TransactionType == transactionType
+			}
+			if matched {
+				histories = append(histories, history)
+			}
+		}
+	}
+	repo.mu.RUnlock()
+
+	sort.Slice(userBalances, func(i, j int) bool { return userBalances[i].UserID < userBalances[j].UserID })
+	for _, userBalance := range userBalances {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.WriteUserBalance(userBalance); err != nil {
+			return err
+		}
+	}
+	for _, history := range histories {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.WriteTransactionHistory(history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshDailyTransactionAggregates 前回の集計以降の日の取引履歴を日毎、取引種類毎に再集計し、集計した時点の日時を返す
+// 一斉加算の金額は実行時点で作成済みかつ加算できる状態だったユーザー数を掛けて集計する
+func (repo *memoryUserBalanceRepository) RefreshDailyTransactionAggregates(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	from := domain.ReportGranularity_Day.Truncate(repo.aggregatedFrom)
+	aggregates := []domain.DailyTransactionAggregate{}
+	for _, aggregate := range repo.dailyAggregates {
+		if aggregate.Day.Before(from) {
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	// 日と取引種類の組み合わせ毎に件数と金額を合計する
+	type aggregateKey struct {
+		day             time.Time
+		transactionType domain.TransactionType
+	}
+	index := make(map[aggregateKey]int)
+	first := sort.Search(len(repo.histories), func(i int) bool { return !repo.histories[i].CreatedAt.Before(from) })
+	for _, history := range repo.histories[first:] {
+		key := aggregateKey{day: domain.ReportGranularity_Day.Truncate(history.CreatedAt), transactionType: history.TransactionType}
+		i, ok := index[key]
+		if !ok {
+			i = len(aggregates)
+			index[key] = i
+			aggregates = append(aggregates, domain.DailyTransactionAggregate{Day: key.day, TransactionType: key.transactionType})
+		}
+		aggregates[i].Count++
+		aggregates[i].Amount += repo.creditedAmount(history)
+	}
+	sort.SliceStable(aggregates, func(i, j int) bool {
+		if !aggregates[i].Day.Equal(aggregates[j].Day) {
+			return aggregates[i].Day.Before(aggregates[j].Day)
+		}
+		return aggregates[i].TransactionType < aggregates[j].TransactionType
+	})
+
+	repo.dailyAggregates = aggregates
+	repo.aggregatedFrom = domain.ReportGranularity_Day.Truncate(now.Add(-aggregateSettleTime))
+	repo.aggregatedAt = now
+	return now, nil
+}
+
+// creditedAmount 取引履歴で残高の総額が増減した金額(一斉加算は加算したユーザー数を掛ける)
+// 呼び出し側でロックを取得すること
+func (repo *memoryUserBalanceRepository) creditedAmount(history domain.TransactionHistoryModel) int64 {
+	if history.TransactionType != domain.TransactionType_AddAllUserBalance {
+		return int64(history.Amount)
+	}
+	var amount int64
+	for userID := range repo.balances {
+		if repo.isUserHistory(userID, history) {
+			amount += int64(history.Amount)
+		}
+	}
+	return amount
+}
+
+// QueryDailyTransactionAggregates 期間内(開始は含み、終了は含まない)の日毎の集計を日と取引種類の順に取得し、最後に集計を完了した日時と合わせて返す
+func (repo *memoryUserBalanceRepository) QueryDailyTransactionAggregates(ctx context.Context, from time.Time, to time.Time) ([]domain.DailyTransactionAggregate, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	aggregates := []domain.DailyTransactionAggregate{}
+	for _, aggregate := range repo.dailyAggregates {
+		if !aggregate.Day.Before(from) && aggregate.Day.Before(to) {
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	return aggregates, repo.aggregatedAt, nil
+}
+
+// QueryBalanceStatusTotals ユーザーの状態毎のユーザー数と残高の合計を状態の名前の順に取得
+func (repo *memoryUserBalanceRepository) QueryBalanceStatusTotals(ctx context.Context) ([]domain.BalanceStatusTotal, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo.mu.RLock()
+	byStatus := make(map[domain.UserStatus]*domain.BalanceStatusTotal)
+	for _, user := range repo.balances {
+		total, ok := byStatus[user.Status]
+		if !ok {
+			total = &domain.BalanceStatusTotal{Status: user.Status}
+			byStatus[user.Status] = total
+		}
+		total.Users++
+		total.Balance += int64(user.Balance)
+	}
+	repo.mu.RUnlock()
+
+	totals := make([]domain.BalanceStatusTotal, 0, len(byStatus))
+	for _, total := range byStatus {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Status < totals[j].Status })
+	return totals, nil
+}
@@ -0,0 +1,130 @@
+package infrastructure
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace メトリクス名の接頭辞
+const metricsNamespace = "user_balance"
+
+// PrometheusMetrics Prometheusのメトリクスとレジストリを格納(domain.MetricsRecorderを実装)
+type PrometheusMetrics struct {
+	registry           *prometheus.Registry
+	operations         *prometheus.CounterVec
+	operationDuration  *prometheus.HistogramVec
+	httpRequests       *prometheus.CounterVec
+	httpRequestLatency *prometheus.HistogramVec
+	grpcRequests       *prometheus.CounterVec
+	grpcRequestLatency *prometheus.HistogramVec
+	cacheLookups       *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics 新しいPrometheusのメトリクスを作成し、DB接続プール(リードレプリカを含む)の統計情報も登録
+func NewPrometheusMetrics(db DB) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "usecase",
+			Name:      "operations_total",
+			Help:      "Number of usecase operations by outcome.",
+		}, []string{"operation", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "usecase",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of usecase operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of RESTful requests by route and status code.",
+		}, []string{"method", "route", "code"}),
+		httpRequestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of RESTful requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		grpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "Number of gRPC requests by method and status code.",
+		}, []string{"method", "code"}),
+		grpcRequestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of gRPC requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "lookups_total",
+			Help:      "Number of cache lookups by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.operations,
+		m.operationDuration,
+		m.httpRequests,
+		m.httpRequestLatency,
+		m.grpcRequests,
+		m.grpcRequestLatency,
+		m.cacheLookups,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db.DB != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db.DB, metricsNamespace))
+		for i, replica := range db.Replicas() {
+			m.registry.MustRegister(collectors.NewDBStatsCollector(replica, metricsNamespace+"_replica"+strconv.Itoa(i)))
+		}
+	}
+
+	return m
+}
+
+// ObserveOperation usecaseの操作の結果と処理時間を記録
+func (m *PrometheusMetrics) ObserveOperation(op string, outcome string, duration time.Duration) {
+	m.operations.WithLabelValues(op, outcome).Inc()
+	m.operationDuration.WithLabelValues(op).Observe(duration.Seconds())
+}
+
+// ObserveHTTPRequest RESTfulリクエストのメソッド、ルート、ステータスコードと処理時間を記録
+func (m *PrometheusMetrics) ObserveHTTPRequest(method string, route string, code int, duration time.Duration) {
+	m.httpRequests.WithLabelValues(method, route, strconv.Itoa(code)).Inc()
+	m.httpRequestLatency.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// ObserveGRPCRequest gRPCリクエストのメソッド、ステータスコードと処理時間を記録
+func (m *PrometheusMetrics) ObserveGRPCRequest(method string, code string, duration time.Duration) {
+	m.grpcRequests.WithLabelValues(method, code).Inc()
+	m.grpcRequestLatency.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// ObserveCacheLookup キャッシュの名前とヒットしたか(resultはhitまたはmiss)を記録
+func (m *PrometheusMetrics) ObserveCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// Handler Prometheusのテキスト形式でメトリクスを出力するハンドラ
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
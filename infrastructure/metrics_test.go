@@ -0,0 +1,41 @@
+package infrastructure
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	db := NewMockDatabase("metrics")
+	defer db.Close()
+
+	metrics := NewPrometheusMetrics(*db)
+	metrics.ObserveOperation("AddBalance", "success", 10*time.Millisecond)
+	metrics.ObserveHTTPRequest("GET", "/balance/{userID}", 404, 5*time.Millisecond)
+	metrics.ObserveGRPCRequest("/user_balance.UserBalance/GetBalanceByUserID", "OK", 5*time.Millisecond)
+	metrics.ObserveCacheLookup("balance", true)
+	metrics.ObserveCacheLookup("balance", true)
+	metrics.ObserveCacheLookup("balance", false)
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expected := []string{
+		`user_balance_usecase_operations_total{operation="AddBalance",outcome="success"} 1`,
+		`user_balance_usecase_operation_duration_seconds_count{operation="AddBalance"} 1`,
+		`user_balance_http_requests_total{code="404",method="GET",route="/balance/{userID}"} 1`,
+		`user_balance_grpc_requests_total{code="OK",method="/user_balance.UserBalance/GetBalanceByUserID"} 1`,
+		`user_balance_cache_lookups_total{cache="balance",result="hit"} 2`,
+		`user_balance_cache_lookups_total{cache="balance",result="miss"} 1`,
+		`go_sql_max_open_connections{db_name="user_balance"}`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("expect metrics to contain [%s]", e)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// migrationFileRegexp マイグレーションのファイル名({バージョン}_{名前}.up.sqlまたは.down.sql)
+var migrationFileRegexp = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+// migrationLockKey マイグレーションの実行中に保持するadvisory lockのキー
+const migrationLockKey int64 = 7294316075
+
+// Migration 1つのバージョンのマイグレーション
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus マイグレーションの適用状況
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// LoadMigrations ファイルシステムの直下からマイグレーションを読み込み、バージョン順に並べる
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", entry.Name())
+		}
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: m[2]}
+			byVersion[uint(version)] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(b)
+		} else {
+			migration.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator 埋め込んだマイグレーションをDBに適用する
+// 適用済みのバージョンはmigrate/migrateと同じschema_migrationsテーブルに記録するため、既存のDBをそのまま引き継げる
+type Migrator struct {
+	db         DB
+	conn       migrationConn
+	migrations []Migration
+}
+
+// migrationConn マイグレーションを実行する接続(通常は接続プール、ロック中はロックを取得した接続)
+type migrationConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// NewMigrator 新しいMigratorを作成
+func NewMigrator(db DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, conn: db.DB, migrations: migrations}, nil
+}
+
+// Latest 埋め込んだマイグレーションの最新バージョン(マイグレーションがない場合は0)
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// ensureTable バージョンを記録するテーブルを作成
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	return err
+}
+
+// Version DBに適用済みのバージョンと、適用中に失敗したか(dirty)を取得
+// 何も適用されていない場合は0を返す
+func (m *Migrator) Version(ctx context.Context) (uint, bool, error) {
+	var version int64
+	var dirty bool
+	err := m.conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows || (err == nil && version < 0) {
+		// migrate/migrateは全てのマイグレーションを取り消した状態を-1で記録する
+		return 0, dirty, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint(version), dirty, nil
+}
+
+// setVersion 適用済みのバージョンを記録(0の場合は未適用にする)
+func (m *Migrator) setVersion(ctx context.Context, version uint, dirty bool) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if version > 0 {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, int64(version), dirty); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// locked 他のプロセスと同時にマイグレーションを実行しないように、advisory lockを取得した接続でfnを実行
+// migrate/migrateと同様に実行の間はロックを保持し、他のプロセスはロックの解放を待つ
+// advisory lockがないPostgres以外のDB(テストのSQLite)ではロックしない
+func (m *Migrator) locked(ctx context.Context, fn func(m *Migrator) error) error {
+	if _, ok := m.db.Driver().(*stdlib.Driver); !ok {
+		return fn(m)
+	}
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			// ロックを保持したまま接続プールに戻さないように接続を破棄する
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	locked := *m
+	locked.conn = conn
+	return fn(&locked)
+}
+
+// index バージョンのマイグレーションの位置(0は先頭の前で-1、存在しない場合はエラー)
+func (m *Migrator) index(version uint) (int, error) {
+	if version == 0 {
+		return -1, nil
+	}
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown schema version %d: the binary does not contain this migration", version)
+}
+
+// current 適用済みのバージョンの位置を取得(dirtyの場合はエラー)
+func (m *Migrator) current(ctx context.Context) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema version %d is dirty: fix the database manually and run migrate force", version)
+	}
+	return m.index(version)
+}
+
+// run マイグレーションのSQLを実行してバージョンを記録
+// SQLの実行に失敗した場合はdirtyのまま残し、手動での修正を求める
+func (m *Migrator) run(ctx context.Context, query string, dirtyVersion uint, version uint) error {
+	if err := m.setVersion(ctx, dirtyVersion, true); err != nil {
+		return err
+	}
+	if _, err := m.conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("migration %d failed: %w", dirtyVersion, err)
+	}
+	return m.setVersion(ctx, version, false)
+}
+
+// Up 未適用のマイグレーションを古い順にn個(0以下の場合は全て)適用し、適用したマイグレーションを返す
+func (m *Migrator) Up(ctx context.Context, n int) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func(m *Migrator) error {
+		i, err := m.current(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations[i+1:] {
+			if n > 0 && len(applied) == n {
+				break
+			}
+			if err := m.run(ctx, migration.Up, migration.Version, migration.Version); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down 適用済みのマイグレーションを新しい順にn個(0以下の場合は全て)取り消し、取り消したマイグレーションを返す
+func (m *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func(m *Migrator) error {
+		i, err := m.current(ctx)
+		if err != nil {
+			return err
+		}
+		for ; i >= 0; i-- {
+			if n > 0 && len(reverted) == n {
+				break
+			}
+			migration := m.migrations[i]
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", migration.Version, migration.Name)
+			}
+			var previous uint
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+			if err := m.run(ctx, migration.Down, migration.Version, previous); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force マイグレーションを実行せずにバージョンを記録し、dirtyを解除する(0の場合は未適用にする)
+func (m *Migrator) Force(ctx context.Context, version uint) error {
+	if _, err := m.index(version); err != nil {
+		return err
+	}
+	return m.locked(ctx, func(m *Migrator) error {
+		if err := m.ensureTable(ctx); err != nil {
+			return err
+		}
+		return m.setVersion(ctx, version, false)
+	})
+}
+
+// Status 全てのマイグレーションの適用状況を取得
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		statuses = append(statuses, MigrationStatus{Migration: migration, Applied: migration.Version <= version})
+	}
+	return statuses, nil
+}
+
+// CheckVersion DBのスキーマが最新バージョンかを検証(テーブルは作成しない)
+func (m *Migrator) CheckVersion(ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version (run migrate up): %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("schema version %d is dirty: fix the database manually and run migrate force", version)
+	}
+	if version != m.Latest() {
+		return fmt.Errorf("schema version %d does not match expected version %d: run migrate up", version, m.Latest())
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kaitolucifer/user-balance-management/migrations"
+)
+
+// testMigrations テスト用のマイグレーション
+var testMigrations = fstest.MapFS{
+	"1_create_a.up.sql":   {Data: []byte(`CREATE TABLE a (id INTEGER)`)},
+	"1_create_a.down.sql": {Data: []byte(`DROP TABLE a`)},
+	"3_create_b.up.sql":   {Data: []byte(`CREATE TABLE b (id INTEGER); CREATE TABLE c (id INTEGER)`)},
+	"3_create_b.down.sql": {Data: []byte(`DROP TABLE c; DROP TABLE b`)},
+	"5_create_d.up.sql":   {Data: []byte(`CREATE TABLE d (id INTEGER)`)},
+	"5_create_d.down.sql": {Data: []byte(`DROP TABLE d`)},
+	"README.md":           {Data: []byte(`not a migration`)},
+	"seed/user.up.sql":    {Data: []byte(`not a migration`)},
+}
+
+// newMigrationDatabase マイグレーションのテスト用にテーブルのないSQLiteの接続を作成
+func newMigrationDatabase(t *testing.T) DB {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.Replace(t.Name(), "/", "-", -1)))
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return DB{DB: conn}
+}
+
+// tableExists テーブルが存在するかを判定
+func tableExists(t *testing.T, db DB, name string) bool {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, name).Scan(&count); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	return count > 0
+}
+
+func TestLoadMigrations(t *testing.T) {
+	cases := []struct {
+		Name             string
+		FS               fstest.MapFS
+		ExpectedVersions []uint
+		ExpectedErrMsg   string
+	}{
+		{"sorted by version", testMigrations, []uint{1, 3, 5}, ""},
+		{"version ordered numerically", fstest.MapFS{
+			"10_b.up.sql": {Data: []byte(`SELECT 1`)},
+			"9_a.up.sql":  {Data: []byte(`SELECT 1`)},
+		}, []uint{9, 10}, ""},
+		{"duplicate version", fstest.MapFS{
+			"1_a.up.sql": {Data: []byte(`SELECT 1`)},
+			"1_b.up.sql": {Data: []byte(`SELECT 1`)},
+		}, nil, "duplicate migration version 1"},
+		{"no up file", fstest.MapFS{
+			"1_a.down.sql": {Data: []byte(`SELECT 1`)},
+		}, nil, "migration 1_a has no up file"},
+		{"zero version", fstest.MapFS{
+			"0_a.up.sql": {Data: []byte(`SELECT 1`)},
+		}, nil, "invalid migration version"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			loaded, err := LoadMigrations(c.FS)
+			if c.ExpectedErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.ExpectedErrMsg) {
+					t.Errorf("expect error containing [%s] but got [%v]", c.ExpectedErrMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if len(loaded) != len(c.ExpectedVersions) {
+				t.Fatalf("expect [%d] migrations but got [%d]", len(c.ExpectedVersions), len(loaded))
+			}
+			for i, migration := range loaded {
+				if migration.Version != c.ExpectedVersions[i] {
+					t.Errorf("expect version [%d] but got [%d]", c.ExpectedVersions[i], migration.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	loaded, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	for _, migration := range loaded {
+		if migration.Down == "" {
+			t.Errorf("expect migration %d_%s to have down file", migration.Version, migration.Name)
+		}
+		// 開発用のテストユーザーはマイグレーションに含めない
+		if strings.Contains(migration.Up, "test_user") {
+			t.Errorf("expect migration %d_%s not to seed test users", migration.Version, migration.Name)
+		}
+	}
+	if migrations.SeedUp == "" || migrations.SeedDown == "" {
+		t.Errorf("expect seed sql to be embedded")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	db := newMigrationDatabase(t)
+	m, err := NewMigrator(db, testMigrations)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if m.Latest() != 5 {
+		t.Errorf("expect latest version [5] but got [%d]", m.Latest())
+	}
+
+	// テーブルが存在しない場合は作成せずにエラー
+	if err := m.CheckVersion(ctx); err == nil || !strings.Contains(err.Error(), "run migrate up") {
+		t.Errorf("expect error containing [run migrate up] but got [%v]", err)
+	}
+	if tableExists(t, db, "schema_migrations") {
+		t.Errorf("expect CheckVersion not to create schema_migrations")
+	}
+
+	applied, err := m.Up(ctx, 2)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("expect 2 migrations applied but got [%d %v]", len(applied), err)
+	}
+	if !tableExists(t, db, "c") || tableExists(t, db, "d") {
+		t.Errorf("expect tables up to version 3 to exist")
+	}
+	if err := m.CheckVersion(ctx); err == nil || !strings.Contains(err.Error(), "schema version 3 does not match expected version 5") {
+		t.Errorf("expect version mismatch but got [%v]", err)
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	for _, status := range statuses {
+		if status.Applied != (status.Version <= 3) {
+			t.Errorf("unexpected status of version %d: applied [%t]", status.Version, status.Applied)
+		}
+	}
+
+	applied, err = m.Up(ctx, 0)
+	if err != nil || len(applied) != 1 || applied[0].Version != 5 {
+		t.Fatalf("expect version 5 applied but got [%v %v]", applied, err)
+	}
+	if err := m.CheckVersion(ctx); err != nil {
+		t.Errorf("expect no error but got [%s]", err)
+	}
+	if applied, err := m.Up(ctx, 0); err != nil || len(applied) != 0 {
+		t.Errorf("expect no migration applied but got [%v %v]", applied, err)
+	}
+
+	reverted, err := m.Down(ctx, 1)
+	if err != nil || len(reverted) != 1 || reverted[0].Version != 5 {
+		t.Fatalf("expect version 5 reverted but got [%v %v]", reverted, err)
+	}
+	if version, _, _ := m.Version(ctx); version != 3 {
+		t.Errorf("expect version [3] but got [%d]", version)
+	}
+	reverted, err = m.Down(ctx, 0)
+	if err != nil || len(reverted) != 2 {
+		t.Fatalf("expect 2 migrations reverted but got [%v %v]", reverted, err)
+	}
+	if version, _, _ := m.Version(ctx); version != 0 {
+		t.Errorf("expect version [0] but got [%d]", version)
+	}
+	if tableExists(t, db, "a") || tableExists(t, db, "b") || tableExists(t, db, "c") {
+		t.Errorf("expect all tables to be dropped")
+	}
+}
+
+func TestMigratorDirty(t *testing.T) {
+	ctx := context.Background()
+	db := newMigrationDatabase(t)
+	m, err := NewMigrator(db, fstest.MapFS{
+		"1_create_a.up.sql":   {Data: []byte(`CREATE TABLE a (id INTEGER)`)},
+		"1_create_a.down.sql": {Data: []byte(`DROP TABLE a`)},
+		"2_broken.up.sql":     {Data: []byte(`CREATE TABLE`)},
+		"2_broken.down.sql":   {Data: []byte(`SELECT 1`)},
+	})
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	applied, err := m.Up(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "migration 2 failed") || len(applied) != 1 {
+		t.Fatalf("expect migration 2 to fail after applying 1 but got [%v %v]", applied, err)
+	}
+	if version, dirty, _ := m.Version(ctx); version != 2 || !dirty {
+		t.Errorf("expect dirty version [2] but got [%d %t]", version, dirty)
+	}
+	if err := m.CheckVersion(ctx); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("expect dirty error but got [%v]", err)
+	}
+	if _, err := m.Up(ctx, 0); err == nil || !strings.Contains(err.Error(), "migrate force") {
+		t.Errorf("expect dirty error but got [%v]", err)
+	}
+
+	if err := m.Force(ctx, 7); err == nil || !strings.Contains(err.Error(), "unknown schema version 7") {
+		t.Errorf("expect unknown version error but got [%v]", err)
+	}
+	if err := m.Force(ctx, 1); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if version, dirty, _ := m.Version(ctx); version != 1 || dirty {
+		t.Errorf("expect clean version [1] but got [%d %t]", version, dirty)
+	}
+}
+
+func TestMigratorLegacyNilVersion(t *testing.T) {
+	// migrate/migrateで全てのマイグレーションを取り消したDB
+	db := newMigrationDatabase(t)
+	db.Exec(`CREATE TABLE schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	db.Exec(`INSERT INTO schema_migrations (version, dirty) VALUES (-1, false)`)
+	m, _ := NewMigrator(db, testMigrations)
+	if version, dirty, err := m.Version(context.Background()); version != 0 || dirty || err != nil {
+		t.Errorf("expect version [0] but got [%d %t %v]", version, dirty, err)
+	}
+}
+
+func TestMigratorLegacySeedVersion(t *testing.T) {
+	// テストユーザーの挿入をバージョン4として適用済みのDB(バージョン5以降はSQLiteで実行できないため、テスト用のマイグレーションに置き換える)
+	legacy := fstest.MapFS{
+		"5_create_d.up.sql":   testMigrations["5_create_d.up.sql"],
+		"5_create_d.down.sql": testMigrations["5_create_d.down.sql"],
+	}
+	for _, name := range []string{"4_seed_user_balance_table.up.sql", "4_seed_user_balance_table.down.sql"} {
+		b, err := fs.ReadFile(migrations.FS, name)
+		if err != nil {
+			t.Fatalf("expect embedded migration [%s] but got [%s]", name, err)
+		}
+		legacy[name] = &fstest.MapFile{Data: b}
+	}
+	db := newMigrationDatabase(t)
+	db.Exec(`CREATE TABLE schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	db.Exec(`INSERT INTO schema_migrations (version, dirty) VALUES (4, false)`)
+	m, err := NewMigrator(db, legacy)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	ctx := context.Background()
+
+	applied, err := m.Up(ctx, 0)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if len(applied) != 1 || applied[0].Version != 5 || !tableExists(t, db, "d") {
+		t.Errorf("expect only version [5] to be applied but got %v", applied)
+	}
+	reverted, err := m.Down(ctx, 2)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if len(reverted) != 2 || tableExists(t, db, "d") {
+		t.Errorf("expect versions [5 4] to be reverted but got %v", reverted)
+	}
+
+	// 埋め込んだマイグレーションにもバージョン4が含まれる
+	embedded, err := NewMigrator(db, migrations.FS)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if _, err := embedded.index(4); err != nil {
+		t.Errorf("expect embedded migrations to contain version [4] but got [%s]", err)
+	}
+}
+
+func TestPostgresMigratorLock(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	conn, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	defer conn.Close()
+	m, err := NewMigrator(DB{DB: conn}, testMigrations)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	// tryLock 別の接続でロックを取得できるかを確認し、取得できた場合はすぐに解放する
+	ctx := context.Background()
+	tryLock := func() bool {
+		other, err := conn.Conn(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		defer other.Close()
+		var acquired bool
+		if err := other.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLockKey).Scan(&acquired); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if acquired {
+			other.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		}
+		return acquired
+	}
+
+	err = m.locked(ctx, func(locked *Migrator) error {
+		if tryLock() {
+			t.Errorf("expect migration lock to be held while migrating")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if !tryLock() {
+		t.Errorf("expect migration lock to be released after migrating")
+	}
+}
@@ -0,0 +1,82 @@
+package infrastructure
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// rateLimiterSweepInterval 使われなくなったバケットを削除する間隔
+const rateLimiterSweepInterval = time.Minute
+
+// tokenBucket キー毎のトークンバケット
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimiter トークンバケットをメモリ上に格納するレートリミッター
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // 1秒あたりに補充されるトークン数
+	burst     float64 // バケットの容量
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryRateLimiter 新しいインメモリのトークンバケット方式のレートリミッターを作成
+func NewMemoryRateLimiter(rate float64, burst int) domain.RateLimiter {
+	return &memoryRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow キーのバケットからトークンを1つ消費できればリクエストを許可
+func (l *memoryRateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep 満杯まで補充されたバケットを削除してメモリ使用量を抑える
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	if l.lastSweep.IsZero() {
+		l.lastSweep = now
+	}
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
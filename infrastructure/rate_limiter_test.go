@@ -0,0 +1,49 @@
+package infrastructure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Date(2021, 5, 29, 0, 0, 0, 0, time.UTC)
+	limiter := NewMemoryRateLimiter(2, 3).(*memoryRateLimiter)
+	limiter.now = func() time.Time { return now }
+
+	cases := []struct {
+		Name          string
+		Key           string
+		Elapsed       time.Duration
+		ExpectedAllow bool
+		ExpectedWait  time.Duration
+	}{
+		{"first request", "user1", 0, true, 0},
+		{"second request", "user1", 0, true, 0},
+		{"third request", "user1", 0, true, 0},
+		{"burst exceeded", "user1", 0, false, 500 * time.Millisecond},
+		{"other key", "user2", 0, true, 0},
+		{"partially refilled", "user1", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled", "user1", 250 * time.Millisecond, true, 0},
+		{"refilled but empty again", "user1", 0, false, 500 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			now = now.Add(c.Elapsed)
+			allow, wait := limiter.Allow(c.Key)
+			if allow != c.ExpectedAllow {
+				t.Errorf("expect allow [%t] but got [%t]", c.ExpectedAllow, allow)
+			}
+			if wait != c.ExpectedWait {
+				t.Errorf("expect wait [%s] but got [%s]", c.ExpectedWait, wait)
+			}
+		})
+	}
+
+	// 一定時間使われなかったバケットは削除される
+	now = now.Add(rateLimiterSweepInterval)
+	limiter.Allow("user3")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expect [1] bucket after sweep but got [%d]", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,231 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// primaryWALPositionQuery PostgresのプライマリのWALの書き込み位置を取得するクエリ
+const primaryWALPositionQuery = `SELECT pg_current_wal_lsn()::text`
+
+// replicaStatusQuery Postgresのリードレプリカの複製の状態を取得するクエリ
+// WALを受信中か、適用済みのWALの位置、最後に適用したトランザクションからの経過時間(秒、未適用の場合はNULL)
+const replicaStatusQuery = `SELECT EXISTS(SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming'),
+	COALESCE(pg_last_wal_replay_lsn()::text, '0/0'),
+	EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())`
+
+var (
+	errReplicaNotStreaming  = errors.New("read replica is not streaming WAL from primary")
+	errReplicaNeverReplayed = errors.New("read replica has not replayed any transaction")
+)
+
+// ReplicaConfig リードレプリカの設定
+type ReplicaConfig struct {
+	DSNs          []string
+	MaxStaleness  time.Duration // 読み取りに使用する複製の遅延の上限
+	CheckInterval time.Duration // 接続と複製の遅延を確認する間隔
+	Logger        domain.Logger // 使用可否が変わった場合に出力する(nilの場合は出力しない)
+}
+
+// replica リードレプリカの接続プールと直近の確認結果
+type replica struct {
+	db      *sql.DB
+	healthy int32 // 1の場合は読み取りに使用できる(初回の確認前は-1)
+}
+
+// replicaSet リードレプリカの一覧
+// 定期的に接続と複製の遅延を確認し、使用できるレプリカに順番に読み取りを振り分ける
+type replicaSet struct {
+	primary       *sql.DB
+	replicas      []*replica
+	maxStaleness  time.Duration
+	interval      time.Duration
+	positionQuery string // プライマリで実行するprimaryWALPositionQuery
+	statusQuery   string // レプリカで実行するreplicaStatusQuery
+	logger        domain.Logger
+	next          uint32
+	stop          chan struct{}
+	stopOnce      sync.Once
+	stopped       sync.WaitGroup
+}
+
+// newReplicaSet リードレプリカの一覧を作成し、初回の確認をしてから定期的な確認を開始
+// 複製の遅延はprimaryで実行するpositionQueryとレプリカで実行するstatusQueryの結果から求める
+func newReplicaSet(primary *sql.DB, dbs []*sql.DB, config ReplicaConfig, positionQuery string, statusQuery string) *replicaSet {
+	s := &replicaSet{
+		primary:       primary,
+		maxStaleness:  config.MaxStaleness,
+		interval:      config.CheckInterval,
+		positionQuery: positionQuery,
+		statusQuery:   statusQuery,
+		logger:        config.Logger,
+		stop:          make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = domain.LoggerFromContext(context.Background())
+	}
+	for _, db := range dbs {
+		s.replicas = append(s.replicas, &replica{db: db, healthy: -1})
+	}
+
+	s.check()
+	if s.interval > 0 {
+		s.stopped.Add(1)
+		go s.run()
+	}
+	return s
+}
+
+// run 停止するまで一定間隔でレプリカを確認
+func (s *replicaSet) run() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check 全てのレプリカの接続と複製の遅延を確認し、使用可否を更新
+// 確認のタイムアウトは確認の間隔(未指定の場合は遅延の上限)とする
+// プライマリのWALの位置を先に取得し、レプリカがその位置まで適用済みであれば遅延なしとする
+func (s *replicaSet) check() {
+	timeout := s.interval
+	if timeout <= 0 {
+		timeout = s.maxStaleness
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var primaryPosition string
+	positionErr := s.primary.QueryRowContext(ctx, s.positionQuery).Scan(&primaryPosition)
+	cancel()
+
+	for i, r := range s.replicas {
+		staleness, err := time.Duration(0), positionErr
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			staleness, err = s.staleness(ctx, r.db, primaryPosition)
+			cancel()
+		}
+
+		healthy := err == nil && staleness <= s.maxStaleness
+		var v int32
+		if healthy {
+			v = 1
+		}
+		if atomic.SwapInt32(&r.healthy, v) == v {
+			continue
+		}
+		if healthy {
+			s.logger.Info("read replica is available", "replica", i)
+		} else if err != nil {
+			s.logger.Warn("read replica is unavailable", "replica", i, "error", err)
+		} else {
+			s.logger.Warn("read replica is too stale", "replica", i, "staleness", staleness.String())
+		}
+	}
+}
+
+// staleness レプリカの複製の遅延を取得
+// WALを受信していない(レプリカへの接続が切れた)レプリカは、適用済みの位置から遅延を判断できないためエラーとする
+// primaryPositionまで適用済みの場合は遅延なし、それ以外は最後に適用したトランザクションからの経過時間を遅延とする
+func (s *replicaSet) staleness(ctx context.Context, db *sql.DB, primaryPosition string) (time.Duration, error) {
+	var streaming bool
+	var replayPosition string
+	var replayAge sql.NullFloat64
+	if err := db.QueryRowContext(ctx, s.statusQuery).Scan(&streaming, &replayPosition, &replayAge); err != nil {
+		return 0, err
+	}
+	if !streaming {
+		return 0, errReplicaNotStreaming
+	}
+
+	primaryLSN, err := parseLSN(primaryPosition)
+	if err != nil {
+		return 0, err
+	}
+	replayLSN, err := parseLSN(replayPosition)
+	if err != nil {
+		return 0, err
+	}
+	if replayLSN >= primaryLSN {
+		return 0, nil
+	}
+	if !replayAge.Valid {
+		return 0, errReplicaNeverReplayed
+	}
+	return time.Duration(replayAge.Float64 * float64(time.Second)), nil
+}
+
+// parseLSN PostgresのWALの位置(例: 16/B374D848)を比較できる数値に変換
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("invalid WAL position: " + lsn)
+	}
+	high, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	low, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return high<<32 | low, nil
+}
+
+// pick 使用できるレプリカを順番に選択(使用できるレプリカがない場合はnil)
+func (s *replicaSet) pick() *sql.DB {
+	if s == nil {
+		return nil
+	}
+	n := uint32(len(s.replicas))
+	start := atomic.AddUint32(&s.next, 1)
+	for i := uint32(0); i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.db
+		}
+	}
+	return nil
+}
+
+// dbs レプリカの接続プールの一覧
+func (s *replicaSet) dbs() []*sql.DB {
+	if s == nil {
+		return nil
+	}
+	dbs := make([]*sql.DB, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		dbs = append(dbs, r.db)
+	}
+	return dbs
+}
+
+// close 確認を停止し、全てのレプリカの接続プールを閉じる
+func (s *replicaSet) close() error {
+	if s == nil {
+		return nil
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.stopped.Wait()
+	var err error
+	for _, r := range s.replicas {
+		if closeErr := r.db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
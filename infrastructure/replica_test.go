@@ -0,0 +1,86 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// testPrimaryPositionQuery テストでプライマリのWALの位置として返すクエリ
+const testPrimaryPositionQuery = "SELECT '1/A0'"
+
+func TestReplicaRouting(t *testing.T) {
+	// StatusQueryはWALを受信中か、適用済みのWALの位置、最後の適用からの経過時間(秒)を返す
+	cases := []struct {
+		Name            string
+		StatusQuery     string
+		CloseReplica    bool
+		PrimaryRead     bool
+		ExpectedBalance int
+	}{
+		{"healthy replica", "SELECT 1, '1/A0', 100", false, false, 99999},
+		{"replica ahead of primary position", "SELECT 1, '2/0', 100", false, false, 99999},
+		{"replica within staleness", "SELECT 1, '1/9F', 4.5", false, false, 99999},
+		{"stale replica", "SELECT 1, '1/9F', 10", false, false, 10000},
+		{"stale replica behind high position", "SELECT 1, '0/FFFFFFFF', 10", false, false, 10000},
+		{"replica never replayed", "SELECT 1, '0/0', NULL", false, false, 10000},
+		{"receiver disconnected with equal positions", "SELECT 0, '1/A0', 0", false, false, 10000},
+		{"unavailable replica", "SELECT 1, '1/A0', 0", true, false, 10000},
+		{"write operation", "SELECT 1, '1/A0', 0", false, true, 10000},
+	}
+
+	for i, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			primary := NewMockDatabase("replica-primary-" + strconv.Itoa(i))
+			defer primary.Close()
+			replicaConn := NewMockDatabase("replica-replica-" + strconv.Itoa(i)).DB
+			defer replicaConn.Close()
+			if _, err := replicaConn.Exec(`UPDATE user_balance SET balance = 99999 WHERE user_id = 'test_user1'`); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if c.CloseReplica {
+				replicaConn.Close()
+			}
+
+			replicas := newReplicaSet(primary.DB, []*sql.DB{replicaConn}, ReplicaConfig{MaxStaleness: 5 * time.Second}, testPrimaryPositionQuery, c.StatusQuery)
+			defer replicas.close()
+			repo := NewUserBalanceRepository(DB{DB: primary.DB, replicas: replicas})
+			ctx := context.Background()
+			if c.PrimaryRead {
+				ctx = domain.ContextWithPrimaryRead(ctx)
+			}
+
+			userBalance, err := repo.QueryUserBalanceByUserID(ctx, "test_user1")
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if userBalance.Balance != c.ExpectedBalance {
+				t.Errorf("expect balance [%d] but got [%d]", c.ExpectedBalance, userBalance.Balance)
+			}
+		})
+	}
+}
+
+func TestReplicaRecovery(t *testing.T) {
+	primary := NewMockDatabase("replica-recovery-primary")
+	defer primary.Close()
+	replicaConn := NewMockDatabase("replica-recovery-replica").DB
+	defer replicaConn.Close()
+
+	replicas := newReplicaSet(primary.DB, []*sql.DB{replicaConn}, ReplicaConfig{MaxStaleness: time.Second}, testPrimaryPositionQuery, "SELECT 1, '1/9F', 10")
+	defer replicas.close()
+	db := DB{DB: primary.DB, replicas: replicas}
+	if db.Reader() != primary.DB {
+		t.Fatalf("expect stale replica not to be used")
+	}
+
+	replicas.statusQuery = "SELECT 1, '1/A0', 10"
+	replicas.check()
+	if db.Reader() != replicaConn {
+		t.Errorf("expect replica to be used after catching up")
+	}
+}
@@ -0,0 +1,1050 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// postgresDSNEnv 適合テストを実行するPostgresのDSNを指定する環境変数
+// テスト毎に全てのテーブルを削除して初期データを挿入するため、マイグレーション済みのテスト専用DBを指定すること
+const postgresDSNEnv = "USER_BALANCE_TEST_POSTGRES_DSN"
+
+// conformanceAddAllTransactionID 初期データに含まれる一斉加算の取引ID
+const conformanceAddAllTransactionID = "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b"
+
+// repositoryFactory 初期データ(NewMockDatabaseと同じ)を格納した新しいrepositoryを作成
+type repositoryFactory func(t *testing.T) domain.UserBalanceRepository
+
+// isPgUniqueViolation Postgresの一意性違反エラーかを判定
+func isPgUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// isSQLiteUniqueViolation SQLiteの一意性違反エラーかを判定
+func isSQLiteUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// newMemoryConformanceRepository 初期データを格納したインメモリrepositoryを作成
+func newMemoryConformanceRepository(t *testing.T) domain.UserBalanceRepository {
+	created, _ := time.Parse("2006-01-02", "2021-05-29")
+	users := []domain.UserBalanceModel{
+		{UserID: "test_user1", Balance: 10000, MerchantID: "shop1", CreatedAt: created, UpdatedAt: created},
+	}
+	for i := 2; i <= 5; i++ {
+		users = append(users, domain.UserBalanceModel{UserID: "test_user" + strconv.Itoa(i), Balance: i * 10000, CreatedAt: created, UpdatedAt: created})
+	}
+	histories := []domain.TransactionHistoryModel{
+		{TransactionID: conformanceAddAllTransactionID, TransactionType: domain.TransactionType_AddAllUserBalance, Amount: 10000, CreatedAt: created, UpdatedAt: created},
+	}
+	return NewMemoryUserBalanceRepository(users, histories)
+}
+
+// newSQLiteConformanceRepository 初期データを格納したSQLiteのrepositoryを作成
+func newSQLiteConformanceRepository(t *testing.T) domain.UserBalanceRepository {
+	db := NewMockDatabase("conformance-" + strings.Replace(t.Name(), "/", "-", -1))
+	t.Cleanup(func() { db.Close() })
+	return NewUserBalanceRepository(*db)
+}
+
+// postgresFixtureQueries Postgresの全てのテーブルを空にして初期データ(NewMockDatabaseと同じ)を挿入するクエリ
+var postgresFixtureQueries = []string{
+	`TRUNCATE user_balance_slot, user_status_history, transaction_history, user_balance, daily_transaction_aggregate`,
+	`UPDATE transaction_aggregate_state SET refreshed_from = NULL, refreshed_at = NULL`,
+	`INSERT INTO user_balance (user_id, balance, merchant_id, created_at, updated_at) VALUES
+		('test_user1', 10000, 'shop1', '2021-05-29', '2021-05-29'),
+		('test_user2', 20000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user3', 30000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user4', 40000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user5', 50000, NULL, '2021-05-29', '2021-05-29')`,
+	`INSERT INTO transaction_history (transaction_id, transaction_type, amount, created_at, updated_at) VALUES
+		('` + conformanceAddAllTransactionID + `', 2, 10000, '2021-05-29', '2021-05-29')`,
+}
+
+// openPostgresFixtures Postgresに接続して初期データを挿入
+func openPostgresFixtures(tb testing.TB, dsn string) *sql.DB {
+	conn, err := sql.Open("pgx", dsn)
+	if err != nil {
+		tb.Fatalf("expect no error but got [%s]", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	for _, query := range postgresFixtureQueries {
+		if _, err := conn.Exec(query); err != nil {
+			tb.Fatalf("failed to prepare fixtures: [%s]", err)
+		}
+	}
+	return conn
+}
+
+// newPostgresConformanceRepository 初期データを格納したPostgresのrepositoryを作成
+func newPostgresConformanceRepository(dsn string) repositoryFactory {
+	return func(t *testing.T) domain.UserBalanceRepository {
+		return NewUserBalanceRepository(DB{DB: openPostgresFixtures(t, dsn)})
+	}
+}
+
+func TestMemoryRepositoryConformance(t *testing.T) {
+	testRepositoryConformance(t, newMemoryConformanceRepository, isPgUniqueViolation)
+}
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	testRepositoryConformance(t, newSQLiteConformanceRepository, isSQLiteUniqueViolation)
+}
+
+func TestPostgresRepositoryConformance(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	testRepositoryConformance(t, newPostgresConformanceRepository(dsn), isPgUniqueViolation)
+}
+
+func TestSQLiteHotAccountCloseConformance(t *testing.T) {
+	testHotAccountCloseConformance(t, func(t *testing.T) DB {
+		db := NewMockDatabase("hot-account-close-" + strings.Replace(t.Name(), "/", "-", -1))
+		t.Cleanup(func() { db.Close() })
+		// SQLiteでは書き込みが並行できないため、接続を1つにしてトランザクションを順番に実行する
+		db.SetMaxOpenConns(1)
+		return *db
+	})
+}
+
+func TestPostgresHotAccountCloseConformance(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	testHotAccountCloseConformance(t, func(t *testing.T) DB {
+		return DB{DB: openPostgresFixtures(t, dsn)}
+	})
+}
+
+// testHotAccountCloseConformance ホットアカウントの解約とスロットへの加算を並行して実行しても、解約したユーザーに残高が残らないことを検証
+func testHotAccountCloseConformance(t *testing.T, newDB func(t *testing.T) DB) {
+	db := newDB(t)
+	repo := NewUserBalanceRepository(db)
+	manager := NewHotAccountManager(db)
+
+	const rounds = 20
+	closed := make(map[string]bool)
+	for i := 0; i < rounds; i++ {
+		userID := "close-race-" + strconv.Itoa(i)
+		err := inTx(repo, func(ctx context.Context) error {
+			now := time.Now()
+			return repo.InsertUser(ctx, domain.UserBalanceModel{UserID: userID, Status: domain.UserStatus_Active, CreatedAt: now, UpdatedAt: now})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := manager.Enable(context.Background(), userID, 4); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		var closeErr, creditErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			closeErr = inTx(repo, func(ctx context.Context) error {
+				return repo.UpdateUserStatusByUserID(ctx, userID, domain.UserStatus_Closed)
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			creditErr = inTx(repo, func(ctx context.Context) error {
+				if err := repo.AddUserBalanceByUserID(ctx, userID, 500); err != nil {
+					return err
+				}
+				return repo.InsertTransactionHistory(ctx, "close-race-credit-"+strconv.Itoa(i), userID, domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{})
+			})
+		}()
+		wg.Wait()
+
+		// どちらか一方のみ成功し、解約した場合は残高が0
+		userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), userID)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if (closeErr == nil) == (creditErr == nil) {
+			t.Errorf("expect exactly one of close [%v] and credit [%v] to succeed", closeErr, creditErr)
+		}
+		if userBalance.Status == domain.UserStatus_Closed && userBalance.Balance != 0 {
+			t.Errorf("expect closed user [%s] to have no balance but got [%d]", userID, userBalance.Balance)
+		}
+		if creditErr == nil && userBalance.Balance != 500 {
+			t.Errorf("expect balance [500] but got [%d]", userBalance.Balance)
+		}
+		closed[userID] = userBalance.Status == domain.UserStatus_Closed
+	}
+
+	// 解約したユーザーはスロットを削除してホットアカウントではなくなる
+	accounts, err := manager.List(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	for _, account := range accounts {
+		if closed[account.UserID] {
+			t.Errorf("expect closed user [%s] not to be a hot account", account.UserID)
+		}
+	}
+}
+
+// recordingExportWriter エクスポートされた行を記録するwriter(errを指定した場合は書き込みに失敗する)
+type recordingExportWriter struct {
+	keys      []string // ユーザーIDまたは取引ID
+	balances  []domain.UserBalanceModel
+	histories []domain.TransactionHistoryModel
+	err       error
+}
+
+func (w *recordingExportWriter) WriteUserBalance(userBalance domain.UserBalanceModel) error {
+	w.keys = append(w.keys, userBalance.UserID)
+	w.balances = append(w.balances, userBalance)
+	return w.err
+}
+
+func (w *recordingExportWriter) WriteTransactionHistory(history domain.TransactionHistoryModel) error {
+	w.keys = append(w.keys, history.TransactionID)
+	w.histories = append(w.histories, history)
+	return w.err
+}
+
+// testRepositoryConformance 全てのrepositoryの実装が満たすべき振る舞いを検証
+// SQLiteの共有キャッシュではトランザクション中に外から読み取るとロックされるため、読み取りはコミットまたはロールバックの後に行う
+func testRepositoryConformance(t *testing.T, newRepo repositoryFactory, isUniqueViolation func(error) bool) {
+	// run トランザクション内で処理を実行し、エラーがなければコミット、あればロールバック
+	run := func(t *testing.T, repo domain.UserBalanceRepository, fn func(ctx context.Context) error) error {
+		ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		ctx, err := repo.BeginTx(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := fn(ctx); err != nil {
+			repo.Rollback(ctx)
+			return err
+		}
+		return repo.Commit(ctx)
+	}
+	// balance コミット済みのユーザー残高を取得
+	balance := func(t *testing.T, repo domain.UserBalanceRepository, userID string) int {
+		userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), userID)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		return userBalance.Balance
+	}
+
+	t.Run("query user balance", func(t *testing.T) {
+		repo := newRepo(t)
+		userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if userBalance.Balance != 10000 || userBalance.MerchantID != "shop1" {
+			t.Errorf("expect balance [10000] and merchant_id [shop1] but got [%d %s]", userBalance.Balance, userBalance.MerchantID)
+		}
+		if _, err := repo.QueryUserBalanceByUserID(context.Background(), "unknown"); err != sql.ErrNoRows {
+			t.Errorf("expect error [%s] but got [%v]", sql.ErrNoRows, err)
+		}
+	})
+
+	t.Run("query user balances by user ids", func(t *testing.T) {
+		repo := newRepo(t)
+		userBalances, err := repo.QueryUserBalancesByUserIDs(context.Background(), []string{"test_user2", "unknown", "test_user1"})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		got := map[string]int{}
+		for _, userBalance := range userBalances {
+			got[userBalance.UserID] = userBalance.Balance
+		}
+		if len(got) != 2 || got["test_user1"] != 10000 || got["test_user2"] != 20000 {
+			t.Errorf("expect balances of test_user1 and test_user2 but got %v", got)
+		}
+		if userBalances, err := repo.QueryUserBalancesByUserIDs(context.Background(), []string{}); err != nil || len(userBalances) != 0 {
+			t.Errorf("expect no balances but got [%v %v]", userBalances, err)
+		}
+	})
+
+	t.Run("query existing transaction ids", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		transactionID := "0d0a5a4e-3333-4f5b-9c1d-000000000001"
+		if err := run(t, repo, func(ctx context.Context) error {
+			return repo.InsertTransactionHistory(ctx, transactionID, "test_user1", domain.TransactionType_AddUserBalance, 100, domain.AuditInfo{})
+		}); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		existing, err := repo.QueryExistingTransactionIDs(ctx, []string{"0d0a5a4e-3333-4f5b-9c1d-000000000002", transactionID, conformanceAddAllTransactionID, transactionID})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		got := map[string]int{}
+		for _, id := range existing {
+			got[id]++
+		}
+		if len(existing) != 2 || got[transactionID] != 1 || got[conformanceAddAllTransactionID] != 1 {
+			t.Errorf("expect transaction ids [%s %s] but got %v", transactionID, conformanceAddAllTransactionID, existing)
+		}
+		if existing, err := repo.QueryExistingTransactionIDs(ctx, []string{}); err != nil || len(existing) != 0 {
+			t.Errorf("expect no transaction ids but got [%v %v]", existing, err)
+		}
+	})
+
+	t.Run("export snapshot", func(t *testing.T) {
+		repo := newRepo(t)
+		transactionID := "0d0a5a4e-3333-4f5b-9c1d-000000000003"
+		err := run(t, repo, func(ctx context.Context) error {
+			if err := repo.AddUserBalanceByUserID(ctx, "test_user2", 500); err != nil {
+				return err
+			}
+			return repo.InsertTransactionHistory(ctx, transactionID, "test_user2", domain.TransactionType_AddUserBalance, 500,
+				domain.AuditInfo{Actor: "admin", Metadata: map[string]string{"ticket": "1"}})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		boundary, _ := time.Parse("2006-01-02", "2021-06-01")
+		cases := []struct {
+			Name     string
+			Query    domain.ExportQuery
+			Expected []string
+		}{
+			{"all", domain.ExportQuery{}, []string{"test_user1", "test_user2", "test_user3", "test_user4", "test_user5", conformanceAddAllTransactionID, transactionID}},
+			{"history only", domain.ExportQuery{Datasets: []domain.ExportDataset{domain.ExportDataset_History}}, []string{conformanceAddAllTransactionID, transactionID}},
+			{"from", domain.ExportQuery{From: boundary}, []string{"test_user2", transactionID}},
+			{"to", domain.ExportQuery{To: boundary}, []string{"test_user1", "test_user3", "test_user4", "test_user5", conformanceAddAllTransactionID}},
+			{"transaction types", domain.ExportQuery{Datasets: []domain.ExportDataset{domain.ExportDataset_History},
+				TransactionTypes: []domain.TransactionType{domain.TransactionType_AddAllUserBalance, domain.TransactionType_ReduceUserBalance}}, []string{conformanceAddAllTransactionID}},
+		}
+
+		for _, c := range cases {
+			t.Run(c.Name, func(t *testing.T) {
+				w := &recordingExportWriter{}
+				if err := repo.ExportSnapshot(context.Background(), c.Query, w); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+				if strings.Join(w.keys, ",") != strings.Join(c.Expected, ",") {
+					t.Errorf("expect rows %v but got %v", c.Expected, w.keys)
+				}
+			})
+		}
+
+		w := &recordingExportWriter{}
+		if err := repo.ExportSnapshot(context.Background(), domain.ExportQuery{}, w); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if w.balances[1].Balance != 20500 || w.histories[1].Actor != "admin" || w.histories[1].Metadata["ticket"] != "1" {
+			t.Errorf("expect exported rows to contain committed values but got %+v %+v", w.balances[1], w.histories[1])
+		}
+
+		writeErr := errors.New("write failed")
+		if err := repo.ExportSnapshot(context.Background(), domain.ExportQuery{}, &recordingExportWriter{err: writeErr}); err != writeErr {
+			t.Errorf("expect error [%s] but got [%v]", writeErr, err)
+		}
+	})
+
+	t.Run("query user balances", func(t *testing.T) {
+		repo := newRepo(t)
+		created, _ := time.Parse("2006-01-02", "2021-06-15")
+		err := run(t, repo, func(ctx context.Context) error {
+			if err := repo.InsertUser(ctx, domain.UserBalanceModel{UserID: "test_user6", Balance: 10000, Status: domain.UserStatus_Active, CreatedAt: created, UpdatedAt: created}); err != nil {
+				return err
+			}
+			return repo.UpdateUserStatusByUserID(ctx, "test_user3", domain.UserStatus_Frozen)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		intPtr := func(i int) *int { return &i }
+		boundary, _ := time.Parse("2006-01-02", "2021-06-01")
+		cases := []struct {
+			Name     string
+			Query    domain.ListAccountsQuery
+			Expected []string
+		}{
+			{"default", domain.ListAccountsQuery{}, []string{"test_user1", "test_user2", "test_user3", "test_user4", "test_user5", "test_user6"}},
+			{"balance range", domain.ListAccountsQuery{MinBalance: intPtr(20000), MaxBalance: intPtr(40000)}, []string{"test_user2", "test_user3", "test_user4"}},
+			{"status", domain.ListAccountsQuery{Statuses: []domain.UserStatus{domain.UserStatus_Frozen, domain.UserStatus_Closed}}, []string{"test_user3"}},
+			{"merchant", domain.ListAccountsQuery{MerchantID: "shop1"}, []string{"test_user1"}},
+			{"created after", domain.ListAccountsQuery{CreatedAfter: boundary}, []string{"test_user6"}},
+			{"created before", domain.ListAccountsQuery{CreatedBefore: boundary, SortBy: domain.AccountSortField_UserID, Descending: true}, []string{"test_user5", "test_user4", "test_user3", "test_user2", "test_user1"}},
+			{"sort by balance", domain.ListAccountsQuery{SortBy: domain.AccountSortField_Balance, PageSize: 3}, []string{"test_user1", "test_user6", "test_user2"}},
+			{"sort by balance descending", domain.ListAccountsQuery{SortBy: domain.AccountSortField_Balance, Descending: true}, []string{"test_user5", "test_user4", "test_user3", "test_user2", "test_user6", "test_user1"}},
+			{"sort by created_at descending", domain.ListAccountsQuery{SortBy: domain.AccountSortField_CreatedAt, Descending: true, PageSize: 1}, []string{"test_user6"}},
+			{"after user", domain.ListAccountsQuery{AfterUserID: "test_user4"}, []string{"test_user5", "test_user6"}},
+			{"after user sorted by balance", domain.ListAccountsQuery{SortBy: domain.AccountSortField_Balance, AfterUserID: "test_user6", PageSize: 2}, []string{"test_user2", "test_user3"}},
+			{"after user sorted by balance descending", domain.ListAccountsQuery{SortBy: domain.AccountSortField_Balance, Descending: true, AfterUserID: "test_user2"}, []string{"test_user6", "test_user1"}},
+			{"after unknown user", domain.ListAccountsQuery{AfterUserID: "unknown"}, []string{}},
+		}
+
+		for _, c := range cases {
+			t.Run(c.Name, func(t *testing.T) {
+				if c.Query.SortBy == "" {
+					c.Query.SortBy = domain.AccountSortField_UserID
+				}
+				if c.Query.PageSize == 0 {
+					c.Query.PageSize = 10
+				}
+				userBalances, err := repo.QueryUserBalances(context.Background(), c.Query)
+				if err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+				got := []string{}
+				for _, userBalance := range userBalances {
+					got = append(got, userBalance.UserID)
+				}
+				if strings.Join(got, ",") != strings.Join(c.Expected, ",") {
+					t.Errorf("expect users %v but got %v", c.Expected, got)
+				}
+			})
+		}
+	})
+
+	t.Run("add user balance", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.AddUserBalanceByUserID(ctx, "test_user1", 500)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if got := balance(t, repo, "test_user1"); got != 10500 {
+			t.Errorf("expect balance [10500] but got [%d]", got)
+		}
+		err = run(t, repo, func(ctx context.Context) error {
+			return repo.AddUserBalanceByUserID(ctx, "unknown", 500)
+		})
+		if err != sql.ErrNoRows {
+			t.Errorf("expect error [%s] but got [%v]", sql.ErrNoRows, err)
+		}
+	})
+
+	t.Run("reduce user balance", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.ReduceUserBalanceByUserID(ctx, "test_user1", 10000)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if got := balance(t, repo, "test_user1"); got != 0 {
+			t.Errorf("expect balance [0] but got [%d]", got)
+		}
+	})
+
+	t.Run("reduce user balance guards non-negative balance", func(t *testing.T) {
+		repo := newRepo(t)
+		for _, userID := range []string{"test_user2", "unknown"} {
+			err := run(t, repo, func(ctx context.Context) error {
+				return repo.ReduceUserBalanceByUserID(ctx, userID, 20001)
+			})
+			if err == nil || err.Error() != "update failed" {
+				t.Errorf("expect error [update failed] for [%s] but got [%v]", userID, err)
+			}
+		}
+		if got := balance(t, repo, "test_user2"); got != 20000 {
+			t.Errorf("expect balance to be unchanged [20000] but got [%d]", got)
+		}
+	})
+
+	t.Run("add all user balance", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.AddAllUserBalance(ctx, 1000)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		for i := 1; i <= 5; i++ {
+			if got := balance(t, repo, "test_user"+strconv.Itoa(i)); got != i*10000+1000 {
+				t.Errorf("expect balance [%d] but got [%d]", i*10000+1000, got)
+			}
+		}
+	})
+
+	t.Run("rollback discards changes", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		ctx, err := repo.BeginTx(ctx)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := repo.InsertTransactionHistory(ctx, "0d0a5a4e-2222-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{}); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 500); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := repo.AddAllUserBalance(ctx, 1000); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if err := repo.Rollback(ctx); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		if got := balance(t, repo, "test_user1"); got != 10000 {
+			t.Errorf("expect balance to be unchanged [10000] but got [%d]", got)
+		}
+		// ロールバックした取引IDは再び使用できる
+		err = run(t, repo, func(ctx context.Context) error {
+			return repo.InsertTransactionHistory(ctx, "0d0a5a4e-2222-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{})
+		})
+		if err != nil {
+			t.Errorf("expect no error but got [%s]", err)
+		}
+	})
+
+	t.Run("unique transaction_id", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.InsertTransactionHistory(ctx, conformanceAddAllTransactionID, "test_user1", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{})
+		})
+		if !isUniqueViolation(err) {
+			t.Errorf("expect unique violation but got [%v]", err)
+		}
+		err = run(t, repo, func(ctx context.Context) error {
+			if err := repo.InsertTransactionHistory(ctx, "0d0a5a4e-2222-4f5b-9c1d-000000000002", "test_user1", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{}); err != nil {
+				return err
+			}
+			return repo.InsertTransactionHistory(ctx, "0d0a5a4e-2222-4f5b-9c1d-000000000002", "test_user2", domain.TransactionType_AddUserBalance, 500, domain.AuditInfo{})
+		})
+		if !isUniqueViolation(err) {
+			t.Errorf("expect unique violation within a transaction but got [%v]", err)
+		}
+	})
+
+	t.Run("insert user", func(t *testing.T) {
+		repo := newRepo(t)
+		now := time.Now()
+		user := domain.UserBalanceModel{UserID: "new_user", Balance: 500, MerchantID: "shop1", Status: domain.UserStatus_Active, CreatedAt: now, UpdatedAt: now}
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.InsertUser(ctx, user)
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		inserted, err := repo.QueryUserBalanceByUserID(context.Background(), "new_user")
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if inserted.Balance != 500 || inserted.MerchantID != "shop1" || inserted.Status != domain.UserStatus_Active {
+			t.Errorf("unexpected user %+v", inserted)
+		}
+		err = run(t, repo, func(ctx context.Context) error {
+			return repo.InsertUser(ctx, user)
+		})
+		if !isUniqueViolation(err) {
+			t.Errorf("expect unique violation but got [%v]", err)
+		}
+	})
+
+	t.Run("user status", func(t *testing.T) {
+		repo := newRepo(t)
+		// setStatus 状態を更新して状態変更履歴を挿入
+		setStatus := func(userID string, status domain.UserStatus) error {
+			return run(t, repo, func(ctx context.Context) error {
+				if err := repo.UpdateUserStatusByUserID(ctx, userID, status); err != nil {
+					return err
+				}
+				return repo.InsertUserStatusHistory(ctx, userID, status, domain.AuditInfo{Actor: "operator1"})
+			})
+		}
+		// change 残高を加減算する
+		change := func(userID string, amount int) error {
+			return run(t, repo, func(ctx context.Context) error {
+				if amount < 0 {
+					return repo.ReduceUserBalanceByUserID(ctx, userID, -amount)
+				}
+				return repo.AddUserBalanceByUserID(ctx, userID, amount)
+			})
+		}
+
+		cases := []struct {
+			Name        string
+			Call        func() error
+			ExpectedErr string
+		}{
+			{"debit frozen user can't be reduced", func() error {
+				if err := setStatus("test_user1", domain.UserStatus_DebitFrozen); err != nil {
+					return err
+				}
+				return change("test_user1", -100)
+			}, "update failed"},
+			{"debit frozen user can be added", func() error { return change("test_user1", 100) }, ""},
+			{"frozen user can't be added", func() error {
+				if err := setStatus("test_user1", domain.UserStatus_Frozen); err != nil {
+					return err
+				}
+				return change("test_user1", 100)
+			}, "update failed"},
+			{"user with balance can't be closed", func() error { return setStatus("test_user1", domain.UserStatus_Closed) }, "update failed"},
+			{"user with zero balance can be closed", func() error {
+				if err := setStatus("test_user2", domain.UserStatus_Active); err != nil {
+					return err
+				}
+				if err := change("test_user2", -20000); err != nil {
+					return err
+				}
+				return setStatus("test_user2", domain.UserStatus_Closed)
+			}, ""},
+			{"closed user can't be reopened", func() error { return setStatus("test_user2", domain.UserStatus_Active) }, "update failed"},
+			{"closed user can't be added", func() error { return change("test_user2", 100) }, "update failed"},
+			{"unknown user", func() error { return setStatus("unknown", domain.UserStatus_Frozen) }, "update failed"},
+		}
+		for _, c := range cases {
+			err := c.Call()
+			if (c.ExpectedErr == "" && err != nil) || (c.ExpectedErr != "" && (err == nil || err.Error() != c.ExpectedErr)) {
+				t.Errorf("%s: expect error [%s] but got [%v]", c.Name, c.ExpectedErr, err)
+			}
+		}
+		if got := balance(t, repo, "test_user1"); got != 10100 {
+			t.Errorf("expect balance [10100] but got [%d]", got)
+		}
+
+		// 一斉加算は加算できる状態のユーザーのみ加算する
+		err := run(t, repo, func(ctx context.Context) error {
+			if err := repo.AddAllUserBalance(ctx, 1000); err != nil {
+				return err
+			}
+			return repo.InsertTransactionHistory(ctx, "4c6e2d3f-3333-4f5b-9c1d-000000000001", "", domain.TransactionType_AddAllUserBalance, 1000, domain.AuditInfo{})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		expected := map[string]int{"test_user1": 10100, "test_user2": 0, "test_user3": 31000}
+		for userID, expectedBalance := range expected {
+			if got := balance(t, repo, userID); got != expectedBalance {
+				t.Errorf("expect balance of [%s] [%d] but got [%d]", userID, expectedBalance, got)
+			}
+		}
+
+		// 加算されなかった一斉加算は取引履歴に含まない
+		for userID, expectedCount := range map[string]int{"test_user1": 0, "test_user3": 1} {
+			histories, err := repo.QueryTransactionHistoryByUserID(context.Background(), userID, conformanceAddAllTransactionID)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			count := 0
+			for _, history := range histories {
+				if history.TransactionType == domain.TransactionType_AddAllUserBalance {
+					count++
+				}
+			}
+			if count != expectedCount {
+				t.Errorf("expect [%d] add all histories of [%s] but got [%d]", expectedCount, userID, count)
+			}
+		}
+	})
+
+	t.Run("transaction history excludes add all before user creation", func(t *testing.T) {
+		repo := newRepo(t)
+		now := time.Now()
+		err := run(t, repo, func(ctx context.Context) error {
+			return repo.InsertUser(ctx, domain.UserBalanceModel{UserID: "new_user", Status: domain.UserStatus_Active, CreatedAt: now, UpdatedAt: now})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		histories, err := repo.QueryTransactionHistoryByUserID(context.Background(), "new_user", "")
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(histories) != 0 {
+			t.Errorf("expect no history but got %v", histories)
+		}
+	})
+
+	t.Run("mutation without transaction", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		errs := []error{
+			repo.AddUserBalanceByUserID(ctx, "test_user1", 500),
+			repo.ReduceUserBalanceByUserID(ctx, "test_user1", 500),
+			repo.AddAllUserBalance(ctx, 500),
+			repo.InsertUser(ctx, domain.UserBalanceModel{UserID: "new_user", Status: domain.UserStatus_Active}),
+			repo.UpdateUserStatusByUserID(ctx, "test_user1", domain.UserStatus_Frozen),
+			repo.InsertUserStatusHistory(ctx, "test_user1", domain.UserStatus_Frozen, domain.AuditInfo{}),
+		}
+		for _, err := range errs {
+			if err == nil || err.Error() != "current thread is not associated with a transaction" {
+				t.Errorf("expect error [current thread is not associated with a transaction] but got [%v]", err)
+			}
+		}
+	})
+
+	t.Run("transaction history records balance after", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			if err := repo.ReduceUserBalanceByUserID(ctx, "test_user1", 3000); err != nil {
+				return err
+			}
+			if err := repo.InsertTransactionHistory(ctx, "6c1f2e3d-4444-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_ReduceUserBalance, 3000, domain.AuditInfo{}); err != nil {
+				return err
+			}
+			if err := repo.AddAllUserBalance(ctx, 500); err != nil {
+				return err
+			}
+			return repo.InsertTransactionHistory(ctx, "6c1f2e3d-4444-4f5b-9c1d-000000000002", "", domain.TransactionType_AddAllUserBalance, 500, domain.AuditInfo{})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		histories, err := repo.QueryTransactionHistoryByUserID(context.Background(), "test_user1", conformanceAddAllTransactionID)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(histories) != 2 {
+			t.Fatalf("expect [2] histories but got %v", histories)
+		}
+		if histories[0].BalanceAfter == nil || *histories[0].BalanceAfter != 7000 {
+			t.Errorf("expect balance_after [7000] but got %v", histories[0].BalanceAfter)
+		}
+		if histories[1].BalanceAfter != nil {
+			t.Errorf("expect no balance_after for add all but got [%d]", *histories[1].BalanceAfter)
+		}
+
+		w := &recordingExportWriter{}
+		if err := repo.ExportSnapshot(context.Background(), domain.ExportQuery{Datasets: []domain.ExportDataset{domain.ExportDataset_History}}, w); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(w.histories) != 3 || w.histories[1].BalanceAfter == nil || *w.histories[1].BalanceAfter != 7000 {
+			t.Errorf("expect exported balance_after [7000] but got %+v", w.histories)
+		}
+	})
+
+	t.Run("transaction history in period", func(t *testing.T) {
+		repo := newRepo(t)
+		err := run(t, repo, func(ctx context.Context) error {
+			if err := repo.ReduceUserBalanceByUserID(ctx, "test_user1", 3000); err != nil {
+				return err
+			}
+			if err := repo.InsertTransactionHistory(ctx, "8e3f4a5b-6666-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_ReduceUserBalance, 3000, domain.AuditInfo{}); err != nil {
+				return err
+			}
+			if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 1000); err != nil {
+				return err
+			}
+			if err := repo.InsertTransactionHistory(ctx, "8e3f4a5b-6666-4f5b-9c1d-000000000002", "test_user1", domain.TransactionType_AddUserBalance, 1000, domain.AuditInfo{}); err != nil {
+				return err
+			}
+			if err := repo.AddAllUserBalance(ctx, 500); err != nil {
+				return err
+			}
+			return repo.InsertTransactionHistory(ctx, "8e3f4a5b-6666-4f5b-9c1d-000000000003", "", domain.TransactionType_AddAllUserBalance, 500, domain.AuditInfo{})
+		})
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+
+		at := func(s string) time.Time {
+			v, _ := time.Parse(time.RFC3339, s)
+			return v
+		}
+		later := time.Now().Add(time.Hour)
+		cases := []struct {
+			Name            string
+			From            time.Time
+			To              time.Time
+			ExpectedOpening int
+			ExpectedIDs     []string
+		}{
+			// 初期データの残高は取引履歴がないため、現在の残高から遡って算出する
+			{"before history", at("2000-01-01T00:00:00Z"), at("2021-05-30T00:00:00Z"), 0, []string{conformanceAddAllTransactionID}},
+			{"without balance after before period", at("2021-05-30T00:00:00Z"), later, 10000,
+				[]string{"8e3f4a5b-6666-4f5b-9c1d-000000000001", "8e3f4a5b-6666-4f5b-9c1d-000000000002", "8e3f4a5b-6666-4f5b-9c1d-000000000003"}},
+			// 最後の取引後の残高8000に、その後の一斉加算500を加える
+			{"after all transactions", later, later.Add(time.Hour), 8500, []string{}},
+		}
+		for _, c := range cases {
+			t.Run(c.Name, func(t *testing.T) {
+				opening, histories, err := repo.QueryTransactionHistoryInPeriod(context.Background(), "test_user1", c.From, c.To)
+				if err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+				if opening != c.ExpectedOpening {
+					t.Errorf("expect opening balance [%d] but got [%d]", c.ExpectedOpening, opening)
+				}
+				if histories == nil || len(histories) != len(c.ExpectedIDs) {
+					t.Fatalf("expect [%d] histories but got %v", len(c.ExpectedIDs), histories)
+				}
+				for i, history := range histories {
+					if history.TransactionID != c.ExpectedIDs[i] {
+						t.Errorf("expect transaction_id [%s] but got [%s]", c.ExpectedIDs[i], history.TransactionID)
+					}
+				}
+			})
+		}
+
+		if _, _, err := repo.QueryTransactionHistoryInPeriod(context.Background(), "unknown", at("2021-05-30T00:00:00Z"), later); err != sql.ErrNoRows {
+			t.Errorf("expect error [%s] but got [%v]", sql.ErrNoRows, err)
+		}
+	})
+
+	t.Run("daily transaction aggregates", func(t *testing.T) {
+		repo := newRepo(t)
+		insert := func(t *testing.T, transactionID string, userID string, transactionType domain.TransactionType, amount int) {
+			err := run(t, repo, func(ctx context.Context) error {
+				return repo.InsertTransactionHistory(ctx, transactionID, userID, transactionType, amount, domain.AuditInfo{})
+			})
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+		}
+		// aggregates 集計を更新し、当日の集計を"取引種類:件数:金額"の形式で取得
+		today := domain.ReportGranularity_Day.Truncate(time.Now())
+		aggregates := func(t *testing.T) string {
+			refreshedAt, err := repo.RefreshDailyTransactionAggregates(context.Background())
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if refreshedAt.IsZero() {
+				t.Errorf("expect refreshed time but got zero")
+			}
+			rows, aggregatedUntil, err := repo.QueryDailyTransactionAggregates(context.Background(), today, today.AddDate(0, 0, 1))
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if aggregatedUntil.IsZero() {
+				t.Errorf("expect aggregated time but got zero")
+			}
+			got := make([]string, 0, len(rows))
+			for _, row := range rows {
+				if !row.Day.Equal(today) {
+					t.Errorf("expect day [%s] but got [%s]", today, row.Day)
+				}
+				got = append(got, strconv.Itoa(int(row.TransactionType))+":"+strconv.FormatInt(row.Count, 10)+":"+strconv.FormatInt(row.Amount, 10))
+			}
+			return strings.Join(got, ",")
+		}
+
+		insert(t, "7d2e3f4a-5555-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_AddUserBalance, 500)
+		insert(t, "7d2e3f4a-5555-4f5b-9c1d-000000000002", "test_user2", domain.TransactionType_ReduceUserBalance, 300)
+		if got := aggregates(t); got != "0:1:500,1:1:300" {
+			t.Errorf("expect aggregates [0:1:500,1:1:300] but got [%s]", got)
+		}
+		if got := aggregates(t); got != "0:1:500,1:1:300" {
+			t.Errorf("expect refreshing twice not to change aggregates but got [%s]", got)
+		}
+
+		insert(t, "7d2e3f4a-5555-4f5b-9c1d-000000000003", "test_user3", domain.TransactionType_AddUserBalance, 200)
+		insert(t, "7d2e3f4a-5555-4f5b-9c1d-000000000004", "", domain.TransactionType_AddAllUserBalance, 100)
+		// 一斉加算は加算できる5ユーザー分の金額を集計する
+		if got := aggregates(t); got != "0:2:700,1:1:300,2:1:500" {
+			t.Errorf("expect aggregates [0:2:700,1:1:300,2:1:500] but got [%s]", got)
+		}
+
+		totals, err := repo.QueryBalanceStatusTotals(context.Background())
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		if len(totals) != 1 || totals[0] != (domain.BalanceStatusTotal{Status: domain.UserStatus_Active, Users: 5, Balance: 150000}) {
+			t.Errorf("expect balance totals [{active 5 150000}] but got %v", totals)
+		}
+	})
+
+	t.Run("daily transaction aggregates reconcile with balance totals", func(t *testing.T) {
+		repo := newRepo(t)
+		// liabilities 全ユーザーの残高の合計
+		liabilities := func(t *testing.T) int64 {
+			totals, err := repo.QueryBalanceStatusTotals(context.Background())
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			var total int64
+			for _, status := range totals {
+				total += status.Balance
+			}
+			return total
+		}
+		before := liabilities(t)
+
+		audit := domain.AuditInfo{}
+		operations := []struct {
+			Name string
+			Fn   func(ctx context.Context) error
+		}{
+			{"add", func(ctx context.Context) error {
+				if err := repo.AddUserBalanceByUserID(ctx, "test_user1", 500); err != nil {
+					return err
+				}
+				return repo.InsertTransactionHistory(ctx, "9c4b2a1d-6666-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_AddUserBalance, 500, audit)
+			}},
+			{"reduce", func(ctx context.Context) error {
+				if err := repo.ReduceUserBalanceByUserID(ctx, "test_user2", 300); err != nil {
+					return err
+				}
+				return repo.InsertTransactionHistory(ctx, "9c4b2a1d-6666-4f5b-9c1d-000000000002", "test_user2", domain.TransactionType_ReduceUserBalance, 300, audit)
+			}},
+			{"freeze", func(ctx context.Context) error {
+				if err := repo.UpdateUserStatusByUserID(ctx, "test_user3", domain.UserStatus_Frozen); err != nil {
+					return err
+				}
+				return repo.InsertUserStatusHistory(ctx, "test_user3", domain.UserStatus_Frozen, audit)
+			}},
+			{"add all", func(ctx context.Context) error {
+				if err := repo.AddAllUserBalance(ctx, 100); err != nil {
+					return err
+				}
+				return repo.InsertTransactionHistory(ctx, "9c4b2a1d-6666-4f5b-9c1d-000000000003", "", domain.TransactionType_AddAllUserBalance, 100, audit)
+			}},
+		}
+		for _, operation := range operations {
+			// 状態変更と一斉加算の作成日時の順序を確定させる
+			time.Sleep(10 * time.Millisecond)
+			if err := run(t, repo, operation.Fn); err != nil {
+				t.Fatalf("expect no error on %s but got [%s]", operation.Name, err)
+			}
+		}
+
+		if _, err := repo.RefreshDailyTransactionAggregates(context.Background()); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		today := domain.ReportGranularity_Day.Truncate(time.Now())
+		rows, _, err := repo.QueryDailyTransactionAggregates(context.Background(), today, today.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		var volume int64
+		for _, row := range rows {
+			if row.TransactionType == domain.TransactionType_ReduceUserBalance {
+				volume -= row.Amount
+			} else {
+				volume += row.Amount
+			}
+		}
+		// 凍結したユーザーを除く4ユーザーに一斉加算する
+		if volume != 500-300+4*100 {
+			t.Errorf("expect net volume [%d] but got [%d]", 500-300+4*100, volume)
+		}
+		if after := liabilities(t); after-before != volume {
+			t.Errorf("expect change of liabilities [%d] to equal net volume [%d]", after-before, volume)
+		}
+	})
+
+	t.Run("transaction history", func(t *testing.T) {
+		repo := newRepo(t)
+		audit := domain.AuditInfo{Actor: "operator1", ReasonCode: "campaign", Source: domain.RequestSource_RESTful, Metadata: map[string]string{"campaign": "summer"}}
+		inserts := []struct {
+			TransactionID   string
+			UserID          string
+			TransactionType domain.TransactionType
+		}{
+			{"3a5d1c2e-1111-4f5b-9c1d-000000000001", "test_user1", domain.TransactionType_AddUserBalance},
+			{"3a5d1c2e-1111-4f5b-9c1d-000000000002", "test_user2", domain.TransactionType_ReduceUserBalance},
+			{"3a5d1c2e-1111-4f5b-9c1d-000000000003", "", domain.TransactionType_AddAllUserBalance},
+		}
+		for _, insert := range inserts {
+			err := run(t, repo, func(ctx context.Context) error {
+				return repo.InsertTransactionHistory(ctx, insert.TransactionID, insert.UserID, insert.TransactionType, 1000, audit)
+			})
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+		}
+
+		cases := []struct {
+			Name               string
+			UserID             string
+			AfterTransactionID string
+			ExpectedIDs        []string
+		}{
+			{"after add all", "test_user1", conformanceAddAllTransactionID, []string{"3a5d1c2e-1111-4f5b-9c1d-000000000001", "3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+			{"after own transaction", "test_user1", "3a5d1c2e-1111-4f5b-9c1d-000000000001", []string{"3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+			{"other user", "test_user2", conformanceAddAllTransactionID, []string{"3a5d1c2e-1111-4f5b-9c1d-000000000002", "3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+			{"unknown transaction", "test_user1", "unknown", []string{}},
+			{"from the beginning", "test_user2", "", []string{conformanceAddAllTransactionID, "3a5d1c2e-1111-4f5b-9c1d-000000000002", "3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+		}
+		for _, c := range cases {
+			t.Run(c.Name, func(t *testing.T) {
+				histories, err := repo.QueryTransactionHistoryByUserID(context.Background(), c.UserID, c.AfterTransactionID)
+				if err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+				if histories == nil || len(histories) != len(c.ExpectedIDs) {
+					t.Fatalf("expect [%d] histories but got %v", len(c.ExpectedIDs), histories)
+				}
+				for i, history := range histories {
+					if history.TransactionID != c.ExpectedIDs[i] {
+						t.Errorf("expect transaction_id [%s] but got [%s]", c.ExpectedIDs[i], history.TransactionID)
+					}
+					if history.TransactionID == conformanceAddAllTransactionID {
+						continue
+					}
+					if history.Actor != "operator1" || history.Source != domain.RequestSource_RESTful || history.Metadata["campaign"] != "summer" {
+						t.Errorf("unexpected audit info [%+v]", history.AuditInfo)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestMemoryRepositoryConcurrentTransactions(t *testing.T) {
+	repo := newMemoryConformanceRepository(t)
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			ctx, err := repo.BeginTx(ctx)
+			if err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+				return
+			}
+			// 偶数は加算してコミット、奇数は減算してロールバック
+			if i%2 == 0 {
+				repo.InsertTransactionHistory(ctx, "concurrent-"+strconv.Itoa(i), "test_user1", domain.TransactionType_AddUserBalance, 100, domain.AuditInfo{})
+				repo.AddUserBalanceByUserID(ctx, "test_user1", 100)
+				repo.Commit(ctx)
+			} else {
+				repo.ReduceUserBalanceByUserID(ctx, "test_user1", 100)
+				repo.Rollback(ctx)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	userBalance, err := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if userBalance.Balance != 10000+workers/2*100 {
+		t.Errorf("expect balance [%d] but got [%d]", 10000+workers/2*100, userBalance.Balance)
+	}
+	histories, _ := repo.QueryTransactionHistoryByUserID(context.Background(), "test_user1", conformanceAddAllTransactionID)
+	if len(histories) != workers/2 {
+		t.Errorf("expect [%d] histories but got [%d]", workers/2, len(histories))
+	}
+
+	// トランザクションの完了を待つ間にコンテキストが終了した場合はエラー
+	txCtx, _ := repo.BeginTx(context.Background())
+	defer repo.Rollback(txCtx)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := repo.BeginTx(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect error [%s] but got [%v]", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,292 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingServiceName トレースに記録するサービス名
+const tracingServiceName = "user-balance-management"
+
+// トレースのエクスポーター
+const (
+	TraceExporter_None   = "none"
+	TraceExporter_Stdout = "stdout"
+	TraceExporter_File   = "file"
+	TraceExporter_OTLP   = "otlp"
+)
+
+// TracerProvider OpenTelemetryのTracerProviderとエクスポーターの出力先を格納
+type TracerProvider struct {
+	*sdktrace.TracerProvider
+	output io.Closer
+}
+
+// NewTracerProvider 指定したエクスポーターで新しいTracerProviderを作成し、グローバルに登録
+// fileエクスポーターはtarget(ファイルパス)に、otlpエクスポーターはtarget(host:port)にトレースを送信する
+func NewTracerProvider(exporter string, target string, sampleRatio float64) (*TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	var output io.Closer
+	var err error
+	switch exporter {
+	case TraceExporter_Stdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporter_File:
+		f, openErr := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr != nil {
+			return nil, openErr
+		}
+		output = f
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case TraceExporter_OTLP:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		spanExporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(target), otlptracegrpc.WithInsecure())
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(tracingServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	SetTracePropagator()
+
+	return &TracerProvider{TracerProvider: tp, output: output}, nil
+}
+
+// SetTracePropagator W3C Trace ContextとBaggageのプロパゲーターをグローバルに登録
+func SetTracePropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Shutdown 未送信のスパンを送信してからエクスポーターを終了
+func (p *TracerProvider) Shutdown(ctx context.Context) error {
+	err := p.TracerProvider.Shutdown(ctx)
+	if p.output != nil {
+		if closeErr := p.output.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// tracedUserBalanceRepository repositoryの各クエリをスパンで計測するデコレータ
+type tracedUserBalanceRepository struct {
+	next   domain.UserBalanceRepository
+	tracer trace.Tracer
+}
+
+// NewTracedUserBalanceRepository repositoryをトレース用のデコレータで包む
+func NewTracedUserBalanceRepository(next domain.UserBalanceRepository) domain.UserBalanceRepository {
+	return &tracedUserBalanceRepository{
+		next:   next,
+		tracer: otel.Tracer("github.com/kaitolucifer/user-balance-management/infrastructure"),
+	}
+}
+
+// startSpan クエリのスパンを開始
+func (repo *tracedUserBalanceRepository) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, semconv.DBSystemPostgreSQL, semconv.DBOperationKey.String(name))
+	return repo.tracer.Start(ctx, "UserBalanceRepository."+name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan エラーを記録してスパンを終了
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// GetCtxWithTimeout タイムアウト付きのコンテキストを作成
+func (repo *tracedUserBalanceRepository) GetCtxWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return repo.next.GetCtxWithTimeout(ctx, timeout)
+}
+
+// BeginTx トランザクションを開始(接続プールからの接続の取得待ちを含む)
+// 返すコンテキストはBeginTxのスパンではなく呼び出し元のスパンを親とする
+func (repo *tracedUserBalanceRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	_, span := repo.startSpan(ctx, "BeginTx")
+	ctx, err := repo.next.BeginTx(ctx)
+	endSpan(span, err)
+	return ctx, err
+}
+
+// Commit トランザクションをコミット
+func (repo *tracedUserBalanceRepository) Commit(ctx context.Context) error {
+	ctx, span := repo.startSpan(ctx, "Commit")
+	err := repo.next.Commit(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// Rollback トランザクションをロールバック
+func (repo *tracedUserBalanceRepository) Rollback(ctx context.Context) error {
+	ctx, span := repo.startSpan(ctx, "Rollback")
+	err := repo.next.Rollback(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// InsertTransactionHistory 取引履歴を挿入
+func (repo *tracedUserBalanceRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int, audit domain.AuditInfo) error {
+	ctx, span := repo.startSpan(ctx, "InsertTransactionHistory", attribute.String("transaction_id", transactionID))
+	err := repo.next.InsertTransactionHistory(ctx, transactionID, userID, transactionType, amount, audit)
+	endSpan(span, err)
+	return err
+}
+
+// QueryUserBalanceByUserID ユーザーIDでユーザー残高を取得
+func (repo *tracedUserBalanceRepository) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	ctx, span := repo.startSpan(ctx, "QueryUserBalanceByUserID", attribute.String("user_id", userID))
+	userBalance, err := repo.next.QueryUserBalanceByUserID(ctx, userID)
+	endSpan(span, err)
+	return userBalance, err
+}
+
+// AddUserBalanceByUserID ユーザーIDでユーザー残高を加算
+func (repo *tracedUserBalanceRepository) AddUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	ctx, span := repo.startSpan(ctx, "AddUserBalanceByUserID", attribute.String("user_id", userID))
+	err := repo.next.AddUserBalanceByUserID(ctx, userID, amount)
+	endSpan(span, err)
+	return err
+}
+
+// ReduceUserBalanceByUserID ユーザーIDでユーザー残高を減算
+func (repo *tracedUserBalanceRepository) ReduceUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
+	ctx, span := repo.startSpan(ctx, "ReduceUserBalanceByUserID", attribute.String("user_id", userID))
+	err := repo.next.ReduceUserBalanceByUserID(ctx, userID, amount)
+	endSpan(span, err)
+	return err
+}
+
+// AddAllUserBalance 全ユーザーの残高を加算
+func (repo *tracedUserBalanceRepository) AddAllUserBalance(ctx context.Context, amount int) error {
+	ctx, span := repo.startSpan(ctx, "AddAllUserBalance")
+	err := repo.next.AddAllUserBalance(ctx, amount)
+	endSpan(span, err)
+	return err
+}
+
+// QueryTransactionHistoryByUserID 指定した取引以降のユーザーに関わる取引履歴を取得
+func (repo *tracedUserBalanceRepository) QueryTransactionHistoryByUserID(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	ctx, span := repo.startSpan(ctx, "QueryTransactionHistoryByUserID", attribute.String("user_id", userID))
+	histories, err := repo.next.QueryTransactionHistoryByUserID(ctx, userID, afterTransactionID)
+	endSpan(span, err)
+	return histories, err
+}
+
+// QueryTransactionHistoryInPeriod 期間の開始時点のユーザー残高と期間内のユーザーに関わる取引履歴を取得
+func (repo *tracedUserBalanceRepository) QueryTransactionHistoryInPeriod(ctx context.Context, userID string, from time.Time, to time.Time) (int, []domain.TransactionHistoryModel, error) {
+	ctx, span := repo.startSpan(ctx, "QueryTransactionHistoryInPeriod", attribute.String("user_id", userID))
+	opening, histories, err := repo.next.QueryTransactionHistoryInPeriod(ctx, userID, from, to)
+	endSpan(span, err)
+	return opening, histories, err
+}
+
+// InsertUser ユーザーを挿入
+func (repo *tracedUserBalanceRepository) InsertUser(ctx context.Context, user domain.UserBalanceModel) error {
+	ctx, span := repo.startSpan(ctx, "InsertUser", attribute.String("user_id", user.UserID))
+	err := repo.next.InsertUser(ctx, user)
+	endSpan(span, err)
+	return err
+}
+
+// UpdateUserStatusByUserID ユーザーIDでユーザーの状態を更新
+func (repo *tracedUserBalanceRepository) UpdateUserStatusByUserID(ctx context.Context, userID string, status domain.UserStatus) error {
+	ctx, span := repo.startSpan(ctx, "UpdateUserStatusByUserID", attribute.String("user_id", userID))
+	err := repo.next.UpdateUserStatusByUserID(ctx, userID, status)
+	endSpan(span, err)
+	return err
+}
+
+// InsertUserStatusHistory ユーザーの状態変更履歴を挿入
+func (repo *tracedUserBalanceRepository) InsertUserStatusHistory(ctx context.Context, userID string, status domain.UserStatus, audit domain.AuditInfo) error {
+	ctx, span := repo.startSpan(ctx, "InsertUserStatusHistory", attribute.String("user_id", userID))
+	err := repo.next.InsertUserStatusHistory(ctx, userID, status, audit)
+	endSpan(span, err)
+	return err
+}
+
+// QueryUserBalancesByUserIDs 複数のユーザーIDでユーザー残高を取得
+func (repo *tracedUserBalanceRepository) QueryUserBalancesByUserIDs(ctx context.Context, userIDs []string) ([]domain.UserBalanceModel, error) {
+	ctx, span := repo.startSpan(ctx, "QueryUserBalancesByUserIDs", attribute.Int("user_count", len(userIDs)))
+	userBalances, err := repo.next.QueryUserBalancesByUserIDs(ctx, userIDs)
+	endSpan(span, err)
+	return userBalances, err
+}
+
+// QueryUserBalances 条件で絞り込んだユーザー残高を並び替えて取得
+func (repo *tracedUserBalanceRepository) QueryUserBalances(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, error) {
+	ctx, span := repo.startSpan(ctx, "QueryUserBalances", attribute.String("sort_by", string(q.SortBy)), attribute.Int("page_size", q.PageSize))
+	userBalances, err := repo.next.QueryUserBalances(ctx, q)
+	endSpan(span, err)
+	return userBalances, err
+}
+
+// QueryExistingTransactionIDs 取引履歴に存在する取引IDを取得
+func (repo *tracedUserBalanceRepository) QueryExistingTransactionIDs(ctx context.Context, transactionIDs []string) ([]string, error) {
+	ctx, span := repo.startSpan(ctx, "QueryExistingTransactionIDs", attribute.Int("transaction_count", len(transactionIDs)))
+	existing, err := repo.next.QueryExistingTransactionIDs(ctx, transactionIDs)
+	endSpan(span, err)
+	return existing, err
+}
+
+// ExportSnapshot ユーザー残高と取引履歴を同じスナップショットから読み取る
+func (repo *tracedUserBalanceRepository) ExportSnapshot(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) error {
+	datasets := make([]string, 0, len(q.Datasets))
+	for _, dataset := range q.Datasets {
+		datasets = append(datasets, string(dataset))
+	}
+	ctx, span := repo.startSpan(ctx, "ExportSnapshot", attribute.StringSlice("datasets", datasets))
+	err := repo.next.ExportSnapshot(ctx, q, w)
+	endSpan(span, err)
+	return err
+}
+
+// RefreshDailyTransactionAggregates 取引履歴の日毎の集計を更新
+func (repo *tracedUserBalanceRepository) RefreshDailyTransactionAggregates(ctx context.Context) (time.Time, error) {
+	ctx, span := repo.startSpan(ctx, "RefreshDailyTransactionAggregates")
+	refreshedAt, err := repo.next.RefreshDailyTransactionAggregates(ctx)
+	endSpan(span, err)
+	return refreshedAt, err
+}
+
+// QueryDailyTransactionAggregates 期間内の日毎の集計を取得
+func (repo *tracedUserBalanceRepository) QueryDailyTransactionAggregates(ctx context.Context, from time.Time, to time.Time) ([]domain.DailyTransactionAggregate, time.Time, error) {
+	ctx, span := repo.startSpan(ctx, "QueryDailyTransactionAggregates", attribute.String("from", from.Format(time.RFC3339)), attribute.String("to", to.Format(time.RFC3339)))
+	aggregates, refreshedAt, err := repo.next.QueryDailyTransactionAggregates(ctx, from, to)
+	endSpan(span, err)
+	return aggregates, refreshedAt, err
+}
+
+// QueryBalanceStatusTotals ユーザーの状態毎の残高の合計を取得
+func (repo *tracedUserBalanceRepository) QueryBalanceStatusTotals(ctx context.Context) ([]domain.BalanceStatusTotal, error) {
+	ctx, span := repo.startSpan(ctx, "QueryBalanceStatusTotals")
+	totals, err := repo.next.QueryBalanceStatusTotals(ctx)
+	endSpan(span, err)
+	return totals, err
+}
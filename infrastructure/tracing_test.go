@@ -0,0 +1,46 @@
+package infrastructure
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracedUserBalanceRepository(t *testing.T) {
+	db := NewMockDatabase("tracing")
+	defer db.Close()
+
+	file := filepath.Join(t.TempDir(), "traces.json")
+	tp, err := NewTracerProvider(TraceExporter_File, file, 1)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	traced := NewTracedUserBalanceRepository(NewUserBalanceRepository(*db))
+	ctx, cancel := traced.GetCtxWithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ctx, _ = traced.BeginTx(ctx)
+	traced.QueryUserBalanceByUserID(ctx, "test_user1")
+	traced.Commit(ctx)
+
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	out, _ := ioutil.ReadFile(file)
+	for _, name := range []string{
+		"UserBalanceRepository.BeginTx",
+		"UserBalanceRepository.QueryUserBalanceByUserID",
+		"UserBalanceRepository.Commit",
+	} {
+		if !strings.Contains(string(out), `"Name":"`+name+`"`) {
+			t.Errorf("expect span [%s] to be exported", name)
+		}
+	}
+
+	if _, err := NewTracerProvider("zipkin", "", 1); err == nil {
+		t.Errorf("expect error for unsupported exporter but got no one")
+	}
+}
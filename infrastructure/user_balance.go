@@ -3,16 +3,33 @@ package infrastructure
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kaitolucifer/user-balance-management/domain"
 )
 
 // userBalanceRepository DB接続を格納
+// トランザクションはBeginTxが返すコンテキストに格納するため、1つのrepositoryを複数のgoroutineで共有できる
 type userBalanceRepository struct {
 	Conn DB
-	Tx   TX
+}
+
+// txKey コンテキストにトランザクションを格納するキー
+type txKey struct{}
+
+// txFromContext BeginTxで開始したトランザクションをコンテキストから取得
+func txFromContext(ctx context.Context) (TX, bool) {
+	tx, ok := ctx.Value(txKey{}).(TX)
+	return tx, ok
+}
+
+// logQuery クエリの処理時間をデバッグログに出力
+func logQuery(ctx context.Context, name string, start time.Time) {
+	domain.LoggerFromContext(ctx).Debug("query executed", "query", name, "elapsed", time.Since(start).String())
 }
 
 // NewUserBalanceRepository 新しいrepositoryを作成
@@ -21,54 +38,96 @@ func NewUserBalanceRepository(db DB) domain.UserBalanceRepository {
 }
 
 // GetCtxWithTimeout タイムアウト付きのコンテキストを取得
-func (repo *userBalanceRepository) GetCtxWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), timeout)
+func (repo *userBalanceRepository) GetCtxWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeout)
 }
 
-// BeginTx トランザクションを開始
-func (repo *userBalanceRepository) BeginTx(ctx context.Context) error {
+// BeginTx トランザクションを開始し、トランザクションを格納したコンテキストを返す
+func (repo *userBalanceRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	defer logQuery(ctx, "BeginTx", time.Now())
+
 	tx, err := repo.Conn.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return ctx, err
 	}
-	repo.Tx = TX{tx}
-	return nil
+	return context.WithValue(ctx, txKey{}, TX{tx}), nil
 }
 
-// Commit トランザクションをコミット
-func (repo *userBalanceRepository) Commit() error {
-	return repo.Tx.Commit()
+// Commit コンテキストに格納したトランザクションをコミット
+func (repo *userBalanceRepository) Commit(ctx context.Context) error {
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return sql.ErrTxDone
+	}
+	return tx.Commit()
 }
 
-// Rollback トランザクションをロールバック
-func (repo *userBalanceRepository) Rollback() error {
-	return repo.Tx.Rollback()
+// Rollback コンテキストに格納したトランザクションをロールバック
+func (repo *userBalanceRepository) Rollback(ctx context.Context) error {
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return sql.ErrTxDone
+	}
+	return tx.Rollback()
 }
 
-// InsertTransactionHistory 取引履歴を挿入
-func (repo *userBalanceRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int) error {
-	var query string
-	if userID == "" {
-		query = `INSERT INTO transaction_history (transaction_id, transaction_type, amount, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5)`
-		_, err := repo.Tx.ExecContext(ctx, query, transactionID, transactionType, amount, time.Now(), time.Now())
-		return err
-	} else {
-		query = `INSERT INTO transaction_history (transaction_id, user_id, transaction_type, amount, created_at, updated_at)
-					VALUES ($1, $2, $3, $4, $5, $6)`
-		_, err := repo.Tx.ExecContext(ctx, query, transactionID, userID, transactionType, amount, time.Now(), time.Now())
-		return err
+// reader 読み取りのクエリを実行する接続プール
+// 残高を変更する操作の中(domain.ContextWithPrimaryRead)はプライマリ、それ以外はリードレプリカ(使用できない場合はプライマリ)で読み取る
+func (repo *userBalanceRepository) reader(ctx context.Context) *sql.DB {
+	if domain.PrimaryReadFromContext(ctx) {
+		return repo.Conn.DB
+	}
+	return repo.Conn.Reader()
+}
+
+// InsertTransactionHistory 取引履歴を監査情報と共に挿入
+// 一斉加算の場合はuserIDを空文字にする
+// 取引後の残高(balance_after)は同じトランザクション内で更新したユーザー残高から記録する
+// 一斉加算と、行をロックせずにスロットを更新するホットアカウントの場合はNULL
+func (repo *userBalanceRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int, audit domain.AuditInfo) error {
+	defer logQuery(ctx, "InsertTransactionHistory", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
 	}
+	var metadata sql.NullString
+	if len(audit.Metadata) > 0 {
+		b, err := json.Marshal(audit.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(b), Valid: true}
+	}
+
+	query := `INSERT INTO transaction_history (transaction_id, user_id, transaction_type, amount, balance_after,
+			actor, reason_code, note, source, client_addr, metadata, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, (SELECT balance FROM user_balance WHERE user_id = $2 AND balance_slots = 0),
+			$5, $6, $7, $8, $9, $10, $11, $12)`
+	_, err := tx.ExecContext(ctx, query, transactionID, nullString(userID), transactionType, amount,
+		nullString(audit.Actor), nullString(audit.ReasonCode), nullString(audit.Note), nullString(string(audit.Source)),
+		nullString(audit.ClientAddr), metadata, time.Now(), time.Now())
+	return err
+}
+
+// nullString 空文字をNULLとして扱う
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
 
 // QueryUserBalanceByUserID ユーザーIDでユーザー残高情報を取得
 func (repo *userBalanceRepository) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	defer logQuery(ctx, "QueryUserBalanceByUserID", time.Now())
+
 	var userBalance domain.UserBalanceModel
 
-	row := repo.Conn.DB.QueryRowContext(ctx, "SELECT * FROM user_balance WHERE user_id = $1", userID)
+	query := `SELECT ` + userBalanceColumns + ` FROM user_balance WHERE user_id = $1`
+	row := repo.reader(ctx).QueryRowContext(ctx, query, userID)
 	err := row.Scan(
 		&userBalance.UserID,
 		&userBalance.Balance,
+		&userBalance.MerchantID,
+		&userBalance.Status,
 		&userBalance.CreatedAt,
 		&userBalance.UpdatedAt,
 	)
@@ -77,13 +136,21 @@ func (repo *userBalanceRepository) QueryUserBalanceByUserID(ctx context.Context,
 }
 
 // AddUserBalanceByUserID ユーザーIDでユーザー残高を加算
+// ホットアカウントの場合はuser_balanceの行ではなく無作為に選んだスロットに加算する
 func (repo *userBalanceRepository) AddUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
-	if (repo.Tx == TX{nil}) {
+	defer logQuery(ctx, "AddUserBalanceByUserID", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
 		return errors.New("current thread is not associated with a transaction")
 	}
+	if added, err := repo.addToBalanceSlot(ctx, tx, userID, amount); err != nil || added {
+		return err
+	}
 
-	query := `UPDATE user_balance SET balance = balance + $1, updated_at = $2 WHERE user_id = $3`
-	res, err := repo.Tx.ExecContext(ctx, query, amount, time.Now(), userID)
+	query := `UPDATE user_balance SET balance = balance + $1, updated_at = $2
+		WHERE user_id = $3 AND status IN ('active', 'debit_frozen')`
+	res, err := tx.ExecContext(ctx, query, amount, time.Now(), userID)
 	if err != nil {
 		return err
 	}
@@ -92,21 +159,31 @@ func (repo *userBalanceRepository) AddUserBalanceByUserID(ctx context.Context, u
 	if err != nil {
 		return err
 	} else if numRow == 0 {
-		// 更新する時点でユーザーが存在しない場合
-		return sql.ErrNoRows
+		// 更新する時点でユーザーが存在しない場合はsql.ErrNoRows、加算できない状態の場合は更新失敗
+		var exists int
+		err := tx.QueryRowContext(ctx, `SELECT 1 FROM user_balance WHERE user_id = $1`, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		domain.LoggerFromContext(ctx).Warn("conditional balance update affected no rows", "user_id", userID, "amount", amount)
+		return errors.New("update failed")
 	}
 
 	return nil
 }
 
 // ReduceUserBalanceByUserID ユーザーIDでユーザー残高を減算
+// ホットアカウントでuser_balanceの行の残高が足りない場合はスロットから減算する
 func (repo *userBalanceRepository) ReduceUserBalanceByUserID(ctx context.Context, userID string, amount int) error {
-	if (repo.Tx == TX{nil}) {
+	defer logQuery(ctx, "ReduceUserBalanceByUserID", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
 		return errors.New("current thread is not associated with a transaction")
 	}
 
-	query := `UPDATE user_balance SET balance = balance - $1, updated_at = $2 WHERE user_id = $3 AND balance - $1 >= 0`
-	res, err := repo.Tx.ExecContext(ctx, query, amount, time.Now(), userID)
+	query := `UPDATE user_balance SET balance = balance - $1, updated_at = $2 WHERE user_id = $3 AND balance - $1 >= 0 AND status = 'active'`
+	res, err := tx.ExecContext(ctx, query, amount, time.Now(), userID)
 	if err != nil {
 		return err
 	}
@@ -115,20 +192,733 @@ func (repo *userBalanceRepository) ReduceUserBalanceByUserID(ctx context.Context
 	if err != nil {
 		return err
 	} else if numRow == 0 {
-		// 更新する時点でユーザーが存在しないまたは減算後残高が負の場合
+		if reduced, err := repo.reduceFromBalanceSlots(ctx, tx, userID, amount); err != nil || reduced {
+			return err
+		}
+		// 更新する時点でユーザーが存在しない、減算後残高が負または減算できない状態の場合
+		domain.LoggerFromContext(ctx).Warn("conditional balance update affected no rows", "user_id", userID, "amount", amount)
 		return errors.New("update failed")
 	}
 
 	return nil
 }
 
-// AddAllUserBalance ユーザー残高を一斉に加算
+// AddAllUserBalance 加算できる状態のユーザー残高を一斉に加算
 func (repo *userBalanceRepository) AddAllUserBalance(ctx context.Context, amount int) error {
-	if (repo.Tx == TX{nil}) {
+	defer logQuery(ctx, "AddAllUserBalance", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
 		return errors.New("current thread is not associated with a transaction")
 	}
 
-	query := `UPDATE user_balance SET balance = balance + $1, updated_at = $2`
-	_, err := repo.Tx.ExecContext(ctx, query, amount, time.Now())
+	query := `UPDATE user_balance SET balance = balance + $1, updated_at = $2 WHERE status IN ('active', 'debit_frozen')`
+	_, err := tx.ExecContext(ctx, query, amount, time.Now())
 	return err
 }
+
+// transactionHistoryColumns scanTransactionHistoryで読み取る取引履歴の列
+const transactionHistoryColumns = `transaction_id, COALESCE(user_id, ''), transaction_type, amount, balance_after,
+			COALESCE(actor, ''), COALESCE(reason_code, ''), COALESCE(note, ''), COALESCE(source, ''),
+			COALESCE(client_addr, ''), metadata, created_at, updated_at`
+
+// scanTransactionHistory transactionHistoryColumnsの列を取引履歴に変換
+func scanTransactionHistory(rows *sql.Rows) (domain.TransactionHistoryModel, error) {
+	var history domain.TransactionHistoryModel
+	var balanceAfter sql.NullInt64
+	var metadata sql.NullString
+	err := rows.Scan(
+		&history.TransactionID,
+		&history.UserID,
+		&history.TransactionType,
+		&history.Amount,
+		&balanceAfter,
+		&history.Actor,
+		&history.ReasonCode,
+		&history.Note,
+		&history.Source,
+		&history.ClientAddr,
+		&metadata,
+		&history.CreatedAt,
+		&history.UpdatedAt,
+	)
+	if err != nil {
+		return history, err
+	}
+	if balanceAfter.Valid {
+		balance := int(balanceAfter.Int64)
+		history.BalanceAfter = &balance
+	}
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &history.Metadata); err != nil {
+			return history, err
+		}
+	}
+	return history, nil
+}
+
+// QueryTransactionHistoryByUserID 指定した取引以降のユーザーに関わる取引履歴を古い順に取得
+// 一斉加算の履歴(user_idがNULL)はユーザーの作成後かつ加算できる状態だったもののみ含み、取引IDが空文字の場合は全ての履歴を取得する
+// 一斉加算の時点の状態は直前の状態変更履歴から判定する(状態変更履歴がない場合は有効)
+// 取引後の残高を記録していないユーザーの取引(ホットアカウントのスロットへの加減算など)は、同じスナップショットの現在の残高から算出する
+func (repo *userBalanceRepository) QueryTransactionHistoryByUserID(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	defer logQuery(ctx, "QueryTransactionHistoryByUserID", time.Now())
+
+	tx, err := repo.reader(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + transactionHistoryColumns + `
+		FROM transaction_history
+		WHERE ` + userTransactionHistoryCond + `
+			AND ($2 = '' OR (created_at, transaction_id) > (SELECT created_at, transaction_id FROM transaction_history WHERE transaction_id = $2))
+		ORDER BY created_at, transaction_id`
+	rows, err := tx.QueryContext(ctx, query, userID, afterTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	histories := []domain.TransactionHistoryModel{}
+	missing := false
+	for rows.Next() {
+		history, err := scanTransactionHistory(rows)
+		if err != nil {
+			return nil, err
+		}
+		missing = missing || (history.UserID == userID && history.BalanceAfter == nil)
+		histories = append(histories, history)
+	}
+	if err := rows.Err(); err != nil || !missing {
+		return histories, err
+	}
+
+	var balance int
+	if err := tx.QueryRowContext(ctx, `SELECT `+balanceTotalExpr+` FROM user_balance WHERE user_id = $1`, userID).Scan(&balance); err != nil {
+		return nil, err
+	}
+	fillBalanceAfter(histories, userID, balance)
+	return histories, nil
+}
+
+// fillBalanceAfter 取引後の残高がないユーザーの取引に、現在の残高から新しい順に取引の金額を差し引いた残高を設定
+// historiesは最新の取引までのユーザーに関わる取引履歴を古い順に含むこと(一斉加算の取引後の残高は設定しない)
+func fillBalanceAfter(histories []domain.TransactionHistoryModel, userID string, balance int) {
+	for i := len(histories) - 1; i >= 0; i-- {
+		if histories[i].UserID == userID && histories[i].BalanceAfter == nil {
+			balanceAfter := balance
+			histories[i].BalanceAfter = &balanceAfter
+		}
+		balance -= histories[i].SignedAmount()
+	}
+}
+
+// userTransactionHistoryCond $1のユーザーに関わる取引履歴の条件
+// ユーザーの取引と、ユーザーの作成後で加算できる状態だった時点の一斉加算を含める
+const userTransactionHistoryCond = `(user_id = $1 OR (user_id IS NULL
+				AND created_at >= (SELECT created_at FROM user_balance WHERE user_id = $1)
+				AND COALESCE((SELECT status FROM user_status_history sh
+					WHERE sh.user_id = $1 AND sh.created_at <= transaction_history.created_at
+					ORDER BY sh.created_at DESC, sh.id DESC LIMIT 1), 'active') IN ('active', 'debit_frozen')))`
+
+// signedAmountExpr 取引履歴の残高の増減を表す符号付きの金額(減算の場合は負)
+var signedAmountExpr = `(CASE WHEN transaction_type = ` + strconv.Itoa(int(domain.TransactionType_ReduceUserBalance)) + ` THEN -amount ELSE amount END)`
+
+// QueryTransactionHistoryInPeriod 期間の開始時点のユーザー残高と、期間内のユーザーに関わる取引履歴を取得
+// 開始時点の残高は期間の前の最後の取引後の残高に、その後の取引後の残高を持たない取引(一斉加算など)を加えて算出する
+// 期間の前に取引後の残高を持つ取引がない場合は、現在の残高から期間の開始以降の取引を差し引いて算出する
+func (repo *userBalanceRepository) QueryTransactionHistoryInPeriod(ctx context.Context, userID string, from time.Time, to time.Time) (int, []domain.TransactionHistoryModel, error) {
+	defer logQuery(ctx, "QueryTransactionHistoryInPeriod", time.Now())
+
+	tx, err := repo.reader(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	opening, err := queryBalanceAt(ctx, tx, userID, from)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	query := `SELECT ` + transactionHistoryColumns + `
+		FROM transaction_history
+		WHERE ` + userTransactionHistoryCond + ` AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at, transaction_id`
+	rows, err := tx.QueryContext(ctx, query, userID, from, to)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	histories := []domain.TransactionHistoryModel{}
+	for rows.Next() {
+		history, err := scanTransactionHistory(rows)
+		if err != nil {
+			return 0, nil, err
+		}
+		histories = append(histories, history)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	return opening, histories, tx.Commit()
+}
+
+// queryBalanceAt 指定した日時の時点のユーザー残高を取得(ユーザーが存在しない場合はsql.ErrNoRows)
+func queryBalanceAt(ctx context.Context, tx *sql.Tx, userID string, at time.Time) (int, error) {
+	var anchorCreatedAt time.Time
+	var anchorTransactionID string
+	var balance int
+	query := `SELECT created_at, transaction_id, balance_after FROM transaction_history
+		WHERE user_id = $1 AND created_at < $2 AND balance_after IS NOT NULL
+		ORDER BY created_at DESC, transaction_id DESC LIMIT 1`
+	err := tx.QueryRowContext(ctx, query, userID, at).Scan(&anchorCreatedAt, &anchorTransactionID, &balance)
+	if err == sql.ErrNoRows {
+		query := `SELECT ` + balanceTotalExpr + ` - COALESCE((SELECT SUM(` + signedAmountExpr + `) FROM transaction_history
+				WHERE ` + userTransactionHistoryCond + ` AND created_at >= $2), 0)
+			FROM user_balance WHERE user_id = $1`
+		err = tx.QueryRowContext(ctx, query, userID, at).Scan(&balance)
+		return balance, err
+	} else if err != nil {
+		return 0, err
+	}
+
+	var delta int
+	query = `SELECT COALESCE(SUM(` + signedAmountExpr + `), 0) FROM transaction_history
+		WHERE ` + userTransactionHistoryCond + ` AND created_at < $2 AND (created_at, transaction_id) > ($3, $4)`
+	if err := tx.QueryRowContext(ctx, query, userID, at, anchorCreatedAt, anchorTransactionID).Scan(&delta); err != nil {
+		return 0, err
+	}
+	return balance + delta, nil
+}
+
+// InsertUser ユーザーを挿入(既に存在する場合は一意性違反)
+func (repo *userBalanceRepository) InsertUser(ctx context.Context, user domain.UserBalanceModel) error {
+	defer logQuery(ctx, "InsertUser", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+
+	query := `INSERT INTO user_balance (user_id, balance, merchant_id, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := tx.ExecContext(ctx, query, user.UserID, user.Balance, nullString(user.MerchantID), user.Status,
+		user.CreatedAt, user.UpdatedAt)
+	return err
+}
+
+// UpdateUserStatusByUserID ユーザーIDでユーザーの状態を更新
+// 解約済みのユーザーと、残高が0でないユーザーの解約は更新しない
+// ホットアカウントのスロットへの加算はuser_balanceの行をロックしないため、解約する場合はスロットもロックして
+// 実行中の加算のコミットを待ってから残高の合計を確認し、解約後はスロットを削除して以降の加算がスロットに入らないようにする
+func (repo *userBalanceRepository) UpdateUserStatusByUserID(ctx context.Context, userID string, status domain.UserStatus) error {
+	defer logQuery(ctx, "UpdateUserStatusByUserID", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+	if status == domain.UserStatus_Closed {
+		if _, _, err := lockBalanceSlots(ctx, tx.Tx, userID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	query := `UPDATE user_balance SET status = $1, updated_at = $2
+		WHERE user_id = $3 AND status <> 'closed' AND ($1 <> 'closed' OR ` + balanceTotalExpr + ` = 0)`
+	res, err := tx.ExecContext(ctx, query, status, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	numRow, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if numRow == 0 {
+		// 更新する時点でユーザーが存在しない、解約済みまたは残高が0でない場合
+		domain.LoggerFromContext(ctx).Warn("conditional status update affected no rows", "user_id", userID, "status", string(status))
+		return errors.New("update failed")
+	}
+
+	if status == domain.UserStatus_Closed {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_balance_slot WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_balance SET balance_slots = 0 WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertUserStatusHistory ユーザーの状態変更履歴を監査情報と共に挿入
+func (repo *userBalanceRepository) InsertUserStatusHistory(ctx context.Context, userID string, status domain.UserStatus, audit domain.AuditInfo) error {
+	defer logQuery(ctx, "InsertUserStatusHistory", time.Now())
+
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return errors.New("current thread is not associated with a transaction")
+	}
+
+	query := `INSERT INTO user_status_history (user_id, status, actor, reason_code, note, source, client_addr, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := tx.ExecContext(ctx, query, userID, status, nullString(audit.Actor), nullString(audit.ReasonCode),
+		nullString(audit.Note), nullString(string(audit.Source)), nullString(audit.ClientAddr), time.Now())
+	return err
+}
+
+// userBalanceColumns scanUserBalancesで読み取るユーザー残高の列(残高はホットアカウントのスロットを含めた合計)
+const userBalanceColumns = `user_id, ` + balanceTotalExpr + `, COALESCE(merchant_id, ''), status, created_at, updated_at`
+
+// scanUserBalances userBalanceColumnsの列をユーザー残高情報に変換
+func scanUserBalances(rows *sql.Rows) ([]domain.UserBalanceModel, error) {
+	defer rows.Close()
+
+	userBalances := []domain.UserBalanceModel{}
+	for rows.Next() {
+		var userBalance domain.UserBalanceModel
+		err := rows.Scan(
+			&userBalance.UserID,
+			&userBalance.Balance,
+			&userBalance.MerchantID,
+			&userBalance.Status,
+			&userBalance.CreatedAt,
+			&userBalance.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		userBalances = append(userBalances, userBalance)
+	}
+
+	return userBalances, rows.Err()
+}
+
+// queryArgs プレースホルダの番号を採番しながらクエリの引数を格納
+type queryArgs []interface{}
+
+// add 引数を追加し、対応するプレースホルダを返す
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// QueryUserBalancesByUserIDs 複数のユーザーIDでユーザー残高情報を1回のクエリで取得
+// 存在しないユーザーは結果に含まれず、順序は保証しない
+func (repo *userBalanceRepository) QueryUserBalancesByUserIDs(ctx context.Context, userIDs []string) ([]domain.UserBalanceModel, error) {
+	defer logQuery(ctx, "QueryUserBalancesByUserIDs", time.Now())
+
+	if len(userIDs) == 0 {
+		return []domain.UserBalanceModel{}, nil
+	}
+	var args queryArgs
+	placeholders := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		placeholders = append(placeholders, args.add(userID))
+	}
+
+	query := `SELECT ` + userBalanceColumns + ` FROM user_balance
+		WHERE user_id IN (` + strings.Join(placeholders, ", ") + `)`
+	rows, err := repo.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUserBalances(rows)
+}
+
+// QueryExistingTransactionIDs 指定した取引IDのうち取引履歴に存在するものを1回のクエリで取得
+// 適用済みの取引を読み飛ばす判定に使用するため、複製の遅延がないプライマリで読み取る
+func (repo *userBalanceRepository) QueryExistingTransactionIDs(ctx context.Context, transactionIDs []string) ([]string, error) {
+	defer logQuery(ctx, "QueryExistingTransactionIDs", time.Now())
+
+	if len(transactionIDs) == 0 {
+		return []string{}, nil
+	}
+	var args queryArgs
+	placeholders := make([]string, 0, len(transactionIDs))
+	for _, transactionID := range transactionIDs {
+		placeholders = append(placeholders, args.add(transactionID))
+	}
+
+	query := `SELECT DISTINCT transaction_id FROM transaction_history
+		WHERE transaction_id IN (` + strings.Join(placeholders, ", ") + `)`
+	rows, err := repo.Conn.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := []string{}
+	for rows.Next() {
+		var transactionID string
+		if err := rows.Scan(&transactionID); err != nil {
+			return nil, err
+		}
+		existing = append(existing, transactionID)
+	}
+	return existing, rows.Err()
+}
+
+// accountSortColumns 口座一覧の並び替えの項目と列(残高はホットアカウントのスロットを含めた合計)の対応
+var accountSortColumns = map[domain.AccountSortField]string{
+	domain.AccountSortField_UserID:    "user_id",
+	domain.AccountSortField_Balance:   balanceTotalExpr,
+	domain.AccountSortField_CreatedAt: "created_at",
+}
+
+// QueryUserBalances 条件で絞り込んだユーザー残高情報を並び替えてPageSize件まで取得
+// 並び替えの項目が同じ値の場合はユーザーIDの順に並べ、AfterUserIDのユーザーの現在の値より後から取得する
+// 残高での絞り込みと並び替えは取得する残高と同じくホットアカウントのスロットを含めた合計で行う
+func (repo *userBalanceRepository) QueryUserBalances(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, error) {
+	defer logQuery(ctx, "QueryUserBalances", time.Now())
+
+	column, ok := accountSortColumns[q.SortBy]
+	if !ok {
+		column = accountSortColumns[domain.AccountSortField_UserID]
+	}
+	order, cmp := "ASC", ">"
+	if q.Descending {
+		order, cmp = "DESC", "<"
+	}
+
+	var args queryArgs
+	conditions := []string{"1 = 1"}
+	if q.MinBalance != nil {
+		conditions = append(conditions, balanceTotalExpr+" >= "+args.add(*q.MinBalance))
+	}
+	if q.MaxBalance != nil {
+		conditions = append(conditions, balanceTotalExpr+" <= "+args.add(*q.MaxBalance))
+	}
+	if len(q.Statuses) > 0 {
+		placeholders := make([]string, 0, len(q.Statuses))
+		for _, status := range q.Statuses {
+			placeholders = append(placeholders, args.add(status))
+		}
+		conditions = append(conditions, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if q.MerchantID != "" {
+		conditions = append(conditions, "merchant_id = "+args.add(q.MerchantID))
+	}
+	if !q.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= "+args.add(q.CreatedAfter))
+	}
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < "+args.add(q.CreatedBefore))
+	}
+	if q.AfterUserID != "" {
+		if column == "user_id" {
+			conditions = append(conditions, "user_id "+cmp+" "+args.add(q.AfterUserID))
+		} else {
+			conditions = append(conditions, "("+column+", user_id) "+cmp+" (SELECT "+column+", user_id FROM user_balance WHERE user_id = "+args.add(q.AfterUserID)+")")
+		}
+	}
+
+	orderBy := "user_id " + order
+	if column != "user_id" {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+	query := `SELECT ` + userBalanceColumns + ` FROM user_balance
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ` + orderBy + `
+		LIMIT ` + args.add(q.PageSize)
+	rows, err := repo.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUserBalances(rows)
+}
+
+// ExportSnapshot ユーザー残高と取引履歴を1つのREPEATABLE READの読み取り専用トランザクションで読み取り、1行ずつwriterに渡す
+// 全ての対象を同じスナップショットから読み取るため、エクスポート中に更新された場合も残高と取引履歴の整合性が保たれる
+// 書き込みのトランザクション(Tx)とは別に開始し、結果は全件をメモリに保持せず順に渡す
+func (repo *userBalanceRepository) ExportSnapshot(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) error {
+	defer logQuery(ctx, "ExportSnapshot", time.Now())
+
+	tx, err := repo.reader(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if q.Includes(domain.ExportDataset_Balances) {
+		if err := exportUserBalances(ctx, tx, q, w); err != nil {
+			return err
+		}
+	}
+	if q.Includes(domain.ExportDataset_History) {
+		if err := exportTransactionHistories(ctx, tx, q, w); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// exportPeriodConditions エクスポートの期間の条件を作成
+func exportPeriodConditions(column string, q domain.ExportQuery, args *queryArgs) []string {
+	conditions := []string{"1 = 1"}
+	if !q.From.IsZero() {
+		conditions = append(conditions, column+" >= "+args.add(q.From))
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, column+" < "+args.add(q.To))
+	}
+	return conditions
+}
+
+// exportUserBalances 更新日時で絞り込んだユーザー残高をユーザーIDの順に渡す
+func exportUserBalances(ctx context.Context, tx *sql.Tx, q domain.ExportQuery, w domain.ExportWriter) error {
+	var args queryArgs
+	conditions := exportPeriodConditions("updated_at", q, &args)
+	query := `SELECT ` + userBalanceColumns + ` FROM user_balance
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY user_id`
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userBalance domain.UserBalanceModel
+		err := rows.Scan(
+			&userBalance.UserID,
+			&userBalance.Balance,
+			&userBalance.MerchantID,
+			&userBalance.Status,
+			&userBalance.CreatedAt,
+			&userBalance.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteUserBalance(userBalance); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportTransactionHistories 作成日時と取引種類で絞り込んだ取引履歴を作成日時と取引IDの順に渡す
+func exportTransactionHistories(ctx context.Context, tx *sql.Tx, q domain.ExportQuery, w domain.ExportWriter) error {
+	var args queryArgs
+	conditions := exportPeriodConditions("created_at", q, &args)
+	if len(q.TransactionTypes) > 0 {
+		placeholders := make([]string, 0, len(q.TransactionTypes))
+		for _, transactionType := range q.TransactionTypes {
+			placeholders = append(placeholders, args.add(transactionType))
+		}
+		conditions = append(conditions, "transaction_type IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	query := `SELECT ` + transactionHistoryColumns + `
+		FROM transaction_history
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY created_at, transaction_id`
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		history, err := scanTransactionHistory(rows)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteTransactionHistory(history); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// aggregateSettleTime 取引履歴の作成日時からコミットまでに許容する遅延
+// 次回の集計は前回の集計時点からこの時間だけ遡った日から行い、日付の境界をまたいでコミットされた取引も反映する
+const aggregateSettleTime = time.Hour
+
+// RefreshDailyTransactionAggregates 前回の集計以降の取引履歴を日毎、取引種類毎の集計(daily_transaction_aggregate)に反映し、集計した時点の日時を返す
+// 前回記録した日(refreshed_from)以降の取引がある日のみを取引種類毎のGROUP BYで再集計するため、取引履歴の全件は走査しない
+// 1日分ずつ別のトランザクションでコミットするため、途中で中断しても次回は続きの日から集計する(日付の境界はUTC)
+// 各トランザクションは集計の状態の行を最初に更新してロックし、同時に実行された集計を直列化する
+func (repo *userBalanceRepository) RefreshDailyTransactionAggregates(ctx context.Context) (time.Time, error) {
+	defer logQuery(ctx, "RefreshDailyTransactionAggregates", time.Now())
+
+	now := time.Now().UTC()
+	settled := domain.ReportGranularity_Day.Truncate(now.Add(-aggregateSettleTime))
+	var after time.Time
+	for {
+		day, ok, err := repo.refreshNextDailyTransactionAggregate(ctx, after, settled)
+		if err != nil {
+			return time.Time{}, err
+		} else if !ok {
+			break
+		}
+		after = domain.ReportGranularity_Day.Next(day)
+	}
+
+	// 先に開始して後に完了した集計で日時を戻さない
+	query := `UPDATE transaction_aggregate_state SET refreshed_at = $1 WHERE id = 1 AND (refreshed_at IS NULL OR refreshed_at < $1)`
+	if _, err := repo.Conn.DB.ExecContext(ctx, query, now); err != nil {
+		return time.Time{}, err
+	}
+	return now, nil
+}
+
+// refreshNextDailyTransactionAggregate refreshed_fromとafterの遅い方以降で取引がある最初の日を再集計してコミットし、その日を返す
+// 集計する日がない場合はfalseを返す。refreshed_fromは再集計した日の翌日(settledより後にはしない)に進める
+func (repo *userBalanceRepository) refreshNextDailyTransactionAggregate(ctx context.Context, after time.Time, settled time.Time) (time.Time, bool, error) {
+	tx, err := repo.Conn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE transaction_aggregate_state SET refreshed_from = refreshed_from WHERE id = 1`); err != nil {
+		return time.Time{}, false, err
+	}
+	var refreshedFrom sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT refreshed_from FROM transaction_aggregate_state WHERE id = 1`).Scan(&refreshedFrom); err != nil {
+		return time.Time{}, false, err
+	}
+	// 初回(refreshed_fromがNULL)はゼロ値の日から開始し、最も古い取引履歴の日から集計する
+	day := domain.ReportGranularity_Day.Truncate(refreshedFrom.Time)
+	if day.Before(after) {
+		day = after
+	}
+	// 取引がない日は読み飛ばす
+	var next time.Time
+	err = tx.QueryRowContext(ctx, `SELECT created_at FROM transaction_history WHERE created_at >= $1 ORDER BY created_at LIMIT 1`, day).Scan(&next)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	day = domain.ReportGranularity_Day.Truncate(next)
+
+	aggregates, err := aggregateTransactionHistories(ctx, tx, day)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM daily_transaction_aggregate WHERE day = $1`, day); err != nil {
+		return time.Time{}, false, err
+	}
+	for _, aggregate := range aggregates {
+		_, err := tx.ExecContext(ctx, `INSERT INTO daily_transaction_aggregate (day, transaction_type, transaction_count, total_amount)
+			VALUES ($1, $2, $3, $4)`, aggregate.Day, aggregate.TransactionType, aggregate.Count, aggregate.Amount)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	from := domain.ReportGranularity_Day.Next(day)
+	if from.After(settled) {
+		from = settled
+	}
+	if from.After(refreshedFrom.Time) {
+		if _, err := tx.ExecContext(ctx, `UPDATE transaction_aggregate_state SET refreshed_from = $1 WHERE id = 1`, from); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	return day, true, tx.Commit()
+}
+
+// creditedAmountExpr 取引履歴で残高の総額が増減した金額
+// 一斉加算は1ユーザーあたりの加算額に、実行時点で作成済みかつ加算できる状態だったユーザー数を掛ける(userTransactionHistoryCondと同じ判定)
+var creditedAmountExpr = `(CASE WHEN transaction_type = ` + strconv.Itoa(int(domain.TransactionType_AddAllUserBalance)) + ` THEN amount * (SELECT COUNT(*) FROM user_balance ub
+			WHERE ub.created_at <= transaction_history.created_at
+			AND COALESCE((SELECT status FROM user_status_history sh
+				WHERE sh.user_id = ub.user_id AND sh.created_at <= transaction_history.created_at
+				ORDER BY sh.created_at DESC, sh.id DESC LIMIT 1), 'active') IN ('active', 'debit_frozen'))
+		ELSE amount END)`
+
+// aggregateTransactionHistories 指定した日の取引履歴を取引種類毎に集計
+func aggregateTransactionHistories(ctx context.Context, tx *sql.Tx, day time.Time) ([]domain.DailyTransactionAggregate, error) {
+	query := `SELECT transaction_type, COUNT(*), CAST(COALESCE(SUM(` + creditedAmountExpr + `), 0) AS BIGINT) FROM transaction_history
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY transaction_type`
+	rows, err := tx.QueryContext(ctx, query, day, domain.ReportGranularity_Day.Next(day))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []domain.DailyTransactionAggregate{}
+	for rows.Next() {
+		aggregate := domain.DailyTransactionAggregate{Day: day}
+		if err := rows.Scan(&aggregate.TransactionType, &aggregate.Count, &aggregate.Amount); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
+// QueryDailyTransactionAggregates 期間内(開始は含み、終了は含まない)の日毎の集計を日と取引種類の順に取得し、最後に集計を完了した日時と合わせて返す
+// 集計は更新しないため、同じ時点の集計と集計の状態を読み取り専用のトランザクションで読み取る
+func (repo *userBalanceRepository) QueryDailyTransactionAggregates(ctx context.Context, from time.Time, to time.Time) ([]domain.DailyTransactionAggregate, time.Time, error) {
+	defer logQuery(ctx, "QueryDailyTransactionAggregates", time.Now())
+
+	tx, err := repo.reader(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var refreshedAt sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT refreshed_at FROM transaction_aggregate_state WHERE id = 1`).Scan(&refreshedAt); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	query := `SELECT day, transaction_type, transaction_count, total_amount FROM daily_transaction_aggregate
+		WHERE day >= $1 AND day < $2
+		ORDER BY day, transaction_type`
+	rows, err := tx.QueryContext(ctx, query, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	aggregates := []domain.DailyTransactionAggregate{}
+	for rows.Next() {
+		var aggregate domain.DailyTransactionAggregate
+		if err := rows.Scan(&aggregate.Day, &aggregate.TransactionType, &aggregate.Count, &aggregate.Amount); err != nil {
+			return nil, time.Time{}, err
+		}
+		aggregate.Day = aggregate.Day.UTC()
+		aggregates = append(aggregates, aggregate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	if !refreshedAt.Valid {
+		return aggregates, time.Time{}, nil
+	}
+	return aggregates, refreshedAt.Time.UTC(), nil
+}
+
+// QueryBalanceStatusTotals ユーザーの状態毎のユーザー数と残高の合計を状態の名前の順に取得
+func (repo *userBalanceRepository) QueryBalanceStatusTotals(ctx context.Context) ([]domain.BalanceStatusTotal, error) {
+	defer logQuery(ctx, "QueryBalanceStatusTotals", time.Now())
+
+	query := `SELECT status, COUNT(*), COALESCE(SUM(` + balanceTotalExpr + `), 0) FROM user_balance GROUP BY status ORDER BY status`
+	rows, err := repo.reader(ctx).QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []domain.BalanceStatusTotal{}
+	for rows.Next() {
+		var total domain.BalanceStatusTotal
+		if err := rows.Scan(&total.Status, &total.Users, &total.Balance); err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
@@ -1,6 +1,7 @@
 package infrastructure
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -24,30 +25,75 @@ func NewMockDatabase(file string) *DB {
 	conn.Exec(`CREATE TABLE user_balance (
 		user_id TEXT PRIMARY KEY,
 		balance INTEGER NOT NULL DEFAULT 0,
+		merchant_id TEXT,
+		status TEXT NOT NULL DEFAULT 'active',
+		balance_slots INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME NOT NULL,
 		updated_at DATETIME NOT NULL
 	)`)
 
+	conn.Exec(`CREATE TABLE user_balance_slot(
+		user_id TEXT NOT NULL,
+		slot INTEGER NOT NULL,
+		balance INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, slot)
+	)`)
+
+	conn.Exec(`CREATE TABLE user_status_history(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		actor TEXT,
+		reason_code TEXT,
+		note TEXT,
+		source TEXT,
+		client_addr TEXT,
+		created_at DATETIME NOT NULL
+	)`)
+
 	conn.Exec(`CREATE TABLE transaction_history(
 		transaction_id TEXT PRIMARY KEY,
 		user_id TEXT,
 		transaction_type INTEGER NOT NULL,
 		amount INTEGER NOT NULL DEFAULT 0,
+		balance_after INTEGER,
+		actor TEXT,
+		reason_code TEXT,
+		note TEXT,
+		source TEXT,
+		client_addr TEXT,
+		metadata TEXT,
 		created_at DATETIME NOT NULL,
 		updated_at DATETIME NOT NULL
 	)`)
 
-	conn.Exec(`INSERT INTO user_balance (user_id, balance, created_at, updated_at) VALUES
-		('test_user1', 10000, '2021-05-29', '2021-05-29'),
-		('test_user2', 20000, '2021-05-29', '2021-05-29'),
-		('test_user3', 30000, '2021-05-29', '2021-05-29'),
-		('test_user4', 40000, '2021-05-29', '2021-05-29'),
-		('test_user5', 50000, '2021-05-29', '2021-05-29')`)
+	conn.Exec(`CREATE TABLE daily_transaction_aggregate(
+		day DATETIME NOT NULL,
+		transaction_type INTEGER NOT NULL,
+		transaction_count INTEGER NOT NULL DEFAULT 0,
+		total_amount INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, transaction_type)
+	)`)
+
+	conn.Exec(`CREATE TABLE transaction_aggregate_state(
+		id INTEGER PRIMARY KEY,
+		refreshed_from DATETIME,
+		refreshed_at DATETIME
+	)`)
+	conn.Exec(`INSERT INTO transaction_aggregate_state (id) VALUES (1)`)
+
+	conn.Exec(`INSERT INTO user_balance (user_id, balance, merchant_id, created_at, updated_at) VALUES
+		('test_user1', 10000, 'shop1', '2021-05-29', '2021-05-29'),
+		('test_user2', 20000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user3', 30000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user4', 40000, NULL, '2021-05-29', '2021-05-29'),
+		('test_user5', 50000, NULL, '2021-05-29', '2021-05-29')`)
 
 	conn.Exec(`INSERT INTO transaction_history (transaction_id, transaction_type, amount, created_at, updated_at) VALUES
 		('b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b', 2, 10000, '2021-05-29', '2021-05-29')`)
 
-	return &DB{conn}
+	return &DB{DB: conn}
 }
 
 func TestInsertTransactionHistory(t *testing.T) {
@@ -57,12 +103,15 @@ func TestInsertTransactionHistory(t *testing.T) {
 		UserID          string
 		TransactionType domain.TransactionType
 		amount          int
+		Audit           domain.AuditInfo
 		ExpectedErrMsg  string
 	}{
-		{"add all user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "", domain.TransactionType_AddAllUserBalance, 10000, ""},
-		{"add user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "test_user1", domain.TransactionType_AddAllUserBalance, 10000, ""},
-		{"reduce user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "test_user5", domain.TransactionType_ReduceUserBalance, 10000, ""},
-		{"duplicated transaction_id", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "test_user5", domain.TransactionType_ReduceUserBalance, 10000, "UNIQUE constraint failed: transaction_history.transaction_id"},
+		{"add all user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "", domain.TransactionType_AddAllUserBalance, 10000, domain.AuditInfo{}, ""},
+		{"add user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "test_user1", domain.TransactionType_AddAllUserBalance, 10000, domain.AuditInfo{}, ""},
+		{"reduce user balance", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "test_user5", domain.TransactionType_ReduceUserBalance, 10000, domain.AuditInfo{}, ""},
+		{"with audit info", "ab20818d-9889-4e6b-b32f-c2be401ec02d", "test_user5", domain.TransactionType_ReduceUserBalance, 10000,
+			domain.AuditInfo{Actor: "operator1", ReasonCode: "refund", Note: "note", Source: domain.RequestSource_RESTful, ClientAddr: "127.0.0.1:12345", Metadata: map[string]string{"campaign": "summer"}}, ""},
+		{"duplicated transaction_id", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "test_user5", domain.TransactionType_ReduceUserBalance, 10000, domain.AuditInfo{}, "UNIQUE constraint failed: transaction_history.transaction_id"},
 	}
 
 	for i, c := range cases {
@@ -71,12 +120,12 @@ func TestInsertTransactionHistory(t *testing.T) {
 			db := NewMockDatabase(file)
 			defer db.Close()
 			repo = NewUserBalanceRepository(*db)
-			ctx, cancel := repo.GetCtxWithTimeout(3 * time.Second)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			repo.BeginTx(ctx)
-			err := repo.InsertTransactionHistory(ctx, c.TransactionID, c.UserID, c.TransactionType, c.amount)
+			ctx, _ = repo.BeginTx(ctx)
+			err := repo.InsertTransactionHistory(ctx, c.TransactionID, c.UserID, c.TransactionType, c.amount, c.Audit)
 			if err != nil {
-				repo.Rollback()
+				repo.Rollback(ctx)
 				var pgErr *pgconn.PgError
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -93,7 +142,7 @@ func TestInsertTransactionHistory(t *testing.T) {
 				if c.ExpectedErrMsg != "" {
 					t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
 				}
-				repo.Commit()
+				repo.Commit(ctx)
 			}
 		})
 	}
@@ -101,15 +150,16 @@ func TestInsertTransactionHistory(t *testing.T) {
 
 func TestQueryUserBalanceByUserID(t *testing.T) {
 	cases := []struct {
-		Name            string
-		UserID          string
-		ExpectedBalance int
-		ExpectedErrMsg  string
+		Name               string
+		UserID             string
+		ExpectedBalance    int
+		ExpectedMerchantID string
+		ExpectedErrMsg     string
 	}{
-		{"existent user1", "test_user1", 10000, ""},
-		{"existent user2", "test_user3", 30000, ""},
-		{"sql injection", "'; DROP TABLE user_balance;'", 0, "sql: no rows in result set"},
-		{"nonexistent user", "unknown", 0, "sql: no rows in result set"},
+		{"existent user1", "test_user1", 10000, "shop1", ""},
+		{"existent user2", "test_user3", 30000, "", ""},
+		{"sql injection", "'; DROP TABLE user_balance;'", 0, "", "sql: no rows in result set"},
+		{"nonexistent user", "unknown", 0, "", "sql: no rows in result set"},
 	}
 
 	for i, c := range cases {
@@ -118,7 +168,7 @@ func TestQueryUserBalanceByUserID(t *testing.T) {
 			db := NewMockDatabase(file)
 			defer db.Close()
 			repo = NewUserBalanceRepository(*db)
-			ctx, cancel := repo.GetCtxWithTimeout(3 * time.Second)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
 			userBalance, err := repo.QueryUserBalanceByUserID(ctx, c.UserID)
 			if err != nil {
@@ -141,6 +191,8 @@ func TestQueryUserBalanceByUserID(t *testing.T) {
 					t.Errorf("expect user_id [%s], got [%s]", c.UserID, userBalance.UserID)
 				} else if userBalance.Balance != c.ExpectedBalance {
 					t.Errorf("expect balance [%d], got [%d]", c.ExpectedBalance, userBalance.Balance)
+				} else if userBalance.MerchantID != c.ExpectedMerchantID {
+					t.Errorf("expect merchant_id [%s], got [%s]", c.ExpectedMerchantID, userBalance.MerchantID)
 				}
 			}
 		})
@@ -166,12 +218,12 @@ func TestAddUserBalanceByUserID(t *testing.T) {
 			db := NewMockDatabase(file)
 			defer db.Close()
 			repo = NewUserBalanceRepository(*db)
-			ctx, cancel := repo.GetCtxWithTimeout(3 * time.Second)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			repo.BeginTx(ctx)
+			ctx, _ = repo.BeginTx(ctx)
 			err := repo.AddUserBalanceByUserID(ctx, c.UserID, c.Amount)
 			if err != nil {
-				repo.Rollback()
+				repo.Rollback(ctx)
 				var pgErr *pgconn.PgError
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -189,7 +241,7 @@ func TestAddUserBalanceByUserID(t *testing.T) {
 					t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
 				}
 				// 更新後残高を検証
-				repo.Commit()
+				repo.Commit(ctx)
 				if !strings.HasPrefix(c.Name, "nonexistent") {
 					var balance int
 					row := db.QueryRow("SELECT balance FROM user_balance WHERE user_id = $1", c.UserID)
@@ -223,12 +275,12 @@ func TestReduceUserBalanceByUserID(t *testing.T) {
 			db := NewMockDatabase(file)
 			defer db.Close()
 			repo = NewUserBalanceRepository(*db)
-			ctx, cancel := repo.GetCtxWithTimeout(3 * time.Second)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			repo.BeginTx(ctx)
+			ctx, _ = repo.BeginTx(ctx)
 			err := repo.ReduceUserBalanceByUserID(ctx, c.UserID, c.Amount)
 			if err != nil {
-				repo.Rollback()
+				repo.Rollback(ctx)
 				var pgErr *pgconn.PgError
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -246,7 +298,7 @@ func TestReduceUserBalanceByUserID(t *testing.T) {
 					t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
 				}
 				// 更新後残高を検証
-				repo.Commit()
+				repo.Commit(ctx)
 				if !strings.HasPrefix(c.Name, "nonexistent") {
 					var balance int
 					row := db.QueryRow("SELECT balance FROM user_balance WHERE user_id = $1", c.UserID)
@@ -278,12 +330,12 @@ func TestAddAllUserBalance(t *testing.T) {
 			db := NewMockDatabase(file)
 			defer db.Close()
 			repo = NewUserBalanceRepository(*db)
-			ctx, cancel := repo.GetCtxWithTimeout(3 * time.Second)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			repo.BeginTx(ctx)
+			ctx, _ = repo.BeginTx(ctx)
 			err := repo.AddAllUserBalance(ctx, c.Amount)
 			if err != nil {
-				repo.Rollback()
+				repo.Rollback(ctx)
 				var pgErr *pgconn.PgError
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -301,7 +353,7 @@ func TestAddAllUserBalance(t *testing.T) {
 					t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
 				}
 				// 更新後残高を検証
-				repo.Commit()
+				repo.Commit(ctx)
 				for userID, expectedBalance := range c.ExpectedBalances {
 					var balance int
 					row := db.QueryRow("SELECT balance FROM user_balance WHERE user_id = $1", userID)
@@ -314,3 +366,50 @@ func TestAddAllUserBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestQueryTransactionHistoryByUserID(t *testing.T) {
+	cases := []struct {
+		Name               string
+		UserID             string
+		AfterTransactionID string
+		ExpectedIDs        []string
+	}{
+		{"after add all", "test_user1", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", []string{"3a5d1c2e-1111-4f5b-9c1d-000000000001", "3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+		{"after own transaction", "test_user1", "3a5d1c2e-1111-4f5b-9c1d-000000000001", []string{"3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+		{"other user", "test_user2", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", []string{"3a5d1c2e-1111-4f5b-9c1d-000000000002", "3a5d1c2e-1111-4f5b-9c1d-000000000003"}},
+		{"unknown transaction", "test_user1", "unknown", []string{}},
+	}
+
+	for i, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			file := "history-" + strconv.Itoa(i)
+			db := NewMockDatabase(file)
+			defer db.Close()
+			db.Exec(`INSERT INTO transaction_history (transaction_id, user_id, transaction_type, amount, actor, reason_code, source, metadata, created_at, updated_at) VALUES
+				('3a5d1c2e-1111-4f5b-9c1d-000000000001', 'test_user1', 0, 1000, 'operator1', 'campaign', 'restful', '{"campaign":"summer"}', '2021-05-30', '2021-05-30'),
+				('3a5d1c2e-1111-4f5b-9c1d-000000000002', 'test_user2', 1, 2000, NULL, NULL, 'grpc', NULL, '2021-05-31', '2021-05-31'),
+				('3a5d1c2e-1111-4f5b-9c1d-000000000003', NULL, 2, 3000, NULL, NULL, NULL, NULL, '2021-06-01', '2021-06-01')`)
+			repo = NewUserBalanceRepository(*db)
+			ctx, cancel := repo.GetCtxWithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			histories, err := repo.QueryTransactionHistoryByUserID(ctx, c.UserID, c.AfterTransactionID)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if len(histories) != len(c.ExpectedIDs) {
+				t.Fatalf("expect [%d] histories but got [%d]", len(c.ExpectedIDs), len(histories))
+			}
+			for j, history := range histories {
+				if history.TransactionID != c.ExpectedIDs[j] {
+					t.Errorf("expect transaction_id [%s] but got [%s]", c.ExpectedIDs[j], history.TransactionID)
+				}
+				// 監査情報を検証
+				if history.TransactionID == "3a5d1c2e-1111-4f5b-9c1d-000000000001" {
+					if history.Actor != "operator1" || history.Source != domain.RequestSource_RESTful || history.Metadata["campaign"] != "summer" {
+						t.Errorf("unexpected audit info [%+v]", history.AuditInfo)
+					}
+				}
+			}
+		})
+	}
+}
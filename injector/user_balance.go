@@ -1,39 +1,203 @@
 package injector
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
 	"github.com/kaitolucifer/user-balance-management/domain"
 	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/migrations"
 	RestfulHandler "github.com/kaitolucifer/user-balance-management/presentation/restful"
 	GrpcHandler "github.com/kaitolucifer/user-balance-management/presentation/grpc"
 	"github.com/kaitolucifer/user-balance-management/usecase"
 )
 
+// InjectLogger 標準出力に構造化ログを出力するLoggerを注入
+func InjectLogger(format string, level string) domain.Logger {
+	logger, err := infrastructure.NewLogger(os.Stdout, format, level)
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
 // InjectDatabase DBを注入
-func InjectDatabase(dsn string) infrastructure.DB {
-	db := infrastructure.NewDatabase(dsn)
+// replicaのDSNを指定しない場合、読み取りもプライマリで行う
+func InjectDatabase(dsn string, pool infrastructure.DBPoolConfig, replica infrastructure.ReplicaConfig) infrastructure.DB {
+	db := infrastructure.NewDatabase(dsn, pool, replica)
 	return *db
 }
 
+// InjectMigrator バイナリに埋め込んだマイグレーションを適用するMigratorを注入
+func InjectMigrator(db infrastructure.DB) *infrastructure.Migrator {
+	migrator, err := infrastructure.NewMigrator(db, migrations.FS)
+	if err != nil {
+		panic(err)
+	}
+	return migrator
+}
+
+// InjectHotAccountManager ホットアカウントの残高の分割と圧縮を行うHotAccountManagerを注入
+func InjectHotAccountManager(db infrastructure.DB) *infrastructure.HotAccountManager {
+	return infrastructure.NewHotAccountManager(db)
+}
+
+// InjectHotAccountCompactor ホットアカウントのスロットの残高を一定間隔で圧縮するジョブを注入
+func InjectHotAccountCompactor(db infrastructure.DB, interval time.Duration, logger domain.Logger) *infrastructure.HotAccountCompactor {
+	return infrastructure.NewHotAccountCompactor(infrastructure.NewHotAccountManager(db), interval, logger)
+}
+
+// InjectAuthenticator 認証器を注入
+// APIキー設定ファイルとJWKSファイルが共に指定されない場合、認証は無効(nil)になる
+func InjectAuthenticator(apiKeysFile string, jwksFile string, issuer string, audience string) domain.Authenticator {
+	if apiKeysFile == "" && jwksFile == "" {
+		return nil
+	}
+	authenticator, err := infrastructure.NewAuthenticator(apiKeysFile, jwksFile, issuer, audience)
+	if err != nil {
+		panic(err)
+	}
+	return authenticator
+}
+
+// InjectRateLimiter レートリミッターを注入
+// rateが0以下の場合、レート制限は無効(nil)になる
+func InjectRateLimiter(rate float64, burst int) domain.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	limiter := infrastructure.NewMemoryRateLimiter(rate, burst)
+	return limiter
+}
+
+// InjectMetrics Prometheusのメトリクスを注入
+func InjectMetrics(db infrastructure.DB) *infrastructure.PrometheusMetrics {
+	metrics := infrastructure.NewPrometheusMetrics(db)
+	return metrics
+}
+
+// InjectTracerProvider TracerProviderを注入
+// exporterが"none"の場合、スパンは記録せずtraceparentの伝播のみを行う(nil)
+func InjectTracerProvider(exporter string, target string, sampleRatio float64) *infrastructure.TracerProvider {
+	if exporter == "" || exporter == infrastructure.TraceExporter_None {
+		infrastructure.SetTracePropagator()
+		return nil
+	}
+	tp, err := infrastructure.NewTracerProvider(exporter, target, sampleRatio)
+	if err != nil {
+		panic(err)
+	}
+	return tp
+}
+
 // InjectRepository repositoryを注入
 func InjectRepository(db infrastructure.DB) domain.UserBalanceRepository {
 	repo := infrastructure.NewUserBalanceRepository(db)
 	return repo
 }
 
+// InjectMemoryRepository インメモリrepositoryを注入
+// seedFileを指定した場合、初期データとしてユーザーを読み込む
+func InjectMemoryRepository(seedFile string) domain.UserBalanceRepository {
+	var users []domain.UserBalanceModel
+	if seedFile != "" {
+		var err error
+		users, err = infrastructure.LoadMemorySeed(seedFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	repo := infrastructure.NewMemoryUserBalanceRepository(users, nil)
+	return repo
+}
+
+// InjectTracedRepository トレース用のデコレータで包んだrepositoryを注入
+func InjectTracedRepository(repo domain.UserBalanceRepository) domain.UserBalanceRepository {
+	traced := infrastructure.NewTracedUserBalanceRepository(repo)
+	return traced
+}
+
+// InjectBalanceCache ユーザー残高のキャッシュを注入
+// sizeが0以下の場合、キャッシュは無効(nil)になる
+func InjectBalanceCache(size int, ttl time.Duration) domain.BalanceCache {
+	if size <= 0 {
+		return nil
+	}
+	cache := infrastructure.NewMemoryBalanceCache(size, ttl)
+	return cache
+}
+
+// InjectCachedRepository ユーザー残高のキャッシュ用のデコレータで包んだrepositoryを注入
+// loadTimeoutはキャッシュにない場合の取得のタイムアウト
+func InjectCachedRepository(repo domain.UserBalanceRepository, cache domain.BalanceCache, metrics domain.MetricsRecorder, loadTimeout time.Duration) domain.UserBalanceRepository {
+	cached := infrastructure.NewCachedUserBalanceRepository(repo, cache, metrics, loadTimeout)
+	return cached
+}
+
 // InjectUsecase usecaseを注入
-func InjectUsecase(repo domain.UserBalanceRepository) domain.UserBalanceUsecase {
-	usecase := usecase.NewUserBalanceUsecase(repo)
+func InjectUsecase(repo domain.UserBalanceRepository, timeout time.Duration, authDisabled bool, hooks ...domain.AfterCommitHook) domain.UserBalanceUsecase {
+	usecase := usecase.NewUserBalanceUsecase(repo, timeout, authDisabled, hooks...)
 	return usecase
 }
 
+// InjectAggregateRefresher 取引履歴の日毎の集計を一定間隔で更新するジョブを注入
+func InjectAggregateRefresher(repo domain.UserBalanceRepository, interval time.Duration, logger domain.Logger) *usecase.AggregateRefresher {
+	refresher := usecase.NewAggregateRefresher(repo, interval, logger)
+	return refresher
+}
+
+// InjectInstrumentedUsecase 計測用のデコレータで包んだusecaseを注入
+func InjectInstrumentedUsecase(next domain.UserBalanceUsecase, metrics domain.MetricsRecorder) domain.UserBalanceUsecase {
+	instrumented := usecase.NewInstrumentedUserBalanceUsecase(next, metrics)
+	return instrumented
+}
+
+// InjectTracedUsecase トレース用のデコレータで包んだusecaseを注入
+func InjectTracedUsecase(next domain.UserBalanceUsecase) domain.UserBalanceUsecase {
+	traced := usecase.NewTracedUserBalanceUsecase(next)
+	return traced
+}
+
+// InjectBalanceEventBroker 残高変更イベントのブローカーを注入
+func InjectBalanceEventBroker() *RestfulHandler.BalanceEventBroker {
+	broker := RestfulHandler.NewBalanceEventBroker()
+	return broker
+}
+
 // InjectRestfulHandler RESTful handlerを注入
 func InjectRestfulHandler(usecase domain.UserBalanceUsecase, app *RestfulHandler.App) *RestfulHandler.RestfulUserBalanceHandler {
 	handler := RestfulHandler.NewRestfulUserBalanceHander(usecase, app)
 	return handler
 }
 
+// InjectGrpcHealthCheckHandler grpcのヘルスチェックhandlerを注入
+func InjectGrpcHealthCheckHandler() *GrpcHandler.HealthCheckHandler {
+	handler := GrpcHandler.NewHealthCheckHandler()
+	return handler
+}
+
+// InjectGateway endpointのgRPCサーバーに変換するゲートウェイを注入
+func InjectGateway(endpoint string) http.Handler {
+	gateway, err := GrpcHandler.NewGateway(context.Background(), endpoint)
+	if err != nil {
+		panic(err)
+	}
+	return gateway
+}
+
 // InjectGrpcHandler grpc handlerを注入
 func InjectGrpcHandler(usecase domain.UserBalanceUsecase, app *GrpcHandler.App) *GrpcHandler.GrpcUserBalanceHander {
 	handler := GrpcHandler.NewGrpcUserBalanceHander(usecase, app)
 	return handler
 }
+
+// InjectGrpcClient gRPCでサーバーを呼び出すusecaseのクライアントを注入
+func InjectGrpcClient(target string, credentials GrpcHandler.ClientCredentials) *GrpcHandler.GrpcUserBalanceClient {
+	client, err := GrpcHandler.NewGrpcUserBalanceClient(target, credentials)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
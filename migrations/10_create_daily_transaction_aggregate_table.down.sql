@@ -0,0 +1,3 @@
+DROP INDEX transaction_history_created_at_idx;
+DROP TABLE transaction_aggregate_state;
+DROP TABLE daily_transaction_aggregate;
@@ -0,0 +1,16 @@
+CREATE TABLE daily_transaction_aggregate(
+    day TIMESTAMP NOT NULL,
+    transaction_type INTEGER NOT NULL,
+    transaction_count BIGINT NOT NULL DEFAULT 0,
+    total_amount BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, transaction_type)
+);
+
+CREATE TABLE transaction_aggregate_state(
+    id INTEGER PRIMARY KEY,
+    refreshed_from TIMESTAMP,
+    refreshed_at TIMESTAMP
+);
+INSERT INTO transaction_aggregate_state (id) VALUES (1);
+
+CREATE INDEX transaction_history_created_at_idx ON transaction_history (created_at);
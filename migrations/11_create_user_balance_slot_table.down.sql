@@ -0,0 +1,3 @@
+UPDATE user_balance SET balance = balance + COALESCE((SELECT SUM(s.balance) FROM user_balance_slot s WHERE s.user_id = user_balance.user_id), 0);
+DROP TABLE user_balance_slot;
+ALTER TABLE user_balance DROP COLUMN balance_slots;
@@ -0,0 +1,12 @@
+ALTER TABLE user_balance ADD COLUMN balance_slots INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE user_balance_slot(
+    user_id VARCHAR(36) NOT NULL,
+    slot INTEGER NOT NULL,
+    balance INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, slot),
+    FOREIGN KEY (user_id) REFERENCES user_balance (user_id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE
+);
@@ -1 +1,2 @@
-DELETE FROM user_balance;
+-- バージョン4で挿入したテストユーザーはdev-seed downで削除する
+SELECT 1;
@@ -1,6 +1,3 @@
-INSERT INTO user_balance (user_id, balance, created_at, updated_at) VALUES
-('test_user1', 100000, '2021-05-29', '2021-05-29'),
-('test_user2', 200000, '2021-05-29', '2021-05-29'),
-('test_user3', 250000, '2021-05-29', '2021-05-29'),
-('test_user4', 150000, '2021-05-29', '2021-05-29'),
-('test_user5', 50000, '2021-05-29', '2021-05-29');
+-- 開発用のテストユーザーはmigrations/seedに移動した(dev-seedで挿入する)
+-- バージョン4を適用済みの既存のDBを引き継げるよう、何もしないマイグレーションとして残す
+SELECT 1;
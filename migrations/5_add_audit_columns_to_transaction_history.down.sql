@@ -0,0 +1,7 @@
+ALTER TABLE transaction_history
+    DROP COLUMN actor,
+    DROP COLUMN reason_code,
+    DROP COLUMN note,
+    DROP COLUMN source,
+    DROP COLUMN client_addr,
+    DROP COLUMN metadata;
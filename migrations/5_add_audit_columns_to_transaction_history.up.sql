@@ -0,0 +1,7 @@
+ALTER TABLE transaction_history
+    ADD COLUMN actor VARCHAR(255),
+    ADD COLUMN reason_code VARCHAR(64),
+    ADD COLUMN note VARCHAR(1000),
+    ADD COLUMN source VARCHAR(16),
+    ADD COLUMN client_addr VARCHAR(64),
+    ADD COLUMN metadata JSONB;
@@ -0,0 +1,2 @@
+DROP INDEX user_balance_merchant_id_idx;
+ALTER TABLE user_balance DROP COLUMN merchant_id;
@@ -0,0 +1,2 @@
+ALTER TABLE user_balance ADD COLUMN merchant_id VARCHAR(36);
+CREATE INDEX user_balance_merchant_id_idx ON user_balance (merchant_id);
@@ -0,0 +1,2 @@
+DROP TABLE user_status_history;
+ALTER TABLE user_balance DROP COLUMN status;
@@ -0,0 +1,18 @@
+ALTER TABLE user_balance
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'debit_frozen', 'frozen', 'closed'));
+CREATE TABLE user_status_history(
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    actor VARCHAR(255),
+    reason_code VARCHAR(64),
+    note VARCHAR(1000),
+    source VARCHAR(16),
+    client_addr VARCHAR(64),
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES user_balance (user_id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE
+);
+CREATE INDEX user_status_history_user_id_created_at_idx ON user_status_history (user_id, created_at);
@@ -0,0 +1,2 @@
+DROP INDEX user_balance_created_at_user_id_idx;
+DROP INDEX user_balance_balance_user_id_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX user_balance_balance_user_id_idx ON user_balance (balance, user_id);
+CREATE INDEX user_balance_created_at_user_id_idx ON user_balance (created_at, user_id);
@@ -0,0 +1,2 @@
+DROP INDEX transaction_history_user_id_created_at_idx;
+ALTER TABLE transaction_history DROP COLUMN balance_after;
@@ -0,0 +1,3 @@
+ALTER TABLE transaction_history ADD COLUMN balance_after INTEGER;
+
+CREATE INDEX transaction_history_user_id_created_at_idx ON transaction_history (user_id, created_at);
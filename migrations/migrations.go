@@ -0,0 +1,18 @@
+package migrations
+
+import "embed"
+
+// FS バイナリに埋め込んだスキーマのマイグレーション({バージョン}_{名前}.up.sql、{バージョン}_{名前}.down.sql)
+//
+//go:embed *.sql
+var FS embed.FS
+
+// SeedUp 開発用のテストユーザーを挿入するSQL(マイグレーションには含めない)
+//
+//go:embed seed/user_balance.up.sql
+var SeedUp string
+
+// SeedDown 開発用のテストユーザーを削除するSQL
+//
+//go:embed seed/user_balance.down.sql
+var SeedDown string
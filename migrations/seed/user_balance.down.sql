@@ -0,0 +1 @@
+DELETE FROM user_balance WHERE user_id IN ('test_user1', 'test_user2', 'test_user3', 'test_user4', 'test_user5');
@@ -0,0 +1,7 @@
+INSERT INTO user_balance (user_id, balance, created_at, updated_at) VALUES
+('test_user1', 100000, '2021-05-29', '2021-05-29'),
+('test_user2', 200000, '2021-05-29', '2021-05-29'),
+('test_user3', 250000, '2021-05-29', '2021-05-29'),
+('test_user4', 150000, '2021-05-29', '2021-05-29'),
+('test_user5', 50000, '2021-05-29', '2021-05-29')
+ON CONFLICT (user_id) DO NOTHING;
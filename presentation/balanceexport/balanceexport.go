@@ -0,0 +1,244 @@
+// Package balanceexport ユーザー残高と取引履歴をCSVまたはNDJSONで書き出す(gzipでの圧縮に対応)
+// RESTfulのダウンロードとCLIのdumpコマンドで共通の形式を扱う
+package balanceexport
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// エクスポートファイルの形式
+const (
+	Format_CSV    = "csv"
+	Format_NDJSON = "ndjson"
+)
+
+// 行の種類(CSVのrecord列とNDJSONのrecordフィールドの値)
+const (
+	Record_Balance     = "balance"
+	Record_Transaction = "transaction"
+)
+
+// header CSVのヘッダー
+// ユーザー残高と取引履歴で共通の列を使い、行の種類に該当しない列は空にする
+var header = []string{
+	"record", "user_id", "balance", "merchant_id", "status",
+	"transaction_id", "transaction_type", "amount", "balance_after", "actor", "reason_code", "note", "source", "metadata",
+	"created_at", "updated_at",
+}
+
+// transactionTypes 絞り込みに指定する取引種類の名前(CLIの表示と同じ)
+var transactionTypes = map[string]domain.TransactionType{
+	"add":     domain.TransactionType_AddUserBalance,
+	"reduce":  domain.TransactionType_ReduceUserBalance,
+	"add-all": domain.TransactionType_AddAllUserBalance,
+}
+
+// balanceRow NDJSONのユーザー残高の行
+type balanceRow struct {
+	Record     string    `json:"record"`
+	UserID     string    `json:"user_id"`
+	Balance    int       `json:"balance"`
+	MerchantID string    `json:"merchant_id,omitempty"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// transactionRow NDJSONの取引履歴の行(一斉加算の場合はuser_idを省略)
+type transactionRow struct {
+	Record          string            `json:"record"`
+	TransactionID   string            `json:"transaction_id"`
+	UserID          string            `json:"user_id,omitempty"`
+	TransactionType int               `json:"transaction_type"`
+	Amount          int               `json:"amount"`
+	BalanceAfter    *int              `json:"balance_after,omitempty"`
+	Actor           string            `json:"actor,omitempty"`
+	ReasonCode      string            `json:"reason_code,omitempty"`
+	Note            string            `json:"note,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// ParseDatasets カンマ区切りのエクスポートする対象を解析(空文字の場合は全て、値はusecaseで検証する)
+func ParseDatasets(s string) []domain.ExportDataset {
+	var datasets []domain.ExportDataset
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			datasets = append(datasets, domain.ExportDataset(name))
+		}
+	}
+	return datasets
+}
+
+// ParseTransactionTypes カンマ区切りの取引種類の名前(add、reduce、add-all)を解析(空文字の場合は全て)
+func ParseTransactionTypes(s string) ([]domain.TransactionType, error) {
+	var types []domain.TransactionType
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		transactionType, ok := transactionTypes[name]
+		if !ok {
+			return nil, errors.New("invalid transaction type")
+		}
+		types = append(types, transactionType)
+	}
+	return types, nil
+}
+
+// ContentType 形式と圧縮の有無に対応するContent-Type
+func ContentType(format string, compress bool) string {
+	if compress {
+		return "application/gzip"
+	} else if format == Format_NDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Extension 形式と圧縮の有無に対応するファイルの拡張子
+func Extension(format string, compress bool) string {
+	if compress {
+		return "." + format + ".gz"
+	}
+	return "." + format
+}
+
+// Writer ユーザー残高と取引履歴を1行ずつ指定した形式で書き出すdomain.ExportWriter
+// 最初の行を受け取るまで何も書き出さないため、エクスポートを開始する前のエラーは呼び出し側で別の形式で返せる
+// 書き出した内容を確定するには最後にCloseを呼び出すこと
+type Writer struct {
+	format   string
+	compress bool
+	out      io.Writer
+	gz       *gzip.Writer
+	csv      *csv.Writer
+	encoder  *json.Encoder
+	started  bool
+}
+
+// NewWriter 形式(csvまたはndjson)とgzipでの圧縮の有無を指定してWriterを作成
+func NewWriter(w io.Writer, format string, compress bool) (*Writer, error) {
+	if format != Format_CSV && format != Format_NDJSON {
+		return nil, errors.New("format must be csv or ndjson")
+	}
+	return &Writer{format: format, compress: compress, out: w}, nil
+}
+
+// Started 1行以上(CSVの場合はヘッダーを含む)書き出したかを判定
+func (w *Writer) Started() bool {
+	return w.started
+}
+
+// start 最初の書き出しの前に圧縮とCSVのヘッダーを準備
+func (w *Writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	out := w.out
+	if w.compress {
+		w.gz = gzip.NewWriter(out)
+		out = w.gz
+	}
+	if w.format == Format_NDJSON {
+		w.encoder = json.NewEncoder(out)
+		return nil
+	}
+	w.csv = csv.NewWriter(out)
+	return w.csv.Write(header)
+}
+
+// WriteUserBalance ユーザー残高の行を書き出す
+func (w *Writer) WriteUserBalance(userBalance domain.UserBalanceModel) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if w.encoder != nil {
+		return w.encoder.Encode(balanceRow{
+			Record:     Record_Balance,
+			UserID:     userBalance.UserID,
+			Balance:    userBalance.Balance,
+			MerchantID: userBalance.MerchantID,
+			Status:     string(userBalance.Status),
+			CreatedAt:  userBalance.CreatedAt,
+			UpdatedAt:  userBalance.UpdatedAt,
+		})
+	}
+	return w.csv.Write([]string{
+		Record_Balance, userBalance.UserID, strconv.Itoa(userBalance.Balance), userBalance.MerchantID, string(userBalance.Status),
+		"", "", "", "", "", "", "", "", "",
+		userBalance.CreatedAt.Format(time.RFC3339Nano), userBalance.UpdatedAt.Format(time.RFC3339Nano),
+	})
+}
+
+// WriteTransactionHistory 取引履歴の行を書き出す
+func (w *Writer) WriteTransactionHistory(history domain.TransactionHistoryModel) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if w.encoder != nil {
+		return w.encoder.Encode(transactionRow{
+			Record:          Record_Transaction,
+			TransactionID:   history.TransactionID,
+			UserID:          history.UserID,
+			TransactionType: int(history.TransactionType),
+			Amount:          history.Amount,
+			BalanceAfter:    history.BalanceAfter,
+			Actor:           history.Actor,
+			ReasonCode:      history.ReasonCode,
+			Note:            history.Note,
+			Source:          string(history.Source),
+			Metadata:        history.Metadata,
+			CreatedAt:       history.CreatedAt,
+			UpdatedAt:       history.UpdatedAt,
+		})
+	}
+	var balanceAfter string
+	if history.BalanceAfter != nil {
+		balanceAfter = strconv.Itoa(*history.BalanceAfter)
+	}
+	var metadata string
+	if len(history.Metadata) > 0 {
+		b, err := json.Marshal(history.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(b)
+	}
+	return w.csv.Write([]string{
+		Record_Transaction, history.UserID, "", "", "",
+		history.TransactionID, strconv.Itoa(int(history.TransactionType)), strconv.Itoa(history.Amount), balanceAfter,
+		history.Actor, history.ReasonCode, history.Note, string(history.Source), metadata,
+		history.CreatedAt.Format(time.RFC3339Nano), history.UpdatedAt.Format(time.RFC3339Nano),
+	})
+}
+
+// Close バッファを書き出し、圧縮を終了する(行がない場合もCSVのヘッダーと空の圧縮データを書き出す)
+// 下位のio.Writerは閉じない
+func (w *Writer) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package balanceexport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+func TestParseTransactionTypes(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Input          string
+		Expected       []domain.TransactionType
+		ExpectedErrMsg string
+	}{
+		{"empty", "", nil, ""},
+		{"names", "add, Reduce,add-all", []domain.TransactionType{domain.TransactionType_AddUserBalance, domain.TransactionType_ReduceUserBalance, domain.TransactionType_AddAllUserBalance}, ""},
+		{"unknown", "add,refund", nil, "invalid transaction type"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			types, err := ParseTransactionTypes(c.Input)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if len(types) != len(c.Expected) {
+				t.Fatalf("expect types %v but got %v", c.Expected, types)
+			}
+			for i := range types {
+				if types[i] != c.Expected[i] {
+					t.Errorf("expect types %v but got %v", c.Expected, types)
+				}
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	created := time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC)
+	balanceAfter := 9500
+	userBalance := domain.UserBalanceModel{UserID: "test_user1", Balance: 10000, MerchantID: "shop1", Status: domain.UserStatus_Active, CreatedAt: created, UpdatedAt: created}
+	history := domain.TransactionHistoryModel{
+		TransactionID:   "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b",
+		UserID:          "test_user1",
+		TransactionType: domain.TransactionType_ReduceUserBalance,
+		Amount:          500,
+		BalanceAfter:    &balanceAfter,
+		AuditInfo:       domain.AuditInfo{Actor: "admin", Note: "line1, \"quoted\"", Metadata: map[string]string{"ticket": "1"}},
+		CreatedAt:       created,
+		UpdatedAt:       created,
+	}
+	cases := []struct {
+		Name          string
+		Format        string
+		Compress      bool
+		Rows          bool
+		ExpectedLines []string
+	}{
+		{"csv", Format_CSV, false, true, []string{
+			strings.Join(header, ","),
+			"balance,test_user1,10000,shop1,active,,,,,,,,,,2021-06-01T09:00:00Z,2021-06-01T09:00:00Z",
+			`transaction,test_user1,,,,b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b,1,500,9500,admin,,"line1, ""quoted""",,"{""ticket"":""1""}",2021-06-01T09:00:00Z,2021-06-01T09:00:00Z`,
+		}},
+		{"ndjson", Format_NDJSON, false, true, []string{
+			`{"record":"balance","user_id":"test_user1","balance":10000,"merchant_id":"shop1","status":"active","created_at":"2021-06-01T09:00:00Z","updated_at":"2021-06-01T09:00:00Z"}`,
+			`{"record":"transaction","transaction_id":"b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b","user_id":"test_user1","transaction_type":1,"amount":500,"balance_after":9500,"actor":"admin","note":"line1, \"quoted\"","metadata":{"ticket":"1"},"created_at":"2021-06-01T09:00:00Z","updated_at":"2021-06-01T09:00:00Z"}`,
+		}},
+		{"gzip csv", Format_CSV, true, true, []string{
+			strings.Join(header, ","),
+			"balance,test_user1,10000,shop1,active,,,,,,,,,,2021-06-01T09:00:00Z,2021-06-01T09:00:00Z",
+			`transaction,test_user1,,,,b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b,1,500,9500,admin,,"line1, ""quoted""",,"{""ticket"":""1""}",2021-06-01T09:00:00Z,2021-06-01T09:00:00Z`,
+		}},
+		{"empty csv", Format_CSV, false, false, []string{strings.Join(header, ",")}},
+		{"empty gzip ndjson", Format_NDJSON, true, false, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, c.Format, c.Compress)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if c.Rows {
+				if w.Started() {
+					t.Errorf("expect writer not to be started before the first row")
+				}
+				if err := w.WriteUserBalance(userBalance); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+				if err := w.WriteTransactionHistory(history); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+
+			b := buf.Bytes()
+			if c.Compress {
+				r, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatalf("expect gzip output but got [%s]", err)
+				}
+				if b, err = ioutil.ReadAll(r); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			if len(c.ExpectedLines) == 0 {
+				got = nil
+				if len(b) != 0 {
+					t.Errorf("expect empty output but got [%s]", b)
+				}
+			}
+			if len(got) != len(c.ExpectedLines) {
+				t.Fatalf("expect %d lines but got [%s]", len(c.ExpectedLines), b)
+			}
+			for i := range got {
+				if got[i] != c.ExpectedLines[i] {
+					t.Errorf("expect line [%s] but got [%s]", c.ExpectedLines[i], got[i])
+				}
+			}
+		})
+	}
+
+	if _, err := NewWriter(ioutil.Discard, "xlsx", false); err == nil || err.Error() != "format must be csv or ndjson" {
+		t.Errorf("expect error [format must be csv or ndjson] but got [%v]", err)
+	}
+}
@@ -0,0 +1,278 @@
+// Package balanceimport 残高操作のインポートファイル(CSVまたはNDJSON)を解析し、usecaseで適用する
+// RESTfulのアップロードとCLIのimportコマンドで共通の形式を扱う
+package balanceimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// インポートファイルの形式
+const (
+	Format_CSV    = "csv"
+	Format_NDJSON = "ndjson"
+)
+
+// 残高操作の種類(CSVのtype列とNDJSONのtypeフィールドの値)
+const (
+	operationType_Add    = "add"
+	operationType_Reduce = "reduce"
+)
+
+// maxLineLength NDJSONの1行の最大長
+const maxLineLength = 64 * 1024
+
+// requiredColumns CSVのヘッダーに必要な列(reason_codeとnoteは任意)
+var requiredColumns = []string{"user_id", "type", "amount", "transaction_id"}
+
+// utf8BOM 表計算ソフトが出力するCSVの先頭に付与されるBOM
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// line NDJSONの1行の形式
+type line struct {
+	UserID        string      `json:"user_id"`
+	Type          string      `json:"type"`
+	Amount        json.Number `json:"amount"`
+	TransactionID string      `json:"transaction_id"`
+	ReasonCode    string      `json:"reason_code"`
+	Note          string      `json:"note"`
+}
+
+// FormatFromFilename ファイルの拡張子から形式を判定(判定できない場合は空文字)
+func FormatFromFilename(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return Format_CSV
+	case ".ndjson", ".jsonl":
+		return Format_NDJSON
+	}
+	return ""
+}
+
+// toOperation 行の値を残高操作に変換(取引種類と金額の形式のみ検証し、その他はusecaseで検証する)
+func toOperation(lineNo int, userID string, operationType string, amount string, transactionID string, reasonCode string, note string) (domain.BalanceOperation, error) {
+	op := domain.BalanceOperation{
+		Line:          lineNo,
+		UserID:        strings.TrimSpace(userID),
+		TransactionID: strings.TrimSpace(transactionID),
+		ReasonCode:    reasonCode,
+		Note:          note,
+	}
+	switch strings.ToLower(strings.TrimSpace(operationType)) {
+	case operationType_Add:
+		op.TransactionType = domain.TransactionType_AddUserBalance
+	case operationType_Reduce:
+		op.TransactionType = domain.TransactionType_ReduceUserBalance
+	default:
+		return op, errors.New("type must be add or reduce")
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(amount), 10, 32)
+	if err != nil {
+		return op, errors.New("amount must be an integer")
+	}
+	op.Amount = int(n)
+	return op, nil
+}
+
+// failedLine 解析に失敗した行の結果
+func failedLine(op domain.BalanceOperation, err error) domain.ImportLineResult {
+	return domain.ImportLineResult{
+		Line:          op.Line,
+		UserID:        op.UserID,
+		TransactionID: op.TransactionID,
+		Status:        domain.ImportLineStatus_Failed,
+		Error:         err.Error(),
+	}
+}
+
+// Parse インポートファイルを解析し、残高操作と解析に失敗した行の結果を返す
+// CSVは1行目をヘッダーとし、行番号はヘッダーを1とするレコードの番号、NDJSONはファイルの行番号(空行は無視する)
+// ヘッダーや形式の誤りなどファイル全体を解析できない場合はエラーを返す
+func Parse(r io.Reader, format string) ([]domain.BalanceOperation, []domain.ImportLineResult, error) {
+	switch format {
+	case Format_CSV:
+		return parseCSV(r)
+	case Format_NDJSON:
+		return parseNDJSON(r)
+	}
+	return nil, nil, errors.New("format must be csv or ndjson")
+}
+
+// parseCSV ヘッダー付きのCSVを解析
+func parseCSV(r io.Reader) ([]domain.BalanceOperation, []domain.ImportLineResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("file is empty")
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = string(bytes.TrimPrefix([]byte(name), utf8BOM))
+		}
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("CSV header must contain %s", strings.Join(requiredColumns, ", "))
+		}
+	}
+	// field 列名で値を取得(任意の列が存在しない場合は空文字)
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	var ops []domain.BalanceOperation
+	var failed []domain.ImportLineResult
+	for lineNo := 2; ; lineNo++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		if len(ops)+len(failed) >= domain.MaxImportOperations {
+			return nil, nil, errors.New("too many operations")
+		}
+		if len(record) != len(header) {
+			failed = append(failed, failedLine(domain.BalanceOperation{Line: lineNo}, errors.New("wrong number of fields")))
+			continue
+		}
+		op, err := toOperation(lineNo, field(record, "user_id"), field(record, "type"), field(record, "amount"),
+			field(record, "transaction_id"), field(record, "reason_code"), field(record, "note"))
+		if err != nil {
+			failed = append(failed, failedLine(op, err))
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, failed, nil
+}
+
+// parseNDJSON 1行に1件のJSONオブジェクトを解析
+func parseNDJSON(r io.Reader) ([]domain.BalanceOperation, []domain.ImportLineResult, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+
+	var ops []domain.BalanceOperation
+	var failed []domain.ImportLineResult
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if lineNo == 1 {
+			text = bytes.TrimPrefix(text, utf8BOM)
+		}
+		if len(text) == 0 {
+			continue
+		}
+		if len(ops)+len(failed) >= domain.MaxImportOperations {
+			return nil, nil, errors.New("too many operations")
+		}
+		var l line
+		if err := json.Unmarshal(text, &l); err != nil {
+			failed = append(failed, failedLine(domain.BalanceOperation{Line: lineNo}, errors.New("line is not a valid JSON object")))
+			continue
+		}
+		op, err := toOperation(lineNo, l.UserID, l.Type, l.Amount.String(), l.TransactionID, l.ReasonCode, l.Note)
+		if err != nil {
+			failed = append(failed, failedLine(op, err))
+			continue
+		}
+		ops = append(ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, nil, errors.New("line is too long")
+		}
+		return nil, nil, err
+	}
+	return ops, failed, nil
+}
+
+// Apply 解析した残高操作をusecaseで適用し、解析に失敗した行を含む行毎の結果を行番号の順に返す
+// atomicの場合は1行でも解析に失敗した場合はusecaseを呼び出さず、他の行を未適用とする
+func Apply(ctx context.Context, usecase domain.UserBalanceUsecase, ops []domain.BalanceOperation, failed []domain.ImportLineResult, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	if mode != "" && mode != domain.ImportMode_Atomic && mode != domain.ImportMode_BestEffort {
+		return nil, errors.New("invalid import mode")
+	}
+	if len(ops)+len(failed) == 0 {
+		return nil, errors.New("operations is empty")
+	}
+
+	if !WillApply(ops, failed, mode) {
+		return DryRun(ops, failed), nil
+	}
+	applied, err := usecase.ImportBalanceOperations(ctx, ops, mode, audit)
+	if err != nil {
+		return nil, err
+	}
+	results := append(append([]domain.ImportLineResult{}, failed...), applied...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+	return results, nil
+}
+
+// WillApply Applyがusecaseを呼び出して残高操作を適用するか
+// atomicの場合は1行でも解析に失敗した場合は適用しない
+func WillApply(ops []domain.BalanceOperation, failed []domain.ImportLineResult, mode domain.ImportMode) bool {
+	return len(ops) > 0 && (len(failed) == 0 || mode == domain.ImportMode_BestEffort)
+}
+
+// DryRun 残高操作を適用せず、解析に失敗した行と未適用の行の結果を行番号の順に返す
+func DryRun(ops []domain.BalanceOperation, failed []domain.ImportLineResult) []domain.ImportLineResult {
+	results := append([]domain.ImportLineResult{}, failed...)
+	for _, op := range ops {
+		results = append(results, domain.ImportLineResult{
+			Line:          op.Line,
+			UserID:        op.UserID,
+			TransactionID: op.TransactionID,
+			Status:        domain.ImportLineStatus_NotApplied,
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+	return results
+}
+
+// Totals 残高操作の加算と減算の金額の合計
+func Totals(ops []domain.BalanceOperation) (added int, reduced int) {
+	for _, op := range ops {
+		if op.TransactionType == domain.TransactionType_ReduceUserBalance {
+			reduced += op.Amount
+		} else {
+			added += op.Amount
+		}
+	}
+	return added, reduced
+}
+
+// Summary 行毎の結果を状態毎に集計
+func Summary(results []domain.ImportLineResult) map[domain.ImportLineStatus]int {
+	summary := map[domain.ImportLineStatus]int{
+		domain.ImportLineStatus_Applied:    0,
+		domain.ImportLineStatus_Skipped:    0,
+		domain.ImportLineStatus_Failed:     0,
+		domain.ImportLineStatus_NotApplied: 0,
+	}
+	for _, result := range results {
+		summary[result.Status]++
+	}
+	return summary
+}
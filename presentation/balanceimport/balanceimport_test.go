@@ -0,0 +1,144 @@
+package balanceimport
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/infrastructure"
+	"github.com/kaitolucifer/user-balance-management/usecase"
+)
+
+// newTestUsecase インメモリrepositoryのusecaseを作成
+func newTestUsecase() (domain.UserBalanceUsecase, domain.UserBalanceRepository) {
+	repo := infrastructure.NewMemoryUserBalanceRepository([]domain.UserBalanceModel{
+		{UserID: "test_user1", Balance: 10000},
+		{UserID: "test_user2", Balance: 20000},
+	}, nil)
+	return usecase.NewUserBalanceUsecase(repo, 3*time.Second, true), repo
+}
+
+// importFile インポートファイルを解析して適用
+func importFile(uc domain.UserBalanceUsecase, file string, format string, mode domain.ImportMode) ([]domain.ImportLineResult, error) {
+	ops, failed, err := Parse(strings.NewReader(file), format)
+	if err != nil {
+		return nil, err
+	}
+	return Apply(context.Background(), uc, ops, failed, mode, domain.AuditInfo{})
+}
+
+func TestFormatFromFilename(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Filename string
+		Expected string
+	}{
+		{"csv", "credits.CSV", Format_CSV},
+		{"ndjson", "credits.ndjson", Format_NDJSON},
+		{"jsonl", "credits.jsonl", Format_NDJSON},
+		{"unknown", "credits.xlsx", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := FormatFromFilename(c.Filename); got != c.Expected {
+				t.Errorf("expect format [%s] but got [%s]", c.Expected, got)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	const csvFile = "\xEF\xBB\xBFuser_id,type,amount,transaction_id,note\n" +
+		"test_user1,add,1000,tx1,campaign\n" +
+		"test_user2, REDUCE ,500,tx2,\n"
+	cases := []struct {
+		Name             string
+		Format           string
+		Mode             domain.ImportMode
+		File             string
+		ExpectedStatuses []domain.ImportLineStatus
+		ExpectedErrors   []string
+		ExpectedLines    []int
+		ExpectedBalance1 int
+		ExpectedErrMsg   string
+	}{
+		{"csv", Format_CSV, domain.ImportMode_Atomic, csvFile,
+			[]domain.ImportLineStatus{domain.ImportLineStatus_Applied, domain.ImportLineStatus_Applied}, []string{"", ""}, []int{2, 3}, 11000, ""},
+		{"ndjson", Format_NDJSON, domain.ImportMode_BestEffort,
+			`{"user_id": "test_user1", "type": "add", "amount": 1000, "transaction_id": "tx1"}` + "\n\n" +
+				`{"user_id": "unknown", "type": "add", "amount": 1000, "transaction_id": "tx2"}` + "\n" +
+				`{"user_id": "test_user2", "type": "reduce", "amount": 1.5, "transaction_id": "tx3"}` + "\n" +
+				`not json` + "\n",
+			[]domain.ImportLineStatus{domain.ImportLineStatus_Applied, domain.ImportLineStatus_Failed, domain.ImportLineStatus_Failed, domain.ImportLineStatus_Failed},
+			[]string{"", "user not found", "amount must be an integer", "line is not a valid JSON object"}, []int{1, 3, 4, 5}, 11000, ""},
+		{"atomic with invalid line", Format_CSV, domain.ImportMode_Atomic,
+			"user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user2,refund,500,tx2\ntest_user2,add\n",
+			[]domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed, domain.ImportLineStatus_Failed},
+			[]string{"", "type must be add or reduce", "wrong number of fields"}, []int{2, 3, 4}, 10000, ""},
+		{"atomic with failed line", Format_CSV, "",
+			"user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user2,reduce,50000,tx2\n",
+			[]domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed},
+			[]string{"", "balance insufficient"}, []int{2, 3}, 10000, ""},
+		{"missing column", Format_CSV, domain.ImportMode_Atomic, "user_id,amount,transaction_id\ntest_user1,1000,tx1\n", nil, nil, nil, 10000,
+			"CSV header must contain user_id, type, amount, transaction_id"},
+		{"header only", Format_CSV, domain.ImportMode_Atomic, "user_id,type,amount,transaction_id\n", nil, nil, nil, 10000, "operations is empty"},
+		{"empty file", Format_CSV, domain.ImportMode_Atomic, "", nil, nil, nil, 10000, "file is empty"},
+		{"unknown format", "xlsx", domain.ImportMode_Atomic, csvFile, nil, nil, nil, 10000, "format must be csv or ndjson"},
+		{"invalid mode", Format_CSV, "all", csvFile, nil, nil, nil, 10000, "invalid import mode"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			uc, repo := newTestUsecase()
+			results, err := importFile(uc, c.File, c.Format, c.Mode)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if len(results) != len(c.ExpectedStatuses) {
+				t.Fatalf("expect [%d] results but got %+v", len(c.ExpectedStatuses), results)
+			}
+			for i, result := range results {
+				if result.Line != c.ExpectedLines[i] || result.Status != c.ExpectedStatuses[i] || result.Error != c.ExpectedErrors[i] {
+					t.Errorf("expect line [%d] to be [%s %s] but got %+v", c.ExpectedLines[i], c.ExpectedStatuses[i], c.ExpectedErrors[i], result)
+				}
+			}
+			userBalance, _ := repo.QueryUserBalanceByUserID(context.Background(), "test_user1")
+			if userBalance.Balance != c.ExpectedBalance1 {
+				t.Errorf("expect balance of test_user1 [%d] but got [%d]", c.ExpectedBalance1, userBalance.Balance)
+			}
+		})
+	}
+}
+
+func TestReimport(t *testing.T) {
+	const file = "user_id,type,amount,transaction_id\ntest_user1,add,1000,tx1\ntest_user2,reduce,500,tx2\n"
+	uc, repo := newTestUsecase()
+	for _, mode := range []domain.ImportMode{domain.ImportMode_Atomic, domain.ImportMode_Atomic, domain.ImportMode_BestEffort} {
+		if _, err := importFile(uc, file, Format_CSV, mode); err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+	}
+
+	results, err := importFile(uc, file, Format_CSV, domain.ImportMode_Atomic)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if summary := Summary(results); summary[domain.ImportLineStatus_Skipped] != 2 || summary[domain.ImportLineStatus_Applied] != 0 {
+		t.Errorf("expect all lines to be skipped but got %v", summary)
+	}
+	for userID, expected := range map[string]int{"test_user1": 11000, "test_user2": 19500} {
+		userBalance, _ := repo.QueryUserBalanceByUserID(context.Background(), userID)
+		if userBalance.Balance != expected {
+			t.Errorf("expect balance of %s [%d] but got [%d]", userID, expected, userBalance.Balance)
+		}
+	}
+}
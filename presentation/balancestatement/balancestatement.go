@@ -0,0 +1,82 @@
+// Package balancestatement 取引明細の期間を解析し、取引明細をCSVで書き出す
+// RESTfulのダウンロードとCLIのstatementコマンドで共通の形式を扱う
+package balancestatement
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// 行の種類(CSVのrecord列の値)
+const (
+	Record_Opening     = "opening"
+	Record_Transaction = "transaction"
+	Record_Closing     = "closing"
+	Record_Total       = "total"
+)
+
+// header CSVのヘッダー
+// 期間の開始時点の残高、取引、終了時点の残高、取引種類毎の合計の順に出力し、行の種類に該当しない列は空にする
+var header = []string{
+	"record", "transaction_id", "created_at", "transaction_type", "amount", "balance_after", "count",
+	"actor", "reason_code", "note",
+}
+
+// ParsePeriod 月(YYYY-MM、UTC)またはRFC3339の開始日時と終了日時から取引明細の期間を解析
+// 月を指定した場合はその月の初日から翌月の初日まで、指定しない場合は開始日時と終了日時が必要
+func ParsePeriod(month string, from string, to string) (time.Time, time.Time, error) {
+	if month != "" {
+		if from != "" || to != "" {
+			return time.Time{}, time.Time{}, errors.New("specify either month or from and to")
+		}
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("month must be YYYY-MM")
+		}
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	if from == "" || to == "" {
+		return time.Time{}, time.Time{}, errors.New("month or from and to is required")
+	}
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("from must be RFC3339")
+	}
+	end, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("to must be RFC3339")
+	}
+	return start, end, nil
+}
+
+// WriteCSV 取引明細をCSVで書き出す(取引種類は数値、日時はRFC3339)
+func WriteCSV(w io.Writer, statement domain.Statement) error {
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.Write([]string{Record_Opening, "", statement.From.Format(time.RFC3339Nano), "", "", strconv.Itoa(statement.OpeningBalance), "", "", "", ""})
+	for _, history := range statement.Transactions {
+		var balanceAfter string
+		if history.BalanceAfter != nil {
+			balanceAfter = strconv.Itoa(*history.BalanceAfter)
+		}
+		writer.Write([]string{
+			Record_Transaction, history.TransactionID, history.CreatedAt.Format(time.RFC3339Nano),
+			strconv.Itoa(int(history.TransactionType)), strconv.Itoa(history.Amount), balanceAfter, "",
+			history.Actor, history.ReasonCode, history.Note,
+		})
+	}
+	writer.Write([]string{Record_Closing, "", statement.To.Format(time.RFC3339Nano), "", "", strconv.Itoa(statement.ClosingBalance), "", "", "", ""})
+	for _, total := range statement.Totals {
+		writer.Write([]string{
+			Record_Total, "", "", strconv.Itoa(int(total.TransactionType)), strconv.FormatInt(total.Amount, 10), "",
+			strconv.Itoa(total.Count), "", "", "",
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
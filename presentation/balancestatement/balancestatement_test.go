@@ -0,0 +1,87 @@
+package balancestatement
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+func TestParsePeriod(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Month          string
+		From           string
+		To             string
+		ExpectedFrom   string
+		ExpectedTo     string
+		ExpectedErrMsg string
+	}{
+		{"month", "2021-12", "", "", "2021-12-01T00:00:00Z", "2022-01-01T00:00:00Z", ""},
+		{"from and to", "", "2021-06-01T00:00:00+09:00", "2021-06-15T00:00:00+09:00", "2021-06-01T00:00:00+09:00", "2021-06-15T00:00:00+09:00", ""},
+		{"invalid month", "2021-6", "", "", "", "", "month must be YYYY-MM"},
+		{"month with from", "2021-06", "2021-06-01T00:00:00Z", "", "", "", "specify either month or from and to"},
+		{"missing to", "", "2021-06-01T00:00:00Z", "", "", "", "month or from and to is required"},
+		{"invalid from", "", "2021-06-01", "2021-07-01T00:00:00Z", "", "", "from must be RFC3339"},
+		{"invalid to", "", "2021-06-01T00:00:00Z", "2021-07-01", "", "", "to must be RFC3339"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			from, to, err := ParsePeriod(c.Month, c.From, c.To)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+				return
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if from.Format(time.RFC3339) != c.ExpectedFrom || to.Format(time.RFC3339) != c.ExpectedTo {
+				t.Errorf("expect period [%s, %s) but got [%s, %s)", c.ExpectedFrom, c.ExpectedTo, from.Format(time.RFC3339), to.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	from, to, _ := ParsePeriod("2021-06", "", "")
+	balanceAfter := 9000
+	statement := domain.Statement{
+		UserID:         "test_user1",
+		From:           from,
+		To:             to,
+		OpeningBalance: 8000,
+		ClosingBalance: 9000,
+		Transactions: []domain.TransactionHistoryModel{
+			{TransactionID: "tx1", TransactionType: domain.TransactionType_AddAllUserBalance, Amount: 1000, BalanceAfter: &balanceAfter,
+				AuditInfo: domain.AuditInfo{Actor: "admin", Note: "bonus, june"}, CreatedAt: from.Add(time.Hour)},
+		},
+		Totals: []domain.StatementTotal{{TransactionType: domain.TransactionType_AddAllUserBalance, Count: 1, Amount: 1000}},
+	}
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, statement); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+
+	expected := []string{
+		"record,transaction_id,created_at,transaction_type,amount,balance_after,count,actor,reason_code,note",
+		"opening,,2021-06-01T00:00:00Z,,,8000,,,,",
+		`transaction,tx1,2021-06-01T01:00:00Z,2,1000,9000,,admin,,"bonus, june"`,
+		"closing,,2021-07-01T00:00:00Z,,,9000,,,,",
+		"total,,,2,1000,,1,,,",
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(got) != len(expected) {
+		t.Fatalf("expect %d lines but got [%s]", len(expected), buf.String())
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("expect line [%s] but got [%s]", expected[i], got[i])
+		}
+	}
+}
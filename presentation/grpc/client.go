@@ -0,0 +1,545 @@
+package presentation
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ClientCredentials gRPCクライアントがサーバーの認証に使用する資格情報(APIキーを優先する)
+type ClientCredentials struct {
+	APIKey string
+	Token  string
+}
+
+// GrpcUserBalanceClient gRPCでサーバーを呼び出し、usecaseと同じインタフェースを提供するクライアント
+// 取引の実行者は監査情報のActorをメタデータで送信する(認証が有効な場合はサーバーで認証された主体が優先される)
+type GrpcUserBalanceClient struct {
+	conn        *grpc.ClientConn
+	client      proto.UserBalanceClient
+	credentials ClientCredentials
+}
+
+// NewGrpcUserBalanceClient 新しいgRPCクライアントを作成
+func NewGrpcUserBalanceClient(target string, credentials ClientCredentials) (*GrpcUserBalanceClient, error) {
+	conn, err := grpc.Dial(target, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcUserBalanceClient{
+		conn:        conn,
+		client:      proto.NewUserBalanceClient(conn),
+		credentials: credentials,
+	}, nil
+}
+
+// Close サーバーとの接続を閉じる
+func (c *GrpcUserBalanceClient) Close() error {
+	return c.conn.Close()
+}
+
+// outgoingContext 資格情報と実行者をメタデータに設定したコンテキストを作成
+func (c *GrpcUserBalanceClient) outgoingContext(ctx context.Context, actor string) context.Context {
+	var pairs []string
+	if c.credentials.APIKey != "" {
+		pairs = append(pairs, apiKeyMetadataKey, c.credentials.APIKey)
+	} else if c.credentials.Token != "" {
+		pairs = append(pairs, "authorization", "Bearer "+c.credentials.Token)
+	}
+	if actor != "" {
+		pairs = append(pairs, actorMetadataKey, actor)
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+// fromStatusError gRPCのステータスのErrorInfoからusecaseと同じエラーに変換するヘルパー
+// ErrorInfoを持たないエラー(接続の失敗など)はそのまま返す
+func fromStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != errorDomain {
+			continue
+		}
+		for msg, reason := range errorReasons {
+			if reason == info.Reason {
+				return errors.New(msg)
+			}
+		}
+	}
+	return err
+}
+
+// AddBalance ユーザー残高を加算
+func (c *GrpcUserBalanceClient) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	_, err := c.client.ChangeBalanceByUserID(c.outgoingContext(ctx, audit.Actor), &proto.ChangeUserBalanceRequest{
+		UserId:        userID,
+		TransactionId: transactionID,
+		Amount:        int32(amount),
+		ReasonCode:    audit.ReasonCode,
+		Note:          audit.Note,
+		Metadata:      audit.Metadata,
+	})
+	return fromStatusError(err)
+}
+
+// ReduceBalance ユーザー残高を減算
+func (c *GrpcUserBalanceClient) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	_, err := c.client.ChangeBalanceByUserID(c.outgoingContext(ctx, audit.Actor), &proto.ChangeUserBalanceRequest{
+		UserId:        userID,
+		TransactionId: transactionID,
+		Amount:        -int32(amount),
+		ReasonCode:    audit.ReasonCode,
+		Note:          audit.Note,
+		Metadata:      audit.Metadata,
+	})
+	return fromStatusError(err)
+}
+
+// AddAllUserBalance ユーザー残高を一斉に加算
+func (c *GrpcUserBalanceClient) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
+	_, err := c.client.AddAllUserBalance(c.outgoingContext(ctx, audit.Actor), &proto.AddAllUserBalanceRequest{
+		TransactionId: transactionID,
+		Amount:        int32(amount),
+		ReasonCode:    audit.ReasonCode,
+		Note:          audit.Note,
+		Metadata:      audit.Metadata,
+	})
+	return fromStatusError(err)
+}
+
+// GetBalance ユーザー残高を取得
+func (c *GrpcUserBalanceClient) GetBalance(ctx context.Context, userID string) (int, error) {
+	resp, err := c.client.GetBalanceByUserID(c.outgoingContext(ctx, ""), &proto.GetUserBalanceRequest{UserId: userID})
+	if err != nil {
+		return 0, fromStatusError(err)
+	}
+	return int(resp.Balance), nil
+}
+
+// GetTransactionHistory 指定した取引以降のユーザーに関わる取引履歴を取得
+func (c *GrpcUserBalanceClient) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	resp, err := c.client.GetTransactionHistory(c.outgoingContext(ctx, ""), &proto.GetTransactionHistoryRequest{
+		UserId:             userID,
+		AfterTransactionId: afterTransactionID,
+	})
+	if err != nil {
+		return nil, fromStatusError(err)
+	}
+
+	histories := make([]domain.TransactionHistoryModel, 0, len(resp.Histories))
+	for _, history := range resp.Histories {
+		histories = append(histories, fromProtoTransactionHistory(history))
+	}
+	return histories, nil
+}
+
+// TransferBalance ユーザー間で残高を振り替える
+func (c *GrpcUserBalanceClient) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	_, err := c.client.TransferBalance(c.outgoingContext(ctx, audit.Actor), &proto.TransferBalanceRequest{
+		FromUserId:    fromUserID,
+		ToUserId:      toUserID,
+		TransactionId: transactionID,
+		Amount:        int32(amount),
+		ReasonCode:    audit.ReasonCode,
+		Note:          audit.Note,
+		Metadata:      audit.Metadata,
+	})
+	return fromStatusError(err)
+}
+
+// CreateUser ユーザーを作成
+func (c *GrpcUserBalanceClient) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	_, err := c.client.CreateUser(c.outgoingContext(ctx, audit.Actor), &proto.CreateUserRequest{
+		UserId:         userID,
+		MerchantId:     merchantID,
+		OpeningBalance: int32(openingBalance),
+		TransactionId:  transactionID,
+		ReasonCode:     audit.ReasonCode,
+		Note:           audit.Note,
+		Metadata:       audit.Metadata,
+	})
+	return fromStatusError(err)
+}
+
+// GetUser ユーザーの状態を含む情報を取得
+func (c *GrpcUserBalanceClient) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	resp, err := c.client.GetUser(c.outgoingContext(ctx, ""), &proto.GetUserRequest{UserId: userID})
+	if err != nil {
+		return domain.UserBalanceModel{}, fromStatusError(err)
+	}
+
+	return fromProtoUser(resp), nil
+}
+
+// fromProtoUser レスポンスのメッセージをユーザーの情報に変換
+func fromProtoUser(resp *proto.User) domain.UserBalanceModel {
+	return domain.UserBalanceModel{
+		UserID:     resp.UserId,
+		Balance:    int(resp.Balance),
+		MerchantID: resp.MerchantId,
+		Status:     protoUserStatuses[resp.Status],
+		CreatedAt:  resp.CreatedAt.AsTime(),
+		UpdatedAt:  resp.UpdatedAt.AsTime(),
+	}
+}
+
+// FreezeUser ユーザーを凍結
+func (c *GrpcUserBalanceClient) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	req := &proto.FreezeUserRequest{
+		UserId:     userID,
+		ReasonCode: audit.ReasonCode,
+		Note:       audit.Note,
+	}
+	for protoScope, s := range freezeScopes {
+		if s == scope {
+			req.Scope = protoScope
+		}
+	}
+	_, err := c.client.FreezeUser(c.outgoingContext(ctx, audit.Actor), req)
+	return fromStatusError(err)
+}
+
+// UnfreezeUser ユーザーの凍結を解除
+func (c *GrpcUserBalanceClient) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	_, err := c.client.UnfreezeUser(c.outgoingContext(ctx, audit.Actor), &proto.ChangeUserStatusRequest{
+		UserId:     userID,
+		ReasonCode: audit.ReasonCode,
+		Note:       audit.Note,
+	})
+	return fromStatusError(err)
+}
+
+// CloseUser ユーザーを解約
+func (c *GrpcUserBalanceClient) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	_, err := c.client.CloseUser(c.outgoingContext(ctx, audit.Actor), &proto.ChangeUserStatusRequest{
+		UserId:     userID,
+		ReasonCode: audit.ReasonCode,
+		Note:       audit.Note,
+	})
+	return fromStatusError(err)
+}
+
+// fromProtoTransactionHistory レスポンスのメッセージを取引履歴に変換するヘルパー
+func fromProtoTransactionHistory(history *proto.TransactionHistory) domain.TransactionHistoryModel {
+	model := domain.TransactionHistoryModel{
+		TransactionID: history.TransactionId,
+		UserID:        history.UserId,
+		Amount:        int(history.Amount),
+		AuditInfo: domain.AuditInfo{
+			Actor:      history.Actor,
+			ReasonCode: history.ReasonCode,
+			Note:       history.Note,
+			Source:     domain.RequestSource(history.Source),
+			Metadata:   history.Metadata,
+		},
+		CreatedAt: history.CreatedAt.AsTime(),
+		UpdatedAt: history.UpdatedAt.AsTime(),
+	}
+	if history.BalanceAfter != nil {
+		balanceAfter := int(history.BalanceAfter.Value)
+		model.BalanceAfter = &balanceAfter
+	}
+	model.TransactionType = fromProtoTransactionType(history.TransactionType)
+	return model
+}
+
+// fromProtoTransactionType Protocol Buffersの列挙型を取引種類に変換
+func fromProtoTransactionType(protoType proto.TransactionType) domain.TransactionType {
+	for transactionType, p := range transactionTypes {
+		if p == protoType {
+			return transactionType
+		}
+	}
+	return domain.TransactionType_AddUserBalance
+}
+
+// GetStatement ユーザーの期間内の取引明細を作成
+func (c *GrpcUserBalanceClient) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	req := &proto.GetStatementRequest{UserId: userID}
+	if !from.IsZero() {
+		req.From = timestamppb.New(from)
+	}
+	if !to.IsZero() {
+		req.To = timestamppb.New(to)
+	}
+	resp, err := c.client.GetStatement(c.outgoingContext(ctx, ""), req)
+	if err != nil {
+		return domain.Statement{}, fromStatusError(err)
+	}
+
+	statement := domain.Statement{
+		UserID:         resp.UserId,
+		From:           resp.From.AsTime(),
+		To:             resp.To.AsTime(),
+		OpeningBalance: int(resp.OpeningBalance),
+		ClosingBalance: int(resp.ClosingBalance),
+		Transactions:   make([]domain.TransactionHistoryModel, 0, len(resp.Transactions)),
+	}
+	for _, history := range resp.Transactions {
+		statement.Transactions = append(statement.Transactions, fromProtoTransactionHistory(history))
+	}
+	for _, total := range resp.Totals {
+		statement.Totals = append(statement.Totals, domain.StatementTotal{
+			TransactionType: fromProtoTransactionType(total.TransactionType),
+			Count:           int(total.Count),
+			Amount:          total.Amount,
+		})
+	}
+	return statement, nil
+}
+
+// GetReport 全ユーザーの残高の合計と期間毎の取引量の集計レポートを作成
+// 未知の期間の単位は存在しない列挙値として送信し、サーバーのエラーとして返す
+func (c *GrpcUserBalanceClient) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	req := &proto.GetReportRequest{}
+	if q.Granularity != "" {
+		granularity, ok := reportGranularities[q.Granularity]
+		if !ok {
+			granularity = proto.ReportGranularity(-1)
+		}
+		req.Granularity = granularity
+	}
+	if !q.From.IsZero() {
+		req.From = timestamppb.New(q.From)
+	}
+	if !q.To.IsZero() {
+		req.To = timestamppb.New(q.To)
+	}
+	resp, err := c.client.GetReport(c.outgoingContext(ctx, ""), req)
+	if err != nil {
+		return domain.Report{}, fromStatusError(err)
+	}
+
+	report := domain.Report{
+		From:            resp.From.AsTime(),
+		To:              resp.To.AsTime(),
+		TotalBalance:    resp.TotalBalance,
+		TotalUsers:      resp.TotalUsers,
+		Balances:        make([]domain.BalanceStatusTotal, 0, len(resp.Balances)),
+		Periods:         make([]domain.ReportPeriod, 0, len(resp.Periods)),
+		Totals:          fromProtoReportVolumes(resp.Totals),
+		AggregatedUntil: resp.AggregatedUntil.AsTime(),
+	}
+	for g, p := range reportGranularities {
+		if p == resp.Granularity {
+			report.Granularity = g
+		}
+	}
+	for _, total := range resp.Balances {
+		report.Balances = append(report.Balances, domain.BalanceStatusTotal{
+			Status:  protoUserStatuses[total.Status],
+			Users:   total.Users,
+			Balance: total.Balance,
+		})
+	}
+	for _, period := range resp.Periods {
+		report.Periods = append(report.Periods, domain.ReportPeriod{
+			Start:   period.Start.AsTime(),
+			End:     period.End.AsTime(),
+			Credit:  period.Credit,
+			Debit:   period.Debit,
+			Volumes: fromProtoReportVolumes(period.Volumes),
+		})
+	}
+	return report, nil
+}
+
+// fromProtoReportVolumes レスポンスのメッセージを取引種類毎の取引量に変換するヘルパー
+func fromProtoReportVolumes(volumes []*proto.ReportVolume) []domain.ReportVolume {
+	resp := make([]domain.ReportVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		resp = append(resp, domain.ReportVolume{
+			TransactionType: fromProtoTransactionType(volume.TransactionType),
+			Count:           volume.Count,
+			Amount:          volume.Amount,
+		})
+	}
+	return resp
+}
+
+// BatchGetBalances 複数のユーザーの残高を一括で取得
+func (c *GrpcUserBalanceClient) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	resp, err := c.client.BatchGetBalances(c.outgoingContext(ctx, ""), &proto.BatchGetBalancesRequest{UserIds: userIDs})
+	if err != nil {
+		return nil, fromStatusError(err)
+	}
+
+	results := make([]domain.BalanceResult, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		results = append(results, domain.BalanceResult{
+			UserID:  result.UserId,
+			Balance: int(result.Balance),
+			Found:   result.Found,
+		})
+	}
+	return results, nil
+}
+
+// ListAccounts 条件で絞り込んだユーザーを並び替えてページ毎に取得
+func (c *GrpcUserBalanceClient) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	req := &proto.ListAccountsRequest{
+		MerchantId: q.MerchantID,
+		Descending: q.Descending,
+		PageSize:   int32(q.PageSize),
+		PageToken:  q.AfterUserID,
+	}
+	if q.MinBalance != nil {
+		req.MinBalance = wrapperspb.Int32(int32(*q.MinBalance))
+	}
+	if q.MaxBalance != nil {
+		req.MaxBalance = wrapperspb.Int32(int32(*q.MaxBalance))
+	}
+	for _, s := range q.Statuses {
+		req.Statuses = append(req.Statuses, userStatuses[s])
+	}
+	if !q.CreatedAfter.IsZero() {
+		req.CreatedAfter = timestamppb.New(q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		req.CreatedBefore = timestamppb.New(q.CreatedBefore)
+	}
+	for protoField, field := range accountSortFields {
+		if field == q.SortBy {
+			req.SortBy = protoField
+		}
+	}
+
+	resp, err := c.client.ListAccounts(c.outgoingContext(ctx, ""), req)
+	if err != nil {
+		return nil, "", fromStatusError(err)
+	}
+	users := make([]domain.UserBalanceModel, 0, len(resp.Users))
+	for _, user := range resp.Users {
+		users = append(users, fromProtoUser(user))
+	}
+	return users, resp.NextPageToken, nil
+}
+
+// ImportBalanceOperations 複数の残高操作を行毎に検証して適用し、行毎の結果を取得
+func (c *GrpcUserBalanceClient) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	req := &proto.ImportBalanceOperationsRequest{
+		ReasonCode: audit.ReasonCode,
+		Note:       audit.Note,
+		Metadata:   audit.Metadata,
+	}
+	if mode != "" {
+		for protoMode, m := range importModes {
+			if m == mode {
+				req.Mode = protoMode
+			}
+		}
+		if req.Mode == proto.ImportMode_IMPORT_MODE_UNSPECIFIED {
+			return nil, errors.New("invalid import mode")
+		}
+	}
+	for _, op := range ops {
+		req.Operations = append(req.Operations, &proto.BalanceOperation{
+			Line:            int32(op.Line),
+			UserId:          op.UserID,
+			TransactionType: transactionTypes[op.TransactionType],
+			Amount:          int32(op.Amount),
+			TransactionId:   op.TransactionID,
+			ReasonCode:      op.ReasonCode,
+			Note:            op.Note,
+		})
+	}
+
+	resp, err := c.client.ImportBalanceOperations(c.outgoingContext(ctx, audit.Actor), req)
+	if err != nil {
+		return nil, fromStatusError(err)
+	}
+
+	results := make([]domain.ImportLineResult, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		r := domain.ImportLineResult{
+			Line:          int(result.Line),
+			UserID:        result.UserId,
+			TransactionID: result.TransactionId,
+			Error:         result.Error,
+		}
+		for s, protoStatus := range importLineStatuses {
+			if protoStatus == result.Status {
+				r.Status = s
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// Export ユーザー残高と取引履歴をストリームで受信し、1件ずつwriterに渡す
+func (c *GrpcUserBalanceClient) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	var summary domain.ExportSummary
+	req := &proto.ExportRequest{}
+	for _, dataset := range q.Datasets {
+		var protoDataset proto.ExportDataset
+		for p, d := range exportDatasets {
+			if d == dataset {
+				protoDataset = p
+			}
+		}
+		if protoDataset == proto.ExportDataset_EXPORT_DATASET_UNSPECIFIED {
+			return summary, errors.New("invalid export dataset")
+		}
+		req.Datasets = append(req.Datasets, protoDataset)
+	}
+	if !q.From.IsZero() {
+		req.From = timestamppb.New(q.From)
+	}
+	if !q.To.IsZero() {
+		req.To = timestamppb.New(q.To)
+	}
+	for _, transactionType := range q.TransactionTypes {
+		protoType, ok := transactionTypes[transactionType]
+		if !ok {
+			return summary, errors.New("invalid transaction type")
+		}
+		req.TransactionTypes = append(req.TransactionTypes, protoType)
+	}
+
+	// writerのエラーで受信を中断した場合にストリームを閉じる
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.client.Export(c.outgoingContext(ctx, ""), req)
+	if err != nil {
+		return summary, fromStatusError(err)
+	}
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			return summary, nil
+		} else if err != nil {
+			return summary, fromStatusError(err)
+		}
+		if balance := record.GetBalance(); balance != nil {
+			userBalance := fromProtoUser(balance)
+			if err := w.WriteUserBalance(userBalance); err != nil {
+				return summary, err
+			}
+			summary.Balances++
+			summary.TotalBalance += int64(userBalance.Balance)
+		} else if transaction := record.GetTransaction(); transaction != nil {
+			if err := w.WriteTransactionHistory(fromProtoTransactionHistory(transaction)); err != nil {
+				return summary, err
+			}
+			summary.Transactions++
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package presentation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// startClientServer テスト用のgRPCサーバーを起動し、接続したクライアントとサーバーが受け取ったメタデータを返す
+func startClientServer(t *testing.T, credentials ClientCredentials) (*GrpcUserBalanceClient, *metadata.MD) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	received := new(metadata.MD)
+	s := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		*received, _ = metadata.FromIncomingContext(ctx)
+		return handler(ctx, req)
+	}), grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		*received, _ = metadata.FromIncomingContext(ss.Context())
+		return handler(srv, ss)
+	}))
+	proto.RegisterUserBalanceServer(s, handler)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	client, err := NewGrpcUserBalanceClient(listener.Addr().String(), credentials)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, received
+}
+
+// recordingExportWriter エクスポートで受信した行を記録するwriter
+type recordingExportWriter struct {
+	balances  []domain.UserBalanceModel
+	histories []domain.TransactionHistoryModel
+}
+
+func (w *recordingExportWriter) WriteUserBalance(userBalance domain.UserBalanceModel) error {
+	w.balances = append(w.balances, userBalance)
+	return nil
+}
+
+func (w *recordingExportWriter) WriteTransactionHistory(history domain.TransactionHistoryModel) error {
+	w.histories = append(w.histories, history)
+	return nil
+}
+
+func TestGrpcUserBalanceClient(t *testing.T) {
+	client, received := startClientServer(t, ClientCredentials{APIKey: "key"})
+	const transactionID = "917cd5c0-0bfc-4283-bc88-b5de8ad13635"
+	audit := domain.AuditInfo{Actor: "operator1", ReasonCode: "refund"}
+
+	cases := []struct {
+		Name           string
+		Call           func(ctx context.Context) error
+		ExpectedErrMsg string
+		ExpectedActor  string
+	}{
+		{"get balance", func(ctx context.Context) error {
+			balance, err := client.GetBalance(ctx, "test_user1")
+			if err == nil && balance != 10000 {
+				t.Errorf("expect balance [10000] but got [%d]", balance)
+			}
+			return err
+		}, "", ""},
+		{"user not found", func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, "unknown")
+			return err
+		}, "user not found", ""},
+		{"add balance", func(ctx context.Context) error {
+			return client.AddBalance(ctx, "test_user1", 1000, transactionID, audit)
+		}, "", "operator1"},
+		{"reduce balance insufficient", func(ctx context.Context) error {
+			return client.ReduceBalance(ctx, "test_user1", 100000, transactionID, audit)
+		}, "balance insufficient", "operator1"},
+		{"add all duplicated transaction_id", func(ctx context.Context) error {
+			return client.AddAllUserBalance(ctx, 1000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", audit)
+		}, "transaction_id must be unique", "operator1"},
+		{"transfer to the same user", func(ctx context.Context) error {
+			return client.TransferBalance(ctx, "test_user1", "test_user1", 1000, transactionID, audit)
+		}, "can't transfer to the same user", "operator1"},
+		{"transfer", func(ctx context.Context) error {
+			return client.TransferBalance(ctx, "test_user1", "test_user2", 1000, transactionID, audit)
+		}, "", "operator1"},
+		{"transaction history", func(ctx context.Context) error {
+			histories, err := client.GetTransactionHistory(ctx, "test_user1", "")
+			if err == nil && (len(histories) != 1 || histories[0].TransactionType != domain.TransactionType_AddUserBalance || histories[0].Amount != 5000) {
+				t.Errorf("unexpected histories %+v", histories)
+			}
+			return err
+		}, "", ""},
+		{"create user", func(ctx context.Context) error {
+			return client.CreateUser(ctx, "new_user", "shop1", 1000, transactionID, audit)
+		}, "", "operator1"},
+		{"create existing user", func(ctx context.Context) error {
+			return client.CreateUser(ctx, "test_user1", "", 0, "", audit)
+		}, "user already exists", "operator1"},
+		{"get user", func(ctx context.Context) error {
+			user, err := client.GetUser(ctx, "frozen_user")
+			if err == nil && (user.UserID != "frozen_user" || user.Status != domain.UserStatus_Frozen) {
+				t.Errorf("unexpected user %+v", user)
+			}
+			return err
+		}, "", ""},
+		{"freeze user", func(ctx context.Context) error {
+			return client.FreezeUser(ctx, "test_user1", domain.FreezeScope_Debit, audit)
+		}, "", "operator1"},
+		{"freeze user with invalid scope", func(ctx context.Context) error {
+			return client.FreezeUser(ctx, "test_user1", domain.FreezeScope("credit"), audit)
+		}, "invalid freeze scope", "operator1"},
+		{"unfreeze active user", func(ctx context.Context) error {
+			return client.UnfreezeUser(ctx, "test_user1", audit)
+		}, "user is not frozen", "operator1"},
+		{"close user with balance", func(ctx context.Context) error {
+			return client.CloseUser(ctx, "test_user1", audit)
+		}, "balance is not zero", "operator1"},
+		{"batch get balances", func(ctx context.Context) error {
+			results, err := client.BatchGetBalances(ctx, []string{"test_user2", "unknown"})
+			if err == nil && (len(results) != 2 || results[0].Balance != 20000 || !results[0].Found || results[1].Found) {
+				t.Errorf("unexpected results %+v", results)
+			}
+			return err
+		}, "", ""},
+		{"list accounts", func(ctx context.Context) error {
+			minBalance := 40000
+			users, nextPageToken, err := client.ListAccounts(ctx, domain.ListAccountsQuery{MinBalance: &minBalance, PageSize: 1})
+			if err == nil && (len(users) != 1 || users[0].UserID != "test_user4" || users[0].Status != domain.UserStatus_Active || nextPageToken != "test_user4") {
+				t.Errorf("unexpected accounts %+v [%s]", users, nextPageToken)
+			}
+			return err
+		}, "", ""},
+		{"list accounts with invalid status", func(ctx context.Context) error {
+			_, _, err := client.ListAccounts(ctx, domain.ListAccountsQuery{Statuses: []domain.UserStatus{"deleted"}})
+			return err
+		}, "invalid user status", ""},
+		{"import balance operations", func(ctx context.Context) error {
+			results, err := client.ImportBalanceOperations(ctx, []domain.BalanceOperation{
+				{Line: 2, UserID: "test_user1", TransactionType: domain.TransactionType_ReduceUserBalance, Amount: 1000, TransactionID: transactionID},
+				{Line: 3, UserID: "unknown", TransactionType: domain.TransactionType_AddUserBalance, Amount: 1000, TransactionID: "tx2"},
+			}, domain.ImportMode_BestEffort, audit)
+			if err == nil && (len(results) != 2 || results[0].Status != domain.ImportLineStatus_Applied || results[1].Line != 3 ||
+				results[1].Status != domain.ImportLineStatus_Failed || results[1].Error != "user not found") {
+				t.Errorf("unexpected results %+v", results)
+			}
+			return err
+		}, "", "operator1"},
+		{"import no balance operations", func(ctx context.Context) error {
+			_, err := client.ImportBalanceOperations(ctx, nil, domain.ImportMode_Atomic, audit)
+			return err
+		}, "operations is empty", "operator1"},
+		{"export", func(ctx context.Context) error {
+			w := &recordingExportWriter{}
+			summary, err := client.Export(ctx, domain.ExportQuery{}, w)
+			if err == nil && (summary.Balances != 6 || summary.Transactions != 1 || summary.TotalBalance != 150000 ||
+				w.balances[5].Status != domain.UserStatus_Frozen || w.histories[0].TransactionType != domain.TransactionType_AddUserBalance || w.histories[0].UpdatedAt.IsZero()) {
+				t.Errorf("unexpected export %+v %+v %+v", summary, w.balances, w.histories)
+			}
+			return err
+		}, "", ""},
+		{"export history of type", func(ctx context.Context) error {
+			w := &recordingExportWriter{}
+			summary, err := client.Export(ctx, domain.ExportQuery{
+				Datasets:         []domain.ExportDataset{domain.ExportDataset_History},
+				TransactionTypes: []domain.TransactionType{domain.TransactionType_ReduceUserBalance},
+			}, w)
+			if err == nil && (summary != domain.ExportSummary{} || len(w.balances)+len(w.histories) != 0) {
+				t.Errorf("unexpected export %+v", summary)
+			}
+			return err
+		}, "", ""},
+		{"export invalid period", func(ctx context.Context) error {
+			now := time.Now()
+			_, err := client.Export(ctx, domain.ExportQuery{From: now, To: now.Add(-time.Hour)}, &recordingExportWriter{})
+			return err
+		}, "invalid export period", ""},
+		{"statement", func(ctx context.Context) error {
+			now := time.Now()
+			statement, err := client.GetStatement(ctx, "test_user1", now.Add(-time.Hour), now.Add(time.Hour))
+			if err == nil && (statement.OpeningBalance != 10000 || statement.ClosingBalance != 15000 || len(statement.Transactions) != 1 ||
+				statement.Transactions[0].BalanceAfter == nil || *statement.Transactions[0].BalanceAfter != 15000 ||
+				len(statement.Totals) != 1 || statement.Totals[0].Count != 1 || statement.Totals[0].Amount != 5000) {
+				t.Errorf("unexpected statement %+v", statement)
+			}
+			return err
+		}, "", ""},
+		{"statement without period", func(ctx context.Context) error {
+			_, err := client.GetStatement(ctx, "test_user1", time.Time{}, time.Time{})
+			return err
+		}, "invalid statement period", ""},
+		{"report", func(ctx context.Context) error {
+			now := time.Now()
+			report, err := client.GetReport(ctx, domain.ReportQuery{From: now, To: now.Add(time.Minute)})
+			if err == nil && (report.Granularity != domain.ReportGranularity_Day || report.TotalBalance != 150000 || report.TotalUsers != 6 ||
+				len(report.Balances) != 1 || report.Balances[0].Status != domain.UserStatus_Active || len(report.Periods) != 1 ||
+				report.Periods[0].Credit != 5000 || report.Periods[0].Volumes[0].Count != 1 || report.AggregatedUntil.IsZero()) {
+				t.Errorf("unexpected report %+v", report)
+			}
+			return err
+		}, "", ""},
+		{"report unknown granularity", func(ctx context.Context) error {
+			now := time.Now()
+			_, err := client.GetReport(ctx, domain.ReportQuery{From: now, To: now.Add(time.Minute), Granularity: "year"})
+			return err
+		}, "invalid report granularity", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			err := c.Call(context.Background())
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if got := received.Get(apiKeyMetadataKey); len(got) != 1 || got[0] != "key" {
+				t.Errorf("expect api key metadata but got %v", got)
+			}
+			if got := received.Get(actorMetadataKey); (c.ExpectedActor == "" && len(got) != 0) || (c.ExpectedActor != "" && (len(got) != 1 || got[0] != c.ExpectedActor)) {
+				t.Errorf("expect actor [%s] but got %v", c.ExpectedActor, got)
+			}
+		})
+	}
+}
+
+func TestGrpcUserBalanceClientToken(t *testing.T) {
+	client, received := startClientServer(t, ClientCredentials{Token: "token"})
+	client.GetBalance(context.Background(), "test_user1")
+	if got := received.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("expect authorization metadata but got %v", got)
+	}
+}
@@ -0,0 +1,112 @@
+package presentation
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// GatewayPathPrefix ゲートウェイが提供するパスの接頭辞(user_balance.protoのHTTPアノテーションと一致させる)
+const GatewayPathPrefix = "/v1"
+
+// gatewayClientAddrMetadataKey ゲートウェイが受け付けたHTTPリクエストのクライアントのアドレスを転送するメタデータのキー
+const gatewayClientAddrMetadataKey = "x-gateway-client-addr"
+
+// gatewaySecretMetadataKey ゲートウェイからのリクエストであることを示すメタデータのキー
+const gatewaySecretMetadataKey = "x-gateway-secret"
+
+// gatewaySecret ゲートウェイからのリクエストを識別する値
+// ゲートウェイとgRPCサーバーは同じプロセスで動作するため、起動毎に生成した値を共有する
+var gatewaySecret = newRequestID()
+
+// gatewayIncomingHeaderMatcher gRPCのメタデータとして転送するHTTPヘッダを判定
+// 認証に使用するヘッダはインターセプタが参照するキーのまま転送する
+// 実行者とゲートウェイが付与するメタデータは、Grpc-Metadata-の接頭辞を付けてもクライアントから指定させない
+func gatewayIncomingHeaderMatcher(key string) (string, bool) {
+	if k := strings.ToLower(key); k == apiKeyMetadataKey {
+		return k, true
+	}
+	key, ok := runtime.DefaultHeaderMatcher(key)
+	switch strings.ToLower(key) {
+	case actorMetadataKey, gatewayClientAddrMetadataKey, gatewaySecretMetadataKey:
+		return "", false
+	}
+	return key, ok
+}
+
+// gatewayOutgoingHeaderMatcher HTTPヘッダとして返すgRPCのヘッダメタデータを判定
+// リクエストIDはRESTfulのミドルウェアが既に返しているため転送しない
+func gatewayOutgoingHeaderMatcher(key string) (string, bool) {
+	switch key {
+	case requestIDMetadataKey:
+		return "", false
+	case "retry-after":
+		return "Retry-After", true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// gatewayMetadata RESTfulのミドルウェアが付与したリクエストIDとクライアントのアドレスをgRPCに引き継ぐ
+// gRPCサーバーから見た接続元はゲートウェイのため、レート制限と監査情報にはこのアドレスを使用する
+func gatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	md := metadata.Pairs(gatewaySecretMetadataKey, gatewaySecret, gatewayClientAddrMetadataKey, r.RemoteAddr)
+	if requestID := domain.RequestIDFromContext(ctx); requestID != "" {
+		md.Set(requestIDMetadataKey, requestID)
+	}
+	return md
+}
+
+// gatewayClientAddr ゲートウェイからのリクエストの場合、ゲートウェイが受け付けたHTTPリクエストのクライアントのアドレスを返す
+func gatewayClientAddr(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	secrets, addrs := md.Get(gatewaySecretMetadataKey), md.Get(gatewayClientAddrMetadataKey)
+	if len(secrets) != 1 || len(addrs) != 1 || subtle.ConstantTimeCompare([]byte(secrets[0]), []byte(gatewaySecret)) != 1 {
+		return "", false
+	}
+	return addrs[0], true
+}
+
+// serveOpenAPI OpenAPIのドキュメントを返すハンドラ
+func serveOpenAPI(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(proto.OpenAPI)
+}
+
+// NewGateway endpointのgRPCサーバーに接続し、user_balance.protoのHTTPアノテーションに従って
+// JSON/HTTPのリクエストをgRPCに変換するゲートウェイを作成
+// gRPCサーバーを経由するため、認証、レート制限、メトリクスなどはgRPCのインターセプタで処理される
+// OpenAPIのドキュメントはGatewayPathPrefix + "/openapi.json"で提供する
+func NewGateway(ctx context.Context, endpoint string) (http.Handler, error) {
+	// RESTful APIと同様にJSONのフィールド名はprotoのフィールド名(スネークケース)を使用する
+	marshaler := &runtime.JSONPb{
+		MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, marshaler),
+		runtime.WithIncomingHeaderMatcher(gatewayIncomingHeaderMatcher),
+		runtime.WithOutgoingHeaderMatcher(gatewayOutgoingHeaderMatcher),
+		runtime.WithMetadata(gatewayMetadata),
+	)
+	if err := mux.HandlePath("GET", GatewayPathPrefix+"/openapi.json", serveOpenAPI); err != nil {
+		return nil, err
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+	}
+	if err := proto.RegisterUserBalanceHandlerFromEndpoint(ctx, mux, endpoint, opts); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
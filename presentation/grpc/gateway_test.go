@@ -0,0 +1,167 @@
+package presentation
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// startGatewayServer テスト用のgRPCサーバーとゲートウェイを起動し、gRPCサーバーが受け取ったメタデータを記録する
+func startGatewayServer(t *testing.T) (*httptest.Server, *metadata.MD) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	received := new(metadata.MD)
+	s := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		*received, _ = metadata.FromIncomingContext(ctx)
+		return handler(ctx, req)
+	}))
+	proto.RegisterUserBalanceServer(s, handler)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	gateway, err := NewGateway(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	// RESTfulのミドルウェアと同様にリクエストIDをコンテキストに格納する
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := domain.ContextWithRequestID(r.Context(), "c0ffee-42")
+		gateway.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, received
+}
+
+func TestGateway(t *testing.T) {
+	ts, received := startGatewayServer(t)
+
+	cases := []struct {
+		Name             string
+		Method           string
+		Path             string
+		Body             string
+		Header           map[string]string
+		ExpectedCode     int
+		ExpectedBody     string
+		ExpectedMetadata map[string]string
+	}{
+		{"get balance", "GET", "/v1/users/test_user1/balance", "", nil, http.StatusOK, `{"balance":10000}`, nil},
+		{"get balance of nonexistent user", "GET", "/v1/users/unknown/balance", "", nil, http.StatusNotFound, `"message":"user not found"`, nil},
+		{"add balance", "POST", "/v1/users/test_user1/balance:change",
+			`{"transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "amount": 1000, "reason_code": "campaign"}`, nil, http.StatusOK, `{}`, nil},
+		{"reduce balance insufficient", "POST", "/v1/users/test_user1/balance:change",
+			`{"transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "amount": -100000}`, nil, http.StatusBadRequest, `"message":"user balance is insufficient"`, nil},
+		{"add all balance", "POST", "/v1/balance:addAll",
+			`{"transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "amount": 1000}`, nil, http.StatusOK, `{}`, nil},
+		{"transfer balance", "POST", "/v1/balance:transfer",
+			`{"from_user_id": "test_user1", "to_user_id": "test_user2", "transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "amount": 1000}`, nil, http.StatusOK, `{}`, nil},
+		{"transaction history", "GET", "/v1/users/test_user1/transactions", "", nil, http.StatusOK, `"transaction_type":"ADD_USER_BALANCE"`, nil},
+		{"create user", "POST", "/v1/users",
+			`{"user_id": "new_user", "merchant_id": "shop1", "opening_balance": 1000, "transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635"}`, nil, http.StatusOK, `{}`, nil},
+		{"create existing user", "POST", "/v1/users", `{"user_id": "test_user1"}`, nil, http.StatusConflict, `"message":"user already exists"`, nil},
+		{"get user", "GET", "/v1/users/frozen_user", "", nil, http.StatusOK, `"status":"FROZEN"`, nil},
+		{"freeze user", "POST", "/v1/users/test_user1:freeze", `{"scope": "DEBIT", "reason_code": "fraud"}`, nil, http.StatusOK, `{}`, nil},
+		{"close user with balance", "POST", "/v1/users/test_user1:close", `{}`, nil, http.StatusBadRequest, `"message":"balance is not zero"`, nil},
+		{"batch get balances", "POST", "/v1/balances:batchGet", `{"user_ids": ["test_user1", "unknown"]}`, nil, http.StatusOK,
+			`{"user_id":"unknown"`, nil},
+		{"list accounts", "GET", "/v1/users?statuses=FROZEN&min_balance=0&page_size=10", "", nil, http.StatusOK, `"user_id":"frozen_user"`, nil},
+		{"import balance operations", "POST", "/v1/balance:import", `{"mode": "BEST_EFFORT", "operations": [{"line": 2, "user_id": "unknown", "transaction_type": "ADD_USER_BALANCE", "amount": 100, "transaction_id": "tx1"}]}`, nil, http.StatusOK,
+			`"status":"FAILED"`, nil},
+		{"statement", "GET", "/v1/users/test_user1/statement?from=2000-01-01T00:00:00Z&to=2000-02-01T00:00:00Z", "", nil, http.StatusOK,
+			`"closing_balance":10000`, nil},
+		{"report", "GET", "/v1/report?from=2021-06-15T00:00:00Z&to=2021-08-01T00:00:00Z&granularity=MONTH", "", nil, http.StatusOK,
+			`"granularity":"MONTH"`, nil},
+		{"export", "GET", "/v1/export?datasets=HISTORY&transaction_types=ADD_USER_BALANCE", "", nil, http.StatusOK,
+			`{"result":{"transaction":{"transaction_id":"b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b"`, nil},
+		{"export invalid dataset", "GET", "/v1/export?datasets=EXPORT_DATASET_UNSPECIFIED", "", nil, http.StatusBadRequest,
+			`"message":"invalid export dataset"`, nil},
+		{"forward headers", "GET", "/v1/users/test_user1/balance", "", map[string]string{
+			"Authorization": "Bearer token",
+			"X-API-Key":     "key",
+			"X-Actor-ID":    "operator",
+		}, http.StatusOK, `{"balance":10000}`, map[string]string{
+			"authorization": "Bearer token",
+			"x-api-key":     "key",
+			"x-actor-id":    "",
+			"x-request-id":  "c0ffee-42",
+		}},
+		{"drop reserved metadata", "GET", "/v1/users/test_user1/balance", "", map[string]string{
+			"Grpc-Metadata-X-Actor-Id":            "operator",
+			"Grpc-Metadata-X-Gateway-Secret":      "guess",
+			"Grpc-Metadata-X-Gateway-Client-Addr": "192.0.2.1:1234",
+			"Grpc-Metadata-X-Campaign":            "summer",
+		}, http.StatusOK, `{"balance":10000}`, map[string]string{
+			"x-actor-id": "",
+			"x-campaign": "summer",
+		}},
+		{"openapi document", "GET", "/v1/openapi.json", "", nil, http.StatusOK, `"/v1/users/{user_id}/balance"`, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			req, _ := http.NewRequest(c.Method, ts.URL+c.Path, strings.NewReader(c.Body))
+			for k, v := range c.Header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != c.ExpectedCode {
+				t.Errorf("expect status code [%d] but got [%d]", c.ExpectedCode, res.StatusCode)
+			}
+			if !strings.Contains(string(body), c.ExpectedBody) {
+				t.Errorf("expect response body containing [%s] but got [%s]", c.ExpectedBody, body)
+			}
+			// 空文字は転送されないことを表す
+			for k, v := range c.ExpectedMetadata {
+				if got := received.Get(k); v == "" && len(got) != 0 {
+					t.Errorf("expect metadata [%s] not to be forwarded but got %v", k, got)
+				} else if got := received.Get(k); v != "" && (len(got) != 1 || got[0] != v) {
+					t.Errorf("expect metadata [%s] to be [%s] but got %v", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayClientAddr(t *testing.T) {
+	ts, received := startGatewayServer(t)
+	req, _ := http.NewRequest("GET", ts.URL+"/v1/users/test_user1/balance", nil)
+	req.Header.Set("Grpc-Metadata-X-Gateway-Client-Addr", "192.0.2.1:1234")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	res.Body.Close()
+
+	// ゲートウェイが転送したHTTPリクエストのクライアントのアドレスを、gRPCのクライアントのアドレスとして扱う
+	ctx := metadata.NewIncomingContext(context.Background(), *received)
+	addr, ok := gatewayClientAddr(ctx)
+	if !ok || !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("expect client address of http request but got [%s %t]", addr, ok)
+	}
+	audit := getAuditInfo(ctx, "", "", nil)
+	if audit.Source != domain.RequestSource_Gateway || audit.ClientAddr != addr {
+		t.Errorf("expect audit info from gateway [%s] but got [%+v]", addr, audit)
+	}
+	if key := clientKey(ctx); key != "ip:127.0.0.1" {
+		t.Errorf("expect client key [ip:127.0.0.1] but got [%s]", key)
+	}
+}
@@ -2,15 +2,34 @@ package presentation
 
 import (
 	"context"
+	"sync/atomic"
 
 	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-type HealthCheckHandler struct{}
+// HealthCheckHandler ヘルスチェックのハンドラ
+type HealthCheckHandler struct {
+	draining int32
+}
+
+// NewHealthCheckHandler 新しいヘルスチェックのハンドラを作成
+func NewHealthCheckHandler() *HealthCheckHandler {
+	return &HealthCheckHandler{}
+}
+
+// SetDraining シャットダウン中はヘルスチェックでNOT_SERVINGを返す
+func (h *HealthCheckHandler) SetDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
 
 func (h *HealthCheckHandler) Check(context.Context, *proto.HealthCheckRequest) (*proto.HealthCheckResponse, error) {
+	if atomic.LoadInt32(&h.draining) == 1 {
+		return &proto.HealthCheckResponse{
+			Status: proto.HealthCheckResponse_NOT_SERVING,
+		}, nil
+	}
 	return &proto.HealthCheckResponse{
 		Status: proto.HealthCheckResponse_SERVING,
 	}, nil
@@ -7,7 +7,7 @@ import (
 	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
 )
 
-var grpcHealthCheckHandler *HealthCheckHandler
+var grpcHealthCheckHandler = NewHealthCheckHandler()
 
 func TestCheck(t *testing.T) {
 	ctx := context.Background()
@@ -21,3 +21,14 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestCheckDraining(t *testing.T) {
+	h := NewHealthCheckHandler()
+	h.SetDraining()
+	resp, err := h.Check(context.Background(), &proto.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if resp.Status != proto.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expect status [%d] but got [%s]", proto.HealthCheckResponse_NOT_SERVING, resp.Status)
+	}
+}
@@ -1,10 +1,64 @@
 package presentation
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+// actorMetadataKey 認証が無効な場合に実行者を示すメタデータのキー
+const actorMetadataKey = "x-actor-id"
+
+// clientAddr クライアントのアドレスを取得(ゲートウェイからのリクエストの場合はHTTPリクエストのクライアント)
+func clientAddr(ctx context.Context) string {
+	if addr, ok := gatewayClientAddr(ctx); ok {
+		return addr
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// getAuditInfo リクエストから取引履歴に記録する監査情報を作成するヘルパー
+// 認証された主体が存在する場合はその主体を実行者とする
+// ゲートウェイからのリクエストの場合は経路をゲートウェイ、クライアントのアドレスをHTTPリクエストのクライアントとする
+func getAuditInfo(ctx context.Context, reasonCode string, note string, md map[string]string) domain.AuditInfo {
+	audit := domain.AuditInfo{
+		ReasonCode: reasonCode,
+		Note:       note,
+		Source:     domain.RequestSource_gRPC,
+		ClientAddr: clientAddr(ctx),
+		Metadata:   md,
+	}
+	if _, ok := gatewayClientAddr(ctx); ok {
+		audit.Source = domain.RequestSource_Gateway
+	}
+	if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+		if actors := incoming.Get(actorMetadataKey); len(actors) > 0 {
+			audit.Actor = actors[0]
+		}
+	}
+	if principal, ok := domain.PrincipalFromContext(ctx); ok {
+		audit.Actor = principal.ID
+	}
+	return audit
+}
+
+// handleError エラーからgRPCのステータスを作成するヘルパー
 func handleError(err error) *status.Status {
 	var st *status.Status
 	if err == nil {
@@ -16,6 +70,8 @@ func handleError(err error) *status.Status {
 			st = status.New(codes.AlreadyExists, "transaction_id must be unique")
 		} else if err.Error() == "user not found" {
 			st = status.New(codes.NotFound, "user not found")
+		} else if err.Error() == "transaction not found" {
+			st = status.New(codes.NotFound, "transaction not found")
 		} else if err.Error() == "balance insufficient" {
 			st = status.New(codes.FailedPrecondition, "user balance is insufficient")
 		} else if err.Error() == "update failed" {
@@ -25,16 +81,515 @@ func handleError(err error) *status.Status {
 			st = status.New(codes.InvalidArgument, err.Error())
 		} else if err.Error() == "user_id is empty" {
 			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "from_user_id is empty" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "to_user_id is empty" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "can't transfer to the same user" {
+			st = status.New(codes.InvalidArgument, err.Error())
 		} else if err.Error() == "amount must be positive" {
 			st = status.New(codes.InvalidArgument, err.Error())
 		} else if err.Error() == "amount can't be 0" {
 			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "unauthenticated" {
+			st = status.New(codes.Unauthenticated, err.Error())
+		} else if err.Error() == "permission denied" {
+			st = status.New(codes.PermissionDenied, err.Error())
+		} else if err.Error() == "rate limit exceeded" {
+			st = status.New(codes.ResourceExhausted, err.Error())
+		} else if err.Error() == "reason_code is too long" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "note is too long" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "user already exists" {
+			st = status.New(codes.AlreadyExists, err.Error())
+		} else if err.Error() == "user is frozen" {
+			st = status.New(codes.FailedPrecondition, err.Error())
+		} else if err.Error() == "user is closed" {
+			st = status.New(codes.FailedPrecondition, err.Error())
+		} else if err.Error() == "user is not frozen" {
+			st = status.New(codes.FailedPrecondition, err.Error())
+		} else if err.Error() == "balance is not zero" {
+			st = status.New(codes.FailedPrecondition, err.Error())
+		} else if err.Error() == "invalid freeze scope" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "user_id is too long" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "merchant_id is too long" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "opening balance must not be negative" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "user_ids is empty" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "too many user_ids" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid sort field" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid user status" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid page_token" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "page_size must not be negative" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid balance range" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid created_at range" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid import mode" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "operations is empty" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "too many operations" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid export dataset" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid export period" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid transaction type" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid statement period" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid report granularity" {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else if err.Error() == "invalid report period" {
+			st = status.New(codes.InvalidArgument, err.Error())
 		} else if err.Error() == "current thread is not associated with a transaction" {
 			st = status.New(codes.Internal, err.Error())
 		} else {
 			st = status.New(codes.Internal, "internal server error")
 		}
+		st = withErrorDetails(st, err)
+	}
+
+	return st
+}
+
+// errorDomain ErrorInfoに設定するエラーのドメイン
+const errorDomain = "user-balance-management"
+
+// contentionRetryDelay データ競合で更新に失敗した場合に再試行を推奨する間隔
+const contentionRetryDelay = 100 * time.Millisecond
+
+// errorReasons エラーとErrorInfoの理由コードの対応(理由コードはクライアントが判定に使用するため変更しない)
+var errorReasons = map[string]string{
+	"database error":                       "DATABASE_ERROR",
+	"transaction_id must be unique":        "DUPLICATE_TRANSACTION",
+	"user not found":                       "USER_NOT_FOUND",
+	"transaction not found":                "TRANSACTION_NOT_FOUND",
+	"balance insufficient":                 "BALANCE_INSUFFICIENT",
+	"update failed":                        "UPDATE_CONFLICT",
+	"transaction_id is empty":              "TRANSACTION_ID_EMPTY",
+	"user_id is empty":                     "USER_ID_EMPTY",
+	"from_user_id is empty":                "FROM_USER_ID_EMPTY",
+	"to_user_id is empty":                  "TO_USER_ID_EMPTY",
+	"can't transfer to the same user":      "SAME_USER_TRANSFER",
+	"amount must be positive":              "AMOUNT_NOT_POSITIVE",
+	"amount can't be 0":                    "AMOUNT_ZERO",
+	"unauthenticated":                      "UNAUTHENTICATED",
+	"permission denied":                    "PERMISSION_DENIED",
+	"rate limit exceeded":                  "RATE_LIMIT_EXCEEDED",
+	"reason_code is too long":              "REASON_CODE_TOO_LONG",
+	"note is too long":                     "NOTE_TOO_LONG",
+	"user already exists":                  "USER_ALREADY_EXISTS",
+	"user is frozen":                       "USER_FROZEN",
+	"user is closed":                       "USER_CLOSED",
+	"user is not frozen":                   "USER_NOT_FROZEN",
+	"balance is not zero":                  "BALANCE_NOT_ZERO",
+	"invalid freeze scope":                 "INVALID_FREEZE_SCOPE",
+	"user_id is too long":                  "USER_ID_TOO_LONG",
+	"merchant_id is too long":              "MERCHANT_ID_TOO_LONG",
+	"opening balance must not be negative": "OPENING_BALANCE_NEGATIVE",
+	"user_ids is empty":                    "USER_IDS_EMPTY",
+	"too many user_ids":                    "TOO_MANY_USER_IDS",
+	"invalid sort field":                   "INVALID_SORT_FIELD",
+	"invalid user status":                  "INVALID_USER_STATUS",
+	"invalid page_token":                   "INVALID_PAGE_TOKEN",
+	"page_size must not be negative":       "PAGE_SIZE_NEGATIVE",
+	"invalid balance range":                "INVALID_BALANCE_RANGE",
+	"invalid created_at range":             "INVALID_CREATED_AT_RANGE",
+	"invalid import mode":                  "INVALID_IMPORT_MODE",
+	"operations is empty":                  "OPERATIONS_EMPTY",
+	"too many operations":                  "TOO_MANY_OPERATIONS",
+	"invalid export dataset":               "INVALID_EXPORT_DATASET",
+	"invalid export period":                "INVALID_EXPORT_PERIOD",
+	"invalid transaction type":             "INVALID_TRANSACTION_TYPE",
+	"invalid statement period":             "INVALID_STATEMENT_PERIOD",
+	"invalid report granularity":           "INVALID_REPORT_GRANULARITY",
+	"invalid report period":                "INVALID_REPORT_PERIOD",
+}
+
+// errorFields 不正な引数のエラーと対象のフィールドの対応
+var errorFields = map[string]string{
+	"transaction_id is empty":              "transaction_id",
+	"user_id is empty":                     "user_id",
+	"from_user_id is empty":                "from_user_id",
+	"to_user_id is empty":                  "to_user_id",
+	"can't transfer to the same user":      "to_user_id",
+	"amount must be positive":              "amount",
+	"amount can't be 0":                    "amount",
+	"reason_code is too long":              "reason_code",
+	"note is too long":                     "note",
+	"invalid freeze scope":                 "scope",
+	"user_id is too long":                  "user_id",
+	"merchant_id is too long":              "merchant_id",
+	"opening balance must not be negative": "opening_balance",
+	"user_ids is empty":                    "user_ids",
+	"too many user_ids":                    "user_ids",
+	"invalid sort field":                   "sort_by",
+	"invalid user status":                  "statuses",
+	"invalid page_token":                   "page_token",
+	"page_size must not be negative":       "page_size",
+	"invalid balance range":                "min_balance",
+	"invalid created_at range":             "created_after",
+	"invalid import mode":                  "mode",
+	"operations is empty":                  "operations",
+	"too many operations":                  "operations",
+	"invalid export dataset":               "datasets",
+	"invalid export period":                "from",
+	"invalid transaction type":             "transaction_types",
+	"invalid statement period":             "from",
+	"invalid report granularity":           "granularity",
+	"invalid report period":                "from",
+}
+
+// withErrorDetails エラーに応じたgoogle.rpcのエラー詳細をステータスに付与するヘルパー
+// 全てのエラーにErrorInfoを付与し、不正な引数にはBadRequest、残高不足とユーザーの状態のエラーにはPreconditionFailure、
+// データ競合にはRetryInfoを追加する
+func withErrorDetails(st *status.Status, err error) *status.Status {
+	reason, ok := errorReasons[err.Error()]
+	if !ok {
+		reason = "INTERNAL"
+	}
+	details := []protoiface.MessageV1{
+		&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain},
+	}
+
+	if field, ok := errorFields[err.Error()]; ok {
+		details = append(details, &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: field, Description: err.Error()},
+			},
+		})
+	}
+	switch err.Error() {
+	case "balance insufficient":
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{
+				{Type: reason, Subject: "balance", Description: "user balance is less than the amount to reduce"},
+			},
+		})
+	case "user is frozen", "user is closed", "user is not frozen":
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{
+				{Type: reason, Subject: "status", Description: err.Error()},
+			},
+		})
+	case "balance is not zero":
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{
+				{Type: reason, Subject: "balance", Description: "user balance must be zero to close the user"},
+			},
+		})
+	case "update failed":
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(contentionRetryDelay)})
+	}
+
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		return withDetails
+	}
+	return st
+}
+
+// transactionTypes 取引種類とProtocol Buffersの列挙型の対応
+var transactionTypes = map[domain.TransactionType]proto.TransactionType{
+	domain.TransactionType_AddUserBalance:    proto.TransactionType_ADD_USER_BALANCE,
+	domain.TransactionType_ReduceUserBalance: proto.TransactionType_REDUCE_USER_BALANCE,
+	domain.TransactionType_AddAllUserBalance: proto.TransactionType_ADD_ALL_USER_BALANCE,
+}
+
+// toProtoTransactionHistory 取引履歴をレスポンスのメッセージに変換するヘルパー
+// 呼び出し元のアドレスは外部に公開しない
+func toProtoTransactionHistory(history domain.TransactionHistoryModel) *proto.TransactionHistory {
+	var balanceAfter *wrapperspb.Int32Value
+	if history.BalanceAfter != nil {
+		balanceAfter = wrapperspb.Int32(int32(*history.BalanceAfter))
+	}
+	return &proto.TransactionHistory{
+		TransactionId:   history.TransactionID,
+		UserId:          history.UserID,
+		TransactionType: transactionTypes[history.TransactionType],
+		Amount:          int32(history.Amount),
+		Actor:           history.Actor,
+		ReasonCode:      history.ReasonCode,
+		Note:            history.Note,
+		Source:          string(history.Source),
+		Metadata:        history.Metadata,
+		CreatedAt:       timestamppb.New(history.CreatedAt),
+		UpdatedAt:       timestamppb.New(history.UpdatedAt),
+		BalanceAfter:    balanceAfter,
+	}
+}
+
+// toProtoStatement 取引明細をレスポンスのメッセージに変換するヘルパー
+func toProtoStatement(statement domain.Statement) *proto.Statement {
+	resp := &proto.Statement{
+		UserId:         statement.UserID,
+		From:           timestamppb.New(statement.From),
+		To:             timestamppb.New(statement.To),
+		OpeningBalance: int32(statement.OpeningBalance),
+		ClosingBalance: int32(statement.ClosingBalance),
+	}
+	for _, history := range statement.Transactions {
+		resp.Transactions = append(resp.Transactions, toProtoTransactionHistory(history))
+	}
+	for _, total := range statement.Totals {
+		resp.Totals = append(resp.Totals, &proto.StatementTotal{
+			TransactionType: transactionTypes[total.TransactionType],
+			Count:           int32(total.Count),
+			Amount:          total.Amount,
+		})
+	}
+	return resp
+}
+
+// reportGranularities 集計レポートの期間の単位とProtocol Buffersの列挙型の対応
+var reportGranularities = map[domain.ReportGranularity]proto.ReportGranularity{
+	domain.ReportGranularity_Day:   proto.ReportGranularity_DAY,
+	domain.ReportGranularity_Week:  proto.ReportGranularity_WEEK,
+	domain.ReportGranularity_Month: proto.ReportGranularity_MONTH,
+}
+
+// toReportQuery 集計レポートのリクエストを期間と単位に変換するヘルパー
+// 単位が未指定の場合は日毎、未知の値の場合は空文字となりusecaseでエラーになる
+func toReportQuery(req *proto.GetReportRequest) domain.ReportQuery {
+	q := domain.ReportQuery{Granularity: domain.ReportGranularity_Day}
+	if req.Granularity != proto.ReportGranularity_REPORT_GRANULARITY_UNSPECIFIED {
+		q.Granularity = ""
+		for g, p := range reportGranularities {
+			if p == req.Granularity {
+				q.Granularity = g
+			}
+		}
 	}
+	if req.From != nil {
+		q.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		q.To = req.To.AsTime()
+	}
+	return q
+}
+
+// toProtoReportVolumes 取引種類毎の取引量をレスポンスのメッセージに変換するヘルパー
+func toProtoReportVolumes(volumes []domain.ReportVolume) []*proto.ReportVolume {
+	resp := make([]*proto.ReportVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		resp = append(resp, &proto.ReportVolume{
+			TransactionType: transactionTypes[volume.TransactionType],
+			Count:           volume.Count,
+			Amount:          volume.Amount,
+		})
+	}
+	return resp
+}
 
+// toProtoReport 集計レポートをレスポンスのメッセージに変換するヘルパー
+func toProtoReport(report domain.Report) *proto.Report {
+	resp := &proto.Report{
+		From:            timestamppb.New(report.From),
+		To:              timestamppb.New(report.To),
+		Granularity:     reportGranularities[report.Granularity],
+		TotalBalance:    report.TotalBalance,
+		TotalUsers:      report.TotalUsers,
+		Totals:          toProtoReportVolumes(report.Totals),
+		AggregatedUntil: timestamppb.New(report.AggregatedUntil),
+	}
+	for _, total := range report.Balances {
+		resp.Balances = append(resp.Balances, &proto.BalanceStatusTotal{
+			Status:  userStatuses[total.Status],
+			Users:   total.Users,
+			Balance: total.Balance,
+		})
+	}
+	for _, period := range report.Periods {
+		resp.Periods = append(resp.Periods, &proto.ReportPeriod{
+			Start:   timestamppb.New(period.Start),
+			End:     timestamppb.New(period.End),
+			Credit:  period.Credit,
+			Debit:   period.Debit,
+			Volumes: toProtoReportVolumes(period.Volumes),
+		})
+	}
+	return resp
+}
+
+// userStatuses ユーザーの状態とProtocol Buffersの列挙型の対応
+var userStatuses = map[domain.UserStatus]proto.UserStatus{
+	domain.UserStatus_Active:      proto.UserStatus_ACTIVE,
+	domain.UserStatus_DebitFrozen: proto.UserStatus_DEBIT_FROZEN,
+	domain.UserStatus_Frozen:      proto.UserStatus_FROZEN,
+	domain.UserStatus_Closed:      proto.UserStatus_CLOSED,
+}
+
+// freezeScopes Protocol Buffersの列挙型と凍結の範囲の対応(未指定の場合は空文字となりusecaseでエラーになる)
+var freezeScopes = map[proto.FreezeScope]domain.FreezeScope{
+	proto.FreezeScope_DEBIT: domain.FreezeScope_Debit,
+	proto.FreezeScope_ALL:   domain.FreezeScope_All,
+}
+
+// protoUserStatuses Protocol Buffersの列挙型とユーザーの状態の対応(未指定の場合は空文字となりusecaseでエラーになる)
+var protoUserStatuses = map[proto.UserStatus]domain.UserStatus{
+	proto.UserStatus_ACTIVE:       domain.UserStatus_Active,
+	proto.UserStatus_DEBIT_FROZEN: domain.UserStatus_DebitFrozen,
+	proto.UserStatus_FROZEN:       domain.UserStatus_Frozen,
+	proto.UserStatus_CLOSED:       domain.UserStatus_Closed,
+}
+
+// accountSortFields Protocol Buffersの列挙型と口座一覧の並び替えの項目の対応(未指定の場合はユーザーID順)
+var accountSortFields = map[proto.AccountSortField]domain.AccountSortField{
+	proto.AccountSortField_USER_ID:    domain.AccountSortField_UserID,
+	proto.AccountSortField_BALANCE:    domain.AccountSortField_Balance,
+	proto.AccountSortField_CREATED_AT: domain.AccountSortField_CreatedAt,
+}
+
+// toListAccountsQuery 口座一覧のリクエストを絞り込みの条件に変換するヘルパー
+// page_tokenは前のページの最後のユーザーIDとして扱う
+func toListAccountsQuery(req *proto.ListAccountsRequest) domain.ListAccountsQuery {
+	q := domain.ListAccountsQuery{
+		MerchantID:  req.MerchantId,
+		SortBy:      accountSortFields[req.SortBy],
+		Descending:  req.Descending,
+		PageSize:    int(req.PageSize),
+		AfterUserID: req.PageToken,
+	}
+	if req.MinBalance != nil {
+		minBalance := int(req.MinBalance.Value)
+		q.MinBalance = &minBalance
+	}
+	if req.MaxBalance != nil {
+		maxBalance := int(req.MaxBalance.Value)
+		q.MaxBalance = &maxBalance
+	}
+	for _, st := range req.Statuses {
+		q.Statuses = append(q.Statuses, protoUserStatuses[st])
+	}
+	if req.CreatedAfter != nil {
+		q.CreatedAfter = req.CreatedAfter.AsTime()
+	}
+	if req.CreatedBefore != nil {
+		q.CreatedBefore = req.CreatedBefore.AsTime()
+	}
+	return q
+}
+
+// importModes Protocol Buffersの列挙型とインポートの適用方法の対応(未指定の場合は空文字となりusecaseでatomicとして扱う)
+var importModes = map[proto.ImportMode]domain.ImportMode{
+	proto.ImportMode_ATOMIC:      domain.ImportMode_Atomic,
+	proto.ImportMode_BEST_EFFORT: domain.ImportMode_BestEffort,
+}
+
+// importLineStatuses インポートの行毎の結果とProtocol Buffersの列挙型の対応
+var importLineStatuses = map[domain.ImportLineStatus]proto.ImportLineStatus{
+	domain.ImportLineStatus_Applied:    proto.ImportLineStatus_APPLIED,
+	domain.ImportLineStatus_Skipped:    proto.ImportLineStatus_SKIPPED,
+	domain.ImportLineStatus_Failed:     proto.ImportLineStatus_FAILED,
+	domain.ImportLineStatus_NotApplied: proto.ImportLineStatus_NOT_APPLIED,
+}
+
+// toBalanceOperations インポートのリクエストを残高操作に変換するヘルパー
+// 取引種類が未指定の場合はインポートできない一斉加算として扱い、usecaseで行毎のエラーになる
+func toBalanceOperations(req *proto.ImportBalanceOperationsRequest) []domain.BalanceOperation {
+	ops := make([]domain.BalanceOperation, 0, len(req.Operations))
+	for _, op := range req.Operations {
+		transactionType := domain.TransactionType_AddAllUserBalance
+		for t, protoType := range transactionTypes {
+			if protoType == op.TransactionType {
+				transactionType = t
+			}
+		}
+		ops = append(ops, domain.BalanceOperation{
+			Line:            int(op.Line),
+			UserID:          op.UserId,
+			TransactionType: transactionType,
+			Amount:          int(op.Amount),
+			TransactionID:   op.TransactionId,
+			ReasonCode:      op.ReasonCode,
+			Note:            op.Note,
+		})
+	}
+	return ops
+}
+
+// exportDatasets Protocol Buffersの列挙型とエクスポートする対象の対応(未指定の場合は空文字となりusecaseでエラーになる)
+var exportDatasets = map[proto.ExportDataset]domain.ExportDataset{
+	proto.ExportDataset_BALANCES: domain.ExportDataset_Balances,
+	proto.ExportDataset_HISTORY:  domain.ExportDataset_History,
+}
+
+// toExportQuery エクスポートのリクエストを絞り込みの条件に変換するヘルパー
+// 取引種類が未指定の場合は存在しない取引種類として扱い、usecaseでエラーになる
+func toExportQuery(req *proto.ExportRequest) domain.ExportQuery {
+	var q domain.ExportQuery
+	for _, dataset := range req.Datasets {
+		q.Datasets = append(q.Datasets, exportDatasets[dataset])
+	}
+	if req.From != nil {
+		q.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		q.To = req.To.AsTime()
+	}
+	for _, protoType := range req.TransactionTypes {
+		transactionType := domain.TransactionType(-1)
+		for t, p := range transactionTypes {
+			if p == protoType {
+				transactionType = t
+			}
+		}
+		q.TransactionTypes = append(q.TransactionTypes, transactionType)
+	}
+	return q
+}
+
+// toProtoUser ユーザーの情報をレスポンスのメッセージに変換するヘルパー
+func toProtoUser(user domain.UserBalanceModel) *proto.User {
+	return &proto.User{
+		UserId:     user.UserID,
+		Balance:    int32(user.Balance),
+		MerchantId: user.MerchantID,
+		Status:     userStatuses[user.Status],
+		CreatedAt:  timestamppb.New(user.CreatedAt),
+		UpdatedAt:  timestamppb.New(user.UpdatedAt),
+	}
+}
+
+// withRetryDelay 再試行までの待ち時間をRetryInfoとしてステータスに付与するヘルパー
+func withRetryDelay(st *status.Status, delay time.Duration) *status.Status {
+	if withDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		return withDetails
+	}
 	return st
 }
+
+// maxRequestIDLength 受け付けるリクエストIDの最大長
+const maxRequestIDLength = 128
+
+// isValidRequestID 呼び出し側から受け取ったリクエストIDがログに出力できる形式かを判定
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID 新しいリクエストIDを生成
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
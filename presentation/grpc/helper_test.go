@@ -1,10 +1,17 @@
 package presentation
 
 import (
+	"context"
 	"errors"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 func TestHandleError(t *testing.T) {
@@ -18,11 +25,24 @@ func TestHandleError(t *testing.T) {
 		{"empty transaction_id", errors.New("transaction_id is empty"), "transaction_id is empty", codes.InvalidArgument},
 		{"non-positive amount", errors.New("amount must be positive"), "amount must be positive", codes.InvalidArgument},
 		{"0 amount", errors.New("amount can't be 0"), "amount can't be 0", codes.InvalidArgument},
+		{"empty from_user_id", errors.New("from_user_id is empty"), "from_user_id is empty", codes.InvalidArgument},
+		{"transfer to the same user", errors.New("can't transfer to the same user"), "can't transfer to the same user", codes.InvalidArgument},
+		{"permission denied", errors.New("permission denied"), "permission denied", codes.PermissionDenied},
+		{"unauthenticated", errors.New("unauthenticated"), "unauthenticated", codes.Unauthenticated},
+		{"too long reason_code", errors.New("reason_code is too long"), "reason_code is too long", codes.InvalidArgument},
 		{"duplicated transaction_id", errors.New("transaction_id must be unique"), "transaction_id must be unique", codes.AlreadyExists},
 		{"other postgresql error", errors.New("database error"), "database error", codes.Internal},
 		{"user not found", errors.New("user not found"), "user not found", codes.NotFound},
 		{"balance insufficient error", errors.New("balance insufficient"), "user balance is insufficient", codes.FailedPrecondition},
 		{"update failed error", errors.New("update failed"), "update failed, please retry", codes.Unavailable},
+		{"user already exists", errors.New("user already exists"), "user already exists", codes.AlreadyExists},
+		{"user is frozen", errors.New("user is frozen"), "user is frozen", codes.FailedPrecondition},
+		{"user is closed", errors.New("user is closed"), "user is closed", codes.FailedPrecondition},
+		{"balance is not zero", errors.New("balance is not zero"), "balance is not zero", codes.FailedPrecondition},
+		{"invalid freeze scope", errors.New("invalid freeze scope"), "invalid freeze scope", codes.InvalidArgument},
+		{"too many user ids", errors.New("too many user_ids"), "too many user_ids", codes.InvalidArgument},
+		{"invalid page token", errors.New("invalid page_token"), "invalid page_token", codes.InvalidArgument},
+		{"too many operations", errors.New("too many operations"), "too many operations", codes.InvalidArgument},
 		{"other server error", errors.New("server error"), "internal server error", codes.Internal},
 	}
 
@@ -44,3 +64,112 @@ func TestHandleError(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleErrorDetails(t *testing.T) {
+	cases := []struct {
+		Name                 string
+		Err                  error
+		ExpectedReason       string
+		ExpectedField        string
+		ExpectedPrecondition bool
+		ExpectedRetryDelay   time.Duration
+	}{
+		{"empty user_id", errors.New("user_id is empty"), "USER_ID_EMPTY", "user_id", false, 0},
+		{"empty transaction_id", errors.New("transaction_id is empty"), "TRANSACTION_ID_EMPTY", "transaction_id", false, 0},
+		{"0 amount", errors.New("amount can't be 0"), "AMOUNT_ZERO", "amount", false, 0},
+		{"too long note", errors.New("note is too long"), "NOTE_TOO_LONG", "note", false, 0},
+		{"balance insufficient error", errors.New("balance insufficient"), "BALANCE_INSUFFICIENT", "", true, 0},
+		{"update failed error", errors.New("update failed"), "UPDATE_CONFLICT", "", false, contentionRetryDelay},
+		{"user not found", errors.New("user not found"), "USER_NOT_FOUND", "", false, 0},
+		{"user is frozen", errors.New("user is frozen"), "USER_FROZEN", "", true, 0},
+		{"balance is not zero", errors.New("balance is not zero"), "BALANCE_NOT_ZERO", "", true, 0},
+		{"invalid freeze scope", errors.New("invalid freeze scope"), "INVALID_FREEZE_SCOPE", "scope", false, 0},
+		{"invalid sort field", errors.New("invalid sort field"), "INVALID_SORT_FIELD", "sort_by", false, 0},
+		{"too long user_id", errors.New("user_id is too long"), "USER_ID_TOO_LONG", "user_id", false, 0},
+		{"invalid import mode", errors.New("invalid import mode"), "INVALID_IMPORT_MODE", "mode", false, 0},
+		{"other server error", errors.New("server error"), "INTERNAL", "", false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var reason, field string
+			var precondition bool
+			var retryDelay time.Duration
+			for _, detail := range handleError(c.Err).Details() {
+				switch d := detail.(type) {
+				case *errdetails.ErrorInfo:
+					reason = d.Reason
+					if d.Domain != errorDomain {
+						t.Errorf("expect domain [%s] but got [%s]", errorDomain, d.Domain)
+					}
+				case *errdetails.BadRequest:
+					field = d.FieldViolations[0].Field
+				case *errdetails.PreconditionFailure:
+					precondition = true
+				case *errdetails.RetryInfo:
+					retryDelay = d.RetryDelay.AsDuration()
+				}
+			}
+			if reason != c.ExpectedReason {
+				t.Errorf("expect reason [%s] but got [%s]", c.ExpectedReason, reason)
+			}
+			if field != c.ExpectedField {
+				t.Errorf("expect field violation of [%s] but got [%s]", c.ExpectedField, field)
+			}
+			if precondition != c.ExpectedPrecondition {
+				t.Errorf("expect precondition failure [%t] but got [%t]", c.ExpectedPrecondition, precondition)
+			}
+			if retryDelay != c.ExpectedRetryDelay {
+				t.Errorf("expect retry delay [%s] but got [%s]", c.ExpectedRetryDelay, retryDelay)
+			}
+		})
+	}
+}
+
+func TestGetAuditInfo(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(actorMetadataKey, "operator1"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}})
+	audit := getAuditInfo(ctx, "refund", "note", map[string]string{"campaign": "summer"})
+
+	expected := domain.AuditInfo{
+		Actor:      "operator1",
+		ReasonCode: "refund",
+		Note:       "note",
+		Source:     domain.RequestSource_gRPC,
+		ClientAddr: "127.0.0.1:12345",
+	}
+	if audit.Actor != expected.Actor || audit.ReasonCode != expected.ReasonCode || audit.Note != expected.Note ||
+		audit.Source != expected.Source || audit.ClientAddr != expected.ClientAddr {
+		t.Errorf("expect audit info [%+v] but got [%+v]", expected, audit)
+	}
+	if audit.Metadata["campaign"] != "summer" {
+		t.Errorf("expect metadata [campaign=summer] but got [%v]", audit.Metadata)
+	}
+}
+
+func TestGetAuditInfoFromGateway(t *testing.T) {
+	cases := []struct {
+		Name               string
+		MD                 metadata.MD
+		ExpectedSource     domain.RequestSource
+		ExpectedClientAddr string
+	}{
+		{"gateway", metadata.Pairs(gatewaySecretMetadataKey, gatewaySecret, gatewayClientAddrMetadataKey, "192.0.2.1:1234"),
+			domain.RequestSource_Gateway, "192.0.2.1:1234"},
+		{"wrong secret", metadata.Pairs(gatewaySecretMetadataKey, "guess", gatewayClientAddrMetadataKey, "192.0.2.1:1234"),
+			domain.RequestSource_gRPC, "127.0.0.1:12345"},
+		{"no secret", metadata.Pairs(gatewayClientAddrMetadataKey, "192.0.2.1:1234"),
+			domain.RequestSource_gRPC, "127.0.0.1:12345"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), c.MD)
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}})
+			audit := getAuditInfo(ctx, "", "", nil)
+			if audit.Source != c.ExpectedSource || audit.ClientAddr != c.ExpectedClientAddr {
+				t.Errorf("expect source [%s] and client address [%s] but got [%s %s]", c.ExpectedSource, c.ExpectedClientAddr, audit.Source, audit.ClientAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package presentation
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeyMetadataKey APIキーを指定するメタデータのキー
+const apiKeyMetadataKey = "x-api-key"
+
+// healthCheckServicePrefix 認証不要なヘルスチェックサービスのメソッド名の接頭辞
+const healthCheckServicePrefix = "/grpc.health.v1.Health/"
+
+// authenticate メタデータのAPIキーまたはJWTで認証し、認証された主体を格納したコンテキストを返す
+func authenticate(ctx context.Context, authenticator domain.Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var principal domain.Principal
+	var err error
+	if keys := md.Get(apiKeyMetadataKey); len(keys) > 0 && keys[0] != "" {
+		principal, err = authenticator.AuthenticateAPIKey(keys[0])
+	} else if auth := md.Get("authorization"); len(auth) > 0 && strings.HasPrefix(auth[0], "Bearer ") {
+		principal, err = authenticator.AuthenticateToken(strings.TrimPrefix(auth[0], "Bearer "))
+	} else {
+		err = errors.New("unauthenticated")
+	}
+	if err != nil {
+		return ctx, handleError(err).Err()
+	}
+
+	return domain.ContextWithPrincipal(ctx, principal), nil
+}
+
+// AuthUnaryInterceptor 単項RPCを認証するインターセプター
+func AuthUnaryInterceptor(authenticator domain.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			return handler(ctx, req)
+		}
+		ctx, err := authenticate(ctx, authenticator)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// wrappedServerStream コンテキストを差し替えたServerStream
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context 差し替えたコンテキストを返す
+func (s *wrappedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthStreamInterceptor ストリーミングRPCを認証するインターセプター
+func AuthStreamInterceptor(authenticator domain.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			return handler(srv, ss)
+		}
+		ctx, err := authenticate(ss.Context(), authenticator)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// userIDGetter user_idを持つリクエスト
+type userIDGetter interface {
+	GetUserId() string
+}
+
+// transferUserIDGetter 送金元と送金先のuser_idを持つリクエスト
+type transferUserIDGetter interface {
+	GetFromUserId() string
+	GetToUserId() string
+}
+
+// allowUsers リクエストの対象ユーザー毎の制限を順に確認し、制限を超えたユーザーがいる場合は再試行までの時間を返す
+// 送金は送金元と送金先の両方のユーザーの制限を消費する
+func allowUsers(userLimiter domain.RateLimiter, req interface{}) (bool, time.Duration) {
+	var userIDs []string
+	switch r := req.(type) {
+	case userIDGetter:
+		userIDs = []string{r.GetUserId()}
+	case transferUserIDGetter:
+		userIDs = []string{r.GetFromUserId(), r.GetToUserId()}
+	}
+	for i, userID := range userIDs {
+		if userID == "" || (i > 0 && userID == userIDs[0]) {
+			continue
+		}
+		if allow, wait := userLimiter.Allow("user:" + userID); !allow {
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// clientKey レート制限に使用するクライアントのキーを取得(認証された主体がない場合はクライアントのIP)
+func clientKey(ctx context.Context) string {
+	if principal, ok := domain.PrincipalFromContext(ctx); ok {
+		return "principal:" + principal.ID
+	}
+	if addr := clientAddr(ctx); addr != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		return "ip:" + host
+	}
+	return "ip:unknown"
+}
+
+// RateLimitUnaryInterceptor クライアント毎と対象ユーザー毎にリクエスト頻度を制限するインターセプター
+// 認証された主体でクライアントを識別するため、認証インターセプターの後に適用する必要がある
+func RateLimitUnaryInterceptor(clientLimiter domain.RateLimiter, userLimiter domain.RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			return handler(ctx, req)
+		}
+
+		allow, wait := true, time.Duration(0)
+		if clientLimiter != nil {
+			allow, wait = clientLimiter.Allow(clientKey(ctx))
+		}
+		if allow && userLimiter != nil {
+			allow, wait = allowUsers(userLimiter, req)
+		}
+
+		if !allow {
+			grpc.SetHeader(ctx, retryAfterHeader(wait))
+			return nil, rateLimitError(wait)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// retryAfterHeader 再試行までの秒数を示すヘッダ
+func retryAfterHeader(wait time.Duration) metadata.MD {
+	return metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// rateLimitError 再試行までの時間を詳細に含むレート制限のエラー
+func rateLimitError(wait time.Duration) error {
+	return withRetryDelay(handleError(errors.New("rate limit exceeded")), wait).Err()
+}
+
+// rateLimitedServerStream 受信したリクエストの対象ユーザー毎にリクエスト頻度を制限するServerStream
+type rateLimitedServerStream struct {
+	grpc.ServerStream
+	userLimiter domain.RateLimiter
+}
+
+// RecvMsg リクエストを受信し、対象ユーザーの制限を超えた場合はエラーを返す
+func (s *rateLimitedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if allow, wait := allowUsers(s.userLimiter, m); !allow {
+		s.SetHeader(retryAfterHeader(wait))
+		return rateLimitError(wait)
+	}
+	return nil
+}
+
+// RateLimitStreamInterceptor ストリームの開始時にクライアント毎、リクエストの受信時に対象ユーザー毎にリクエスト頻度を制限するインターセプター
+// 認証された主体でクライアントを識別するため、認証インターセプターの後に適用する必要がある
+func RateLimitStreamInterceptor(clientLimiter domain.RateLimiter, userLimiter domain.RateLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			return handler(srv, ss)
+		}
+
+		if clientLimiter != nil {
+			if allow, wait := clientLimiter.Allow(clientKey(ss.Context())); !allow {
+				ss.SetHeader(retryAfterHeader(wait))
+				return rateLimitError(wait)
+			}
+		}
+		if userLimiter != nil {
+			ss = &rateLimitedServerStream{ServerStream: ss, userLimiter: userLimiter}
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// MetricsUnaryInterceptor メソッド毎のリクエスト数、ステータスコードと処理時間を記録するインターセプタ
+// 認証やレート制限で拒否されたリクエストも記録するため、最初に適用する必要がある
+func MetricsUnaryInterceptor(metrics domain.MetricsRecorder) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		metrics.ObserveGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
+		return resp, err
+	}
+}
+
+// MetricsStreamInterceptor メソッド毎のストリーム数、ステータスコードとストリームの終了までの時間を記録するインターセプタ
+// 認証やレート制限で拒否されたストリームも記録するため、最初に適用する必要がある
+func MetricsStreamInterceptor(metrics domain.MetricsRecorder) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		metrics.ObserveGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
+		return err
+	}
+}
+
+// TracingUnaryInterceptor メタデータのtraceparentを引き継いでリクエスト毎にスパンを作成するインターセプタ
+func TracingUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return otelgrpc.UnaryServerInterceptor()
+}
+
+// TracingStreamInterceptor メタデータのtraceparentを引き継いでストリーム毎にスパンを作成するインターセプタ
+func TracingStreamInterceptor() grpc.StreamServerInterceptor {
+	return otelgrpc.StreamServerInterceptor()
+}
+
+// requestIDMetadataKey リクエストIDを受け渡すメタデータのキー
+const requestIDMetadataKey = "x-request-id"
+
+// withRequestID メタデータのリクエストIDを受け付けまたは生成し、リクエストIDを付与したLoggerと共にコンテキストに格納
+func withRequestID(ctx context.Context, logger domain.Logger) (context.Context, string, domain.Logger) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var requestID string
+	if ids := md.Get(requestIDMetadataKey); len(ids) > 0 && isValidRequestID(ids[0]) {
+		requestID = ids[0]
+	} else {
+		requestID = newRequestID()
+	}
+
+	keysAndValues := []interface{}{"request_id", requestID}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		keysAndValues = append(keysAndValues, "trace_id", sc.TraceID().String())
+	}
+	reqLogger := logger.With(keysAndValues...)
+	ctx = domain.ContextWithRequestID(ctx, requestID)
+	ctx = domain.ContextWithLogger(ctx, reqLogger)
+	return ctx, requestID, reqLogger
+}
+
+// RequestIDUnaryInterceptor リクエストIDとリクエストIDを付与したLoggerをコンテキストに格納し、完了時にアクセスログを出力するインターセプタ
+func RequestIDUnaryInterceptor(logger domain.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		ctx, requestID, reqLogger := withRequestID(ctx, logger)
+		grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, requestID))
+
+		resp, err := handler(ctx, req)
+		if !strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			reqLogger.Info("request completed", "method", info.FullMethod, "code", status.Code(err).String(),
+				"elapsed", time.Since(start).String())
+		}
+		return resp, err
+	}
+}
+
+// RequestIDStreamInterceptor リクエストIDとリクエストIDを付与したLoggerをコンテキストに格納し、完了時にアクセスログを出力するインターセプタ
+func RequestIDStreamInterceptor(logger domain.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx, requestID, reqLogger := withRequestID(ss.Context(), logger)
+		ss.SetHeader(metadata.Pairs(requestIDMetadataKey, requestID))
+
+		err := handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+		if !strings.HasPrefix(info.FullMethod, healthCheckServicePrefix) {
+			reqLogger.Info("request completed", "method", info.FullMethod, "code", status.Code(err).String(),
+				"elapsed", time.Since(start).String())
+		}
+		return err
+	}
+}
@@ -0,0 +1,348 @@
+package presentation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type mockAuthenticator struct{}
+
+func (a *mockAuthenticator) AuthenticateAPIKey(key string) (domain.Principal, error) {
+	if key == "valid-key" {
+		return domain.Principal{ID: "dashboard", Kind: domain.PrincipalKind_APIKey}, nil
+	}
+	return domain.Principal{}, errors.New("unauthenticated")
+}
+
+func (a *mockAuthenticator) AuthenticateToken(token string) (domain.Principal, error) {
+	if token == "valid-token" {
+		return domain.Principal{ID: "operator1", Kind: domain.PrincipalKind_JWT}, nil
+	}
+	return domain.Principal{}, errors.New("unauthenticated")
+}
+
+func TestAuthUnaryInterceptor(t *testing.T) {
+	cases := []struct {
+		Name         string
+		FullMethod   string
+		MD           metadata.MD
+		ExpectedID   string
+		ExpectedCode codes.Code
+	}{
+		{"valid api key", "/user_balance.UserBalance/GetBalanceByUserID", metadata.Pairs(apiKeyMetadataKey, "valid-key"), "dashboard", codes.OK},
+		{"invalid api key", "/user_balance.UserBalance/GetBalanceByUserID", metadata.Pairs(apiKeyMetadataKey, "wrong-key"), "", codes.Unauthenticated},
+		{"valid token", "/user_balance.UserBalance/AddAllUserBalance", metadata.Pairs("authorization", "Bearer valid-token"), "operator1", codes.OK},
+		{"invalid token", "/user_balance.UserBalance/AddAllUserBalance", metadata.Pairs("authorization", "Bearer wrong-token"), "", codes.Unauthenticated},
+		{"no credential", "/user_balance.UserBalance/AddAllUserBalance", metadata.MD{}, "", codes.Unauthenticated},
+		{"health check", "/grpc.health.v1.Health/Check", metadata.MD{}, "", codes.OK},
+	}
+
+	interceptor := AuthUnaryInterceptor(&mockAuthenticator{})
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var principalID string
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				principal, _ := domain.PrincipalFromContext(ctx)
+				principalID = principal.ID
+				return nil, nil
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), c.MD)
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: c.FullMethod}, handler)
+			if st, _ := status.FromError(err); st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if principalID != c.ExpectedID {
+				t.Errorf("expect principal [%s] but got [%s]", c.ExpectedID, principalID)
+			}
+		})
+	}
+}
+
+type mockRateLimiter struct {
+	denied map[string]bool
+	keys   []string
+}
+
+func (l *mockRateLimiter) Allow(key string) (bool, time.Duration) {
+	l.keys = append(l.keys, key)
+	if l.denied[key] {
+		return false, time.Second
+	}
+	return true, 0
+}
+
+func TestRateLimitUnaryInterceptor(t *testing.T) {
+	clientLimiter := &mockRateLimiter{denied: map[string]bool{"principal:hammering-client": true, "ip:192.0.2.1": true}}
+	userLimiter := &mockRateLimiter{denied: map[string]bool{"user:hot_user": true}}
+	cases := []struct {
+		Name         string
+		PrincipalID  string
+		Addr         string
+		Req          interface{}
+		ExpectedCode codes.Code
+	}{
+		{"allowed", "dashboard", "192.0.2.2:1234", &proto.GetUserBalanceRequest{UserId: "test_user1"}, codes.OK},
+		{"client limited by principal", "hammering-client", "192.0.2.2:1234", &proto.GetUserBalanceRequest{UserId: "test_user1"}, codes.ResourceExhausted},
+		{"client limited by ip", "", "192.0.2.1:1234", &proto.GetUserBalanceRequest{UserId: "test_user1"}, codes.ResourceExhausted},
+		{"user limited", "dashboard", "192.0.2.2:1234", &proto.ChangeUserBalanceRequest{UserId: "hot_user"}, codes.ResourceExhausted},
+		{"no user", "dashboard", "192.0.2.2:1234", &proto.AddAllUserBalanceRequest{}, codes.OK},
+		{"transfer allowed", "dashboard", "192.0.2.2:1234", &proto.TransferBalanceRequest{FromUserId: "test_user1", ToUserId: "test_user2"}, codes.OK},
+		{"transfer limited by sender", "dashboard", "192.0.2.2:1234", &proto.TransferBalanceRequest{FromUserId: "hot_user", ToUserId: "test_user2"}, codes.ResourceExhausted},
+		{"transfer limited by recipient", "dashboard", "192.0.2.2:1234", &proto.TransferBalanceRequest{FromUserId: "test_user1", ToUserId: "hot_user"}, codes.ResourceExhausted},
+	}
+
+	interceptor := RateLimitUnaryInterceptor(clientLimiter, userLimiter)
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			}
+			addr, _ := net.ResolveTCPAddr("tcp", c.Addr)
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+			if c.PrincipalID != "" {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: c.PrincipalID})
+			}
+			_, err := interceptor(ctx, c.Req, &grpc.UnaryServerInfo{FullMethod: "/user_balance.UserBalance/Test"}, handler)
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if c.ExpectedCode == codes.ResourceExhausted {
+				hasRetryInfo := false
+				for _, detail := range st.Details() {
+					if d, ok := detail.(*errdetails.RetryInfo); ok && d.RetryDelay.AsDuration() > 0 {
+						hasRetryInfo = true
+					}
+				}
+				if !hasRetryInfo {
+					t.Errorf("expect RetryInfo with positive delay but got %v", st.Details())
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitTransferBalance(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Req          *proto.TransferBalanceRequest
+		ExpectedKeys []string
+	}{
+		{"both users", &proto.TransferBalanceRequest{FromUserId: "test_user1", ToUserId: "test_user2"}, []string{"user:test_user1", "user:test_user2"}},
+		{"same user", &proto.TransferBalanceRequest{FromUserId: "test_user1", ToUserId: "test_user1"}, []string{"user:test_user1"}},
+		{"no recipient", &proto.TransferBalanceRequest{FromUserId: "test_user1"}, []string{"user:test_user1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			userLimiter := &mockRateLimiter{}
+			interceptor := RateLimitUnaryInterceptor(nil, userLimiter)
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			}
+			if _, err := interceptor(context.Background(), c.Req, &grpc.UnaryServerInfo{FullMethod: "/user_balance.UserBalance/TransferBalance"}, handler); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if !reflect.DeepEqual(userLimiter.keys, c.ExpectedKeys) {
+				t.Errorf("expect limiter keys %v but got %v", c.ExpectedKeys, userLimiter.keys)
+			}
+		})
+	}
+}
+
+// mockServerStream コンテキストと受信するリクエストの対象ユーザーを指定したServerStream
+type mockServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	userID string
+	header metadata.MD
+}
+
+func (s *mockServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *mockServerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *mockServerStream) RecvMsg(m interface{}) error {
+	m.(*proto.GetUserBalanceRequest).UserId = s.userID
+	return nil
+}
+
+func TestRateLimitStreamInterceptor(t *testing.T) {
+	clientLimiter := &mockRateLimiter{denied: map[string]bool{"principal:hammering-client": true, "ip:192.0.2.1": true}}
+	userLimiter := &mockRateLimiter{denied: map[string]bool{"user:hot_user": true}}
+	cases := []struct {
+		Name         string
+		FullMethod   string
+		PrincipalID  string
+		Addr         string
+		UserID       string
+		ExpectedCode codes.Code
+	}{
+		{"allowed", "/user_balance.UserBalance/Test", "dashboard", "192.0.2.2:1234", "test_user1", codes.OK},
+		{"client limited by principal", "/user_balance.UserBalance/Test", "hammering-client", "192.0.2.2:1234", "test_user1", codes.ResourceExhausted},
+		{"client limited by ip", "/user_balance.UserBalance/Test", "", "192.0.2.1:1234", "test_user1", codes.ResourceExhausted},
+		{"user limited", "/user_balance.UserBalance/Test", "dashboard", "192.0.2.2:1234", "hot_user", codes.ResourceExhausted},
+		{"no user", "/user_balance.UserBalance/Test", "dashboard", "192.0.2.2:1234", "", codes.OK},
+		{"health check", "/grpc.health.v1.Health/Watch", "", "192.0.2.1:1234", "hot_user", codes.OK},
+	}
+
+	interceptor := RateLimitStreamInterceptor(clientLimiter, userLimiter)
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			handler := func(srv interface{}, ss grpc.ServerStream) error {
+				return ss.RecvMsg(&proto.GetUserBalanceRequest{})
+			}
+			addr, _ := net.ResolveTCPAddr("tcp", c.Addr)
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+			if c.PrincipalID != "" {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: c.PrincipalID})
+			}
+			ss := &mockServerStream{ctx: ctx, userID: c.UserID}
+			err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: c.FullMethod}, handler)
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if c.ExpectedCode == codes.ResourceExhausted && len(ss.header.Get("retry-after")) == 0 {
+				t.Errorf("expect retry-after header but got %v", ss.header)
+			}
+		})
+	}
+}
+
+type mockMetricsRecorder struct {
+	method string
+	code   string
+}
+
+func (m *mockMetricsRecorder) ObserveOperation(op string, outcome string, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveHTTPRequest(method string, route string, code int, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveGRPCRequest(method string, code string, duration time.Duration) {
+	m.method = method
+	m.code = code
+}
+
+func (m *mockMetricsRecorder) ObserveCacheLookup(cache string, hit bool) {
+}
+
+func TestMetricsUnaryInterceptor(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Err          error
+		ExpectedCode string
+	}{
+		{"ok", nil, "OK"},
+		{"not found", handleError(errors.New("user not found")).Err(), "NotFound"},
+		{"rate limited", handleError(errors.New("rate limit exceeded")).Err(), "ResourceExhausted"},
+	}
+
+	metrics := &mockMetricsRecorder{}
+	interceptor := MetricsUnaryInterceptor(metrics)
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, c.Err
+			}
+			interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/user_balance.UserBalance/Test"}, handler)
+			if metrics.method != "/user_balance.UserBalance/Test" || metrics.code != c.ExpectedCode {
+				t.Errorf("expect [%s] but got [%s %s]", c.ExpectedCode, metrics.method, metrics.code)
+			}
+		})
+	}
+}
+
+func TestMetricsStreamInterceptor(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Err          error
+		ExpectedCode string
+	}{
+		{"ok", nil, "OK"},
+		{"rate limited", handleError(errors.New("rate limit exceeded")).Err(), "ResourceExhausted"},
+	}
+
+	metrics := &mockMetricsRecorder{}
+	interceptor := MetricsStreamInterceptor(metrics)
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			handler := func(srv interface{}, ss grpc.ServerStream) error {
+				return c.Err
+			}
+			interceptor(nil, &mockServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/user_balance.UserBalance/Export"}, handler)
+			if metrics.method != "/user_balance.UserBalance/Export" || metrics.code != c.ExpectedCode {
+				t.Errorf("expect [%s] but got [%s %s]", c.ExpectedCode, metrics.method, metrics.code)
+			}
+		})
+	}
+}
+
+type mockLogger struct {
+	fields []interface{}
+}
+
+func (l *mockLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (l *mockLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (l *mockLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (l *mockLogger) Error(msg string, keysAndValues ...interface{}) {}
+func (l *mockLogger) With(keysAndValues ...interface{}) domain.Logger {
+	return &mockLogger{fields: append(l.fields, keysAndValues...)}
+}
+
+func TestRequestIDUnaryInterceptor(t *testing.T) {
+	cases := []struct {
+		Name        string
+		RequestID   string
+		ExpectEqual bool
+	}{
+		{"accept request id", "c0ffee-42", true},
+		{"generate request id", "", false},
+		{"reject invalid request id", "bad id\n", false},
+	}
+
+	interceptor := RequestIDUnaryInterceptor(&mockLogger{})
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var ctxRequestID string
+			var ctxFields []interface{}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				ctxRequestID = domain.RequestIDFromContext(ctx)
+				ctxFields = domain.LoggerFromContext(ctx).(*mockLogger).fields
+				return nil, nil
+			}
+			ctx := context.Background()
+			if c.RequestID != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(requestIDMetadataKey, c.RequestID))
+			}
+			interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/user_balance.UserBalance/Test"}, handler)
+
+			if ctxRequestID == "" || (ctxRequestID == c.RequestID) != c.ExpectEqual {
+				t.Errorf("unexpected request id [%s] for metadata [%s]", ctxRequestID, c.RequestID)
+			}
+			if len(ctxFields) < 2 || ctxFields[0] != "request_id" || ctxFields[1] != ctxRequestID {
+				t.Errorf("expect logger to have request_id field but got [%v]", ctxFields)
+			}
+		})
+	}
+}
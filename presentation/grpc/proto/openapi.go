@@ -0,0 +1,8 @@
+package proto
+
+import _ "embed"
+
+// OpenAPI user_balance.protoのHTTPアノテーションから生成したOpenAPI(Swagger 2.0)のドキュメント
+//
+//go:embed user_balance.swagger.json
+var OpenAPI []byte
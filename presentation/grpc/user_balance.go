@@ -3,7 +3,7 @@ package presentation
 import (
 	"context"
 	"errors"
-	"log"
+	"time"
 
 	"github.com/kaitolucifer/user-balance-management/domain"
 	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
@@ -11,8 +11,7 @@ import (
 
 // App アプリケーションが持つコンポーネントや設定を格納
 type App struct {
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	Logger domain.Logger
 }
 
 // GrpcUserBalanceHander usecaseとアプリケーション設定を格納
@@ -36,7 +35,7 @@ func (h *GrpcUserBalanceHander) GetBalanceByUserID(ctx context.Context, req *pro
 	if req.UserId == "" {
 		err = errors.New("user_id is empty")
 	} else {
-		balance, newErr := h.usecase.GetBalance(req.UserId)
+		balance, newErr := h.usecase.GetBalance(ctx, req.UserId)
 		if newErr == nil {
 			resp = &proto.GetUserBalanceResponse{
 				Balance: int32(balance),
@@ -47,7 +46,7 @@ func (h *GrpcUserBalanceHander) GetBalanceByUserID(ctx context.Context, req *pro
 	}
 
 	if err != nil {
-		h.App.ErrorLog.Println(err)
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
 	}
 
 	st := handleError(err)
@@ -63,17 +62,18 @@ func (h *GrpcUserBalanceHander) ChangeBalanceByUserID(ctx context.Context, req *
 	} else if req.TransactionId == "" {
 		err = errors.New("transaction_id is empty")
 	} else {
+		audit := getAuditInfo(ctx, req.ReasonCode, req.Note, req.Metadata)
 		if req.Amount > 0 {
-			err = h.usecase.AddBalance(req.UserId, int(req.Amount), req.TransactionId)
+			err = h.usecase.AddBalance(ctx, req.UserId, int(req.Amount), req.TransactionId, audit)
 		} else if req.Amount < 0 {
-			err = h.usecase.ReduceBalance(req.UserId, -int(req.Amount), req.TransactionId)
+			err = h.usecase.ReduceBalance(ctx, req.UserId, -int(req.Amount), req.TransactionId, audit)
 		} else {
 			err = errors.New("amount can't be 0")
 		}
 	}
 
 	if err != nil {
-		h.App.ErrorLog.Println(err)
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
 	}
 
 	st := handleError(err)
@@ -90,13 +90,314 @@ func (h *GrpcUserBalanceHander) AddAllUserBalance(ctx context.Context, req *prot
 	} else if req.Amount <= 0 {
 		err = errors.New("amount must be positive")
 	} else {
-		err = h.usecase.AddAllUserBalance(int(req.Amount), req.TransactionId)
+		audit := getAuditInfo(ctx, req.ReasonCode, req.Note, req.Metadata)
+		err = h.usecase.AddAllUserBalance(ctx, int(req.Amount), req.TransactionId, audit)
 	}
 
 	if err != nil {
-		h.App.ErrorLog.Println(err)
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
 	}
 
 	st := handleError(err)
 	return resp, st.Err()
 }
+
+// TransferBalance ユーザー間で残高を振り替えるハンドラ
+func (h *GrpcUserBalanceHander) TransferBalance(ctx context.Context, req *proto.TransferBalanceRequest) (*proto.EmptyResponse, error) {
+	resp := &proto.EmptyResponse{}
+
+	var err error
+	if req.FromUserId == "" {
+		err = errors.New("from_user_id is empty")
+	} else if req.ToUserId == "" {
+		err = errors.New("to_user_id is empty")
+	} else if req.TransactionId == "" {
+		err = errors.New("transaction_id is empty")
+	} else if req.Amount <= 0 {
+		err = errors.New("amount must be positive")
+	} else {
+		audit := getAuditInfo(ctx, req.ReasonCode, req.Note, req.Metadata)
+		err = h.usecase.TransferBalance(ctx, req.FromUserId, req.ToUserId, int(req.Amount), req.TransactionId, audit)
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// GetTransactionHistory ユーザーの取引履歴を取得するハンドラ
+func (h *GrpcUserBalanceHander) GetTransactionHistory(ctx context.Context, req *proto.GetTransactionHistoryRequest) (*proto.GetTransactionHistoryResponse, error) {
+	resp := &proto.GetTransactionHistoryResponse{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		histories, newErr := h.usecase.GetTransactionHistory(ctx, req.UserId, req.AfterTransactionId)
+		if newErr == nil {
+			for _, history := range histories {
+				resp.Histories = append(resp.Histories, toProtoTransactionHistory(history))
+			}
+		} else {
+			err = newErr
+		}
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// GetStatement ユーザーの期間内の取引明細を作成するハンドラ
+func (h *GrpcUserBalanceHander) GetStatement(ctx context.Context, req *proto.GetStatementRequest) (*proto.Statement, error) {
+	resp := &proto.Statement{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		var from, to time.Time
+		if req.From != nil {
+			from = req.From.AsTime()
+		}
+		if req.To != nil {
+			to = req.To.AsTime()
+		}
+		statement, newErr := h.usecase.GetStatement(ctx, req.UserId, from, to)
+		if newErr == nil {
+			resp = toProtoStatement(statement)
+		} else {
+			err = newErr
+		}
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// GetReport 全ユーザーの残高の合計と期間毎の取引量の集計レポートを作成するハンドラ
+func (h *GrpcUserBalanceHander) GetReport(ctx context.Context, req *proto.GetReportRequest) (*proto.Report, error) {
+	resp := &proto.Report{}
+
+	report, err := h.usecase.GetReport(ctx, toReportQuery(req))
+	if err == nil {
+		resp = toProtoReport(report)
+	} else {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// CreateUser ユーザーを作成するハンドラ
+func (h *GrpcUserBalanceHander) CreateUser(ctx context.Context, req *proto.CreateUserRequest) (*proto.EmptyResponse, error) {
+	resp := &proto.EmptyResponse{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else if req.OpeningBalance < 0 {
+		err = errors.New("opening balance must not be negative")
+	} else if req.OpeningBalance > 0 && req.TransactionId == "" {
+		err = errors.New("transaction_id is empty")
+	} else {
+		audit := getAuditInfo(ctx, req.ReasonCode, req.Note, req.Metadata)
+		err = h.usecase.CreateUser(ctx, req.UserId, req.MerchantId, int(req.OpeningBalance), req.TransactionId, audit)
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// GetUser ユーザーの状態を含む情報を取得するハンドラ
+func (h *GrpcUserBalanceHander) GetUser(ctx context.Context, req *proto.GetUserRequest) (*proto.User, error) {
+	resp := &proto.User{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		user, newErr := h.usecase.GetUser(ctx, req.UserId)
+		if newErr == nil {
+			resp = toProtoUser(user)
+		} else {
+			err = newErr
+		}
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// FreezeUser ユーザーを凍結するハンドラ
+func (h *GrpcUserBalanceHander) FreezeUser(ctx context.Context, req *proto.FreezeUserRequest) (*proto.EmptyResponse, error) {
+	resp := &proto.EmptyResponse{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		audit := getAuditInfo(ctx, req.ReasonCode, req.Note, nil)
+		err = h.usecase.FreezeUser(ctx, req.UserId, freezeScopes[req.Scope], audit)
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// UnfreezeUser ユーザーの凍結を解除するハンドラ
+func (h *GrpcUserBalanceHander) UnfreezeUser(ctx context.Context, req *proto.ChangeUserStatusRequest) (*proto.EmptyResponse, error) {
+	resp := &proto.EmptyResponse{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		err = h.usecase.UnfreezeUser(ctx, req.UserId, getAuditInfo(ctx, req.ReasonCode, req.Note, nil))
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// CloseUser ユーザーを解約するハンドラ
+func (h *GrpcUserBalanceHander) CloseUser(ctx context.Context, req *proto.ChangeUserStatusRequest) (*proto.EmptyResponse, error) {
+	resp := &proto.EmptyResponse{}
+
+	var err error
+	if req.UserId == "" {
+		err = errors.New("user_id is empty")
+	} else {
+		err = h.usecase.CloseUser(ctx, req.UserId, getAuditInfo(ctx, req.ReasonCode, req.Note, nil))
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// BatchGetBalances 複数のユーザーの残高を一括で取得するハンドラ
+func (h *GrpcUserBalanceHander) BatchGetBalances(ctx context.Context, req *proto.BatchGetBalancesRequest) (*proto.BatchGetBalancesResponse, error) {
+	resp := &proto.BatchGetBalancesResponse{}
+
+	results, err := h.usecase.BatchGetBalances(ctx, req.UserIds)
+	if err == nil {
+		for _, result := range results {
+			resp.Results = append(resp.Results, &proto.BalanceResult{
+				UserId:  result.UserID,
+				Balance: int32(result.Balance),
+				Found:   result.Found,
+			})
+		}
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// ListAccounts 条件で絞り込んだユーザーを並び替えてページ毎に取得するハンドラ
+func (h *GrpcUserBalanceHander) ListAccounts(ctx context.Context, req *proto.ListAccountsRequest) (*proto.ListAccountsResponse, error) {
+	resp := &proto.ListAccountsResponse{}
+
+	users, nextPageToken, err := h.usecase.ListAccounts(ctx, toListAccountsQuery(req))
+	if err == nil {
+		for _, user := range users {
+			resp.Users = append(resp.Users, toProtoUser(user))
+		}
+		resp.NextPageToken = nextPageToken
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// ImportBalanceOperations 複数の残高操作を行毎に検証して適用し、行毎の結果を返すハンドラ
+func (h *GrpcUserBalanceHander) ImportBalanceOperations(ctx context.Context, req *proto.ImportBalanceOperationsRequest) (*proto.ImportBalanceOperationsResponse, error) {
+	resp := &proto.ImportBalanceOperationsResponse{}
+
+	audit := getAuditInfo(ctx, req.ReasonCode, req.Note, req.Metadata)
+	results, err := h.usecase.ImportBalanceOperations(ctx, toBalanceOperations(req), importModes[req.Mode], audit)
+	if err == nil {
+		for _, result := range results {
+			resp.Results = append(resp.Results, &proto.ImportLineResult{
+				Line:          int32(result.Line),
+				UserId:        result.UserID,
+				TransactionId: result.TransactionID,
+				Status:        importLineStatuses[result.Status],
+				Error:         result.Error,
+			})
+		}
+	}
+
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+	}
+
+	st := handleError(err)
+	return resp, st.Err()
+}
+
+// streamExportWriter エクスポートする行をストリームで1件ずつ送信するdomain.ExportWriter
+type streamExportWriter struct {
+	stream proto.UserBalance_ExportServer
+}
+
+func (w *streamExportWriter) WriteUserBalance(userBalance domain.UserBalanceModel) error {
+	return w.stream.Send(&proto.ExportRecord{Record: &proto.ExportRecord_Balance{Balance: toProtoUser(userBalance)}})
+}
+
+func (w *streamExportWriter) WriteTransactionHistory(history domain.TransactionHistoryModel) error {
+	return w.stream.Send(&proto.ExportRecord{Record: &proto.ExportRecord_Transaction{Transaction: toProtoTransactionHistory(history)}})
+}
+
+// Export ユーザー残高と取引履歴を1つのスナップショットから読み取り、1件ずつストリームで送信するハンドラ
+func (h *GrpcUserBalanceHander) Export(req *proto.ExportRequest, stream proto.UserBalance_ExportServer) error {
+	ctx := stream.Context()
+	summary, err := h.usecase.Export(ctx, toExportQuery(req), &streamExportWriter{stream: stream})
+	if err != nil {
+		domain.LoggerFromContext(ctx).Error("request failed", "error", err)
+		return handleError(err).Err()
+	}
+
+	domain.LoggerFromContext(ctx).Info("export completed",
+		"balances", summary.Balances, "transactions", summary.Transactions, "total_balance", summary.TotalBalance)
+	return nil
+}
@@ -3,8 +3,6 @@ package presentation
 import (
 	"context"
 	"errors"
-	"io/ioutil"
-	"log"
 	"os"
 	"strings"
 	"testing"
@@ -14,6 +12,8 @@ import (
 	"github.com/kaitolucifer/user-balance-management/presentation/grpc/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var handler *GrpcUserBalanceHander
@@ -25,11 +25,12 @@ type mockUsecase struct {
 
 func NewMockUsecase() domain.UserBalanceUsecase {
 	userBalances := []domain.UserBalanceModel{
-		{UserID: "test_user1", Balance: 10000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user2", Balance: 20000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user3", Balance: 30000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user4", Balance: 40000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user5", Balance: 50000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user1", Balance: 10000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user2", Balance: 20000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user3", Balance: 30000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user4", Balance: 40000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user5", Balance: 50000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "frozen_user", Balance: 0, Status: domain.UserStatus_Frozen, CreatedAt: time.Now(), UpdatedAt: time.Now()},
 	}
 
 	transactionHistory := []domain.TransactionHistoryModel{
@@ -49,7 +50,7 @@ func NewMockUsecase() domain.UserBalanceUsecase {
 	}
 }
 
-func (u *mockUsecase) AddBalance(userID string, amount int, transactionID string) error {
+func (u *mockUsecase) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
 	userExist := false
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID {
@@ -69,7 +70,7 @@ func (u *mockUsecase) AddBalance(userID string, amount int, transactionID string
 	return nil
 }
 
-func (u *mockUsecase) ReduceBalance(userID string, amount int, transactionID string) error {
+func (u *mockUsecase) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
 	userExist := false
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID && ub.Balance-amount >= 0 {
@@ -91,7 +92,7 @@ func (u *mockUsecase) ReduceBalance(userID string, amount int, transactionID str
 	return nil
 }
 
-func (u *mockUsecase) AddAllUserBalance(amount int, transactionID string) error {
+func (u *mockUsecase) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
 	for _, th := range u.transactionHistory {
 		if th.TransactionID == transactionID {
 			return errors.New("transaction_id must be unique")
@@ -101,7 +102,7 @@ func (u *mockUsecase) AddAllUserBalance(amount int, transactionID string) error
 	return nil
 }
 
-func (u *mockUsecase) GetBalance(userID string) (int, error) {
+func (u *mockUsecase) GetBalance(ctx context.Context, userID string) (int, error) {
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID {
 			return ub.Balance, nil
@@ -110,11 +111,254 @@ func (u *mockUsecase) GetBalance(userID string) (int, error) {
 	return 0, errors.New("user not found")
 }
 
+func (u *mockUsecase) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	if fromUserID == toUserID {
+		return errors.New("can't transfer to the same user")
+	}
+	if _, err := u.GetBalance(ctx, toUserID); err != nil {
+		return err
+	}
+	return u.ReduceBalance(ctx, fromUserID, amount, transactionID, audit)
+}
+
+func (u *mockUsecase) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	histories := []domain.TransactionHistoryModel{}
+	found := afterTransactionID == ""
+	for _, th := range u.transactionHistory {
+		if found && (th.UserID == userID || th.UserID == "") {
+			histories = append(histories, th)
+		}
+		if th.TransactionID == afterTransactionID {
+			found = true
+		}
+	}
+
+	return histories, nil
+}
+
+func (u *mockUsecase) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	if _, err := u.GetUser(ctx, userID); err == nil {
+		return errors.New("user already exists")
+	}
+	for _, th := range u.transactionHistory {
+		if th.TransactionID == transactionID {
+			return errors.New("transaction_id must be unique")
+		}
+	}
+
+	return nil
+}
+
+func (u *mockUsecase) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	for _, ub := range u.userBalance {
+		if ub.UserID == userID {
+			return ub, nil
+		}
+	}
+	return domain.UserBalanceModel{}, errors.New("user not found")
+}
+
+func (u *mockUsecase) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	if _, ok := scope.Status(); !ok {
+		return errors.New("invalid freeze scope")
+	}
+	_, err := u.GetUser(ctx, userID)
+	return err
+}
+
+func (u *mockUsecase) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Status == domain.UserStatus_Active {
+		return errors.New("user is not frozen")
+	}
+	return nil
+}
+
+func (u *mockUsecase) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Balance != 0 {
+		return errors.New("balance is not zero")
+	}
+	return nil
+}
+
+func (u *mockUsecase) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	if len(userIDs) == 0 {
+		return nil, errors.New("user_ids is empty")
+	}
+	results := []domain.BalanceResult{}
+	for _, userID := range userIDs {
+		user, err := u.GetUser(ctx, userID)
+		results = append(results, domain.BalanceResult{UserID: userID, Balance: user.Balance, Found: err == nil})
+	}
+	return results, nil
+}
+
+func (u *mockUsecase) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	users := []domain.UserBalanceModel{}
+	for _, ub := range u.userBalance {
+		matched := len(q.Statuses) == 0
+		for _, s := range q.Statuses {
+			if !s.Valid() {
+				return nil, "", errors.New("invalid user status")
+			}
+			matched = matched || ub.Status == s
+		}
+		if matched && (q.MinBalance == nil || ub.Balance >= *q.MinBalance) && ub.UserID > q.AfterUserID {
+			users = append(users, ub)
+		}
+	}
+	if q.PageSize > 0 && len(users) > q.PageSize {
+		users = users[:q.PageSize]
+		return users, users[q.PageSize-1].UserID, nil
+	}
+	return users, "", nil
+}
+
+func (u *mockUsecase) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	if mode != "" && mode != domain.ImportMode_Atomic && mode != domain.ImportMode_BestEffort {
+		return nil, errors.New("invalid import mode")
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("operations is empty")
+	}
+	results := []domain.ImportLineResult{}
+	failed := false
+	for _, op := range ops {
+		result := domain.ImportLineResult{Line: op.Line, UserID: op.UserID, TransactionID: op.TransactionID, Status: domain.ImportLineStatus_Applied}
+		if op.TransactionType == domain.TransactionType_AddAllUserBalance {
+			result.Status, result.Error = domain.ImportLineStatus_Failed, "invalid transaction type"
+		} else if _, err := u.GetUser(ctx, op.UserID); err != nil {
+			result.Status, result.Error = domain.ImportLineStatus_Failed, err.Error()
+		} else if op.TransactionID == "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b" {
+			result.Status = domain.ImportLineStatus_Skipped
+		}
+		failed = failed || result.Status == domain.ImportLineStatus_Failed
+		results = append(results, result)
+	}
+	if failed && mode != domain.ImportMode_BestEffort {
+		for i := range results {
+			if results[i].Status == domain.ImportLineStatus_Applied {
+				results[i].Status = domain.ImportLineStatus_NotApplied
+			}
+		}
+	}
+	return results, nil
+}
+
+func (u *mockUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	var summary domain.ExportSummary
+	for _, dataset := range q.Datasets {
+		if !dataset.Valid() {
+			return summary, errors.New("invalid export dataset")
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return summary, errors.New("invalid export period")
+	}
+	for _, transactionType := range q.TransactionTypes {
+		if _, ok := transactionTypes[transactionType]; !ok {
+			return summary, errors.New("invalid transaction type")
+		}
+	}
+	if q.Includes(domain.ExportDataset_Balances) {
+		for _, ub := range u.userBalance {
+			if err := w.WriteUserBalance(ub); err != nil {
+				return summary, err
+			}
+			summary.Balances++
+			summary.TotalBalance += int64(ub.Balance)
+		}
+	}
+	if q.Includes(domain.ExportDataset_History) {
+		for _, th := range u.transactionHistory {
+			matched := len(q.TransactionTypes) == 0
+			for _, transactionType := range q.TransactionTypes {
+				matched = matched || th.TransactionType == transactionType
+			}
+			if !matched {
+				continue
+			}
+			if err := w.WriteTransactionHistory(th); err != nil {
+				return summary, err
+			}
+			summary.Transactions++
+		}
+	}
+	return summary, nil
+}
+
+func (u *mockUsecase) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	if from.IsZero() || to.IsZero() || !from.Before(to) {
+		return domain.Statement{}, errors.New("invalid statement period")
+	}
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return domain.Statement{}, err
+	}
+	statement := domain.Statement{
+		UserID:         userID,
+		From:           from,
+		To:             to,
+		OpeningBalance: user.Balance,
+		ClosingBalance: user.Balance,
+		Totals:         []domain.StatementTotal{{TransactionType: domain.TransactionType_AddUserBalance}},
+	}
+	for _, th := range u.transactionHistory {
+		if th.UserID != userID || th.CreatedAt.Before(from) || !th.CreatedAt.Before(to) {
+			continue
+		}
+		statement.ClosingBalance += th.SignedAmount()
+		balanceAfter := statement.ClosingBalance
+		th.BalanceAfter = &balanceAfter
+		statement.Transactions = append(statement.Transactions, th)
+		statement.Totals[0].Count++
+		statement.Totals[0].Amount += int64(th.Amount)
+	}
+	return statement, nil
+}
+
+func (u *mockUsecase) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	if !q.Granularity.Valid() {
+		return domain.Report{}, errors.New("invalid report granularity")
+	}
+	if q.From.IsZero() || q.To.IsZero() || !q.From.Before(q.To) {
+		return domain.Report{}, errors.New("invalid report period")
+	}
+	report := domain.Report{From: q.Granularity.Truncate(q.From), Granularity: q.Granularity, AggregatedUntil: time.Now()}
+	for _, ub := range u.userBalance {
+		report.TotalUsers++
+		report.TotalBalance += int64(ub.Balance)
+	}
+	report.Balances = []domain.BalanceStatusTotal{{Status: domain.UserStatus_Active, Users: report.TotalUsers, Balance: report.TotalBalance}}
+	for report.To = report.From; report.To.Before(q.To); report.To = q.Granularity.Next(report.To) {
+		period := domain.ReportPeriod{
+			Start:   report.To,
+			End:     q.Granularity.Next(report.To),
+			Volumes: []domain.ReportVolume{{TransactionType: domain.TransactionType_AddUserBalance}},
+		}
+		for _, th := range u.transactionHistory {
+			if th.TransactionType == domain.TransactionType_AddUserBalance && !th.CreatedAt.Before(period.Start) && th.CreatedAt.Before(period.End) {
+				period.Credit += int64(th.Amount)
+				period.Volumes[0].Count++
+				period.Volumes[0].Amount += int64(th.Amount)
+			}
+		}
+		report.Periods = append(report.Periods, period)
+	}
+	return report, nil
+}
+
 func TestMain(m *testing.M) {
 	usecase := NewMockUsecase()
 	app := App{
-		InfoLog:  log.New(ioutil.Discard, "INFO\t", log.Ldate|log.Ltime),
-		ErrorLog: log.New(ioutil.Discard, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+		Logger: domain.NewNopLogger(),
 	}
 	handler = NewGrpcUserBalanceHander(usecase, &app)
 
@@ -264,3 +508,433 @@ func TestAddAllUserBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestTransferBalance(t *testing.T) {
+	cases := []struct {
+		Name          string
+		FromUserID    string
+		ToUserID      string
+		Amount        int32
+		TransactionID string
+		ExpectedMsg   string
+		ExpectedCode  codes.Code
+	}{
+		{"existent users", "test_user1", "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "", codes.OK},
+		{"balance insufficient", "test_user1", "test_user2", 100000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user balance is insufficient", codes.FailedPrecondition},
+		{"nonexistent to user", "test_user1", "unknown", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user not found", codes.NotFound},
+		{"same user", "test_user1", "test_user1", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "can't transfer to the same user", codes.InvalidArgument},
+		{"duplicated transaction_id", "test_user1", "test_user2", 1000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique", codes.AlreadyExists},
+		{"invalid amount", "test_user1", "test_user2", -1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "amount must be positive", codes.InvalidArgument},
+		{"empty from_user_id", "", "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "from_user_id is empty", codes.InvalidArgument},
+		{"empty to_user_id", "test_user1", "", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "to_user_id is empty", codes.InvalidArgument},
+		{"empty transaction_id", "test_user1", "test_user2", 1000, "", "transaction_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := context.Background()
+			req := &proto.TransferBalanceRequest{
+				FromUserId:    c.FromUserID,
+				ToUserId:      c.ToUserID,
+				Amount:        c.Amount,
+				TransactionId: c.TransactionID,
+			}
+			_, err := handler.TransferBalance(ctx, req)
+			st, ok := status.FromError(err)
+			if !ok {
+				t.Fatal("failed to get status from error")
+			}
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+		})
+	}
+}
+
+func TestGetTransactionHistory(t *testing.T) {
+	cases := []struct {
+		Name               string
+		UserID             string
+		AfterTransactionID string
+		ExpectedCount      int
+		ExpectedMsg        string
+		ExpectedCode       codes.Code
+	}{
+		{"from the beginning", "test_user1", "", 1, "", codes.OK},
+		{"after latest transaction", "test_user1", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", 0, "", codes.OK},
+		{"empty user id", "", "", 0, "user_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := context.Background()
+			req := &proto.GetTransactionHistoryRequest{
+				UserId:             c.UserID,
+				AfterTransactionId: c.AfterTransactionID,
+			}
+			resp, err := handler.GetTransactionHistory(ctx, req)
+			st, ok := status.FromError(err)
+			if !ok {
+				t.Fatal("failed to get status from error")
+			}
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if len(resp.GetHistories()) != c.ExpectedCount {
+				t.Fatalf("expect [%d] histories but got [%d]", c.ExpectedCount, len(resp.GetHistories()))
+			}
+			for _, history := range resp.GetHistories() {
+				if history.TransactionType != proto.TransactionType_ADD_USER_BALANCE || history.CreatedAt == nil {
+					t.Errorf("unexpected history %v", history)
+				}
+			}
+		})
+	}
+}
+
+func TestGetStatement(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		Name                 string
+		UserID               string
+		From                 *timestamppb.Timestamp
+		To                   *timestamppb.Timestamp
+		ExpectedTransactions int
+		ExpectedClosing      int32
+		ExpectedMsg          string
+		ExpectedCode         codes.Code
+	}{
+		{"with transaction", "test_user1", timestamppb.New(now.Add(-time.Hour)), timestamppb.New(now.Add(time.Hour)), 1, 15000, "", codes.OK},
+		{"without transaction", "test_user2", timestamppb.New(now.Add(-time.Hour)), timestamppb.New(now.Add(time.Hour)), 0, 20000, "", codes.OK},
+		{"missing period", "test_user1", nil, nil, 0, 0, "invalid statement period", codes.InvalidArgument},
+		{"nonexistent user", "unknown", timestamppb.New(now.Add(-time.Hour)), timestamppb.New(now.Add(time.Hour)), 0, 0, "user not found", codes.NotFound},
+		{"empty user id", "", nil, nil, 0, 0, "user_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.GetStatement(context.Background(), &proto.GetStatementRequest{UserId: c.UserID, From: c.From, To: c.To})
+			st, ok := status.FromError(err)
+			if !ok {
+				t.Fatal("failed to get status from error")
+			}
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if len(resp.GetTransactions()) != c.ExpectedTransactions || resp.GetClosingBalance() != c.ExpectedClosing {
+				t.Fatalf("expect [%d] transactions and closing balance [%d] but got %v", c.ExpectedTransactions, c.ExpectedClosing, resp)
+			}
+			for _, history := range resp.GetTransactions() {
+				if history.GetBalanceAfter().GetValue() != c.ExpectedClosing {
+					t.Errorf("expect balance_after [%d] but got %v", c.ExpectedClosing, history)
+				}
+			}
+		})
+	}
+}
+
+func TestGetReport(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		Name            string
+		From            *timestamppb.Timestamp
+		To              *timestamppb.Timestamp
+		Granularity     proto.ReportGranularity
+		ExpectedPeriods int
+		ExpectedCredit  int64
+		ExpectedMsg     string
+		ExpectedCode    codes.Code
+	}{
+		{"daily by default", timestamppb.New(now), timestamppb.New(now.Add(time.Minute)), proto.ReportGranularity_REPORT_GRANULARITY_UNSPECIFIED, 1, 5000, "", codes.OK},
+		{"monthly", timestamppb.New(now.AddDate(0, -1, 0)), timestamppb.New(now), proto.ReportGranularity_MONTH, 2, 5000, "", codes.OK},
+		{"missing period", nil, nil, proto.ReportGranularity_DAY, 0, 0, "invalid report period", codes.InvalidArgument},
+		{"unknown granularity", timestamppb.New(now), timestamppb.New(now.Add(time.Minute)), proto.ReportGranularity(9), 0, 0, "invalid report granularity", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.GetReport(context.Background(), &proto.GetReportRequest{From: c.From, To: c.To, Granularity: c.Granularity})
+			st, ok := status.FromError(err)
+			if !ok {
+				t.Fatal("failed to get status from error")
+			}
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if len(resp.GetPeriods()) != c.ExpectedPeriods {
+				t.Fatalf("expect [%d] periods but got %v", c.ExpectedPeriods, resp)
+			}
+			if c.ExpectedCode != codes.OK {
+				return
+			}
+			if resp.GetTotalBalance() != 150000 || resp.GetTotalUsers() != 6 || resp.GetBalances()[0].GetStatus() != proto.UserStatus_ACTIVE {
+				t.Errorf("expect total balance [150000] of [6] users but got %v", resp)
+			}
+			if credit := resp.GetPeriods()[len(resp.GetPeriods())-1].GetCredit(); credit != c.ExpectedCredit {
+				t.Errorf("expect credit [%d] in the last period but got [%d]", c.ExpectedCredit, credit)
+			}
+		})
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	cases := []struct {
+		Name           string
+		UserID         string
+		OpeningBalance int32
+		TransactionID  string
+		ExpectedMsg    string
+		ExpectedCode   codes.Code
+	}{
+		{"without opening balance", "new_user", 0, "", "", codes.OK},
+		{"with opening balance", "new_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "", codes.OK},
+		{"user already exists", "test_user1", 0, "", "user already exists", codes.AlreadyExists},
+		{"duplicated transaction_id", "new_user", 1000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique", codes.AlreadyExists},
+		{"empty user id", "", 0, "", "user_id is empty", codes.InvalidArgument},
+		{"negative opening balance", "new_user", -1, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "opening balance must not be negative", codes.InvalidArgument},
+		{"opening balance without transaction_id", "new_user", 1000, "", "transaction_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			req := &proto.CreateUserRequest{
+				UserId:         c.UserID,
+				OpeningBalance: c.OpeningBalance,
+				TransactionId:  c.TransactionID,
+			}
+			_, err := handler.CreateUser(context.Background(), req)
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	cases := []struct {
+		Name           string
+		UserID         string
+		ExpectedStatus proto.UserStatus
+		ExpectedMsg    string
+		ExpectedCode   codes.Code
+	}{
+		{"active user", "test_user1", proto.UserStatus_ACTIVE, "", codes.OK},
+		{"frozen user", "frozen_user", proto.UserStatus_FROZEN, "", codes.OK},
+		{"nonexistent user", "unknown", proto.UserStatus_USER_STATUS_UNSPECIFIED, "user not found", codes.NotFound},
+		{"empty user id", "", proto.UserStatus_USER_STATUS_UNSPECIFIED, "user_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.GetUser(context.Background(), &proto.GetUserRequest{UserId: c.UserID})
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if resp.GetStatus() != c.ExpectedStatus {
+				t.Errorf("expect user status [%s] but got [%s]", c.ExpectedStatus, resp.GetStatus())
+			}
+			if c.ExpectedCode == codes.OK && (resp.GetUserId() != c.UserID || resp.GetCreatedAt() == nil) {
+				t.Errorf("unexpected user %v", resp)
+			}
+		})
+	}
+}
+
+func TestChangeUserStatus(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Call         func(context.Context) error
+		ExpectedMsg  string
+		ExpectedCode codes.Code
+	}{
+		{"freeze", func(ctx context.Context) error {
+			_, err := handler.FreezeUser(ctx, &proto.FreezeUserRequest{UserId: "test_user1", Scope: proto.FreezeScope_DEBIT})
+			return err
+		}, "", codes.OK},
+		{"freeze without scope", func(ctx context.Context) error {
+			_, err := handler.FreezeUser(ctx, &proto.FreezeUserRequest{UserId: "test_user1"})
+			return err
+		}, "invalid freeze scope", codes.InvalidArgument},
+		{"freeze nonexistent user", func(ctx context.Context) error {
+			_, err := handler.FreezeUser(ctx, &proto.FreezeUserRequest{UserId: "unknown", Scope: proto.FreezeScope_ALL})
+			return err
+		}, "user not found", codes.NotFound},
+		{"unfreeze", func(ctx context.Context) error {
+			_, err := handler.UnfreezeUser(ctx, &proto.ChangeUserStatusRequest{UserId: "frozen_user"})
+			return err
+		}, "", codes.OK},
+		{"unfreeze active user", func(ctx context.Context) error {
+			_, err := handler.UnfreezeUser(ctx, &proto.ChangeUserStatusRequest{UserId: "test_user1"})
+			return err
+		}, "user is not frozen", codes.FailedPrecondition},
+		{"close", func(ctx context.Context) error {
+			_, err := handler.CloseUser(ctx, &proto.ChangeUserStatusRequest{UserId: "frozen_user"})
+			return err
+		}, "", codes.OK},
+		{"close user with balance", func(ctx context.Context) error {
+			_, err := handler.CloseUser(ctx, &proto.ChangeUserStatusRequest{UserId: "test_user1"})
+			return err
+		}, "balance is not zero", codes.FailedPrecondition},
+		{"close empty user id", func(ctx context.Context) error {
+			_, err := handler.CloseUser(ctx, &proto.ChangeUserStatusRequest{})
+			return err
+		}, "user_id is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			st, _ := status.FromError(c.Call(context.Background()))
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+		})
+	}
+}
+
+func TestBatchGetBalances(t *testing.T) {
+	cases := []struct {
+		Name            string
+		UserIDs         []string
+		ExpectedResults []*proto.BalanceResult
+		ExpectedMsg     string
+		ExpectedCode    codes.Code
+	}{
+		{"normal case", []string{"test_user1", "unknown", "test_user2"}, []*proto.BalanceResult{
+			{UserId: "test_user1", Balance: 10000, Found: true},
+			{UserId: "unknown"},
+			{UserId: "test_user2", Balance: 20000, Found: true},
+		}, "", codes.OK},
+		{"empty user ids", nil, nil, "user_ids is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.BatchGetBalances(context.Background(), &proto.BatchGetBalancesRequest{UserIds: c.UserIDs})
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if len(resp.GetResults()) != len(c.ExpectedResults) {
+				t.Fatalf("expect [%d] results but got [%d]", len(c.ExpectedResults), len(resp.GetResults()))
+			}
+			for i, expected := range c.ExpectedResults {
+				got := resp.GetResults()[i]
+				if got.UserId != expected.UserId || got.Balance != expected.Balance || got.Found != expected.Found {
+					t.Errorf("expect result %v but got %v", expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	cases := []struct {
+		Name              string
+		Request           *proto.ListAccountsRequest
+		ExpectedUsers     []string
+		ExpectedPageToken string
+		ExpectedMsg       string
+		ExpectedCode      codes.Code
+	}{
+		{"filter by status", &proto.ListAccountsRequest{Statuses: []proto.UserStatus{proto.UserStatus_FROZEN}}, []string{"frozen_user"}, "", "", codes.OK},
+		{"filter by min balance", &proto.ListAccountsRequest{MinBalance: wrapperspb.Int32(40000)}, []string{"test_user4", "test_user5"}, "", "", codes.OK},
+		{"first page", &proto.ListAccountsRequest{MinBalance: wrapperspb.Int32(10000), PageSize: 2}, []string{"test_user1", "test_user2"}, "test_user2", "", codes.OK},
+		{"next page", &proto.ListAccountsRequest{MinBalance: wrapperspb.Int32(10000), PageSize: 2, PageToken: "test_user4"}, []string{"test_user5"}, "", "", codes.OK},
+		{"unspecified status", &proto.ListAccountsRequest{Statuses: []proto.UserStatus{proto.UserStatus_USER_STATUS_UNSPECIFIED}}, nil, "", "invalid user status", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.ListAccounts(context.Background(), c.Request)
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			got := []string{}
+			for _, user := range resp.GetUsers() {
+				got = append(got, user.UserId)
+			}
+			if strings.Join(got, ",") != strings.Join(c.ExpectedUsers, ",") {
+				t.Errorf("expect users %v but got %v", c.ExpectedUsers, got)
+			}
+			if resp.GetNextPageToken() != c.ExpectedPageToken {
+				t.Errorf("expect next page token [%s] but got [%s]", c.ExpectedPageToken, resp.GetNextPageToken())
+			}
+		})
+	}
+}
+
+func TestImportBalanceOperations(t *testing.T) {
+	operations := []*proto.BalanceOperation{
+		{Line: 2, UserId: "test_user1", TransactionType: proto.TransactionType_ADD_USER_BALANCE, Amount: 1000, TransactionId: "tx1"},
+		{Line: 3, UserId: "unknown", TransactionType: proto.TransactionType_REDUCE_USER_BALANCE, Amount: 1000, TransactionId: "tx2"},
+		{Line: 4, UserId: "test_user2", TransactionType: proto.TransactionType_ADD_USER_BALANCE, Amount: 1000, TransactionId: "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b"},
+		{Line: 5, UserId: "test_user2", Amount: 1000, TransactionId: "tx3"},
+	}
+	cases := []struct {
+		Name             string
+		Request          *proto.ImportBalanceOperationsRequest
+		ExpectedStatuses []proto.ImportLineStatus
+		ExpectedErrors   []string
+		ExpectedMsg      string
+		ExpectedCode     codes.Code
+	}{
+		{"best effort", &proto.ImportBalanceOperationsRequest{Operations: operations, Mode: proto.ImportMode_BEST_EFFORT}, []proto.ImportLineStatus{
+			proto.ImportLineStatus_APPLIED, proto.ImportLineStatus_FAILED, proto.ImportLineStatus_SKIPPED, proto.ImportLineStatus_FAILED,
+		}, []string{"", "user not found", "", "invalid transaction type"}, "", codes.OK},
+		{"atomic by default", &proto.ImportBalanceOperationsRequest{Operations: operations[:3]}, []proto.ImportLineStatus{
+			proto.ImportLineStatus_NOT_APPLIED, proto.ImportLineStatus_FAILED, proto.ImportLineStatus_SKIPPED,
+		}, []string{"", "user not found", ""}, "", codes.OK},
+		{"empty operations", &proto.ImportBalanceOperationsRequest{Mode: proto.ImportMode_ATOMIC}, nil, nil, "operations is empty", codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			resp, err := handler.ImportBalanceOperations(context.Background(), c.Request)
+			st, _ := status.FromError(err)
+			if st.Code() != c.ExpectedCode {
+				t.Errorf("expect status code [%s] but got [%s]", c.ExpectedCode, st.Code())
+			}
+			if st.Message() != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, st.Message())
+			}
+			if len(resp.GetResults()) != len(c.ExpectedStatuses) {
+				t.Fatalf("expect [%d] results but got [%d]", len(c.ExpectedStatuses), len(resp.GetResults()))
+			}
+			for i, got := range resp.GetResults() {
+				if got.Line != c.Request.Operations[i].Line || got.Status != c.ExpectedStatuses[i] || got.Error != c.ExpectedErrors[i] {
+					t.Errorf("expect line [%d] to be [%s %s] but got %v", c.Request.Operations[i].Line, c.ExpectedStatuses[i], c.ExpectedErrors[i], got)
+				}
+			}
+		})
+	}
+}
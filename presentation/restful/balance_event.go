@@ -0,0 +1,244 @@
+package presentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// sseHeartbeatInterval 接続維持のためにハートビートを送信する間隔
+const sseHeartbeatInterval = 15 * time.Second
+
+// subscriberBufferSize 購読者毎にバッファリングするイベント数
+const subscriberBufferSize = 16
+
+// resetReasonOverflow 受信が追いつかずイベントを取りこぼしたため、ストリームを終了する場合のresetイベントの理由
+const resetReasonOverflow = "overflow"
+
+// resetReasonUnknownLastEventID Last-Event-IDの取引が存在せず再送できない場合のresetイベントの理由
+const resetReasonUnknownLastEventID = "unknown_last_event_id"
+
+// BalanceEventBroker usecaseのコミット後フックから受け取った残高変更イベントを購読者に配信
+type BalanceEventBroker struct {
+	mu          sync.RWMutex
+	subscribers map[chan domain.BalanceChangeEvent]string
+	overflowed  map[chan domain.BalanceChangeEvent]bool // バッファが溢れて購読を打ち切ったチャネル
+	closed      bool
+}
+
+// NewBalanceEventBroker 新しいイベントブローカーを作成
+func NewBalanceEventBroker() *BalanceEventBroker {
+	return &BalanceEventBroker{
+		subscribers: make(map[chan domain.BalanceChangeEvent]string),
+		overflowed:  make(map[chan domain.BalanceChangeEvent]bool),
+	}
+}
+
+// Publish 対象ユーザーの購読者にイベントを配信(domain.AfterCommitHookとして登録する)
+// 一斉加算のイベントは全ての購読者に配信する
+// 受信が追いつかずバッファが溢れた購読者はイベントを黙って破棄せず、チャネルを閉じて購読を打ち切る(Overflowedで判定できる)
+func (b *BalanceEventBroker) Publish(event domain.BalanceChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, userID := range b.subscribers {
+		if event.UserID != "" && event.UserID != userID {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			close(ch)
+			delete(b.subscribers, ch)
+			b.overflowed[ch] = true
+		}
+	}
+}
+
+// Overflowed バッファが溢れて購読を打ち切ったチャネルかを判定
+func (b *BalanceEventBroker) Overflowed(ch chan domain.BalanceChangeEvent) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.overflowed[ch]
+}
+
+// Subscribe ユーザーIDでイベントを購読(Close後はクローズ済みのチャネルを返す)
+func (b *BalanceEventBroker) Subscribe(userID string) chan domain.BalanceChangeEvent {
+	ch := make(chan domain.BalanceChangeEvent, subscriberBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[ch] = userID
+	return ch
+}
+
+// Unsubscribe 購読を解除
+func (b *BalanceEventBroker) Unsubscribe(ch chan domain.BalanceChangeEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	delete(b.overflowed, ch)
+	b.mu.Unlock()
+}
+
+// Close 全ての購読者のチャネルを閉じて配信を終了する
+// シャットダウン時にServer-Sent Eventsの接続を終了させるため、http.Server.RegisterOnShutdownで登録する
+func (b *BalanceEventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+}
+
+// balanceEventData Server-Sent Eventsで送信するイベントのデータフォーマット
+type balanceEventData struct {
+	TransactionID   string            `json:"transaction_id"`
+	UserID          string            `json:"user_id,omitempty"`
+	TransactionType int               `json:"transaction_type"`
+	Amount          int               `json:"amount"`
+	Actor           string            `json:"actor,omitempty"`
+	ReasonCode      string            `json:"reason_code,omitempty"`
+	Note            string            `json:"note,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	ClientAddr      string            `json:"client_addr,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// writeBalanceEvent 残高変更イベントをServer-Sent Events形式で書き込む
+func writeBalanceEvent(w http.ResponseWriter, event domain.BalanceChangeEvent) {
+	data, _ := json.Marshal(balanceEventData{
+		TransactionID:   event.TransactionID,
+		UserID:          event.UserID,
+		TransactionType: int(event.TransactionType),
+		Amount:          event.Amount,
+		Actor:           event.Actor,
+		ReasonCode:      event.ReasonCode,
+		Note:            event.Note,
+		Source:          string(event.Source),
+		ClientAddr:      event.ClientAddr,
+		Metadata:        event.Metadata,
+		CreatedAt:       event.CreatedAt,
+	})
+	fmt.Fprintf(w, "id: %s\nevent: balance_change\ndata: %s\n\n", event.TransactionID, data)
+}
+
+// writeResetEvent 取りこぼしたイベントがあり、クライアントが残高を取得し直す必要があることをresetイベントで通知
+func writeResetEvent(w http.ResponseWriter, reason string) {
+	fmt.Fprintf(w, "event: reset\ndata: {\"reason\":%q}\n\n", reason)
+}
+
+// BalanceEvents ユーザーIDでの残高変更をServer-Sent Eventsで配信するハンドラ
+// Last-Event-IDヘッダが指定された場合、その取引以降の履歴を再送してから配信を開始する
+// Last-Event-IDの取引が存在しない場合と、受信が追いつかずイベントを取りこぼした場合はresetイベントを送信する
+func (h *RestfulUserBalanceHandler) BalanceEvents(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	var resp getUserBalanceResponse
+	if userID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		resp.Status = "fail"
+		resp.Message = "user_id is empty"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || h.App.EventBroker == nil {
+		w.Header().Set("Content-Type", "application/json")
+		resp.Status = "error"
+		resp.Message = "streaming is not supported"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(out)
+		return
+	}
+
+	// 取りこぼしを防ぐため、履歴の再送より先に購読を開始する
+	ch := h.App.EventBroker.Subscribe(userID)
+	defer h.App.EventBroker.Unsubscribe(ch)
+
+	balance, err := h.usecase.GetBalance(r.Context(), userID)
+	var histories []domain.TransactionHistoryModel
+	unknownLastEventID := false
+	if lastEventID := r.Header.Get("Last-Event-ID"); err == nil && lastEventID != "" {
+		histories, err = h.usecase.GetTransactionHistory(r.Context(), userID, lastEventID)
+		if err != nil && err.Error() == "transaction not found" {
+			unknownLastEventID, err = true, nil
+		}
+	}
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "event: balance\ndata: {\"user_id\":%q,\"balance\":%d}\n\n", userID, balance)
+	if unknownLastEventID {
+		// 再送できないため、直前に送信した現在の残高から取得し直すよう通知して配信を続ける
+		writeResetEvent(w, resetReasonUnknownLastEventID)
+	}
+	sent := make(map[string]bool, len(histories))
+	for _, history := range histories {
+		writeBalanceEvent(w, domain.BalanceChangeEvent{
+			TransactionID:   history.TransactionID,
+			UserID:          history.UserID,
+			TransactionType: history.TransactionType,
+			Amount:          history.Amount,
+			AuditInfo:       history.AuditInfo,
+			CreatedAt:       history.CreatedAt,
+		})
+		sent[history.TransactionID] = true
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				// 取りこぼした場合は通知して終了し、クライアントの再接続時にLast-Event-IDから再送する
+				if h.App.EventBroker.Overflowed(ch) {
+					writeResetEvent(w, resetReasonOverflow)
+					flusher.Flush()
+				}
+				return
+			}
+			if sent[event.TransactionID] {
+				continue
+			}
+			writeBalanceEvent(w, event)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package presentation
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+func TestBalanceEventBrokerPublish(t *testing.T) {
+	broker := NewBalanceEventBroker()
+	ch1 := broker.Subscribe("test_user1")
+	ch2 := broker.Subscribe("test_user2")
+	defer broker.Unsubscribe(ch1)
+	defer broker.Unsubscribe(ch2)
+
+	broker.Publish(domain.BalanceChangeEvent{TransactionID: "1", UserID: "test_user1"})
+	broker.Publish(domain.BalanceChangeEvent{TransactionID: "2"})
+
+	cases := []struct {
+		Name        string
+		Ch          chan domain.BalanceChangeEvent
+		ExpectedIDs []string
+	}{
+		{"subscriber of target user", ch1, []string{"1", "2"}},
+		{"subscriber of other user", ch2, []string{"2"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if len(c.Ch) != len(c.ExpectedIDs) {
+				t.Fatalf("expect [%d] events but got [%d]", len(c.ExpectedIDs), len(c.Ch))
+			}
+			for _, id := range c.ExpectedIDs {
+				event := <-c.Ch
+				if event.TransactionID != id {
+					t.Errorf("expect transaction_id [%s] but got [%s]", id, event.TransactionID)
+				}
+			}
+		})
+	}
+}
+
+func TestBalanceEventBrokerOverflow(t *testing.T) {
+	broker := NewBalanceEventBroker()
+	ch := broker.Subscribe("test_user1")
+	defer broker.Unsubscribe(ch)
+
+	for i := 0; i <= subscriberBufferSize; i++ {
+		broker.Publish(domain.BalanceChangeEvent{TransactionID: strconv.Itoa(i), UserID: "test_user1"})
+	}
+
+	// バッファに入ったイベントを受信した後はチャネルが閉じられる
+	for i := 0; i < subscriberBufferSize; i++ {
+		if event := <-ch; event.TransactionID != strconv.Itoa(i) {
+			t.Errorf("expect transaction_id [%d] but got [%s]", i, event.TransactionID)
+		}
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expect channel to be closed after overflow")
+	}
+	if !broker.Overflowed(ch) {
+		t.Error("expect subscriber to be marked as overflowed")
+	}
+	// 打ち切った購読者には配信せず、閉じたチャネルへの送信も行わない
+	broker.Publish(domain.BalanceChangeEvent{TransactionID: "next", UserID: "test_user1"})
+	broker.Close()
+}
+
+func TestBalanceEvents(t *testing.T) {
+	broker := NewBalanceEventBroker()
+	h := NewRestfulUserBalanceHander(handler.usecase, &App{
+		Logger:      handler.App.Logger,
+		EventBroker: broker,
+	})
+	r := chi.NewRouter()
+	r.Get("/balance/{userID}/events", h.BalanceEvents)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/balance/test_user1/events", nil)
+	req.Header.Set("Last-Event-ID", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expect http status code [%d] but got [%d]", http.StatusOK, res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expect content type [text/event-stream] but got [%s]", ct)
+	}
+
+	ids := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "id: ") {
+				ids <- strings.TrimPrefix(scanner.Text(), "id: ")
+			}
+		}
+		close(ids)
+	}()
+
+	expectedIDs := []string{
+		"0d6f5b8e-2f5a-4c0e-9a43-6f1f3f6f2a11", // Last-Event-ID以降の履歴
+		"6c1a0f4e-8f7d-4d6b-8a65-2b1f0d5c9e37",
+		"917cd5c0-0bfc-4283-bc88-b5de8ad13635", // コミット後フックからの新しいイベント
+	}
+	for i, expectedID := range expectedIDs {
+		if i == 2 {
+			broker.Publish(domain.BalanceChangeEvent{TransactionID: "a0000000-0000-0000-0000-000000000000", UserID: "test_user2"})
+			broker.Publish(domain.BalanceChangeEvent{TransactionID: expectedID, UserID: "test_user1"})
+		}
+		select {
+		case id := <-ids:
+			if id != expectedID {
+				t.Errorf("expect event id [%s] but got [%s]", expectedID, id)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout while waiting for event [%s]", expectedID)
+		}
+	}
+
+	// ブローカーを閉じるとストリームが終了する
+	broker.Close()
+	select {
+	case id, ok := <-ids:
+		if ok {
+			t.Errorf("expect stream to be closed but got event [%s]", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout while waiting for stream to be closed")
+	}
+}
+
+func TestBalanceEventsNotFound(t *testing.T) {
+	h := NewRestfulUserBalanceHander(handler.usecase, &App{
+		Logger:      handler.App.Logger,
+		EventBroker: NewBalanceEventBroker(),
+	})
+	r := chi.NewRouter()
+	r.Get("/balance/{userID}/events", h.BalanceEvents)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/balance/unknown/events")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expect http status code [%d] but got [%d]", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestBalanceEventsReset(t *testing.T) {
+	broker := NewBalanceEventBroker()
+	h := NewRestfulUserBalanceHander(handler.usecase, &App{
+		Logger:      handler.App.Logger,
+		EventBroker: broker,
+	})
+	r := chi.NewRouter()
+	r.Get("/balance/{userID}/events", h.BalanceEvents)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/balance/test_user1/events", nil)
+	req.Header.Set("Last-Event-ID", "00000000-0000-0000-0000-000000000000")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expect http status code [%d] but got [%d]", http.StatusOK, res.StatusCode)
+	}
+
+	resets := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") && event == "reset" {
+				resets <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(resets)
+	}()
+
+	expectReset := func(expected string) {
+		t.Helper()
+		select {
+		case data := <-resets:
+			if data != expected {
+				t.Errorf("expect reset event [%s] but got [%s]", expected, data)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout while waiting for reset event [%s]", expected)
+		}
+	}
+
+	// Last-Event-IDの取引が存在しない場合は再送せずにresetを送信して配信を続ける
+	expectReset(`{"reason":"unknown_last_event_id"}`)
+
+	// 受信が追いつかずバッファが溢れた場合はresetを送信してストリームを終了する
+	for i := 0; i <= subscriberBufferSize*4; i++ {
+		broker.Publish(domain.BalanceChangeEvent{TransactionID: strconv.Itoa(i), UserID: "test_user1"})
+	}
+	expectReset(`{"reason":"overflow"}`)
+	select {
+	case data, ok := <-resets:
+		if ok {
+			t.Errorf("expect stream to be closed but got reset event [%s]", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout while waiting for stream to be closed")
+	}
+}
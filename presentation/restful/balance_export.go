@@ -0,0 +1,136 @@
+package presentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/balanceexport"
+)
+
+// downloadWriter 最初の書き出しの時点でダウンロードのヘッダーを設定するhttp.ResponseWriterのラッパー
+// 書き出す前のエラーはJSONで返せるよう、ヘッダーの送信を遅らせる
+type downloadWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	wrote       bool
+}
+
+// writeHeader ダウンロードのヘッダーを送信
+func (d *downloadWriter) writeHeader() {
+	if d.wrote {
+		return
+	}
+	d.wrote = true
+	d.w.Header().Set("Content-Type", d.contentType)
+	d.w.Header().Set("Content-Disposition", `attachment; filename="`+d.filename+`"`)
+	d.w.WriteHeader(http.StatusOK)
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	d.writeHeader()
+	return d.w.Write(p)
+}
+
+// parseExportQuery エクスポートのクエリパラメータを絞り込みの条件に変換
+// datasetsとtypesはカンマ区切りで複数指定でき、期間はRFC3339で指定する
+func parseExportQuery(values url.Values) (domain.ExportQuery, string) {
+	q := domain.ExportQuery{Datasets: balanceexport.ParseDatasets(values.Get("datasets"))}
+	for _, name := range []string{"from", "to"} {
+		v := values.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, name + " must be RFC3339"
+		}
+		if name == "from" {
+			q.From = t
+		} else {
+			q.To = t
+		}
+	}
+	types, err := balanceexport.ParseTransactionTypes(values.Get("types"))
+	if err != nil {
+		return q, err.Error()
+	}
+	q.TransactionTypes = types
+	return q, ""
+}
+
+// Export ユーザー残高と取引履歴を1つのスナップショットから読み取り、CSVまたはNDJSONでストリーミングするハンドラ
+// formatにcsv(デフォルト)またはndjson、gzipにtrueを指定した場合は圧縮したファイルを返す
+// 書き出しを開始した後にエラーが発生した場合は、不完全なファイルを完全なものと誤認されないよう接続を中断する
+func (h *RestfulUserBalanceHandler) Export(w http.ResponseWriter, r *http.Request) {
+	var resp changeUserBalanceResponse
+	// fail リクエストの誤りを400で返す
+	fail := func(msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		resp.Status = "fail"
+		resp.Message = msg
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+	}
+
+	values := r.URL.Query()
+	format := values.Get("format")
+	if format == "" {
+		format = balanceexport.Format_CSV
+	}
+	var compress bool
+	if v := values.Get("gzip"); v != "" {
+		var err error
+		if compress, err = strconv.ParseBool(v); err != nil {
+			fail("gzip must be a boolean")
+			return
+		}
+	}
+	q, msg := parseExportQuery(values)
+	if msg != "" {
+		fail(msg)
+		return
+	}
+
+	dw := &downloadWriter{
+		w:           w,
+		contentType: balanceexport.ContentType(format, compress),
+		filename:    "export-" + time.Now().UTC().Format("20060102T150405Z") + balanceexport.Extension(format, compress),
+	}
+	ew, err := balanceexport.NewWriter(dw, format, compress)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	summary, err := h.usecase.Export(r.Context(), q, ew)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		if dw.wrote {
+			domain.LoggerFromContext(r.Context()).Error("export aborted", "error", err, "balances", summary.Balances, "transactions", summary.Transactions)
+			panic(http.ErrAbortHandler)
+		}
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+	dw.writeHeader()
+	domain.LoggerFromContext(r.Context()).Info("export completed",
+		"balances", summary.Balances, "transactions", summary.Transactions, "total_balance", summary.TotalBalance)
+}
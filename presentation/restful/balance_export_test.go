@@ -0,0 +1,134 @@
+package presentation
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+func TestExport(t *testing.T) {
+	cases := []struct {
+		Name                string
+		Query               string
+		ExpectedCode        int
+		ExpectedContentType string
+		ExpectedExtension   string
+		ExpectedLines       int
+		ExpectedMsg         string
+	}{
+		{"csv", "", http.StatusOK, "text/csv; charset=utf-8", ".csv", 10, ""},
+		{"gzip ndjson history", "?format=ndjson&gzip=true&datasets=history&types=add,add-all", http.StatusOK, "application/gzip", ".ndjson.gz", 2, ""},
+		{"empty ndjson", "?format=ndjson&datasets=balances,history&types=add&from=2099-01-01T00:00:00Z", http.StatusOK, "application/x-ndjson", ".ndjson", 0, ""},
+		{"unknown format", "?format=xlsx", http.StatusBadRequest, "application/json", "", 0, "format must be csv or ndjson"},
+		{"invalid gzip", "?gzip=yes", http.StatusBadRequest, "application/json", "", 0, "gzip must be a boolean"},
+		{"invalid from", "?from=2021-06-01", http.StatusBadRequest, "application/json", "", 0, "from must be RFC3339"},
+		{"invalid type", "?types=refund", http.StatusBadRequest, "application/json", "", 0, "invalid transaction type"},
+		{"invalid dataset", "?datasets=users", http.StatusBadRequest, "application/json", "", 0, "invalid export dataset"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/export"+c.Query, nil)
+			w := httptest.NewRecorder()
+			handler.Export(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != c.ExpectedContentType {
+				t.Errorf("expect content type [%s] but got [%s]", c.ExpectedContentType, got)
+			}
+			if c.ExpectedCode != http.StatusOK {
+				var resp changeUserBalanceResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Errorf("expect no error but got [%s]", err)
+				}
+				if resp.Status != "fail" || resp.Message != c.ExpectedMsg {
+					t.Errorf("expect message [%s] but got %+v", c.ExpectedMsg, resp)
+				}
+				return
+			}
+
+			if disposition := w.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, c.ExpectedExtension+`"`) {
+				t.Errorf("expect attachment with extension [%s] but got [%s]", c.ExpectedExtension, disposition)
+			}
+			body := w.Body.Bytes()
+			if strings.HasSuffix(c.ExpectedExtension, ".gz") {
+				gr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("expect gzip body but got [%s]", err)
+				}
+				if body, err = ioutil.ReadAll(gr); err != nil {
+					t.Fatalf("expect no error but got [%s]", err)
+				}
+			}
+			var lines []string
+			if len(body) > 0 {
+				lines = strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+			}
+			if len(lines) != c.ExpectedLines {
+				t.Errorf("expect [%d] lines but got [%s]", c.ExpectedLines, body)
+			}
+		})
+	}
+}
+
+// failingExportUsecase 指定した件数のユーザー残高を書き出した後にDBのエラーを返すusecase
+type failingExportUsecase struct {
+	*mockUsecase
+	rows int
+}
+
+func (u *failingExportUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	for i := 0; i < u.rows; i++ {
+		if err := w.WriteUserBalance(domain.UserBalanceModel{UserID: "user" + strconv.Itoa(i), Balance: i}); err != nil {
+			return domain.ExportSummary{}, err
+		}
+	}
+	return domain.ExportSummary{Balances: u.rows}, errors.New("database error")
+}
+
+func TestExportFailed(t *testing.T) {
+	cases := []struct {
+		Name string
+		Rows int
+	}{
+		// 書き出した行がバッファに収まる場合はまだ送信していないため、エラーをJSONで返す
+		{"before response", 10},
+		// 送信を開始した後は接続を中断する
+		{"after response", 1000},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			h := NewRestfulUserBalanceHander(&failingExportUsecase{mockUsecase: NewMockUsecase().(*mockUsecase), rows: c.Rows}, &App{Logger: domain.NewNopLogger()})
+			r := httptest.NewRequest("GET", "/export", nil)
+			w := httptest.NewRecorder()
+			defer func() {
+				rvr := recover()
+				if c.Rows < 100 {
+					if rvr != nil || w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), `"message":"database error"`) {
+						t.Errorf("expect database error response but got [%v %d %s]", rvr, w.Code, w.Body.String())
+					}
+					return
+				}
+				if rvr != http.ErrAbortHandler {
+					t.Errorf("expect handler to abort the response but got [%v]", rvr)
+				}
+				if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "record,") {
+					t.Errorf("expect partial export before abort but got [%d]", w.Code)
+				}
+			}()
+			h.Export(w, r)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package presentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/balanceimport"
+)
+
+// maxImportFileSize アップロードできるインポートファイルの最大サイズ
+const maxImportFileSize = 10 << 20
+
+// maxImportMemory multipartの解析でメモリに保持する最大サイズ(超えた分は一時ファイルに書き出す)
+const maxImportMemory = 1 << 20
+
+// importLineResult インポートの行毎の結果
+type importLineResult struct {
+	Line          int    `json:"line"`
+	UserID        string `json:"user_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+// importBalanceOperationsResponse 残高操作をインポートするエンドポイントのレスポンスフォーマット
+type importBalanceOperationsResponse struct {
+	Status  string                          `json:"status"`
+	Message string                          `json:"message"`
+	Summary map[domain.ImportLineStatus]int `json:"summary,omitempty"`
+	Results []importLineResult              `json:"results,omitempty"`
+}
+
+// ImportBalanceOperations multipartでアップロードされたCSVまたはNDJSONの残高操作を適用するハンドラ
+// fileフィールドにファイル、formatに形式(省略した場合は拡張子で判定)、modeにatomicまたはbest_effortを指定する
+// 失敗した行がある場合は422で行毎の結果を返す
+func (h *RestfulUserBalanceHandler) ImportBalanceOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var resp importBalanceOperationsResponse
+
+	// fail リクエストの誤りを400で返す
+	fail := func(msg string) {
+		resp.Status = "fail"
+		resp.Message = msg
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportFileSize)
+	if err := r.ParseMultipartForm(maxImportMemory); err != nil {
+		fail("request body must be multipart/form-data within 10MB")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		fail("file is required")
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = balanceimport.FormatFromFilename(header.Filename)
+	}
+	ops, failed, err := balanceimport.Parse(file, format)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	audit := getAuditInfo(r, r.FormValue("reason_code"), r.FormValue("note"), nil)
+	results, err := balanceimport.Apply(r.Context(), h.usecase, ops, failed, domain.ImportMode(r.FormValue("mode")), audit)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Summary = balanceimport.Summary(results)
+	for _, result := range results {
+		resp.Results = append(resp.Results, importLineResult{
+			Line:          result.Line,
+			UserID:        result.UserID,
+			TransactionID: result.TransactionID,
+			Status:        string(result.Status),
+			Error:         result.Error,
+		})
+	}
+	httpCode := http.StatusOK
+	if resp.Summary[domain.ImportLineStatus_Failed] > 0 {
+		resp.Status = "fail"
+		resp.Message = fmt.Sprintf("%d of %d lines failed", resp.Summary[domain.ImportLineStatus_Failed], len(results))
+		httpCode = http.StatusUnprocessableEntity
+	} else {
+		resp.Status = "success"
+		resp.Message = fmt.Sprintf("%d lines applied, %d lines skipped", resp.Summary[domain.ImportLineStatus_Applied], resp.Summary[domain.ImportLineStatus_Skipped])
+	}
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(httpCode)
+	w.Write(out)
+}
@@ -0,0 +1,104 @@
+package presentation
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// newImportRequest インポートファイルとフォームの値をmultipartで送信するリクエストを作成
+func newImportRequest(t *testing.T, filename string, file string, fields map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if filename != "" {
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("expect no error but got [%s]", err)
+		}
+		part.Write([]byte(file))
+	}
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	writer.Close()
+
+	r := httptest.NewRequest("POST", "/balance/import", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestImportBalanceOperations(t *testing.T) {
+	const csvFile = "user_id,type,amount,transaction_id\n" +
+		"test_user1,add,1000,917cd5c0-0bfc-4283-bc88-b5de8ad13635\n" +
+		"test_user2,reduce,500,b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b\n"
+	cases := []struct {
+		Name             string
+		Filename         string
+		File             string
+		Fields           map[string]string
+		ExpectedStatus   string
+		ExpectedMsg      string
+		ExpectedStatuses []string
+		ExpectedCode     int
+	}{
+		{"csv", "credits.csv", csvFile, map[string]string{"mode": "atomic", "reason_code": "campaign"}, "success", "1 lines applied, 1 lines skipped",
+			[]string{"applied", "skipped"}, http.StatusOK},
+		{"ndjson with failed line", "credits.txt", `{"user_id": "unknown", "type": "add", "amount": 1000, "transaction_id": "tx1"}` + "\n" +
+			`{"user_id": "test_user1", "type": "refund", "amount": 1000, "transaction_id": "tx2"}` + "\n",
+			map[string]string{"format": "ndjson", "mode": "best_effort"}, "fail", "2 of 2 lines failed", []string{"failed", "failed"}, http.StatusUnprocessableEntity},
+		{"missing file", "", "", map[string]string{"mode": "atomic"}, "fail", "file is required", nil, http.StatusBadRequest},
+		{"unknown format", "credits.xlsx", csvFile, nil, "fail", "format must be csv or ndjson", nil, http.StatusBadRequest},
+		{"invalid header", "credits.csv", "user,amount\ntest_user1,1000\n", nil, "fail", "CSV header must contain user_id, type, amount, transaction_id", nil, http.StatusBadRequest},
+		{"invalid mode", "credits.csv", csvFile, map[string]string{"mode": "all"}, "fail", "invalid import mode", nil, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := newImportRequest(t, c.Filename, c.File, c.Fields)
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.ImportBalanceOperations)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			var resp importBalanceOperationsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			if len(resp.Results) != len(c.ExpectedStatuses) {
+				t.Fatalf("expect [%d] results but got [%d]", len(c.ExpectedStatuses), len(resp.Results))
+			}
+			for i, expected := range c.ExpectedStatuses {
+				if resp.Results[i].Status != expected {
+					t.Errorf("expect line [%d] to be [%s] but got %+v", resp.Results[i].Line, expected, resp.Results[i])
+				}
+			}
+			if c.ExpectedStatuses != nil && resp.Summary[domain.ImportLineStatus_Failed]+resp.Summary[domain.ImportLineStatus_Applied]+resp.Summary[domain.ImportLineStatus_Skipped] != len(c.ExpectedStatuses) {
+				t.Errorf("expect summary of [%d] lines but got %v", len(c.ExpectedStatuses), resp.Summary)
+			}
+		})
+	}
+}
+
+func TestImportBalanceOperationsNotMultipart(t *testing.T) {
+	r := httptest.NewRequest("POST", "/balance/import", bytes.NewReader([]byte(`{"user_id": "test_user1"}`)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ImportBalanceOperations(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect http status code [%d] but got [%d]", http.StatusBadRequest, w.Code)
+	}
+}
@@ -1,11 +1,14 @@
 package presentation
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"reflect"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/kaitolucifer/user-balance-management/domain"
 )
 
 // handleError エラーからハンドラに必要な情報を吐き出すヘルパー
@@ -26,6 +29,10 @@ func handleError(err error) (string, string, int) {
 			status = "fail"
 			msg = "user not found"
 			httpCode = http.StatusNotFound
+		} else if err.Error() == "transaction not found" {
+			status = "fail"
+			msg = "transaction not found"
+			httpCode = http.StatusNotFound
 		} else if err.Error() == "balance insufficient" {
 			status = "fail"
 			msg = "user balance is insufficient"
@@ -35,6 +42,47 @@ func handleError(err error) (string, string, int) {
 			status = "fail"
 			msg = "update failed, please retry"
 			httpCode = http.StatusConflict
+		} else if err.Error() == "unauthenticated" {
+			status = "fail"
+			msg = "unauthenticated"
+			httpCode = http.StatusUnauthorized
+		} else if err.Error() == "permission denied" {
+			status = "fail"
+			msg = "permission denied"
+			httpCode = http.StatusForbidden
+		} else if err.Error() == "rate limit exceeded" {
+			status = "fail"
+			msg = "rate limit exceeded"
+			httpCode = http.StatusTooManyRequests
+		} else if err.Error() == "reason_code is too long" || err.Error() == "note is too long" {
+			status = "fail"
+			msg = err.Error()
+			httpCode = http.StatusBadRequest
+		} else if err.Error() == "user already exists" {
+			status = "fail"
+			msg = "user already exists"
+			httpCode = http.StatusConflict
+		} else if err.Error() == "user is frozen" || err.Error() == "user is closed" ||
+			err.Error() == "user is not frozen" || err.Error() == "balance is not zero" {
+			// ユーザーの状態により操作できない
+			status = "fail"
+			msg = err.Error()
+			httpCode = http.StatusUnprocessableEntity
+		} else if err.Error() == "user_id is empty" || err.Error() == "user_id is too long" ||
+			err.Error() == "merchant_id is too long" || err.Error() == "transaction_id is empty" ||
+			err.Error() == "opening balance must not be negative" || err.Error() == "invalid freeze scope" ||
+			err.Error() == "user_ids is empty" || err.Error() == "too many user_ids" ||
+			err.Error() == "invalid sort field" || err.Error() == "invalid user status" ||
+			err.Error() == "invalid page_token" || err.Error() == "page_size must not be negative" ||
+			err.Error() == "invalid balance range" || err.Error() == "invalid created_at range" ||
+			err.Error() == "invalid import mode" || err.Error() == "operations is empty" ||
+			err.Error() == "too many operations" || err.Error() == "invalid export dataset" ||
+			err.Error() == "invalid export period" || err.Error() == "invalid transaction type" ||
+			err.Error() == "invalid statement period" || err.Error() == "invalid report granularity" ||
+			err.Error() == "invalid report period" {
+			status = "fail"
+			msg = err.Error()
+			httpCode = http.StatusBadRequest
 		} else if err.Error() == "current thread is not associated with a transaction" {
 			status = "fail"
 			msg = "current thread is not associated with a transaction"
@@ -49,6 +97,26 @@ func handleError(err error) (string, string, int) {
 	return status, msg, httpCode
 }
 
+// actorHeader 認証が無効な場合に実行者を示すリクエストヘッダ
+const actorHeader = "X-Actor-ID"
+
+// getAuditInfo リクエストから取引履歴に記録する監査情報を作成するヘルパー
+// 認証された主体が存在する場合はその主体を実行者とする
+func getAuditInfo(r *http.Request, reasonCode string, note string, md map[string]string) domain.AuditInfo {
+	actor := r.Header.Get(actorHeader)
+	if principal, ok := domain.PrincipalFromContext(r.Context()); ok {
+		actor = principal.ID
+	}
+	return domain.AuditInfo{
+		Actor:      actor,
+		ReasonCode: reasonCode,
+		Note:       note,
+		Source:     domain.RequestSource_RESTful,
+		ClientAddr: r.RemoteAddr,
+		Metadata:   md,
+	}
+}
+
 // getValidator 入力データのバリデーターを取得用のヘルパー
 func getValidator() *validator.Validate {
 	v := validator.New()
@@ -61,3 +129,26 @@ func getValidator() *validator.Validate {
 	})
 	return v
 }
+
+// maxRequestIDLength 受け付けるリクエストIDの最大長
+const maxRequestIDLength = 128
+
+// isValidRequestID 呼び出し側から受け取ったリクエストIDがログに出力できる形式かを判定
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID 新しいリクエストIDを生成
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -3,10 +3,12 @@ package presentation
 import (
 	"errors"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/kaitolucifer/user-balance-management/domain"
 )
 
 func TestHandleError(t *testing.T) {
@@ -22,6 +24,15 @@ func TestHandleError(t *testing.T) {
 		{"user not found", errors.New("user not found"), "user not found", "fail", http.StatusNotFound},
 		{"balance insufficient error", errors.New("balance insufficient"), "user balance is insufficient", "fail", http.StatusUnprocessableEntity},
 		{"update failed error", errors.New("update failed"), "update failed, please retry", "fail", http.StatusConflict},
+		{"permission denied", errors.New("permission denied"), "permission denied", "fail", http.StatusForbidden},
+		{"unauthenticated", errors.New("unauthenticated"), "unauthenticated", "fail", http.StatusUnauthorized},
+		{"too long note", errors.New("note is too long"), "note is too long", "fail", http.StatusBadRequest},
+		{"user already exists", errors.New("user already exists"), "user already exists", "fail", http.StatusConflict},
+		{"user is frozen", errors.New("user is frozen"), "user is frozen", "fail", http.StatusUnprocessableEntity},
+		{"balance is not zero", errors.New("balance is not zero"), "balance is not zero", "fail", http.StatusUnprocessableEntity},
+		{"invalid freeze scope", errors.New("invalid freeze scope"), "invalid freeze scope", "fail", http.StatusBadRequest},
+		{"too many user ids", errors.New("too many user_ids"), "too many user_ids", "fail", http.StatusBadRequest},
+		{"invalid page token", errors.New("invalid page_token"), "invalid page_token", "fail", http.StatusBadRequest},
 		{"other server error", errors.New("server error"), "internal server error", "error", http.StatusInternalServerError},
 	}
 
@@ -48,3 +59,27 @@ func TestGetValidator(t *testing.T) {
 		t.Errorf("return type is not *validator.Validate")
 	}
 }
+
+func TestGetAuditInfo(t *testing.T) {
+	r := httptest.NewRequest("PATCH", "/balance/add/test_user1", nil)
+	r.Header.Set(actorHeader, "operator1")
+	req := ChangeUserBalanceRequest{
+		ReasonCode: "refund",
+		Note:       "note",
+		Metadata:   map[string]string{"campaign": "summer"},
+	}
+	audit := getAuditInfo(r, req.ReasonCode, req.Note, req.Metadata)
+
+	if audit.Actor != "operator1" {
+		t.Errorf("expect actor [operator1] but got [%s]", audit.Actor)
+	}
+	if audit.ReasonCode != "refund" || audit.Note != "note" || audit.Metadata["campaign"] != "summer" {
+		t.Errorf("unexpected audit info [%+v]", audit)
+	}
+	if audit.Source != domain.RequestSource_RESTful {
+		t.Errorf("expect source [%s] but got [%s]", domain.RequestSource_RESTful, audit.Source)
+	}
+	if audit.ClientAddr != r.RemoteAddr {
+		t.Errorf("expect client address [%s] but got [%s]", r.RemoteAddr, audit.ClientAddr)
+	}
+}
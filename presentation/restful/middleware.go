@@ -0,0 +1,163 @@
+package presentation
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiKeyHeader APIキーを指定するリクエストヘッダ
+const apiKeyHeader = "X-API-Key"
+
+// Authenticate APIキーまたはJWTでリクエストを認証し、認証された主体をコンテキストに格納するミドルウェア
+func Authenticate(authenticator domain.Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var principal domain.Principal
+			var err error
+			if key := r.Header.Get(apiKeyHeader); key != "" {
+				principal, err = authenticator.AuthenticateAPIKey(key)
+			} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				principal, err = authenticator.AuthenticateToken(strings.TrimPrefix(auth, "Bearer "))
+			} else {
+				err = errors.New("unauthenticated")
+			}
+
+			if err != nil {
+				status, msg, httpCode := handleError(err)
+				out, _ := json.Marshal(changeUserBalanceResponse{Status: status, Message: msg})
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="user-balance-management"`)
+				w.WriteHeader(httpCode)
+				w.Write(out)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(domain.ContextWithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// clientKey レート制限に使用するクライアントのキーを取得(認証された主体がない場合はクライアントのIP)
+func clientKey(r *http.Request) string {
+	if principal, ok := domain.PrincipalFromContext(r.Context()); ok {
+		return "principal:" + principal.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// RateLimit クライアント毎と対象ユーザー毎にリクエスト頻度を制限するミドルウェア
+// URLパラメータを参照するため、ルーティング後に適用する必要がある
+func RateLimit(clientLimiter domain.RateLimiter, userLimiter domain.RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allow, wait := true, time.Duration(0)
+			if clientLimiter != nil {
+				allow, wait = clientLimiter.Allow(clientKey(r))
+			}
+			if userID := chi.URLParam(r, "userID"); allow && userLimiter != nil && userID != "" {
+				allow, wait = userLimiter.Allow("user:" + userID)
+			}
+
+			if !allow {
+				status, msg, httpCode := handleError(errors.New("rate limit exceeded"))
+				out, _ := json.Marshal(changeUserBalanceResponse{Status: status, Message: msg})
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(httpCode)
+				w.Write(out)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Metrics ルート毎のリクエスト数、ステータスコードと処理時間を記録するミドルウェア
+// ユーザーIDなどでラベルの種類が増えないよう、URLではなくchiのルートパターンを記録する
+func Metrics(metrics domain.MetricsRecorder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			code := ww.Status()
+			if code == 0 {
+				code = http.StatusOK
+			}
+			metrics.ObserveHTTPRequest(r.Method, route, code, time.Since(start))
+		})
+	}
+}
+
+// Tracing traceparentヘッダを引き継いでリクエスト毎にスパンを作成するミドルウェア
+// スパン名にはURLではなくchiのルートパターンを使用する
+func Tracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+		}
+	}), "HTTP request")
+}
+
+// requestIDHeader リクエストIDを受け渡すヘッダ
+const requestIDHeader = "X-Request-ID"
+
+// RequestID リクエストIDを受け付けまたは生成し、リクエストIDを付与したLoggerと共にコンテキストに格納するミドルウェア
+// リクエストの完了時にアクセスログを出力する
+func RequestID(logger domain.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestID := r.Header.Get(requestIDHeader)
+			if !isValidRequestID(requestID) {
+				requestID = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, requestID)
+
+			keysAndValues := []interface{}{"request_id", requestID}
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				keysAndValues = append(keysAndValues, "trace_id", sc.TraceID().String())
+			}
+			reqLogger := logger.With(keysAndValues...)
+			ctx := domain.ContextWithRequestID(r.Context(), requestID)
+			ctx = domain.ContextWithLogger(ctx, reqLogger)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			code := ww.Status()
+			if code == 0 {
+				code = http.StatusOK
+			}
+			reqLogger.Info("request completed", "method", r.Method, "path", r.URL.Path, "status", code,
+				"elapsed", time.Since(start).String(), "remote_addr", r.RemoteAddr)
+		})
+	}
+}
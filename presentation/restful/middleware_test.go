@@ -0,0 +1,279 @@
+package presentation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type mockAuthenticator struct{}
+
+func (a *mockAuthenticator) AuthenticateAPIKey(key string) (domain.Principal, error) {
+	if key == "valid-key" {
+		return domain.Principal{ID: "dashboard", Kind: domain.PrincipalKind_APIKey}, nil
+	}
+	return domain.Principal{}, errors.New("unauthenticated")
+}
+
+func (a *mockAuthenticator) AuthenticateToken(token string) (domain.Principal, error) {
+	if token == "valid-token" {
+		return domain.Principal{ID: "operator1", Kind: domain.PrincipalKind_JWT}, nil
+	}
+	return domain.Principal{}, errors.New("unauthenticated")
+}
+
+func TestAuthenticate(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Header       string
+		Value        string
+		ExpectedID   string
+		ExpectedCode int
+	}{
+		{"valid api key", apiKeyHeader, "valid-key", "dashboard", http.StatusOK},
+		{"invalid api key", apiKeyHeader, "wrong-key", "", http.StatusUnauthorized},
+		{"valid token", "Authorization", "Bearer valid-token", "operator1", http.StatusOK},
+		{"invalid token", "Authorization", "Bearer wrong-token", "", http.StatusUnauthorized},
+		{"not bearer", "Authorization", "Basic dXNlcjpwYXNz", "", http.StatusUnauthorized},
+		{"no credential", "", "", "", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var principalID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, _ := domain.PrincipalFromContext(r.Context())
+				principalID = principal.ID
+			})
+			r := httptest.NewRequest("GET", "/balance/test_user1", nil)
+			if c.Header != "" {
+				r.Header.Set(c.Header, c.Value)
+			}
+			w := httptest.NewRecorder()
+			Authenticate(&mockAuthenticator{})(next).ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+			if principalID != c.ExpectedID {
+				t.Errorf("expect principal [%s] but got [%s]", c.ExpectedID, principalID)
+			}
+		})
+	}
+}
+
+type mockRateLimiter struct {
+	denied map[string]bool
+}
+
+func (l *mockRateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.denied[key] {
+		return false, 1500 * time.Millisecond
+	}
+	return true, 0
+}
+
+func TestRateLimit(t *testing.T) {
+	clientLimiter := &mockRateLimiter{denied: map[string]bool{"principal:hammering-client": true, "ip:192.0.2.1": true}}
+	userLimiter := &mockRateLimiter{denied: map[string]bool{"user:hot_user": true}}
+	cases := []struct {
+		Name               string
+		PrincipalID        string
+		RemoteAddr         string
+		UserID             string
+		ExpectedCode       int
+		ExpectedRetryAfter string
+	}{
+		{"allowed", "dashboard", "192.0.2.2:1234", "test_user1", http.StatusOK, ""},
+		{"client limited by principal", "hammering-client", "192.0.2.2:1234", "test_user1", http.StatusTooManyRequests, "2"},
+		{"client limited by ip", "", "192.0.2.1:1234", "test_user1", http.StatusTooManyRequests, "2"},
+		{"user limited", "dashboard", "192.0.2.2:1234", "hot_user", http.StatusTooManyRequests, "2"},
+		{"no user", "dashboard", "192.0.2.2:1234", "", http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if c.PrincipalID != "" {
+						r = r.WithContext(domain.ContextWithPrincipal(r.Context(), domain.Principal{ID: c.PrincipalID}))
+					}
+					next.ServeHTTP(w, r)
+				})
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(RateLimit(clientLimiter, userLimiter))
+				r.Get("/balance/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+				r.Get("/balance", func(w http.ResponseWriter, r *http.Request) {})
+			})
+
+			url := "/balance"
+			if c.UserID != "" {
+				url += "/" + c.UserID
+			}
+			req := httptest.NewRequest("GET", url, nil)
+			req.RemoteAddr = c.RemoteAddr
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != c.ExpectedRetryAfter {
+				t.Errorf("expect Retry-After [%s] but got [%s]", c.ExpectedRetryAfter, retryAfter)
+			}
+		})
+	}
+}
+
+type mockMetricsRecorder struct {
+	method string
+	route  string
+	code   int
+}
+
+func (m *mockMetricsRecorder) ObserveOperation(op string, outcome string, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveHTTPRequest(method string, route string, code int, duration time.Duration) {
+	m.method = method
+	m.route = route
+	m.code = code
+}
+
+func (m *mockMetricsRecorder) ObserveGRPCRequest(method string, code string, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveCacheLookup(cache string, hit bool) {
+}
+
+func TestMetrics(t *testing.T) {
+	cases := []struct {
+		Name          string
+		Method        string
+		Path          string
+		ExpectedRoute string
+		ExpectedCode  int
+	}{
+		{"get balance", "GET", "/balance/test_user1", "/balance/{userID}", http.StatusOK},
+		{"user not found", "GET", "/balance/non_existent_user", "/balance/{userID}", http.StatusNotFound},
+		{"add balance", "PATCH", "/balance/add/test_user1", "/balance/add/{userID}", http.StatusBadRequest},
+	}
+
+	metrics := &mockMetricsRecorder{}
+	r := chi.NewRouter()
+	r.Use(Metrics(metrics))
+	r.Get("/balance/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "userID") != "test_user1" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	r.Patch("/balance/add/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(c.Method, c.Path, nil))
+
+			if metrics.method != c.Method || metrics.route != c.ExpectedRoute || metrics.code != c.ExpectedCode {
+				t.Errorf("expect [%s %s %d] but got [%s %s %d]", c.Method, c.ExpectedRoute, c.ExpectedCode,
+					metrics.method, metrics.route, metrics.code)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var traceID string
+	r := chi.NewRouter()
+	r.Use(Tracing)
+	r.Get("/balance/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		traceID = trace.SpanFromContext(r.Context()).SpanContext().TraceID().String()
+	})
+
+	req := httptest.NewRequest("GET", "/balance/test_user1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expect trace id to be propagated but got [%s]", traceID)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "GET /balance/{userID}" {
+		t.Errorf("expect span [GET /balance/{userID}] but got [%v]", spans)
+	}
+}
+
+type mockLogger struct {
+	fields []interface{}
+	msgs   *[]string
+}
+
+func (l *mockLogger) Debug(msg string, keysAndValues ...interface{}) { *l.msgs = append(*l.msgs, msg) }
+func (l *mockLogger) Info(msg string, keysAndValues ...interface{})  { *l.msgs = append(*l.msgs, msg) }
+func (l *mockLogger) Warn(msg string, keysAndValues ...interface{})  { *l.msgs = append(*l.msgs, msg) }
+func (l *mockLogger) Error(msg string, keysAndValues ...interface{}) { *l.msgs = append(*l.msgs, msg) }
+func (l *mockLogger) With(keysAndValues ...interface{}) domain.Logger {
+	return &mockLogger{fields: append(l.fields, keysAndValues...), msgs: l.msgs}
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		Name        string
+		RequestID   string
+		ExpectEqual bool
+	}{
+		{"accept request id", "c0ffee-42", true},
+		{"generate request id", "", false},
+		{"reject invalid request id", "bad id\n", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var msgs []string
+			var ctxRequestID string
+			var ctxFields []interface{}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxRequestID = domain.RequestIDFromContext(r.Context())
+				ctxFields = domain.LoggerFromContext(r.Context()).(*mockLogger).fields
+			})
+			r := httptest.NewRequest("GET", "/balance/test_user1", nil)
+			if c.RequestID != "" {
+				r.Header.Set(requestIDHeader, c.RequestID)
+			}
+			w := httptest.NewRecorder()
+			RequestID(&mockLogger{msgs: &msgs})(next).ServeHTTP(w, r)
+
+			respID := w.Header().Get(requestIDHeader)
+			if respID == "" || respID != ctxRequestID {
+				t.Errorf("expect response request id [%s] to equal context request id [%s]", respID, ctxRequestID)
+			}
+			if (respID == c.RequestID) != c.ExpectEqual {
+				t.Errorf("unexpected request id [%s] for header [%s]", respID, c.RequestID)
+			}
+			if len(ctxFields) < 2 || ctxFields[0] != "request_id" || ctxFields[1] != respID {
+				t.Errorf("expect logger to have request_id field but got [%v]", ctxFields)
+			}
+			if len(msgs) != 1 || msgs[0] != "request completed" {
+				t.Errorf("expect access log but got [%v]", msgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package presentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// reportVolume 集計レポートの取引種類毎の取引量のレスポンスフォーマット(取引種類は残高変更イベントと同じ数値)
+type reportVolume struct {
+	TransactionType int   `json:"transaction_type"`
+	Count           int64 `json:"count"`
+	Amount          int64 `json:"amount"`
+}
+
+// reportPeriod 集計レポートの1期間分のレスポンスフォーマット
+type reportPeriod struct {
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Credit  int64          `json:"credit"`
+	Debit   int64          `json:"debit"`
+	Volumes []reportVolume `json:"volumes"`
+}
+
+// reportBalance 集計レポートの状態毎の残高のレスポンスフォーマット
+type reportBalance struct {
+	Status  string `json:"status"`
+	Users   int64  `json:"users"`
+	Balance int64  `json:"balance"`
+}
+
+// reportResponse 集計レポートのレスポンスフォーマット
+type reportResponse struct {
+	From            time.Time       `json:"from"`
+	To              time.Time       `json:"to"`
+	Granularity     string          `json:"granularity"`
+	TotalBalance    int64           `json:"total_balance"`
+	TotalUsers      int64           `json:"total_users"`
+	Balances        []reportBalance `json:"balances"`
+	Periods         []reportPeriod  `json:"periods"`
+	Totals          []reportVolume  `json:"totals"`
+	AggregatedUntil time.Time       `json:"aggregated_until"`
+}
+
+// getReportResponse 集計レポートを取得するエンドポイントのレスポンスフォーマット
+type getReportResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message,omitempty"`
+	Report  *reportResponse `json:"report,omitempty"`
+}
+
+// toReportVolumes 取引種類毎の取引量をレスポンスフォーマットに変換
+func toReportVolumes(volumes []domain.ReportVolume) []reportVolume {
+	resp := make([]reportVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		resp = append(resp, reportVolume{TransactionType: int(volume.TransactionType), Count: volume.Count, Amount: volume.Amount})
+	}
+	return resp
+}
+
+// toReportResponse 集計レポートをレスポンスフォーマットに変換
+func toReportResponse(report domain.Report) *reportResponse {
+	resp := &reportResponse{
+		From:            report.From,
+		To:              report.To,
+		Granularity:     string(report.Granularity),
+		TotalBalance:    report.TotalBalance,
+		TotalUsers:      report.TotalUsers,
+		Balances:        make([]reportBalance, 0, len(report.Balances)),
+		Periods:         make([]reportPeriod, 0, len(report.Periods)),
+		Totals:          toReportVolumes(report.Totals),
+		AggregatedUntil: report.AggregatedUntil,
+	}
+	for _, total := range report.Balances {
+		resp.Balances = append(resp.Balances, reportBalance{Status: string(total.Status), Users: total.Users, Balance: total.Balance})
+	}
+	for _, period := range report.Periods {
+		resp.Periods = append(resp.Periods, reportPeriod{
+			Start:   period.Start,
+			End:     period.End,
+			Credit:  period.Credit,
+			Debit:   period.Debit,
+			Volumes: toReportVolumes(period.Volumes),
+		})
+	}
+	return resp
+}
+
+// GetReport 全ユーザーの残高の合計と期間毎の取引量の集計レポートを取得するハンドラ
+// 期間はfromとto(RFC3339)、単位はgranularity(day(デフォルト)、weekまたはmonth)で指定する
+func (h *RestfulUserBalanceHandler) GetReport(w http.ResponseWriter, r *http.Request) {
+	var resp getReportResponse
+	// writeJSON JSONのレスポンスを返す
+	writeJSON := func(httpCode int) {
+		w.Header().Set("Content-Type", "application/json")
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(httpCode)
+		w.Write(out)
+	}
+
+	values := r.URL.Query()
+	q := domain.ReportQuery{Granularity: domain.ReportGranularity(values.Get("granularity"))}
+	if q.Granularity == "" {
+		q.Granularity = domain.ReportGranularity_Day
+	}
+	for _, name := range []string{"from", "to"} {
+		v := values.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			resp.Status = "fail"
+			resp.Message = name + " must be RFC3339"
+			writeJSON(http.StatusBadRequest)
+			return
+		}
+		if name == "from" {
+			q.From = t
+		} else {
+			q.To = t
+		}
+	}
+
+	report, err := h.usecase.GetReport(r.Context(), q)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		writeJSON(httpCode)
+		return
+	}
+	resp.Status = "success"
+	resp.Report = toReportResponse(report)
+	writeJSON(http.StatusOK)
+}
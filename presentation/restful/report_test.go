@@ -0,0 +1,64 @@
+package presentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGetReport(t *testing.T) {
+	now := time.Now().UTC()
+	period := url.Values{
+		"from": {now.Format(time.RFC3339)},
+		"to":   {now.Add(time.Minute).Format(time.RFC3339)},
+	}.Encode()
+	cases := []struct {
+		Name            string
+		Query           string
+		ExpectedCode    int
+		ExpectedMsg     string
+		ExpectedPeriods int
+		ExpectedCredit  int64
+		ExpectedDebit   int64
+	}{
+		{"daily by default", period, http.StatusOK, "", 1, 6000, 3000},
+		{"monthly", "from=2021-06-15T00:00:00Z&to=2021-08-01T00:00:00Z&granularity=month", http.StatusOK, "", 2, 0, 0},
+		{"invalid from", "from=2021-06-01&to=2021-07-01T00:00:00Z", http.StatusBadRequest, "from must be RFC3339", 0, 0, 0},
+		{"invalid granularity", "from=2021-06-01T00:00:00Z&to=2021-07-01T00:00:00Z&granularity=year", http.StatusBadRequest, "invalid report granularity", 0, 0, 0},
+		{"missing period", "", http.StatusBadRequest, "invalid report period", 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/report?"+c.Query, nil)
+			w := httptest.NewRecorder()
+			http.HandlerFunc(handler.GetReport).ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+			var resp getReportResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			if c.ExpectedCode != http.StatusOK {
+				return
+			}
+			if resp.Report == nil || len(resp.Report.Periods) != c.ExpectedPeriods {
+				t.Fatalf("expect [%d] periods but got %+v", c.ExpectedPeriods, resp.Report)
+			}
+			if resp.Report.TotalBalance != 150000 || resp.Report.TotalUsers != 6 {
+				t.Errorf("expect total balance [150000] of [6] users but got [%d] of [%d]", resp.Report.TotalBalance, resp.Report.TotalUsers)
+			}
+			if p := resp.Report.Periods[0]; p.Credit != c.ExpectedCredit || p.Debit != c.ExpectedDebit {
+				t.Errorf("expect credit [%d] and debit [%d] but got [%d] and [%d]", c.ExpectedCredit, c.ExpectedDebit, p.Credit, p.Debit)
+			}
+		})
+	}
+}
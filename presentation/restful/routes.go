@@ -5,20 +5,59 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	GrpcHandler "github.com/kaitolucifer/user-balance-management/presentation/grpc"
 )
 
 // Routes chiを使用してHTTP用のmultiplexerを作成する
 func Routes(handler *RestfulUserBalanceHandler) http.Handler {
 	r := chi.NewRouter()
 
+	if handler.App != nil && handler.App.Tracing {
+		r.Use(Tracing)
+	}
+	logger := domain.NewNopLogger()
+	if handler.App != nil && handler.App.Logger != nil {
+		logger = handler.App.Logger
+	}
+	r.Use(RequestID(logger))
 	r.Use(middleware.Recoverer)
+	if handler.App != nil && handler.App.Metrics != nil {
+		r.Use(Metrics(handler.App.Metrics))
+	}
 
 	r.Get("/", handler.HealthCheck)
 	r.NotFound(handler.NotFound)
-	r.Get("/balance/{userID}", handler.GetUserBalance)
-	r.Patch("/balance/add/{userID}", handler.ChangeUserBalance)
-	r.Patch("/balance/reduce/{userID}", handler.ChangeUserBalance)
-	r.Patch("/balance/add-all", handler.AddAllUserBalance)
+	if handler.App != nil && handler.App.Gateway != nil {
+		// 認証とレート制限は変換先のgRPCサーバーで行う
+		r.Mount(GrpcHandler.GatewayPathPrefix, handler.App.Gateway)
+	}
+
+	r.Group(func(r chi.Router) {
+		// ヘルスチェック以外のエンドポイントは認証が必要
+		if handler.App != nil && handler.App.Authenticator != nil {
+			r.Use(Authenticate(handler.App.Authenticator))
+		}
+		if handler.App != nil && (handler.App.ClientRateLimiter != nil || handler.App.UserRateLimiter != nil) {
+			r.Use(RateLimit(handler.App.ClientRateLimiter, handler.App.UserRateLimiter))
+		}
+		r.Get("/balance/{userID}", handler.GetUserBalance)
+		r.Get("/balance/{userID}/events", handler.BalanceEvents)
+		r.Patch("/balance/add/{userID}", handler.ChangeUserBalance)
+		r.Patch("/balance/reduce/{userID}", handler.ChangeUserBalance)
+		r.Patch("/balance/add-all", handler.AddAllUserBalance)
+		r.Post("/balance/batch", handler.BatchGetBalances)
+		r.Post("/balance/import", handler.ImportBalanceOperations)
+		r.Get("/export", handler.Export)
+		r.Get("/report", handler.GetReport)
+		r.Post("/users", handler.CreateUser)
+		r.Get("/users", handler.ListAccounts)
+		r.Get("/users/{userID}", handler.GetUser)
+		r.Get("/users/{userID}/statement", handler.GetStatement)
+		r.Patch("/users/{userID}/freeze", handler.FreezeUser)
+		r.Patch("/users/{userID}/unfreeze", handler.UnfreezeUser)
+		r.Patch("/users/{userID}/close", handler.CloseUser)
+	})
 
 	return r
 }
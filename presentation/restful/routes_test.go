@@ -1,6 +1,9 @@
 package presentation
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/go-chi/chi"
@@ -15,3 +18,35 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("return type is not [*chi.Mux], got [%s]", v)
 	}
 }
+
+func TestRoutesGateway(t *testing.T) {
+	gateway := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("gateway " + r.URL.Path))
+	})
+	h := NewRestfulUserBalanceHander(handler.usecase, &App{Gateway: gateway})
+	ts := httptest.NewServer(Routes(h))
+	defer ts.Close()
+
+	cases := []struct {
+		Name         string
+		Path         string
+		ExpectedBody string
+	}{
+		{"gateway path", "/v1/users/test_user1/balance", "gateway /v1/users/test_user1/balance"},
+		{"restful path", "/", `{"status": "success", "message": "healthy"}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			res, err := http.Get(ts.URL + c.Path)
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != c.ExpectedBody {
+				t.Errorf("expect response body [%s] but got [%s]", c.ExpectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package presentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"github.com/kaitolucifer/user-balance-management/presentation/balancestatement"
+)
+
+// statementTransaction 取引明細の取引のレスポンスフォーマット(取引種類は残高変更イベントと同じ数値)
+type statementTransaction struct {
+	TransactionID   string            `json:"transaction_id"`
+	TransactionType int               `json:"transaction_type"`
+	Amount          int               `json:"amount"`
+	BalanceAfter    int               `json:"balance_after"`
+	Actor           string            `json:"actor,omitempty"`
+	ReasonCode      string            `json:"reason_code,omitempty"`
+	Note            string            `json:"note,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// statementTotal 取引明細の取引種類毎の合計のレスポンスフォーマット
+type statementTotal struct {
+	TransactionType int   `json:"transaction_type"`
+	Count           int   `json:"count"`
+	Amount          int64 `json:"amount"`
+}
+
+// statementResponse 取引明細のレスポンスフォーマット
+type statementResponse struct {
+	UserID         string                 `json:"user_id"`
+	From           time.Time              `json:"from"`
+	To             time.Time              `json:"to"`
+	OpeningBalance int                    `json:"opening_balance"`
+	ClosingBalance int                    `json:"closing_balance"`
+	Transactions   []statementTransaction `json:"transactions"`
+	Totals         []statementTotal       `json:"totals"`
+}
+
+// getStatementResponse 取引明細を取得するエンドポイントのレスポンスフォーマット
+type getStatementResponse struct {
+	Status    string             `json:"status"`
+	Message   string             `json:"message,omitempty"`
+	Statement *statementResponse `json:"statement,omitempty"`
+}
+
+// toStatementResponse 取引明細をレスポンスフォーマットに変換
+func toStatementResponse(statement domain.Statement) *statementResponse {
+	resp := &statementResponse{
+		UserID:         statement.UserID,
+		From:           statement.From,
+		To:             statement.To,
+		OpeningBalance: statement.OpeningBalance,
+		ClosingBalance: statement.ClosingBalance,
+		Transactions:   make([]statementTransaction, 0, len(statement.Transactions)),
+		Totals:         make([]statementTotal, 0, len(statement.Totals)),
+	}
+	for _, history := range statement.Transactions {
+		transaction := statementTransaction{
+			TransactionID:   history.TransactionID,
+			TransactionType: int(history.TransactionType),
+			Amount:          history.Amount,
+			Actor:           history.Actor,
+			ReasonCode:      history.ReasonCode,
+			Note:            history.Note,
+			Source:          string(history.Source),
+			Metadata:        history.Metadata,
+			CreatedAt:       history.CreatedAt,
+		}
+		if history.BalanceAfter != nil {
+			transaction.BalanceAfter = *history.BalanceAfter
+		}
+		resp.Transactions = append(resp.Transactions, transaction)
+	}
+	for _, total := range statement.Totals {
+		resp.Totals = append(resp.Totals, statementTotal{
+			TransactionType: int(total.TransactionType),
+			Count:           total.Count,
+			Amount:          total.Amount,
+		})
+	}
+	return resp
+}
+
+// GetStatement ユーザーの期間内の取引明細を取得するハンドラ
+// 期間はmonth(YYYY-MM、UTC)またはfromとto(RFC3339)で指定し、formatにcsvを指定した場合はCSVのファイルを返す
+func (h *RestfulUserBalanceHandler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	var resp getStatementResponse
+	// writeJSON JSONのレスポンスを返す
+	writeJSON := func(httpCode int) {
+		w.Header().Set("Content-Type", "application/json")
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(httpCode)
+		w.Write(out)
+	}
+
+	values := r.URL.Query()
+	format := values.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		resp.Status = "fail"
+		resp.Message = "format must be json or csv"
+		writeJSON(http.StatusBadRequest)
+		return
+	}
+	if userID == "" {
+		resp.Status = "fail"
+		resp.Message = "user_id is empty"
+		writeJSON(http.StatusBadRequest)
+		return
+	}
+	from, to, err := balancestatement.ParsePeriod(values.Get("month"), values.Get("from"), values.Get("to"))
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = err.Error()
+		writeJSON(http.StatusBadRequest)
+		return
+	}
+
+	statement, err := h.usecase.GetStatement(r.Context(), userID, from, to)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		writeJSON(httpCode)
+		return
+	}
+
+	if format == "csv" {
+		filename := "statement-" + from.UTC().Format("20060102") + "-" + to.UTC().Format("20060102") + ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.WriteHeader(http.StatusOK)
+		balancestatement.WriteCSV(w, statement)
+		return
+	}
+	resp.Status = "success"
+	resp.Statement = toStatementResponse(statement)
+	writeJSON(http.StatusOK)
+}
@@ -0,0 +1,99 @@
+package presentation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestGetStatement(t *testing.T) {
+	now := time.Now().UTC()
+	period := url.Values{
+		"from": {now.Add(-time.Hour).Format(time.RFC3339)},
+		"to":   {now.Add(time.Hour).Format(time.RFC3339)},
+	}.Encode()
+	cases := []struct {
+		Name                 string
+		UserID               string
+		Query                string
+		ExpectedCode         int
+		ExpectedMsg          string
+		ExpectedTransactions int
+		ExpectedClosing      int
+	}{
+		{"with bulk credit", "test_user1", period, http.StatusOK, "", 3, 13000},
+		{"month without transactions", "test_user2", "month=2021-06", http.StatusOK, "", 0, 20000},
+		{"invalid month", "test_user1", "month=June", http.StatusBadRequest, "month must be YYYY-MM", 0, 0},
+		{"missing period", "test_user1", "", http.StatusBadRequest, "month or from and to is required", 0, 0},
+		{"invalid period", "test_user1", "from=2021-07-01T00:00:00Z&to=2021-06-01T00:00:00Z", http.StatusBadRequest, "invalid statement period", 0, 0},
+		{"invalid format", "test_user1", "month=2021-06&format=xml", http.StatusBadRequest, "format must be json or csv", 0, 0},
+		{"nonexistent user", "unknown", "month=2021-06", http.StatusNotFound, "user not found", 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users/"+c.UserID+"/statement?"+c.Query, nil)
+			w := httptest.NewRecorder()
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", c.UserID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx))
+			http.HandlerFunc(handler.GetStatement).ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+			var resp getStatementResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			if c.ExpectedCode != http.StatusOK {
+				return
+			}
+			if resp.Statement == nil {
+				t.Fatalf("expect statement but got none")
+			}
+			if len(resp.Statement.Transactions) != c.ExpectedTransactions || resp.Statement.ClosingBalance != c.ExpectedClosing || len(resp.Statement.Totals) != 3 {
+				t.Errorf("expect [%d] transactions and closing balance [%d] but got %+v", c.ExpectedTransactions, c.ExpectedClosing, resp.Statement)
+			}
+			if n := len(resp.Statement.Transactions); n > 0 && resp.Statement.Transactions[n-1].BalanceAfter != c.ExpectedClosing {
+				t.Errorf("expect last balance_after [%d] but got %+v", c.ExpectedClosing, resp.Statement.Transactions[n-1])
+			}
+		})
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/users/test_user1/statement?format=csv&"+period, nil)
+		w := httptest.NewRecorder()
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", "test_user1")
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx))
+		http.HandlerFunc(handler.GetStatement).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expect http status code [%d] but got [%d]", http.StatusOK, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+			t.Errorf("expect csv content type but got [%s]", ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="statement-`) {
+			t.Errorf("expect attachment but got [%s]", cd)
+		}
+		// ヘッダー、開始時点の残高、取引3件、終了時点の残高、取引種類毎の合計3件
+		if lines := strings.Count(w.Body.String(), "\n"); lines != 9 {
+			t.Errorf("expect [9] lines but got [%d]: %s", lines, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), "\nclosing,,"+now.Add(time.Hour).Format(time.RFC3339)+",,,13000,") {
+			t.Errorf("expect closing balance but got [%s]", w.Body.String())
+		}
+	})
+}
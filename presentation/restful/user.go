@@ -0,0 +1,421 @@
+package presentation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// CreateUserRequest ユーザーを作成するエンドポイントのリクエストフォーマット
+// 初期残高を指定する場合はtransaction_idが必要
+type CreateUserRequest struct {
+	UserID         string            `json:"user_id" validate:"required"`
+	MerchantID     string            `json:"merchant_id,omitempty"`
+	OpeningBalance int               `json:"opening_balance,omitempty"`
+	TransactionID  string            `json:"transaction_id,omitempty"`
+	ReasonCode     string            `json:"reason_code,omitempty"`
+	Note           string            `json:"note,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+// ChangeUserStatusRequest ユーザーの状態を変更するエンドポイントのリクエストフォーマット
+// scopeは凍結の場合のみ使用する(debitまたはall)
+type ChangeUserStatusRequest struct {
+	Scope      string `json:"scope,omitempty"`
+	ReasonCode string `json:"reason_code,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// userResponse ユーザーの情報のレスポンスフォーマット
+type userResponse struct {
+	UserID     string    `json:"user_id"`
+	Balance    int       `json:"balance"`
+	MerchantID string    `json:"merchant_id,omitempty"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// getUserResponse ユーザーの情報を参照するエンドポイントのレスポンスフォーマット
+type getUserResponse struct {
+	Status  string        `json:"status"`
+	Message string        `json:"message,omitempty"`
+	User    *userResponse `json:"user,omitempty"`
+}
+
+// BatchGetBalancesRequest 複数のユーザーの残高を一括で参照するエンドポイントのリクエストフォーマット
+type BatchGetBalancesRequest struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// balanceResult 一括残高参照のユーザー毎の結果のフォーマット
+type balanceResult struct {
+	UserID  string `json:"user_id"`
+	Balance int    `json:"balance"`
+	Found   bool   `json:"found"`
+}
+
+// batchGetBalancesResponse 複数のユーザーの残高を一括で参照するエンドポイントのレスポンスフォーマット
+type batchGetBalancesResponse struct {
+	Status   string          `json:"status"`
+	Message  string          `json:"message,omitempty"`
+	Balances []balanceResult `json:"balances,omitempty"`
+}
+
+// listAccountsResponse 口座一覧のエンドポイントのレスポンスフォーマット
+type listAccountsResponse struct {
+	Status        string         `json:"status"`
+	Message       string         `json:"message,omitempty"`
+	Users         []userResponse `json:"users"`
+	NextPageToken string         `json:"next_page_token,omitempty"`
+}
+
+// toUserResponse ユーザーの情報をレスポンスフォーマットに変換
+func toUserResponse(user domain.UserBalanceModel) userResponse {
+	return userResponse{
+		UserID:     user.UserID,
+		Balance:    user.Balance,
+		MerchantID: user.MerchantID,
+		Status:     string(user.Status),
+		CreatedAt:  user.CreatedAt,
+		UpdatedAt:  user.UpdatedAt,
+	}
+}
+
+// CreateUser ユーザーを作成するハンドラ
+func (h *RestfulUserBalanceHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var resp changeUserBalanceResponse
+	var req CreateUserRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = "request body is invalid"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = "request body's JSON format is invalid (user_id: string, opening_balance: int, transaction_id: string)"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	v := getValidator()
+	if err := v.Struct(req); err != nil {
+		resp.Status = "fail"
+		invalidFields := []string{}
+		for _, validErr := range err.(validator.ValidationErrors) {
+			invalidFields = append(invalidFields, validErr.Field())
+		}
+		resp.Message = strings.Join(invalidFields, ", ") + " can't be null"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	audit := getAuditInfo(r, req.ReasonCode, req.Note, req.Metadata)
+	err = h.usecase.CreateUser(r.Context(), req.UserID, req.MerchantID, req.OpeningBalance, req.TransactionID, audit)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Message = "user has been created successfully"
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
+
+// GetUser ユーザーIDで状態を含むユーザーの情報を取得するハンドラ
+func (h *RestfulUserBalanceHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	w.Header().Set("Content-Type", "application/json")
+	var resp getUserResponse
+
+	if userID == "" {
+		resp.Status = "fail"
+		resp.Message = "user_id is empty"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	user, err := h.usecase.GetUser(r.Context(), userID)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Status = "success"
+	userResp := toUserResponse(user)
+	resp.User = &userResp
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// FreezeUser ユーザーを凍結するハンドラ
+func (h *RestfulUserBalanceHandler) FreezeUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, "user has been frozen successfully", func(userID string, req ChangeUserStatusRequest) error {
+		audit := getAuditInfo(r, req.ReasonCode, req.Note, nil)
+		return h.usecase.FreezeUser(r.Context(), userID, domain.FreezeScope(req.Scope), audit)
+	})
+}
+
+// UnfreezeUser ユーザーの凍結を解除するハンドラ
+func (h *RestfulUserBalanceHandler) UnfreezeUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, "user has been unfrozen successfully", func(userID string, req ChangeUserStatusRequest) error {
+		return h.usecase.UnfreezeUser(r.Context(), userID, getAuditInfo(r, req.ReasonCode, req.Note, nil))
+	})
+}
+
+// CloseUser ユーザーを解約するハンドラ
+func (h *RestfulUserBalanceHandler) CloseUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, "user has been closed successfully", func(userID string, req ChangeUserStatusRequest) error {
+		return h.usecase.CloseUser(r.Context(), userID, getAuditInfo(r, req.ReasonCode, req.Note, nil))
+	})
+}
+
+// changeUserStatus ユーザーの状態を変更するハンドラの共通処理
+// リクエストボディは省略できる
+func (h *RestfulUserBalanceHandler) changeUserStatus(w http.ResponseWriter, r *http.Request, successMsg string, change func(string, ChangeUserStatusRequest) error) {
+	userID := chi.URLParam(r, "userID")
+	w.Header().Set("Content-Type", "application/json")
+	var resp changeUserBalanceResponse
+	var req ChangeUserStatusRequest
+
+	if userID == "" {
+		resp.Status = "fail"
+		resp.Message = "user_id is empty"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = "request body is invalid"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			resp.Status = "fail"
+			resp.Message = "request body's JSON format is invalid (scope: string, reason_code: string, note: string)"
+			out, _ := json.Marshal(resp)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(out)
+			return
+		}
+	}
+
+	if err := change(userID, req); err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Message = successMsg
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// BatchGetBalances 複数のユーザーの残高を一括で取得するハンドラ
+// 見つからないユーザーはfoundがfalseの結果として返す
+func (h *RestfulUserBalanceHandler) BatchGetBalances(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var resp batchGetBalancesResponse
+	var req BatchGetBalancesRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = "request body is invalid"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		resp.Status = "fail"
+		resp.Message = "request body's JSON format is invalid (user_ids: []string)"
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	results, err := h.usecase.BatchGetBalances(r.Context(), req.UserIDs)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Status = "success"
+	for _, result := range results {
+		resp.Balances = append(resp.Balances, balanceResult{UserID: result.UserID, Balance: result.Balance, Found: result.Found})
+	}
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// parseListAccountsQuery 口座一覧のクエリパラメータを絞り込みの条件に変換
+// statusはカンマ区切りで複数指定でき、作成日時はRFC3339で指定する
+func parseListAccountsQuery(values url.Values) (domain.ListAccountsQuery, string) {
+	q := domain.ListAccountsQuery{
+		MerchantID:  values.Get("merchant_id"),
+		SortBy:      domain.AccountSortField(values.Get("sort")),
+		AfterUserID: values.Get("page_token"),
+	}
+	for _, name := range []string{"min_balance", "max_balance", "page_size"} {
+		v := values.Get(name)
+		if v == "" {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return q, name + " must be an integer"
+		}
+		switch name {
+		case "min_balance":
+			q.MinBalance = &i
+		case "max_balance":
+			q.MaxBalance = &i
+		default:
+			q.PageSize = i
+		}
+	}
+	for _, name := range []string{"created_after", "created_before"} {
+		v := values.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, name + " must be RFC3339"
+		}
+		if name == "created_after" {
+			q.CreatedAfter = t
+		} else {
+			q.CreatedBefore = t
+		}
+	}
+	if statuses := values.Get("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			q.Statuses = append(q.Statuses, domain.UserStatus(status))
+		}
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, "order must be asc or desc"
+	}
+	return q, ""
+}
+
+// ListAccounts 条件で絞り込んだユーザーを並び替えてページ毎に取得するハンドラ
+// 次のページがある場合はnext_page_tokenをpage_tokenに指定する
+func (h *RestfulUserBalanceHandler) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := listAccountsResponse{Users: []userResponse{}}
+
+	q, msg := parseListAccountsQuery(r.URL.Query())
+	if msg != "" {
+		resp.Status = "fail"
+		resp.Message = msg
+		out, _ := json.Marshal(resp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(out)
+		return
+	}
+
+	users, nextPageToken, err := h.usecase.ListAccounts(r.Context(), q)
+	if err != nil {
+		status, msg, httpCode := handleError(err)
+		if status == "error" {
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
+		}
+
+		resp.Status = status
+		resp.Message = msg
+		w.WriteHeader(httpCode)
+		out, _ := json.Marshal(resp)
+		w.Write(out)
+		return
+	}
+
+	resp.Status = "success"
+	for _, user := range users {
+		resp.Users = append(resp.Users, toUserResponse(user))
+	}
+	resp.NextPageToken = nextPageToken
+	out, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
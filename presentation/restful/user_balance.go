@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
 	"github.com/go-chi/chi"
 	"github.com/go-playground/validator/v10"
@@ -15,14 +15,22 @@ import (
 
 // App アプリケーションが持つコンポーネントや設定を格納
 type App struct {
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	Logger            domain.Logger
+	EventBroker       *BalanceEventBroker
+	Authenticator     domain.Authenticator
+	ClientRateLimiter domain.RateLimiter
+	UserRateLimiter   domain.RateLimiter
+	Metrics           domain.MetricsRecorder
+	Tracing           bool
+	// Gateway gRPCに変換するゲートウェイ(/v1以下に割り当てる)
+	Gateway http.Handler
 }
 
 // UserBalanceHandler usecaseとアプリケーション設定を格納
 type RestfulUserBalanceHandler struct {
-	usecase domain.UserBalanceUsecase
-	App     *App
+	usecase  domain.UserBalanceUsecase
+	App      *App
+	draining int32
 }
 
 // NewUserBalanceHander 新しいRESTfulハンドラを作成
@@ -33,9 +41,19 @@ func NewRestfulUserBalanceHander(usecase domain.UserBalanceUsecase, app *App) *R
 	}
 }
 
+// SetDraining シャットダウン中はヘルスチェックで503を返す
+func (h *RestfulUserBalanceHandler) SetDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
 // HealthCheck ヘルスチェック用ハンドラ
 func (h *RestfulUserBalanceHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if atomic.LoadInt32(&h.draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status": "error", "message": "shutting down"}`))
+		return
+	}
 	resp := []byte(`{"status": "success", "message": "healthy"}`)
 	w.Write(resp)
 }
@@ -72,11 +90,11 @@ func (h *RestfulUserBalanceHandler) GetUserBalance(w http.ResponseWriter, r *htt
 		return
 	}
 
-	balance, err := h.usecase.GetBalance(userID)
+	balance, err := h.usecase.GetBalance(r.Context(), userID)
 	if err != nil {
 		status, msg, httpCode := handleError(err)
 		if status == "error" {
-			h.App.ErrorLog.Println(err)
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
 		}
 
 		resp.Status = status
@@ -102,8 +120,11 @@ type changeUserBalanceResponse struct {
 
 // changeUserBalanceResponse 残高を加減算するエンドポイントのリクエストフォーマット
 type ChangeUserBalanceRequest struct {
-	Amount        *int    `json:"amount" validate:"required"`
-	TransactionID string `json:"transaction_id" validate:"required"`
+	Amount        *int              `json:"amount" validate:"required"`
+	TransactionID string            `json:"transaction_id" validate:"required"`
+	ReasonCode    string            `json:"reason_code,omitempty"`
+	Note          string            `json:"note,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
 }
 
 // ChangeUserBalance ユーザーIDでの残高加減算処理を扱うハンドラ
@@ -169,15 +190,15 @@ func (h *RestfulUserBalanceHandler) ChangeUserBalance(w http.ResponseWriter, r *
 	}
 
 	if change_type == "add" {
-		err = h.usecase.AddBalance(userID, *req.Amount, req.TransactionID)
+		err = h.usecase.AddBalance(r.Context(), userID, *req.Amount, req.TransactionID, getAuditInfo(r, req.ReasonCode, req.Note, req.Metadata))
 	} else {
-		err = h.usecase.ReduceBalance(userID, *req.Amount, req.TransactionID)
+		err = h.usecase.ReduceBalance(r.Context(), userID, *req.Amount, req.TransactionID, getAuditInfo(r, req.ReasonCode, req.Note, req.Metadata))
 	}
 
 	if err != nil {
 		status, msg, httpCode := handleError(err)
 		if status == "error" {
-			h.App.ErrorLog.Println(err)
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
 		}
 
 		resp.Status = status
@@ -243,11 +264,11 @@ func (h *RestfulUserBalanceHandler) AddAllUserBalance(w http.ResponseWriter, r *
 		return
 	}
 
-	err = h.usecase.AddAllUserBalance(*req.Amount, req.TransactionID)
+	err = h.usecase.AddAllUserBalance(r.Context(), *req.Amount, req.TransactionID, getAuditInfo(r, req.ReasonCode, req.Note, req.Metadata))
 	if err != nil {
 		status, msg, httpCode := handleError(err)
 		if status == "error" {
-			h.App.ErrorLog.Println(err)
+			domain.LoggerFromContext(r.Context()).Error("request failed", "error", err)
 		}
 
 		resp.Status = status
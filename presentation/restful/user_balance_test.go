@@ -7,7 +7,6 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -33,6 +32,7 @@ func NewMockUsecase() domain.UserBalanceUsecase {
 		{UserID: "test_user3", Balance: 30000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
 		{UserID: "test_user4", Balance: 40000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
 		{UserID: "test_user5", Balance: 50000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "frozen_user", Balance: 0, Status: domain.UserStatus_Frozen, CreatedAt: time.Now(), UpdatedAt: time.Now()},
 	}
 
 	transactionHistory := []domain.TransactionHistoryModel{
@@ -44,6 +44,21 @@ func NewMockUsecase() domain.UserBalanceUsecase {
 			CreatedAt:       time.Now(),
 			UpdatedAt:       time.Now(),
 		},
+		{
+			TransactionID:   "0d6f5b8e-2f5a-4c0e-9a43-6f1f3f6f2a11",
+			UserID:          "test_user1",
+			TransactionType: domain.TransactionType_ReduceUserBalance,
+			Amount:          3000,
+			CreatedAt:       time.Now(),
+			UpdatedAt:       time.Now(),
+		},
+		{
+			TransactionID:   "6c1a0f4e-8f7d-4d6b-8a65-2b1f0d5c9e37",
+			TransactionType: domain.TransactionType_AddAllUserBalance,
+			Amount:          1000,
+			CreatedAt:       time.Now(),
+			UpdatedAt:       time.Now(),
+		},
 	}
 
 	return &mockUsecase{
@@ -52,7 +67,7 @@ func NewMockUsecase() domain.UserBalanceUsecase {
 	}
 }
 
-func (u *mockUsecase) AddBalance(userID string, amount int, transactionID string) error {
+func (u *mockUsecase) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
 	userExist := false
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID {
@@ -72,7 +87,7 @@ func (u *mockUsecase) AddBalance(userID string, amount int, transactionID string
 	return nil
 }
 
-func (u *mockUsecase) ReduceBalance(userID string, amount int, transactionID string) error {
+func (u *mockUsecase) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
 	userExist := false
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID && ub.Balance-amount >= 0 {
@@ -94,7 +109,7 @@ func (u *mockUsecase) ReduceBalance(userID string, amount int, transactionID str
 	return nil
 }
 
-func (u *mockUsecase) AddAllUserBalance(amount int, transactionID string) error {
+func (u *mockUsecase) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
 	for _, th := range u.transactionHistory {
 		if th.TransactionID == transactionID {
 			return errors.New("transaction_id must be unique")
@@ -104,7 +119,7 @@ func (u *mockUsecase) AddAllUserBalance(amount int, transactionID string) error
 	return nil
 }
 
-func (u *mockUsecase) GetBalance(userID string) (int, error) {
+func (u *mockUsecase) GetBalance(ctx context.Context, userID string) (int, error) {
 	for _, ub := range u.userBalance {
 		if ub.UserID == userID {
 			return ub.Balance, nil
@@ -113,11 +128,242 @@ func (u *mockUsecase) GetBalance(userID string) (int, error) {
 	return 0, errors.New("user not found")
 }
 
+func (u *mockUsecase) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	if fromUserID == toUserID {
+		return errors.New("can't transfer to the same user")
+	}
+	if _, err := u.GetBalance(ctx, toUserID); err != nil {
+		return err
+	}
+	return u.ReduceBalance(ctx, fromUserID, amount, transactionID, audit)
+}
+
+func (u *mockUsecase) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	histories := []domain.TransactionHistoryModel{}
+	found := false
+	for _, th := range u.transactionHistory {
+		if found && (th.UserID == userID || th.UserID == "") {
+			histories = append(histories, th)
+		}
+		if th.TransactionID == afterTransactionID {
+			found = true
+		}
+	}
+	if afterTransactionID != "" && !found {
+		return nil, errors.New("transaction not found")
+	}
+
+	return histories, nil
+}
+
+func (u *mockUsecase) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	if _, err := u.GetUser(ctx, userID); err == nil {
+		return errors.New("user already exists")
+	}
+	if openingBalance < 0 {
+		return errors.New("opening balance must not be negative")
+	}
+
+	return nil
+}
+
+func (u *mockUsecase) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	for _, ub := range u.userBalance {
+		if ub.UserID == userID {
+			return ub, nil
+		}
+	}
+	return domain.UserBalanceModel{}, errors.New("user not found")
+}
+
+func (u *mockUsecase) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	if _, ok := scope.Status(); !ok {
+		return errors.New("invalid freeze scope")
+	}
+	_, err := u.GetUser(ctx, userID)
+	return err
+}
+
+func (u *mockUsecase) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Status != domain.UserStatus_Frozen {
+		return errors.New("user is not frozen")
+	}
+	return nil
+}
+
+func (u *mockUsecase) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Balance != 0 {
+		return errors.New("balance is not zero")
+	}
+	return nil
+}
+
+func (u *mockUsecase) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	if len(userIDs) == 0 {
+		return nil, errors.New("user_ids is empty")
+	}
+	results := []domain.BalanceResult{}
+	for _, userID := range userIDs {
+		user, err := u.GetUser(ctx, userID)
+		results = append(results, domain.BalanceResult{UserID: userID, Balance: user.Balance, Found: err == nil})
+	}
+	return results, nil
+}
+
+func (u *mockUsecase) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	if q.SortBy != "" && !q.SortBy.Valid() {
+		return nil, "", errors.New("invalid sort field")
+	}
+	users := []domain.UserBalanceModel{}
+	for _, ub := range u.userBalance {
+		matched := len(q.Statuses) == 0
+		for _, s := range q.Statuses {
+			matched = matched || ub.Status == s
+		}
+		if matched && (q.MinBalance == nil || ub.Balance >= *q.MinBalance) && ub.UserID > q.AfterUserID {
+			users = append(users, ub)
+		}
+	}
+	if q.PageSize > 0 && len(users) > q.PageSize {
+		users = users[:q.PageSize]
+		return users, users[q.PageSize-1].UserID, nil
+	}
+	return users, "", nil
+}
+
+func (u *mockUsecase) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	if mode != "" && mode != domain.ImportMode_Atomic && mode != domain.ImportMode_BestEffort {
+		return nil, errors.New("invalid import mode")
+	}
+	results := []domain.ImportLineResult{}
+	for _, op := range ops {
+		result := domain.ImportLineResult{Line: op.Line, UserID: op.UserID, TransactionID: op.TransactionID, Status: domain.ImportLineStatus_Applied}
+		if _, err := u.GetUser(ctx, op.UserID); err != nil {
+			result.Status, result.Error = domain.ImportLineStatus_Failed, err.Error()
+		} else if op.TransactionID == "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b" {
+			result.Status = domain.ImportLineStatus_Skipped
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (u *mockUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	var summary domain.ExportSummary
+	for _, dataset := range q.Datasets {
+		if !dataset.Valid() {
+			return summary, errors.New("invalid export dataset")
+		}
+	}
+	inPeriod := func(at time.Time) bool {
+		return (q.From.IsZero() || !at.Before(q.From)) && (q.To.IsZero() || at.Before(q.To))
+	}
+	if q.Includes(domain.ExportDataset_Balances) {
+		for _, ub := range u.userBalance {
+			if !inPeriod(ub.UpdatedAt) {
+				continue
+			}
+			if err := w.WriteUserBalance(ub); err != nil {
+				return summary, err
+			}
+			summary.Balances++
+			summary.TotalBalance += int64(ub.Balance)
+		}
+	}
+	if q.Includes(domain.ExportDataset_History) {
+		for _, th := range u.transactionHistory {
+			matched := len(q.TransactionTypes) == 0
+			for _, transactionType := range q.TransactionTypes {
+				matched = matched || th.TransactionType == transactionType
+			}
+			if !matched || !inPeriod(th.CreatedAt) {
+				continue
+			}
+			if err := w.WriteTransactionHistory(th); err != nil {
+				return summary, err
+			}
+			summary.Transactions++
+		}
+	}
+	return summary, nil
+}
+
+func (u *mockUsecase) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	if !from.Before(to) {
+		return domain.Statement{}, errors.New("invalid statement period")
+	}
+	user, err := u.GetUser(ctx, userID)
+	if err != nil {
+		return domain.Statement{}, err
+	}
+	statement := domain.Statement{
+		UserID:         userID,
+		From:           from,
+		To:             to,
+		OpeningBalance: user.Balance,
+		ClosingBalance: user.Balance,
+		Transactions:   []domain.TransactionHistoryModel{},
+	}
+	for transactionType := domain.TransactionType_AddUserBalance; transactionType <= domain.TransactionType_AddAllUserBalance; transactionType++ {
+		statement.Totals = append(statement.Totals, domain.StatementTotal{TransactionType: transactionType})
+	}
+	for _, th := range u.transactionHistory {
+		if (th.UserID != userID && th.UserID != "") || th.CreatedAt.Before(from) || !th.CreatedAt.Before(to) {
+			continue
+		}
+		statement.ClosingBalance += th.SignedAmount()
+		balanceAfter := statement.ClosingBalance
+		th.BalanceAfter = &balanceAfter
+		statement.Transactions = append(statement.Transactions, th)
+		statement.Totals[th.TransactionType].Count++
+		statement.Totals[th.TransactionType].Amount += int64(th.Amount)
+	}
+	return statement, nil
+}
+
+func (u *mockUsecase) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	if !q.Granularity.Valid() {
+		return domain.Report{}, errors.New("invalid report granularity")
+	}
+	if !q.From.Before(q.To) {
+		return domain.Report{}, errors.New("invalid report period")
+	}
+	report := domain.Report{From: q.Granularity.Truncate(q.From), Granularity: q.Granularity, AggregatedUntil: time.Now()}
+	for _, ub := range u.userBalance {
+		report.TotalUsers++
+		report.TotalBalance += int64(ub.Balance)
+	}
+	report.Balances = []domain.BalanceStatusTotal{{Status: domain.UserStatus_Active, Users: report.TotalUsers, Balance: report.TotalBalance}}
+	for report.To = report.From; report.To.Before(q.To); report.To = q.Granularity.Next(report.To) {
+		report.Periods = append(report.Periods, domain.ReportPeriod{Start: report.To, End: q.Granularity.Next(report.To)})
+	}
+	for _, th := range u.transactionHistory {
+		for i, period := range report.Periods {
+			if th.CreatedAt.Before(period.Start) || !th.CreatedAt.Before(period.End) {
+				continue
+			}
+			if th.TransactionType == domain.TransactionType_ReduceUserBalance {
+				report.Periods[i].Debit += int64(th.Amount)
+			} else {
+				report.Periods[i].Credit += int64(th.Amount)
+			}
+		}
+	}
+	return report, nil
+}
+
 func TestMain(m *testing.M) {
 	usecase := NewMockUsecase()
 	app := App{
-		InfoLog:  log.New(ioutil.Discard, "INFO\t", log.Ldate|log.Ltime),
-		ErrorLog: log.New(ioutil.Discard, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+		Logger: domain.NewNopLogger(),
 	}
 	handler = NewRestfulUserBalanceHander(usecase, &app)
 	code := m.Run()
@@ -146,6 +392,31 @@ func TestHealthCheck(t *testing.T) {
 	}
 }
 
+func TestHealthCheckDraining(t *testing.T) {
+	h := NewRestfulUserBalanceHander(handler.usecase, handler.App)
+	h.SetDraining()
+	ts := httptest.NewServer(http.HandlerFunc(h.HealthCheck))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Errorf("expect no error but got [%s]", err)
+	}
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expect status code [%d] but got [%d]", http.StatusServiceUnavailable, res.StatusCode)
+	}
+	expectedResBody := `{"status": "error", "message": "shutting down"}`
+	if string(resBody) != expectedResBody {
+		t.Errorf("expect response body [%s]\nbut got [%s]", expectedResBody, string(resBody))
+	}
+}
+
 func TestNotFound(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(handler.NotFound))
 	defer ts.Close()
@@ -0,0 +1,255 @@
+package presentation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestCreateUser(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Body           string
+		ExpectedStatus string
+		ExpectedMsg    string
+		ExpectedCode   int
+	}{
+		{"normal case", `{"user_id": "new_user", "merchant_id": "shop1", "opening_balance": 1000, "transaction_id": "917cd5c0-0bfc-4283-bc88-b5de8ad13635"}`, "success", "user has been created successfully", http.StatusCreated},
+		{"user already exists", `{"user_id": "test_user1"}`, "fail", "user already exists", http.StatusConflict},
+		{"negative opening balance", `{"user_id": "new_user", "opening_balance": -1}`, "fail", "opening balance must not be negative", http.StatusBadRequest},
+		{"empty user_id", `{"opening_balance": 1000}`, "fail", "user_id can't be null", http.StatusBadRequest},
+		{"invalid json", `{"user_id": 1}`, "fail", "request body's JSON format is invalid (user_id: string, opening_balance: int, transaction_id: string)", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/users", nil)
+			w := httptest.NewRecorder()
+			r.Body = ioutil.NopCloser(bytes.NewReader([]byte(c.Body)))
+			h := http.HandlerFunc(handler.CreateUser)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			body, err := io.ReadAll(w.Body)
+			if err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			var resp changeUserBalanceResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	cases := []struct {
+		Name               string
+		UserID             string
+		ExpectedStatus     string
+		ExpectedMsg        string
+		ExpectedUserStatus string
+		ExpectedCode       int
+	}{
+		{"frozen user", "frozen_user", "success", "", "frozen", http.StatusOK},
+		{"nonexistent user", "unknown", "fail", "user not found", "", http.StatusNotFound},
+		{"empty user id", "", "fail", "user_id is empty", "", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users", nil)
+			w := httptest.NewRecorder()
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", c.UserID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx))
+			h := http.HandlerFunc(handler.GetUser)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			var resp getUserResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			if c.ExpectedUserStatus != "" && (resp.User == nil || resp.User.Status != c.ExpectedUserStatus || resp.User.UserID != c.UserID) {
+				t.Errorf("expect user status [%s] but got %+v", c.ExpectedUserStatus, resp.User)
+			}
+		})
+	}
+}
+
+func TestChangeUserStatus(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Handler        http.HandlerFunc
+		UserID         string
+		Body           string
+		ExpectedStatus string
+		ExpectedMsg    string
+		ExpectedCode   int
+	}{
+		{"freeze", handler.FreezeUser, "test_user1", `{"scope": "debit", "reason_code": "fraud"}`, "success", "user has been frozen successfully", http.StatusOK},
+		{"freeze without scope", handler.FreezeUser, "test_user1", "", "fail", "invalid freeze scope", http.StatusBadRequest},
+		{"freeze nonexistent user", handler.FreezeUser, "unknown", `{"scope": "all"}`, "fail", "user not found", http.StatusNotFound},
+		{"unfreeze", handler.UnfreezeUser, "frozen_user", "", "success", "user has been unfrozen successfully", http.StatusOK},
+		{"unfreeze active user", handler.UnfreezeUser, "test_user1", "", "fail", "user is not frozen", http.StatusUnprocessableEntity},
+		{"close", handler.CloseUser, "frozen_user", `{"note": "requested by user"}`, "success", "user has been closed successfully", http.StatusOK},
+		{"close user with balance", handler.CloseUser, "test_user1", "", "fail", "balance is not zero", http.StatusUnprocessableEntity},
+		{"invalid json", handler.CloseUser, "frozen_user", `{"note": 1}`, "fail", "request body's JSON format is invalid (scope: string, reason_code: string, note: string)", http.StatusBadRequest},
+		{"empty user id", handler.CloseUser, "", "", "fail", "user_id is empty", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("PATCH", "/users", bytes.NewReader([]byte(c.Body)))
+			w := httptest.NewRecorder()
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", c.UserID)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, chiCtx))
+			c.Handler.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			var resp changeUserBalanceResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+		})
+	}
+}
+
+func TestBatchGetBalances(t *testing.T) {
+	cases := []struct {
+		Name             string
+		Body             string
+		ExpectedStatus   string
+		ExpectedMsg      string
+		ExpectedBalances []balanceResult
+		ExpectedCode     int
+	}{
+		{"normal case", `{"user_ids": ["test_user1", "unknown"]}`, "success", "",
+			[]balanceResult{{UserID: "test_user1", Balance: 10000, Found: true}, {UserID: "unknown"}}, http.StatusOK},
+		{"empty user ids", `{"user_ids": []}`, "fail", "user_ids is empty", nil, http.StatusBadRequest},
+		{"invalid json", `{"user_ids": "test_user1"}`, "fail", "request body's JSON format is invalid (user_ids: []string)", nil, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/balance/batch", bytes.NewReader([]byte(c.Body)))
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.BatchGetBalances)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			var resp batchGetBalancesResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			if len(resp.Balances) != len(c.ExpectedBalances) {
+				t.Fatalf("expect [%d] balances but got [%d]", len(c.ExpectedBalances), len(resp.Balances))
+			}
+			for i, expected := range c.ExpectedBalances {
+				if resp.Balances[i] != expected {
+					t.Errorf("expect balance %+v but got %+v", expected, resp.Balances[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	cases := []struct {
+		Name              string
+		Query             string
+		ExpectedStatus    string
+		ExpectedMsg       string
+		ExpectedUsers     []string
+		ExpectedPageToken string
+		ExpectedCode      int
+	}{
+		{"filter by status", "?status=frozen,closed", "success", "", []string{"frozen_user"}, "", http.StatusOK},
+		{"first page", "?min_balance=40000&page_size=1", "success", "", []string{"test_user4"}, "test_user4", http.StatusOK},
+		{"next page", "?min_balance=40000&page_size=1&page_token=test_user4", "success", "", []string{"test_user5"}, "", http.StatusOK},
+		{"invalid min balance", "?min_balance=abc", "fail", "min_balance must be an integer", []string{}, "", http.StatusBadRequest},
+		{"invalid created_after", "?created_after=2021-05-29", "fail", "created_after must be RFC3339", []string{}, "", http.StatusBadRequest},
+		{"invalid order", "?order=random", "fail", "order must be asc or desc", []string{}, "", http.StatusBadRequest},
+		{"invalid sort", "?sort=name", "fail", "invalid sort field", []string{}, "", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/users"+c.Query, nil)
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.ListAccounts)
+			h.ServeHTTP(w, r)
+
+			if w.Code != c.ExpectedCode {
+				t.Errorf("expect http status code [%d] but got [%d]", c.ExpectedCode, w.Code)
+			}
+
+			var resp listAccountsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("expect no error but got [%s]", err)
+			}
+			if resp.Status != c.ExpectedStatus {
+				t.Errorf("expect status [%s] but got [%s]", c.ExpectedStatus, resp.Status)
+			}
+			if resp.Message != c.ExpectedMsg {
+				t.Errorf("expect message [%s] but got [%s]", c.ExpectedMsg, resp.Message)
+			}
+			got := []string{}
+			for _, user := range resp.Users {
+				got = append(got, user.UserID)
+			}
+			if strings.Join(got, ",") != strings.Join(c.ExpectedUsers, ",") {
+				t.Errorf("expect users %v but got %v", c.ExpectedUsers, got)
+			}
+			if resp.NextPageToken != c.ExpectedPageToken {
+				t.Errorf("expect next page token [%s] but got [%s]", c.ExpectedPageToken, resp.NextPageToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// AggregateRefresher 集計レポートが読み取る取引履歴の日毎の集計を一定間隔で更新するバックグラウンドジョブ
+// 集計レポートは集計を読み取るのみのため、集計の更新はリクエストの処理とは別にこのジョブで行う
+type AggregateRefresher struct {
+	repo     domain.UserBalanceRepository
+	interval time.Duration
+	logger   domain.Logger
+}
+
+// NewAggregateRefresher 集計を更新するジョブを作成
+func NewAggregateRefresher(repo domain.UserBalanceRepository, interval time.Duration, logger domain.Logger) *AggregateRefresher {
+	return &AggregateRefresher{repo: repo, interval: interval, logger: logger}
+}
+
+// Run ctxがキャンセルされるまで、開始直後と一定間隔毎に集計を更新
+func (r *AggregateRefresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh 集計を1回更新(タイムアウトは更新の間隔)
+// 集計は1日分ずつコミットされるため、タイムアウトした場合も次回は続きの日から更新する
+func (r *AggregateRefresher) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(domain.ContextWithLogger(ctx, r.logger), r.interval)
+	defer cancel()
+	start := time.Now()
+	refreshedAt, err := r.repo.RefreshDailyTransactionAggregates(ctx)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		r.logger.Warn("failed to refresh daily transaction aggregates", "error", err)
+		return
+	}
+	r.logger.Debug("refreshed daily transaction aggregates", "aggregated_until", refreshedAt, "duration", time.Since(start).String())
+}
@@ -0,0 +1,66 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// refreshCountingRepository 集計の更新の呼び出しを通知するrepository(受信側が待っていない場合は通知しない)
+type refreshCountingRepository struct {
+	domain.UserBalanceRepository
+	refreshed chan struct{}
+	err       error
+}
+
+func (repo *refreshCountingRepository) RefreshDailyTransactionAggregates(ctx context.Context) (time.Time, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return time.Time{}, errors.New("refresh without deadline")
+	}
+	select {
+	case repo.refreshed <- struct{}{}:
+	default:
+	}
+	return time.Now(), repo.err
+}
+
+func TestAggregateRefresher(t *testing.T) {
+	cases := []struct {
+		Name string
+		Err  error
+	}{
+		{"success", nil},
+		{"keep running after failure", errors.New("database is down")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			repo := &refreshCountingRepository{UserBalanceRepository: NewMockRepository(), refreshed: make(chan struct{}), err: c.Err}
+			refresher := NewAggregateRefresher(repo, 10*time.Millisecond, domain.NewNopLogger())
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				refresher.Run(ctx)
+				close(done)
+			}()
+
+			// 開始直後と一定間隔後に更新する
+			for i := 0; i < 2; i++ {
+				select {
+				case <-repo.refreshed:
+				case <-time.After(time.Second):
+					t.Fatalf("expect refresh [%d] but timed out", i+1)
+				}
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("expect refresher to stop after cancel")
+			}
+		})
+	}
+}
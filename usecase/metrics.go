@@ -0,0 +1,217 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+// operationOutcomes usecaseのエラーメッセージとメトリクスのラベルの対応
+// 対応しないエラーは"internal_error"として集計し、ラベルの種類が増え続けないようにする
+var operationOutcomes = map[string]string{
+	"user not found":                       "user_not_found",
+	"transaction not found":                "transaction_not_found",
+	"balance insufficient":                 "balance_insufficient",
+	"transaction_id must be unique":        "duplicate_transaction",
+	"permission denied":                    "permission_denied",
+	"unauthenticated":                      "unauthenticated",
+	"database error":                       "database_error",
+	"reason_code is too long":              "invalid_argument",
+	"note is too long":                     "invalid_argument",
+	"can't transfer to the same user":      "invalid_argument",
+	"user_id is empty":                     "invalid_argument",
+	"user_id is too long":                  "invalid_argument",
+	"merchant_id is too long":              "invalid_argument",
+	"transaction_id is empty":              "invalid_argument",
+	"opening balance must not be negative": "invalid_argument",
+	"invalid freeze scope":                 "invalid_argument",
+	"user_ids is empty":                    "invalid_argument",
+	"too many user_ids":                    "invalid_argument",
+	"invalid sort field":                   "invalid_argument",
+	"invalid user status":                  "invalid_argument",
+	"invalid page_token":                   "invalid_argument",
+	"page_size must not be negative":       "invalid_argument",
+	"invalid balance range":                "invalid_argument",
+	"invalid created_at range":             "invalid_argument",
+	"invalid import mode":                  "invalid_argument",
+	"operations is empty":                  "invalid_argument",
+	"too many operations":                  "invalid_argument",
+	"invalid export dataset":               "invalid_argument",
+	"invalid export period":                "invalid_argument",
+	"invalid transaction type":             "invalid_argument",
+	"invalid statement period":             "invalid_argument",
+	"invalid report granularity":           "invalid_argument",
+	"invalid report period":                "invalid_argument",
+	"user already exists":                  "user_already_exists",
+	"user is frozen":                       "user_frozen",
+	"user is closed":                       "user_closed",
+	"user is not frozen":                   "invalid_user_status",
+	"balance is not zero":                  "invalid_user_status",
+}
+
+// operationOutcome エラーをメトリクスのラベルに変換(成功時は"success")
+func operationOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if outcome, ok := operationOutcomes[err.Error()]; ok {
+		return outcome
+	}
+	return "internal_error"
+}
+
+// instrumentedUserBalanceUsecase usecaseの各操作の結果と処理時間を計測するデコレータ
+type instrumentedUserBalanceUsecase struct {
+	next    domain.UserBalanceUsecase
+	metrics domain.MetricsRecorder
+}
+
+// NewInstrumentedUserBalanceUsecase usecaseを計測用のデコレータで包む
+func NewInstrumentedUserBalanceUsecase(next domain.UserBalanceUsecase, metrics domain.MetricsRecorder) domain.UserBalanceUsecase {
+	return &instrumentedUserBalanceUsecase{
+		next:    next,
+		metrics: metrics,
+	}
+}
+
+// observe 操作の結果と開始からの処理時間を記録
+func (u *instrumentedUserBalanceUsecase) observe(op string, start time.Time, err error) {
+	u.metrics.ObserveOperation(op, operationOutcome(err), time.Since(start))
+}
+
+// AddBalance ユーザーIDでユーザー残高を加算
+func (u *instrumentedUserBalanceUsecase) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.AddBalance(ctx, userID, amount, transactionID, audit)
+	u.observe(string(domain.Operation_AddBalance), start, err)
+	return err
+}
+
+// ReduceBalance ユーザーIDでユーザー残高を減算
+func (u *instrumentedUserBalanceUsecase) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.ReduceBalance(ctx, userID, amount, transactionID, audit)
+	u.observe(string(domain.Operation_ReduceBalance), start, err)
+	return err
+}
+
+// AddAllUserBalance 全ユーザーの残高を加算
+func (u *instrumentedUserBalanceUsecase) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.AddAllUserBalance(ctx, amount, transactionID, audit)
+	u.observe(string(domain.Operation_AddAllUserBalance), start, err)
+	return err
+}
+
+// GetBalance ユーザーIDでユーザー残高を取得
+func (u *instrumentedUserBalanceUsecase) GetBalance(ctx context.Context, userID string) (int, error) {
+	start := time.Now()
+	balance, err := u.next.GetBalance(ctx, userID)
+	u.observe(string(domain.Operation_GetBalance), start, err)
+	return balance, err
+}
+
+// GetTransactionHistory 指定した取引以降のユーザーに関わる取引履歴を取得
+func (u *instrumentedUserBalanceUsecase) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	start := time.Now()
+	histories, err := u.next.GetTransactionHistory(ctx, userID, afterTransactionID)
+	u.observe("GetTransactionHistory", start, err)
+	return histories, err
+}
+
+// TransferBalance ユーザー間で残高を振り替える
+func (u *instrumentedUserBalanceUsecase) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.TransferBalance(ctx, fromUserID, toUserID, amount, transactionID, audit)
+	u.observe("TransferBalance", start, err)
+	return err
+}
+
+// CreateUser ユーザーを作成
+func (u *instrumentedUserBalanceUsecase) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.CreateUser(ctx, userID, merchantID, openingBalance, transactionID, audit)
+	u.observe(string(domain.Operation_CreateUser), start, err)
+	return err
+}
+
+// GetUser ユーザーIDでユーザーの情報を取得
+func (u *instrumentedUserBalanceUsecase) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	start := time.Now()
+	user, err := u.next.GetUser(ctx, userID)
+	u.observe("GetUser", start, err)
+	return user, err
+}
+
+// FreezeUser ユーザーを凍結
+func (u *instrumentedUserBalanceUsecase) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.FreezeUser(ctx, userID, scope, audit)
+	u.observe(string(domain.Operation_FreezeUser), start, err)
+	return err
+}
+
+// UnfreezeUser ユーザーの凍結を解除
+func (u *instrumentedUserBalanceUsecase) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.UnfreezeUser(ctx, userID, audit)
+	u.observe("UnfreezeUser", start, err)
+	return err
+}
+
+// CloseUser ユーザーを解約
+func (u *instrumentedUserBalanceUsecase) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	start := time.Now()
+	err := u.next.CloseUser(ctx, userID, audit)
+	u.observe(string(domain.Operation_CloseUser), start, err)
+	return err
+}
+
+// BatchGetBalances 複数のユーザーIDでユーザー残高を取得
+func (u *instrumentedUserBalanceUsecase) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	start := time.Now()
+	results, err := u.next.BatchGetBalances(ctx, userIDs)
+	u.observe("BatchGetBalances", start, err)
+	return results, err
+}
+
+// ListAccounts 条件で絞り込んだ口座を並び替えて取得
+func (u *instrumentedUserBalanceUsecase) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	start := time.Now()
+	accounts, nextPageToken, err := u.next.ListAccounts(ctx, q)
+	u.observe("ListAccounts", start, err)
+	return accounts, nextPageToken, err
+}
+
+// ImportBalanceOperations 複数の残高操作を行毎に検証して適用
+func (u *instrumentedUserBalanceUsecase) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	start := time.Now()
+	results, err := u.next.ImportBalanceOperations(ctx, ops, mode, audit)
+	u.observe("ImportBalanceOperations", start, err)
+	return results, err
+}
+
+// Export ユーザー残高と取引履歴を1つのスナップショットからエクスポート
+func (u *instrumentedUserBalanceUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	start := time.Now()
+	summary, err := u.next.Export(ctx, q, w)
+	u.observe("Export", start, err)
+	return summary, err
+}
+
+// GetStatement ユーザーの期間内の取引明細を作成
+func (u *instrumentedUserBalanceUsecase) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	start := time.Now()
+	statement, err := u.next.GetStatement(ctx, userID, from, to)
+	u.observe("GetStatement", start, err)
+	return statement, err
+}
+
+// GetReport 残高の合計と期間毎の取引量の集計レポートを作成
+func (u *instrumentedUserBalanceUsecase) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	start := time.Now()
+	report, err := u.next.GetReport(ctx, q)
+	u.observe("GetReport", start, err)
+	return report, err
+}
@@ -0,0 +1,67 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+)
+
+type mockMetricsRecorder struct {
+	operation string
+	outcome   string
+}
+
+func (m *mockMetricsRecorder) ObserveOperation(op string, outcome string, duration time.Duration) {
+	m.operation = op
+	m.outcome = outcome
+}
+
+func (m *mockMetricsRecorder) ObserveHTTPRequest(method string, route string, code int, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveGRPCRequest(method string, code string, duration time.Duration) {
+}
+
+func (m *mockMetricsRecorder) ObserveCacheLookup(cache string, hit bool) {
+}
+
+func TestInstrumentedUsecase(t *testing.T) {
+	metrics := &mockMetricsRecorder{}
+	instrumented := NewInstrumentedUserBalanceUsecase(NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true), metrics)
+	cases := []struct {
+		Name              string
+		Call              func() error
+		ExpectedOperation string
+		ExpectedOutcome   string
+	}{
+		{"get balance", func() error {
+			_, err := instrumented.GetBalance(context.Background(), "test_user1")
+			return err
+		}, "GetBalance", "success"},
+		{"user not found", func() error {
+			_, err := instrumented.GetBalance(context.Background(), "non_existent_user")
+			return err
+		}, "GetBalance", "user_not_found"},
+		{"balance insufficient", func() error {
+			return instrumented.ReduceBalance(context.Background(), "test_user1", 1000000, "2e6bd5c6-57d4-4f0a-9f0e-2d1a3b7b8c10", domain.AuditInfo{})
+		}, "ReduceBalance", "balance_insufficient"},
+		{"duplicate transaction", func() error {
+			return instrumented.AddBalance(context.Background(), "test_user1", 100, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", domain.AuditInfo{})
+		}, "AddBalance", "duplicate_transaction"},
+		{"permission denied", func() error {
+			ctx := domain.ContextWithPrincipal(context.Background(), domain.Principal{ID: "dashboard", Roles: []string{domain.Role_Reader}})
+			return instrumented.AddAllUserBalance(ctx, 100, "5f0c8a2e-3b1d-4e6f-8a9b-0c1d2e3f4a5b", domain.AuditInfo{})
+		}, "AddAllUserBalance", "permission_denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Call()
+			if metrics.operation != c.ExpectedOperation || metrics.outcome != c.ExpectedOutcome {
+				t.Errorf("expect [%s/%s] but got [%s/%s]", c.ExpectedOperation, c.ExpectedOutcome, metrics.operation, metrics.outcome)
+			}
+		})
+	}
+}
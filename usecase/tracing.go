@@ -0,0 +1,186 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedUserBalanceUsecase usecaseの各操作をスパンで計測するデコレータ
+type tracedUserBalanceUsecase struct {
+	next   domain.UserBalanceUsecase
+	tracer trace.Tracer
+}
+
+// NewTracedUserBalanceUsecase usecaseをトレース用のデコレータで包む
+func NewTracedUserBalanceUsecase(next domain.UserBalanceUsecase) domain.UserBalanceUsecase {
+	return &tracedUserBalanceUsecase{
+		next:   next,
+		tracer: otel.Tracer("github.com/kaitolucifer/user-balance-management/usecase"),
+	}
+}
+
+// startSpan 操作のスパンを開始
+func (u *tracedUserBalanceUsecase) startSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return u.tracer.Start(ctx, "UserBalanceUsecase."+op, trace.WithAttributes(attrs...))
+}
+
+// endSpan エラーを記録してスパンを終了
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AddBalance ユーザーIDでユーザー残高を加算
+func (u *tracedUserBalanceUsecase) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_AddBalance),
+		attribute.String("user_id", userID), attribute.Int("amount", amount), attribute.String("transaction_id", transactionID))
+	err := u.next.AddBalance(ctx, userID, amount, transactionID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// ReduceBalance ユーザーIDでユーザー残高を減算
+func (u *tracedUserBalanceUsecase) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_ReduceBalance),
+		attribute.String("user_id", userID), attribute.Int("amount", amount), attribute.String("transaction_id", transactionID))
+	err := u.next.ReduceBalance(ctx, userID, amount, transactionID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// AddAllUserBalance 全ユーザーの残高を加算
+func (u *tracedUserBalanceUsecase) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_AddAllUserBalance),
+		attribute.Int("amount", amount), attribute.String("transaction_id", transactionID))
+	err := u.next.AddAllUserBalance(ctx, amount, transactionID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// GetBalance ユーザーIDでユーザー残高を取得
+func (u *tracedUserBalanceUsecase) GetBalance(ctx context.Context, userID string) (int, error) {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_GetBalance), attribute.String("user_id", userID))
+	balance, err := u.next.GetBalance(ctx, userID)
+	endSpan(span, err)
+	return balance, err
+}
+
+// GetTransactionHistory 指定した取引以降のユーザーに関わる取引履歴を取得
+func (u *tracedUserBalanceUsecase) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	ctx, span := u.startSpan(ctx, "GetTransactionHistory", attribute.String("user_id", userID))
+	histories, err := u.next.GetTransactionHistory(ctx, userID, afterTransactionID)
+	endSpan(span, err)
+	return histories, err
+}
+
+// TransferBalance ユーザー間で残高を振り替える
+func (u *tracedUserBalanceUsecase) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, "TransferBalance",
+		attribute.String("from_user_id", fromUserID), attribute.String("to_user_id", toUserID),
+		attribute.Int("amount", amount), attribute.String("transaction_id", transactionID))
+	err := u.next.TransferBalance(ctx, fromUserID, toUserID, amount, transactionID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// CreateUser ユーザーを作成
+func (u *tracedUserBalanceUsecase) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_CreateUser),
+		attribute.String("user_id", userID), attribute.Int("opening_balance", openingBalance), attribute.String("transaction_id", transactionID))
+	err := u.next.CreateUser(ctx, userID, merchantID, openingBalance, transactionID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// GetUser ユーザーIDでユーザーの情報を取得
+func (u *tracedUserBalanceUsecase) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	ctx, span := u.startSpan(ctx, "GetUser", attribute.String("user_id", userID))
+	user, err := u.next.GetUser(ctx, userID)
+	endSpan(span, err)
+	return user, err
+}
+
+// FreezeUser ユーザーを凍結
+func (u *tracedUserBalanceUsecase) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_FreezeUser),
+		attribute.String("user_id", userID), attribute.String("scope", string(scope)))
+	err := u.next.FreezeUser(ctx, userID, scope, audit)
+	endSpan(span, err)
+	return err
+}
+
+// UnfreezeUser ユーザーの凍結を解除
+func (u *tracedUserBalanceUsecase) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, "UnfreezeUser", attribute.String("user_id", userID))
+	err := u.next.UnfreezeUser(ctx, userID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// CloseUser ユーザーを解約
+func (u *tracedUserBalanceUsecase) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	ctx, span := u.startSpan(ctx, string(domain.Operation_CloseUser), attribute.String("user_id", userID))
+	err := u.next.CloseUser(ctx, userID, audit)
+	endSpan(span, err)
+	return err
+}
+
+// BatchGetBalances 複数のユーザーIDでユーザー残高を取得
+func (u *tracedUserBalanceUsecase) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	ctx, span := u.startSpan(ctx, "BatchGetBalances", attribute.Int("user_count", len(userIDs)))
+	results, err := u.next.BatchGetBalances(ctx, userIDs)
+	endSpan(span, err)
+	return results, err
+}
+
+// ListAccounts 条件で絞り込んだ口座を並び替えて取得
+func (u *tracedUserBalanceUsecase) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	ctx, span := u.startSpan(ctx, "ListAccounts", attribute.String("sort_by", string(q.SortBy)), attribute.Int("page_size", q.PageSize))
+	accounts, nextPageToken, err := u.next.ListAccounts(ctx, q)
+	endSpan(span, err)
+	return accounts, nextPageToken, err
+}
+
+// ImportBalanceOperations 複数の残高操作を行毎に検証して適用
+func (u *tracedUserBalanceUsecase) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	ctx, span := u.startSpan(ctx, "ImportBalanceOperations", attribute.String("mode", string(mode)), attribute.Int("operation_count", len(ops)))
+	results, err := u.next.ImportBalanceOperations(ctx, ops, mode, audit)
+	endSpan(span, err)
+	return results, err
+}
+
+// Export ユーザー残高と取引履歴を1つのスナップショットからエクスポート
+func (u *tracedUserBalanceUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	ctx, span := u.startSpan(ctx, "Export")
+	summary, err := u.next.Export(ctx, q, w)
+	span.SetAttributes(attribute.Int("balance_count", summary.Balances), attribute.Int("transaction_count", summary.Transactions))
+	endSpan(span, err)
+	return summary, err
+}
+
+// GetStatement ユーザーの期間内の取引明細を作成
+func (u *tracedUserBalanceUsecase) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	ctx, span := u.startSpan(ctx, "GetStatement", attribute.String("user_id", userID))
+	statement, err := u.next.GetStatement(ctx, userID, from, to)
+	span.SetAttributes(attribute.Int("transaction_count", len(statement.Transactions)))
+	endSpan(span, err)
+	return statement, err
+}
+
+// GetReport 残高の合計と期間毎の取引量の集計レポートを作成
+func (u *tracedUserBalanceUsecase) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	ctx, span := u.startSpan(ctx, "GetReport", attribute.String("granularity", string(q.Granularity)))
+	report, err := u.next.GetReport(ctx, q)
+	span.SetAttributes(attribute.Int("period_count", len(report.Periods)))
+	endSpan(span, err)
+	return report, err
+}
@@ -0,0 +1,44 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaitolucifer/user-balance-management/domain"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracedUsecase(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	traced := NewTracedUserBalanceUsecase(NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true))
+	traced.(*tracedUserBalanceUsecase).tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	cases := []struct {
+		Name           string
+		Call           func() error
+		ExpectedSpan   string
+		ExpectedStatus codes.Code
+	}{
+		{"get balance", func() error {
+			_, err := traced.GetBalance(context.Background(), "test_user1")
+			return err
+		}, "UserBalanceUsecase.GetBalance", codes.Unset},
+		{"balance insufficient", func() error {
+			return traced.ReduceBalance(context.Background(), "test_user1", 1000000, "2e6bd5c6-57d4-4f0a-9f0e-2d1a3b7b8c10", domain.AuditInfo{})
+		}, "UserBalanceUsecase.ReduceBalance", codes.Error},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Call()
+			spans := recorder.Ended()
+			span := spans[len(spans)-1]
+			if span.Name() != c.ExpectedSpan || span.Status().Code != c.ExpectedStatus {
+				t.Errorf("expect span [%s/%s] but got [%s/%s]", c.ExpectedSpan, c.ExpectedStatus, span.Name(), span.Status().Code)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -9,46 +10,161 @@ import (
 	"github.com/kaitolucifer/user-balance-management/domain"
 )
 
-// userBalanceUsecase repositoryを格納
+// userBalanceUsecase repositoryとコミット後フックを格納
 type userBalanceUsecase struct {
-	repo domain.UserBalanceRepository
+	repo         domain.UserBalanceRepository
+	timeout      time.Duration
+	authDisabled bool
+	hooks        []domain.AfterCommitHook
 }
 
 // NewUserBalanceUsecase 新しいusecaseを作成
-func NewUserBalanceUsecase(repo domain.UserBalanceRepository) domain.UserBalanceUsecase {
+// timeoutはDBアクセスを含む各操作のタイムアウト
+// authDisabledは設定で認証を無効にした場合のみtrueとし、主体のない呼び出しを全て許可する
+func NewUserBalanceUsecase(repo domain.UserBalanceRepository, timeout time.Duration, authDisabled bool, hooks ...domain.AfterCommitHook) domain.UserBalanceUsecase {
 	return &userBalanceUsecase{
-		repo: repo,
+		repo:         repo,
+		timeout:      timeout,
+		authDisabled: authDisabled,
+		hooks:        hooks,
 	}
 }
 
+// databaseError DBのエラーを原因と共にログに出力し、呼び出し側に返すエラーに変換
+func databaseError(ctx context.Context, err error) error {
+	domain.LoggerFromContext(ctx).Error("database error", "error", err)
+	return errors.New("database error")
+}
+
+// notifyAfterCommit コミット成功をログに出力し、登録されたフックへ残高変更イベントを通知
+func (u *userBalanceUsecase) notifyAfterCommit(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int, audit domain.AuditInfo) {
+	event := domain.BalanceChangeEvent{
+		TransactionID:   transactionID,
+		UserID:          userID,
+		TransactionType: transactionType,
+		Amount:          amount,
+		AuditInfo:       audit,
+		CreatedAt:       time.Now(),
+	}
+	domain.LoggerFromContext(ctx).Info("balance changed",
+		"transaction_id", transactionID, "user_id", userID, "transaction_type", int(transactionType), "amount", amount, "actor", audit.Actor)
+	for _, hook := range u.hooks {
+		hook(event)
+	}
+}
+
+// anonymousPrincipal 認証を無効にした場合に主体のない呼び出しを扱う主体(全ての操作の権限を持つ)
+var anonymousPrincipal = domain.Principal{ID: "anonymous", Roles: []string{domain.Role_Admin}}
+
+// principalFromContext コンテキストに格納された主体を取得
+// 主体が格納されていない場合、認証を無効にしていれば全ての操作の権限を持つ主体とし、そうでなければ拒否する
+func (u *userBalanceUsecase) principalFromContext(ctx context.Context) (domain.Principal, error) {
+	if principal, ok := domain.PrincipalFromContext(ctx); ok {
+		return principal, nil
+	}
+	if u.authDisabled {
+		return anonymousPrincipal, nil
+	}
+	return domain.Principal{}, errors.New("unauthenticated")
+}
+
+// authorize コンテキストに格納された主体が対象ユーザーへの操作の権限を持つかを検証
+// userIDが空文字の場合は全てのユーザーを対象とする操作として検証する
+func (u *userBalanceUsecase) authorize(ctx context.Context, op domain.Operation, userID string) error {
+	principal, err := u.principalFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if domain.Authorize(principal, op, "") {
+		return nil
+	}
+
+	// 加盟店スコープのロールの場合、対象ユーザーが所属する加盟店で再度判定
+	if userID == "" || !principal.HasMerchantRole() {
+		return errors.New("permission denied")
+	}
+	userBalance, err := u.repo.QueryUserBalanceByUserID(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// 他加盟店のユーザーの存在を推測されないよう権限エラーとする
+			return errors.New("permission denied")
+		}
+		return databaseError(ctx, err)
+	}
+	if !domain.Authorize(principal, op, userBalance.MerchantID) {
+		return errors.New("permission denied")
+	}
+
+	return nil
+}
+
+// queryUser ユーザーIDでユーザーを取得し、repositoryのエラーを呼び出し側に返すエラーに変換
+func (u *userBalanceUsecase) queryUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	userBalance, err := u.repo.QueryUserBalanceByUserID(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return userBalance, errors.New("user not found")
+		}
+		return userBalance, databaseError(ctx, err)
+	}
+	return userBalance, nil
+}
+
+// statusError ユーザーの状態により操作できない場合のエラー
+func statusError(status domain.UserStatus) error {
+	if status == domain.UserStatus_Closed {
+		return errors.New("user is closed")
+	}
+	return errors.New("user is frozen")
+}
+
 // AddBalance ユーザーIDでユーザー残高を加算
-func (u *userBalanceUsecase) AddBalance(userID string, amount int, transactionID string) error {
-	ctx, cancel := u.repo.GetCtxWithTimeout(3 * time.Second)
+func (u *userBalanceUsecase) AddBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
 	defer cancel()
-	if err := u.repo.BeginTx(ctx); err != nil {
-		return errors.New("database error")
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, domain.Operation_AddBalance, userID); err != nil {
+		return err
 	}
 
-	err := u.repo.AddUserBalanceByUserID(ctx, userID, amount)
+	userBalance, err := u.queryUser(ctx, userID)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		return err
+	}
+	if !userBalance.Status.CanCredit() {
+		return statusError(userBalance.Status)
+	}
+
+	ctx, err = u.repo.BeginTx(ctx)
+	if err != nil {
+		return databaseError(ctx, err)
+	}
+
+	err = u.repo.AddUserBalanceByUserID(ctx, userID, amount)
+	if err != nil {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
 		if err == sql.ErrNoRows {
 			return errors.New("user not found")
 		} else if errors.As(err, &pgErr) {
-			return errors.New("database error")
+			return databaseError(ctx, err)
 		}
 
 		return err
 	}
 
-	err = u.repo.InsertTransactionHistory(ctx, transactionID, userID, domain.TransactionType_AddUserBalance, amount)
+	err = u.repo.InsertTransactionHistory(ctx, transactionID, userID, domain.TransactionType_AddUserBalance, amount, audit)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
@@ -57,24 +173,34 @@ func (u *userBalanceUsecase) AddBalance(userID string, amount int, transactionID
 			case "23505":
 				return errors.New("transaction_id must be unique")
 			default:
-				return errors.New("database error")
+				return databaseError(ctx, err)
 			}
 		}
 
 		return err
 	}
 
-	if err := u.repo.Commit(); err != nil {
-		return errors.New("database error")
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
 	}
+	u.notifyAfterCommit(ctx, transactionID, userID, domain.TransactionType_AddUserBalance, amount, audit)
 
 	return nil
 }
 
 // ReduceBalance ユーザーIDでユーザー残高を減算
-func (u *userBalanceUsecase) ReduceBalance(userID string, amount int, transactionID string) error {
-	ctx, cancel := u.repo.GetCtxWithTimeout(3 * time.Second)
+func (u *userBalanceUsecase) ReduceBalance(ctx context.Context, userID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
 	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, domain.Operation_ReduceBalance, userID); err != nil {
+		return err
+	}
 
 	userBalance, err := u.repo.QueryUserBalanceByUserID(ctx, userID)
 	if err != nil {
@@ -84,32 +210,36 @@ func (u *userBalanceUsecase) ReduceBalance(userID string, amount int, transactio
 		return err
 	}
 
+	if !userBalance.Status.CanDebit() {
+		return statusError(userBalance.Status)
+	}
 	if userBalance.Balance-amount < 0 {
 		return errors.New("balance insufficient")
 	}
 
-	if err := u.repo.BeginTx(ctx); err != nil {
-		return errors.New("database error")
+	ctx, err = u.repo.BeginTx(ctx)
+	if err != nil {
+		return databaseError(ctx, err)
 	}
 	
 	err = u.repo.ReduceUserBalanceByUserID(ctx, userID, amount)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
-			return errors.New("database error")
+			return databaseError(ctx, err)
 		}
 
 		return err
 	}
 
-	err = u.repo.InsertTransactionHistory(ctx, transactionID, userID, domain.TransactionType_ReduceUserBalance, amount)
+	err = u.repo.InsertTransactionHistory(ctx, transactionID, userID, domain.TransactionType_ReduceUserBalance, amount, audit)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
@@ -118,46 +248,58 @@ func (u *userBalanceUsecase) ReduceBalance(userID string, amount int, transactio
 			case "23505":
 				return errors.New("transaction_id must be unique")
 			default:
-				return errors.New("database error")
+				return databaseError(ctx, err)
 			}
 		}
 
 		return err
 	}
 
-	if err := u.repo.Commit(); err != nil {
-		return errors.New("database error")
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
 	}
+	u.notifyAfterCommit(ctx, transactionID, userID, domain.TransactionType_ReduceUserBalance, amount, audit)
 
 	return nil
 }
 
 // ユーザー残高を一斉に加算
-func (u *userBalanceUsecase) AddAllUserBalance(amount int, transactionID string) error {
-	ctx, cancel := u.repo.GetCtxWithTimeout(3 * time.Second)
+func (u *userBalanceUsecase) AddAllUserBalance(ctx context.Context, amount int, transactionID string, audit domain.AuditInfo) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
 	defer cancel()
-	if err := u.repo.BeginTx(ctx); err != nil {
-		return errors.New("database error")
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, domain.Operation_AddAllUserBalance, ""); err != nil {
+		return err
 	}
 
-	err := u.repo.AddAllUserBalance(ctx, amount)
+	ctx, err := u.repo.BeginTx(ctx)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		return databaseError(ctx, err)
+	}
+
+	err = u.repo.AddAllUserBalance(ctx, amount)
+	if err != nil {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
-			return errors.New("database error")
+			return databaseError(ctx, err)
 		}
 
 		return err
 	}
 
-	err = u.repo.InsertTransactionHistory(ctx, transactionID, "", domain.TransactionType_AddAllUserBalance, amount)
+	err = u.repo.InsertTransactionHistory(ctx, transactionID, "", domain.TransactionType_AddAllUserBalance, amount, audit)
 	if err != nil {
-		if err := u.repo.Rollback(); err != nil {
-			return errors.New("database error")
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
 		}
 
 		var pgErr *pgconn.PgError
@@ -166,23 +308,29 @@ func (u *userBalanceUsecase) AddAllUserBalance(amount int, transactionID string)
 			case "23505":
 				return errors.New("transaction_id must be unique")
 			default:
-				return errors.New("database error")
+				return databaseError(ctx, err)
 			}
 		}
 
 		return err
 	}
 
-	if err := u.repo.Commit(); err != nil {
-		return errors.New("database error")
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
 	}
+	u.notifyAfterCommit(ctx, transactionID, "", domain.TransactionType_AddAllUserBalance, amount, audit)
 
 	return nil
 }
 
-func (u *userBalanceUsecase) GetBalance(userID string) (int, error) {
-	ctx, cancel := u.repo.GetCtxWithTimeout(3 * time.Second)
+// GetBalance ユーザーIDでユーザー残高を取得
+func (u *userBalanceUsecase) GetBalance(ctx context.Context, userID string) (int, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
 	defer cancel()
+
+	if err := u.authorize(ctx, domain.Operation_GetBalance, userID); err != nil {
+		return 0, err
+	}
 	
 	userBalance, err := u.repo.QueryUserBalanceByUserID(ctx, userID)
 	if err != nil {
@@ -192,11 +340,930 @@ func (u *userBalanceUsecase) GetBalance(userID string) (int, error) {
 		
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
-			return 0, errors.New("database error")
+			return 0, databaseError(ctx, err)
 		}
 
 		return 0, err
 	}
+	if userBalance.Status == domain.UserStatus_Closed {
+		return 0, statusError(userBalance.Status)
+	}
 
 	return userBalance.Balance, nil
 }
+
+// GetTransactionHistory 指定した取引以降のユーザーに関わる取引履歴を取得
+// 指定した取引が存在しない場合は、以降の履歴がないのか判別できないためエラーにする
+func (u *userBalanceUsecase) GetTransactionHistory(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if err := u.authorize(ctx, domain.Operation_GetBalance, userID); err != nil {
+		return nil, err
+	}
+
+	if afterTransactionID != "" {
+		existing, err := u.repo.QueryExistingTransactionIDs(ctx, []string{afterTransactionID})
+		if err != nil {
+			return nil, databaseError(ctx, err)
+		}
+		if len(existing) == 0 {
+			return nil, errors.New("transaction not found")
+		}
+	}
+
+	histories, err := u.repo.QueryTransactionHistoryByUserID(ctx, userID, afterTransactionID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			return nil, databaseError(ctx, err)
+		}
+
+		return nil, err
+	}
+
+	return histories, nil
+}
+
+// withTransferMetadata 振替の取引履歴に記録する監査情報を作成(メタデータは複製して振替の情報を追加する)
+func withTransferMetadata(audit domain.AuditInfo, transactionID string, key string, counterpartyID string) domain.AuditInfo {
+	metadata := make(map[string]string, len(audit.Metadata)+2)
+	for k, v := range audit.Metadata {
+		metadata[k] = v
+	}
+	metadata[domain.MetadataKey_TransferID] = transactionID
+	metadata[key] = counterpartyID
+	audit.Metadata = metadata
+	return audit
+}
+
+// TransferBalance ユーザー間で残高を振り替える
+// 出金と入金、2件の取引履歴の挿入を1つのトランザクションで行う
+func (u *userBalanceUsecase) TransferBalance(ctx context.Context, fromUserID string, toUserID string, amount int, transactionID string, audit domain.AuditInfo) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+	if fromUserID == toUserID {
+		return errors.New("can't transfer to the same user")
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, domain.Operation_ReduceBalance, fromUserID); err != nil {
+		return err
+	}
+	if err := u.authorize(ctx, domain.Operation_AddBalance, toUserID); err != nil {
+		return err
+	}
+
+	userBalance, err := u.queryUser(ctx, fromUserID)
+	if err != nil {
+		return err
+	}
+	if !userBalance.Status.CanDebit() {
+		return statusError(userBalance.Status)
+	}
+	if userBalance.Balance-amount < 0 {
+		return errors.New("balance insufficient")
+	}
+	toUserBalance, err := u.queryUser(ctx, toUserID)
+	if err != nil {
+		return err
+	}
+	if !toUserBalance.Status.CanCredit() {
+		return statusError(toUserBalance.Status)
+	}
+
+	ctx, err = u.repo.BeginTx(ctx)
+	if err != nil {
+		return databaseError(ctx, err)
+	}
+
+	// rollback トランザクションをロールバックし、repositoryのエラーを呼び出し側に返すエラーに変換
+	rollback := func(err error) error {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
+		}
+
+		var pgErr *pgconn.PgError
+		if err == sql.ErrNoRows {
+			return errors.New("user not found")
+		} else if errors.As(err, &pgErr) {
+			if pgErr.Code == "23505" {
+				return errors.New("transaction_id must be unique")
+			}
+			return databaseError(ctx, err)
+		}
+
+		return err
+	}
+
+	// 逆方向の振替と同時に実行された場合のデッドロックを防ぐため、ユーザーIDの順に行をロックする
+	debit := func() error { return u.repo.ReduceUserBalanceByUserID(ctx, fromUserID, amount) }
+	credit := func() error { return u.repo.AddUserBalanceByUserID(ctx, toUserID, amount) }
+	updates := []func() error{debit, credit}
+	if toUserID < fromUserID {
+		updates = []func() error{credit, debit}
+	}
+	for _, update := range updates {
+		if err := update(); err != nil {
+			return rollback(err)
+		}
+	}
+
+	creditTransactionID := domain.TransferCreditTransactionID(transactionID)
+	debitAudit := withTransferMetadata(audit, transactionID, domain.MetadataKey_TransferTo, toUserID)
+	creditAudit := withTransferMetadata(audit, transactionID, domain.MetadataKey_TransferFrom, fromUserID)
+	if err := u.repo.InsertTransactionHistory(ctx, transactionID, fromUserID, domain.TransactionType_ReduceUserBalance, amount, debitAudit); err != nil {
+		return rollback(err)
+	}
+	if err := u.repo.InsertTransactionHistory(ctx, creditTransactionID, toUserID, domain.TransactionType_AddUserBalance, amount, creditAudit); err != nil {
+		return rollback(err)
+	}
+
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
+	}
+	u.notifyAfterCommit(ctx, transactionID, fromUserID, domain.TransactionType_ReduceUserBalance, amount, debitAudit)
+	u.notifyAfterCommit(ctx, creditTransactionID, toUserID, domain.TransactionType_AddUserBalance, amount, creditAudit)
+
+	return nil
+}
+
+// CreateUser 加盟店IDと初期残高を指定してユーザーを作成
+// 初期残高が0より大きい場合は加算の取引履歴として記録し、ユーザーの挿入と同じトランザクションで行う
+func (u *userBalanceUsecase) CreateUser(ctx context.Context, userID string, merchantID string, openingBalance int, transactionID string, audit domain.AuditInfo) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+	if userID == "" {
+		return errors.New("user_id is empty")
+	} else if len(userID) > domain.MaxUserIDLength {
+		return errors.New("user_id is too long")
+	} else if len(merchantID) > domain.MaxUserIDLength {
+		return errors.New("merchant_id is too long")
+	} else if openingBalance < 0 {
+		return errors.New("opening balance must not be negative")
+	} else if openingBalance > 0 && transactionID == "" {
+		return errors.New("transaction_id is empty")
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, domain.Operation_CreateUser, ""); err != nil {
+		return err
+	}
+
+	ctx, err := u.repo.BeginTx(ctx)
+	if err != nil {
+		return databaseError(ctx, err)
+	}
+
+	// rollback トランザクションをロールバックし、repositoryのエラーを呼び出し側に返すエラーに変換
+	// uniqueErrはエラーが一意性違反の場合に返すエラー
+	rollback := func(err error, uniqueErr string) error {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
+		}
+
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == "23505" {
+				return errors.New(uniqueErr)
+			}
+			return databaseError(ctx, err)
+		}
+
+		return err
+	}
+
+	now := time.Now()
+	user := domain.UserBalanceModel{
+		UserID:     userID,
+		Balance:    openingBalance,
+		MerchantID: merchantID,
+		Status:     domain.UserStatus_Active,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := u.repo.InsertUser(ctx, user); err != nil {
+		return rollback(err, "user already exists")
+	}
+	if err := u.repo.InsertUserStatusHistory(ctx, userID, domain.UserStatus_Active, audit); err != nil {
+		return rollback(err, "user already exists")
+	}
+	if openingBalance > 0 {
+		err := u.repo.InsertTransactionHistory(ctx, transactionID, userID, domain.TransactionType_AddUserBalance, openingBalance, audit)
+		if err != nil {
+			return rollback(err, "transaction_id must be unique")
+		}
+	}
+
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
+	}
+	domain.LoggerFromContext(ctx).Info("user created", "user_id", userID, "merchant_id", merchantID, "actor", audit.Actor)
+	if openingBalance > 0 {
+		u.notifyAfterCommit(ctx, transactionID, userID, domain.TransactionType_AddUserBalance, openingBalance, audit)
+	}
+
+	return nil
+}
+
+// GetUser ユーザーIDで状態を含むユーザーの情報を取得(解約済みのユーザーも取得できる)
+func (u *userBalanceUsecase) GetUser(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if err := u.authorize(ctx, domain.Operation_GetBalance, userID); err != nil {
+		return domain.UserBalanceModel{}, err
+	}
+
+	return u.queryUser(ctx, userID)
+}
+
+// FreezeUser ユーザーを凍結(scopeがdebitの場合は減算のみ、allの場合は全ての残高変更を凍結)
+func (u *userBalanceUsecase) FreezeUser(ctx context.Context, userID string, scope domain.FreezeScope, audit domain.AuditInfo) error {
+	status, ok := scope.Status()
+	if !ok {
+		return errors.New("invalid freeze scope")
+	}
+
+	return u.changeStatus(ctx, domain.Operation_FreezeUser, userID, status, audit, nil)
+}
+
+// UnfreezeUser ユーザーの凍結を解除
+func (u *userBalanceUsecase) UnfreezeUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	return u.changeStatus(ctx, domain.Operation_FreezeUser, userID, domain.UserStatus_Active, audit, func(user domain.UserBalanceModel) error {
+		if user.Status == domain.UserStatus_Active {
+			return errors.New("user is not frozen")
+		}
+		return nil
+	})
+}
+
+// CloseUser ユーザーを解約(残高が0の場合のみ)
+func (u *userBalanceUsecase) CloseUser(ctx context.Context, userID string, audit domain.AuditInfo) error {
+	return u.changeStatus(ctx, domain.Operation_CloseUser, userID, domain.UserStatus_Closed, audit, func(user domain.UserBalanceModel) error {
+		if user.Balance != 0 {
+			return errors.New("balance is not zero")
+		}
+		return nil
+	})
+}
+
+// changeStatus ユーザーの状態を更新し、状態変更履歴を同じトランザクションで挿入
+// checkは現在のユーザーが更新できる状態かを検証し(nilの場合は検証しない)、既に同じ状態の場合は何もしない
+func (u *userBalanceUsecase) changeStatus(ctx context.Context, op domain.Operation, userID string, status domain.UserStatus, audit domain.AuditInfo, check func(domain.UserBalanceModel) error) error {
+	if err := audit.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	if err := u.authorize(ctx, op, userID); err != nil {
+		return err
+	}
+
+	user, err := u.queryUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Status == domain.UserStatus_Closed {
+		return statusError(user.Status)
+	}
+	if check != nil {
+		if err := check(user); err != nil {
+			return err
+		}
+	}
+	if user.Status == status {
+		return nil
+	}
+
+	ctx, err = u.repo.BeginTx(ctx)
+	if err != nil {
+		return databaseError(ctx, err)
+	}
+
+	err = u.repo.UpdateUserStatusByUserID(ctx, userID, status)
+	if err == nil {
+		err = u.repo.InsertUserStatusHistory(ctx, userID, status, audit)
+	}
+	if err != nil {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return databaseError(ctx, err)
+		}
+
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			return databaseError(ctx, err)
+		}
+
+		return err
+	}
+
+	if err := u.repo.Commit(ctx); err != nil {
+		return databaseError(ctx, err)
+	}
+	domain.LoggerFromContext(ctx).Info("user status changed",
+		"user_id", userID, "from", string(user.Status), "to", string(status), "actor", audit.Actor)
+
+	return nil
+}
+
+// authorizeReadUsers 複数のユーザーを参照する操作の権限を検証し、ユーザー毎に参照できるかを判定する関数を返す
+// 加盟店スコープのロールのみを持つ場合は自加盟店に所属するユーザーのみ参照できる
+func (u *userBalanceUsecase) authorizeReadUsers(ctx context.Context) (func(domain.UserBalanceModel) bool, error) {
+	principal, err := u.principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if domain.Authorize(principal, domain.Operation_GetBalance, "") {
+		return func(domain.UserBalanceModel) bool { return true }, nil
+	}
+	if !principal.HasMerchantRole() {
+		return nil, errors.New("permission denied")
+	}
+	return func(user domain.UserBalanceModel) bool {
+		return domain.Authorize(principal, domain.Operation_GetBalance, user.MerchantID)
+	}, nil
+}
+
+// BatchGetBalances 複数のユーザーIDでユーザー残高を1回のクエリで取得し、指定した順(重複を除く)に返す
+// 存在しない、解約済みまたは参照する権限がないユーザーは見つからないものとして個別に返す
+func (u *userBalanceUsecase) BatchGetBalances(ctx context.Context, userIDs []string) ([]domain.BalanceResult, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if len(userIDs) == 0 {
+		return nil, errors.New("user_ids is empty")
+	}
+	if len(userIDs) > domain.MaxBatchGetBalancesSize {
+		return nil, errors.New("too many user_ids")
+	}
+	uniqueUserIDs := make([]string, 0, len(userIDs))
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == "" {
+			return nil, errors.New("user_id is empty")
+		}
+		if !seen[userID] {
+			seen[userID] = true
+			uniqueUserIDs = append(uniqueUserIDs, userID)
+		}
+	}
+	canRead, err := u.authorizeReadUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userBalances, err := u.repo.QueryUserBalancesByUserIDs(ctx, uniqueUserIDs)
+	if err != nil {
+		return nil, databaseError(ctx, err)
+	}
+	found := make(map[string]domain.UserBalanceModel, len(userBalances))
+	for _, userBalance := range userBalances {
+		if userBalance.Status != domain.UserStatus_Closed && canRead(userBalance) {
+			found[userBalance.UserID] = userBalance
+		}
+	}
+
+	results := make([]domain.BalanceResult, 0, len(uniqueUserIDs))
+	for _, userID := range uniqueUserIDs {
+		userBalance, ok := found[userID]
+		results = append(results, domain.BalanceResult{UserID: userID, Balance: userBalance.Balance, Found: ok})
+	}
+	return results, nil
+}
+
+// ListAccounts 条件で絞り込んだ口座(ユーザー)を並び替えてページ毎に取得
+// 次のページがある場合は次のページの取得に指定するユーザーIDを返す
+// 加盟店スコープのロールのみを持つ場合は自加盟店での絞り込みが必要
+func (u *userBalanceUsecase) ListAccounts(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, string, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if q.SortBy == "" {
+		q.SortBy = domain.AccountSortField_UserID
+	}
+	if !q.SortBy.Valid() {
+		return nil, "", errors.New("invalid sort field")
+	}
+	for _, status := range q.Statuses {
+		if !status.Valid() {
+			return nil, "", errors.New("invalid user status")
+		}
+	}
+	if q.MinBalance != nil && q.MaxBalance != nil && *q.MinBalance > *q.MaxBalance {
+		return nil, "", errors.New("invalid balance range")
+	}
+	if !q.CreatedAfter.IsZero() && !q.CreatedBefore.IsZero() && !q.CreatedAfter.Before(q.CreatedBefore) {
+		return nil, "", errors.New("invalid created_at range")
+	}
+	if q.PageSize < 0 {
+		return nil, "", errors.New("page_size must not be negative")
+	} else if q.PageSize == 0 {
+		q.PageSize = domain.DefaultListAccountsPageSize
+	} else if q.PageSize > domain.MaxListAccountsPageSize {
+		q.PageSize = domain.MaxListAccountsPageSize
+	}
+
+	principal, err := u.principalFromContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if !domain.Authorize(principal, domain.Operation_GetBalance, "") {
+		if q.MerchantID == "" || !domain.Authorize(principal, domain.Operation_GetBalance, q.MerchantID) {
+			return nil, "", errors.New("permission denied")
+		}
+	}
+	if q.AfterUserID != "" {
+		if _, err := u.repo.QueryUserBalanceByUserID(ctx, q.AfterUserID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, "", errors.New("invalid page_token")
+			}
+			return nil, "", databaseError(ctx, err)
+		}
+	}
+
+	// 次のページの有無を判定するため1件多く取得する
+	pageSize := q.PageSize
+	q.PageSize++
+	userBalances, err := u.repo.QueryUserBalances(ctx, q)
+	if err != nil {
+		return nil, "", databaseError(ctx, err)
+	}
+	if len(userBalances) <= pageSize {
+		return userBalances, "", nil
+	}
+	userBalances = userBalances[:pageSize]
+	return userBalances, userBalances[pageSize-1].UserID, nil
+}
+
+// maxTransactionIDLength 取引IDの最大長(transaction_historyテーブルの列の長さ)
+const maxTransactionIDLength = 36
+
+// operationAudit インポートの行に記録する監査情報を作成(行に指定した取引理由とメモを優先する)
+func operationAudit(audit domain.AuditInfo, op domain.BalanceOperation) domain.AuditInfo {
+	if op.ReasonCode != "" {
+		audit.ReasonCode = op.ReasonCode
+	}
+	if op.Note != "" {
+		audit.Note = op.Note
+	}
+	return audit
+}
+
+// validateOperation インポートの行を検証(同じインポート内での取引IDの重複も検証する)
+func validateOperation(op domain.BalanceOperation, audit domain.AuditInfo, seen map[string]bool) error {
+	if op.UserID == "" {
+		return errors.New("user_id is empty")
+	}
+	if op.TransactionType != domain.TransactionType_AddUserBalance && op.TransactionType != domain.TransactionType_ReduceUserBalance {
+		return errors.New("invalid transaction type")
+	}
+	if op.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if op.TransactionID == "" {
+		return errors.New("transaction_id is empty")
+	}
+	if len(op.TransactionID) > maxTransactionIDLength {
+		return errors.New("transaction_id is too long")
+	}
+	if seen[op.TransactionID] {
+		return errors.New("duplicate transaction_id in import")
+	}
+	seen[op.TransactionID] = true
+	return operationAudit(audit, op).Validate()
+}
+
+// operationName 残高操作の取引種類に対応する権限の操作
+func operationName(transactionType domain.TransactionType) domain.Operation {
+	if transactionType == domain.TransactionType_ReduceUserBalance {
+		return domain.Operation_ReduceBalance
+	}
+	return domain.Operation_AddBalance
+}
+
+// ImportBalanceOperations 複数の残高操作(加算または減算)を行毎に検証して適用し、行毎の結果を指定した順に返す
+// 取引履歴に存在する取引IDの行は適用済みとしてスキップするため、同じ内容を再度インポートしても二重に適用されない
+// atomicの場合は全ての行を1つのトランザクションで適用し、1行でも失敗した場合は他の行も適用しない
+// best_effortの場合は行毎に加算または減算と同じ処理で適用する
+func (u *userBalanceUsecase) ImportBalanceOperations(ctx context.Context, ops []domain.BalanceOperation, mode domain.ImportMode, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	if mode == "" {
+		mode = domain.ImportMode_Atomic
+	}
+	if mode != domain.ImportMode_Atomic && mode != domain.ImportMode_BestEffort {
+		return nil, errors.New("invalid import mode")
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("operations is empty")
+	}
+	if len(ops) > domain.MaxImportOperations {
+		return nil, errors.New("too many operations")
+	}
+	if err := audit.Validate(); err != nil {
+		return nil, err
+	}
+
+	results := make([]domain.ImportLineResult, len(ops))
+	pending := make([]int, 0, len(ops)) // 検証に成功した行の添字
+	seen := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		results[i] = domain.ImportLineResult{Line: op.Line, UserID: op.UserID, TransactionID: op.TransactionID}
+		if err := validateOperation(op, audit, seen); err != nil {
+			results[i].Status = domain.ImportLineStatus_Failed
+			results[i].Error = err.Error()
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if mode == domain.ImportMode_Atomic && len(pending) < len(ops) {
+		return abortImport(results, pending), nil
+	}
+
+	pending, err := u.skipAppliedOperations(ctx, ops, pending, results)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == domain.ImportMode_BestEffort {
+		for _, i := range pending {
+			op := ops[i]
+			if op.TransactionType == domain.TransactionType_ReduceUserBalance {
+				err = u.ReduceBalance(ctx, op.UserID, op.Amount, op.TransactionID, operationAudit(audit, op))
+			} else {
+				err = u.AddBalance(ctx, op.UserID, op.Amount, op.TransactionID, operationAudit(audit, op))
+			}
+			switch {
+			case err == nil:
+				results[i].Status = domain.ImportLineStatus_Applied
+			case err.Error() == "transaction_id must be unique":
+				// 事前の確認後に同じ取引IDが適用された
+				results[i].Status = domain.ImportLineStatus_Skipped
+			default:
+				results[i].Status = domain.ImportLineStatus_Failed
+				results[i].Error = err.Error()
+			}
+		}
+		return results, nil
+	}
+
+	return u.applyOperationsAtomically(ctx, ops, pending, results, audit)
+}
+
+// abortImport 一括適用を中止し、失敗していない行を未適用とした結果を返す
+func abortImport(results []domain.ImportLineResult, pending []int) []domain.ImportLineResult {
+	for _, i := range pending {
+		if results[i].Status == "" {
+			results[i].Status = domain.ImportLineStatus_NotApplied
+		}
+	}
+	return results
+}
+
+// skipAppliedOperations 取引履歴に存在する取引IDの行をスキップし、残りの行の添字を返す
+func (u *userBalanceUsecase) skipAppliedOperations(ctx context.Context, ops []domain.BalanceOperation, pending []int, results []domain.ImportLineResult) ([]int, error) {
+	if len(pending) == 0 {
+		return pending, nil
+	}
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	transactionIDs := make([]string, 0, len(pending))
+	for _, i := range pending {
+		transactionIDs = append(transactionIDs, ops[i].TransactionID)
+	}
+	existing, err := u.repo.QueryExistingTransactionIDs(ctx, transactionIDs)
+	if err != nil {
+		return nil, databaseError(ctx, err)
+	}
+	applied := make(map[string]bool, len(existing))
+	for _, transactionID := range existing {
+		applied[transactionID] = true
+	}
+
+	remaining := make([]int, 0, len(pending))
+	for _, i := range pending {
+		if applied[ops[i].TransactionID] {
+			results[i].Status = domain.ImportLineStatus_Skipped
+			continue
+		}
+		remaining = append(remaining, i)
+	}
+	return remaining, nil
+}
+
+// applyOperationsAtomically 権限、ユーザーの状態と残高を全ての行について検証した後、全ての行を1つのトランザクションで適用
+// タイムアウトは100行毎に1操作分を加算する
+func (u *userBalanceUsecase) applyOperationsAtomically(ctx context.Context, ops []domain.BalanceOperation, pending []int, results []domain.ImportLineResult, audit domain.AuditInfo) ([]domain.ImportLineResult, error) {
+	if len(pending) == 0 {
+		return results, nil
+	}
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout*time.Duration(1+len(pending)/100))
+	defer cancel()
+	ctx = domain.ContextWithPrimaryRead(ctx)
+
+	// fail 行を失敗として一括適用を中止
+	fail := func(i int, err error) []domain.ImportLineResult {
+		results[i].Status = domain.ImportLineStatus_Failed
+		results[i].Error = err.Error()
+		return abortImport(results, pending)
+	}
+
+	userIDs := make([]string, 0, len(pending))
+	for _, i := range pending {
+		if err := u.authorize(ctx, operationName(ops[i].TransactionType), ops[i].UserID); err != nil {
+			if err.Error() == "permission denied" {
+				return fail(i, err), nil
+			}
+			return nil, err
+		}
+		userIDs = append(userIDs, ops[i].UserID)
+	}
+	userBalances, err := u.repo.QueryUserBalancesByUserIDs(ctx, userIDs)
+	if err != nil {
+		return nil, databaseError(ctx, err)
+	}
+	users := make(map[string]domain.UserBalanceModel, len(userBalances))
+	for _, userBalance := range userBalances {
+		users[userBalance.UserID] = userBalance
+	}
+	// 同じユーザーの行を順に適用した後の残高で検証する
+	for _, i := range pending {
+		op := ops[i]
+		userBalance, ok := users[op.UserID]
+		if !ok {
+			return fail(i, errors.New("user not found")), nil
+		}
+		if op.TransactionType == domain.TransactionType_ReduceUserBalance {
+			if !userBalance.Status.CanDebit() {
+				return fail(i, statusError(userBalance.Status)), nil
+			}
+			if userBalance.Balance-op.Amount < 0 {
+				return fail(i, errors.New("balance insufficient")), nil
+			}
+			userBalance.Balance -= op.Amount
+		} else {
+			if !userBalance.Status.CanCredit() {
+				return fail(i, statusError(userBalance.Status)), nil
+			}
+			userBalance.Balance += op.Amount
+		}
+		users[op.UserID] = userBalance
+	}
+
+	ctx, err = u.repo.BeginTx(ctx)
+	if err != nil {
+		return nil, databaseError(ctx, err)
+	}
+
+	// rollback トランザクションをロールバックし、repositoryのエラーを行の結果に変換
+	rollback := func(i int, err error) ([]domain.ImportLineResult, error) {
+		if err := u.repo.Rollback(ctx); err != nil {
+			return nil, databaseError(ctx, err)
+		}
+
+		var pgErr *pgconn.PgError
+		if err == sql.ErrNoRows {
+			err = errors.New("user not found")
+		} else if errors.As(err, &pgErr) {
+			if pgErr.Code != "23505" {
+				return nil, databaseError(ctx, err)
+			}
+			err = errors.New("transaction_id must be unique")
+		}
+		return fail(i, err), nil
+	}
+
+	for _, i := range pending {
+		op := ops[i]
+		if op.TransactionType == domain.TransactionType_ReduceUserBalance {
+			err = u.repo.ReduceUserBalanceByUserID(ctx, op.UserID, op.Amount)
+		} else {
+			err = u.repo.AddUserBalanceByUserID(ctx, op.UserID, op.Amount)
+		}
+		if err != nil {
+			return rollback(i, err)
+		}
+		if err := u.repo.InsertTransactionHistory(ctx, op.TransactionID, op.UserID, op.TransactionType, op.Amount, operationAudit(audit, op)); err != nil {
+			return rollback(i, err)
+		}
+	}
+
+	if err := u.repo.Commit(ctx); err != nil {
+		return nil, databaseError(ctx, err)
+	}
+	for _, i := range pending {
+		op := ops[i]
+		results[i].Status = domain.ImportLineStatus_Applied
+		u.notifyAfterCommit(ctx, op.TransactionID, op.UserID, op.TransactionType, op.Amount, operationAudit(audit, op))
+	}
+	return results, nil
+}
+
+// countingExportWriter エクスポートした件数と残高の合計を集計し、writerが返したエラーを記録する
+type countingExportWriter struct {
+	next    domain.ExportWriter
+	summary domain.ExportSummary
+	err     error
+}
+
+func (w *countingExportWriter) WriteUserBalance(userBalance domain.UserBalanceModel) error {
+	if err := w.next.WriteUserBalance(userBalance); err != nil {
+		w.err = err
+		return err
+	}
+	w.summary.Balances++
+	w.summary.TotalBalance += int64(userBalance.Balance)
+	return nil
+}
+
+func (w *countingExportWriter) WriteTransactionHistory(history domain.TransactionHistoryModel) error {
+	if err := w.next.WriteTransactionHistory(history); err != nil {
+		w.err = err
+		return err
+	}
+	w.summary.Transactions++
+	return nil
+}
+
+// Export ユーザー残高と取引履歴を1つのスナップショットから読み取り、絞り込んだ行を順にwriterに渡す
+// 全てのユーザーを参照する権限が必要で、件数に比例して時間がかかるため操作のタイムアウトは適用せず呼び出し側のコンテキストに従う
+// writerがエラーを返した場合(クライアントの切断など)はそのエラーを返す
+func (u *userBalanceUsecase) Export(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) (domain.ExportSummary, error) {
+	for _, dataset := range q.Datasets {
+		if !dataset.Valid() {
+			return domain.ExportSummary{}, errors.New("invalid export dataset")
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return domain.ExportSummary{}, errors.New("invalid export period")
+	}
+	for _, transactionType := range q.TransactionTypes {
+		if transactionType < domain.TransactionType_AddUserBalance || transactionType > domain.TransactionType_AddAllUserBalance {
+			return domain.ExportSummary{}, errors.New("invalid transaction type")
+		}
+	}
+	if err := u.authorize(ctx, domain.Operation_GetBalance, ""); err != nil {
+		return domain.ExportSummary{}, err
+	}
+
+	cw := &countingExportWriter{next: w}
+	if err := u.repo.ExportSnapshot(ctx, q, cw); err != nil {
+		if cw.err != nil {
+			return cw.summary, cw.err
+		}
+		return cw.summary, databaseError(ctx, err)
+	}
+	return cw.summary, nil
+}
+
+// GetStatement ユーザーの期間内の取引明細を作成
+// 期間の開始時点の残高、期間内の取引(ユーザーに適用された一斉加算を含む)と各取引後の残高、終了時点の残高と取引種類毎の合計を返す
+// 期間の前の取引履歴は読み込まず、開始時点の残高はrepositoryで期間の前の最後の取引後の残高(balance_after)から取得する
+// 取引後の残高は記録されたbalance_afterを優先し、記録されていない取引(一斉加算など)は直前の取引後の残高から算出する
+func (u *userBalanceUsecase) GetStatement(ctx context.Context, userID string, from time.Time, to time.Time) (domain.Statement, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if from.IsZero() || to.IsZero() || !from.Before(to) || to.Sub(from) > domain.MaxStatementPeriod {
+		return domain.Statement{}, errors.New("invalid statement period")
+	}
+	if err := u.authorize(ctx, domain.Operation_GetBalance, userID); err != nil {
+		return domain.Statement{}, err
+	}
+
+	if _, err := u.queryUser(ctx, userID); err != nil {
+		return domain.Statement{}, err
+	}
+	opening, histories, err := u.repo.QueryTransactionHistoryInPeriod(ctx, userID, from, to)
+	if err != nil {
+		return domain.Statement{}, databaseError(ctx, err)
+	}
+
+	statement := domain.Statement{
+		UserID:         userID,
+		From:           from,
+		To:             to,
+		OpeningBalance: opening,
+		Transactions:   []domain.TransactionHistoryModel{},
+		Totals: []domain.StatementTotal{
+			{TransactionType: domain.TransactionType_AddUserBalance},
+			{TransactionType: domain.TransactionType_ReduceUserBalance},
+			{TransactionType: domain.TransactionType_AddAllUserBalance},
+		},
+	}
+	// 取引後の残高を持たない取引(一斉加算など)は直前の取引後の残高から算出する
+	balance := opening
+	for _, history := range histories {
+		if history.BalanceAfter != nil {
+			balance = *history.BalanceAfter
+		} else {
+			balance += history.SignedAmount()
+		}
+		balanceAfter := balance
+		history.BalanceAfter = &balanceAfter
+		statement.Transactions = append(statement.Transactions, history)
+		for j := range statement.Totals {
+			if statement.Totals[j].TransactionType == history.TransactionType {
+				statement.Totals[j].Count++
+				statement.Totals[j].Amount += int64(history.Amount)
+			}
+		}
+	}
+	statement.ClosingBalance = statement.OpeningBalance
+	if n := len(statement.Transactions); n > 0 {
+		statement.ClosingBalance = *statement.Transactions[n-1].BalanceAfter
+	}
+	return statement, nil
+}
+
+// reportVolumes 全ての取引種類の空の取引量
+func reportVolumes() []domain.ReportVolume {
+	return []domain.ReportVolume{
+		{TransactionType: domain.TransactionType_AddUserBalance},
+		{TransactionType: domain.TransactionType_ReduceUserBalance},
+		{TransactionType: domain.TransactionType_AddAllUserBalance},
+	}
+}
+
+// addReportVolume 日毎の集計を同じ取引種類の取引量に加算
+func addReportVolume(volumes []domain.ReportVolume, aggregate domain.DailyTransactionAggregate) {
+	for i := range volumes {
+		if volumes[i].TransactionType == aggregate.TransactionType {
+			volumes[i].Count += aggregate.Count
+			volumes[i].Amount += aggregate.Amount
+		}
+	}
+}
+
+// GetReport 全ユーザーの残高の合計(負債)と状態毎の内訳、期間毎の取引種類毎の取引件数と金額の集計レポートを作成
+// 期間は単位(日、週、月)の境界に広げ、取引量はAggregateRefresherが更新した日毎の集計を読み取るのみで、取引履歴の走査や書き込みは行わない
+// 全てのユーザーを参照する権限が必要で、加盟店スコープのロールは実行できない
+func (u *userBalanceUsecase) GetReport(ctx context.Context, q domain.ReportQuery) (domain.Report, error) {
+	ctx, cancel := u.repo.GetCtxWithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if !q.Granularity.Valid() {
+		return domain.Report{}, errors.New("invalid report granularity")
+	}
+	if q.From.IsZero() || q.To.IsZero() || !q.From.Before(q.To) {
+		return domain.Report{}, errors.New("invalid report period")
+	}
+	report := domain.Report{
+		From:        q.Granularity.Truncate(q.From),
+		Granularity: q.Granularity,
+		Periods:     []domain.ReportPeriod{},
+		Totals:      reportVolumes(),
+	}
+	for report.To = report.From; report.To.Before(q.To); report.To = q.Granularity.Next(report.To) {
+		if len(report.Periods) == domain.MaxReportPeriods {
+			return domain.Report{}, errors.New("invalid report period")
+		}
+		report.Periods = append(report.Periods, domain.ReportPeriod{Start: report.To, End: q.Granularity.Next(report.To), Volumes: reportVolumes()})
+	}
+	if err := u.authorize(ctx, domain.Operation_GetBalance, ""); err != nil {
+		return domain.Report{}, err
+	}
+
+	var err error
+	if report.Balances, err = u.repo.QueryBalanceStatusTotals(ctx); err != nil {
+		return domain.Report{}, databaseError(ctx, err)
+	}
+	for _, total := range report.Balances {
+		report.TotalUsers += total.Users
+		report.TotalBalance += total.Balance
+	}
+	aggregates, aggregatedUntil, err := u.repo.QueryDailyTransactionAggregates(ctx, report.From, report.To)
+	if err != nil {
+		return domain.Report{}, databaseError(ctx, err)
+	}
+	report.AggregatedUntil = aggregatedUntil
+
+	// 日毎の集計は日の順のため、期間の添字は先頭から順に進める
+	p := 0
+	for _, aggregate := range aggregates {
+		for p < len(report.Periods)-1 && !aggregate.Day.Before(report.Periods[p].End) {
+			p++
+		}
+		period := &report.Periods[p]
+		addReportVolume(period.Volumes, aggregate)
+		addReportVolume(report.Totals, aggregate)
+		if aggregate.TransactionType == domain.TransactionType_ReduceUserBalance {
+			period.Debit += aggregate.Amount
+		} else {
+			period.Credit += aggregate.Amount
+		}
+	}
+	return report, nil
+}
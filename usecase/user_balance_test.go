@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,15 +18,20 @@ import (
 type mockRepository struct {
 	userBalance        []domain.UserBalanceModel
 	transactionHistory []domain.TransactionHistoryModel
+	dailyAggregates    []domain.DailyTransactionAggregate
 }
 
 func NewMockRepository() domain.UserBalanceRepository {
 	userBalances := []domain.UserBalanceModel{
-		{UserID: "test_user1", Balance: 10000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user2", Balance: 20000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user3", Balance: 30000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user4", Balance: 40000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{UserID: "test_user5", Balance: 50000, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user1", Balance: 10000, MerchantID: "shop1", Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user2", Balance: 20000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user3", Balance: 30000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user4", Balance: 40000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "test_user5", Balance: 50000, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "debit_frozen_user", Balance: 10000, Status: domain.UserStatus_DebitFrozen, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "frozen_user", Balance: 10000, Status: domain.UserStatus_Frozen, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "closed_user", Balance: 0, Status: domain.UserStatus_Closed, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{UserID: "zero_user", Balance: 0, Status: domain.UserStatus_Active, CreatedAt: time.Now(), UpdatedAt: time.Now()},
 	}
 
 	transactionHistory := []domain.TransactionHistoryModel{
@@ -43,23 +51,23 @@ func NewMockRepository() domain.UserBalanceRepository {
 	}
 }
 
-func (repo *mockRepository) GetCtxWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), timeout)
+func (repo *mockRepository) GetCtxWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeout)
 }
 
-func (repo *mockRepository) BeginTx(ctx context.Context) error {
-	return nil
+func (repo *mockRepository) BeginTx(ctx context.Context) (context.Context, error) {
+	return ctx, nil
 }
 
-func (repo *mockRepository) Commit() error {
+func (repo *mockRepository) Commit(ctx context.Context) error {
 	return nil
 }
 
-func (repo *mockRepository) Rollback() error {
+func (repo *mockRepository) Rollback(ctx context.Context) error {
 	return nil
 }
 
-func (repo *mockRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int) error {
+func (repo *mockRepository) InsertTransactionHistory(ctx context.Context, transactionID string, userID string, transactionType domain.TransactionType, amount int, audit domain.AuditInfo) error {
 	for _, th := range repo.transactionHistory {
 		if th.TransactionID == transactionID {
 			pgErr := &pgconn.PgError{
@@ -112,12 +120,177 @@ func (repo *mockRepository) AddAllUserBalance(ctx context.Context, amount int) e
 	return nil
 }
 
+func (repo *mockRepository) QueryTransactionHistoryByUserID(ctx context.Context, userID string, afterTransactionID string) ([]domain.TransactionHistoryModel, error) {
+	histories := []domain.TransactionHistoryModel{}
+	found := afterTransactionID == ""
+	for _, th := range repo.transactionHistory {
+		if found && (th.UserID == userID || th.UserID == "") {
+			histories = append(histories, th)
+		}
+		if th.TransactionID == afterTransactionID {
+			found = true
+		}
+	}
+
+	return histories, nil
+}
+
+func (repo *mockRepository) QueryTransactionHistoryInPeriod(ctx context.Context, userID string, from time.Time, to time.Time) (int, []domain.TransactionHistoryModel, error) {
+	userBalance, err := repo.QueryUserBalanceByUserID(ctx, userID)
+	if err != nil {
+		return 0, nil, err
+	}
+	anchored := false
+	opening := 0
+	sinceFrom := 0
+	histories := []domain.TransactionHistoryModel{}
+	for _, th := range repo.transactionHistory {
+		if th.UserID != userID && th.UserID != "" {
+			continue
+		}
+		if !th.CreatedAt.Before(from) {
+			sinceFrom += th.SignedAmount()
+			if th.CreatedAt.Before(to) {
+				histories = append(histories, th)
+			}
+		} else if th.BalanceAfter != nil {
+			anchored = true
+			opening = *th.BalanceAfter
+		} else {
+			opening += th.SignedAmount()
+		}
+	}
+	if !anchored {
+		opening = userBalance.Balance - sinceFrom
+	}
+	return opening, histories, nil
+}
+
+func (repo *mockRepository) InsertUser(ctx context.Context, user domain.UserBalanceModel) error {
+	for _, ub := range repo.userBalance {
+		if ub.UserID == user.UserID {
+			pgErr := &pgconn.PgError{
+				Code: "23505",
+			}
+			return pgErr
+		}
+	}
+
+	return nil
+}
+
+func (repo *mockRepository) UpdateUserStatusByUserID(ctx context.Context, userID string, status domain.UserStatus) error {
+	for _, ub := range repo.userBalance {
+		if ub.UserID == userID && ub.Status != domain.UserStatus_Closed && (status != domain.UserStatus_Closed || ub.Balance == 0) {
+			return nil
+		}
+	}
+
+	return errors.New("update failed")
+}
+
+func (repo *mockRepository) InsertUserStatusHistory(ctx context.Context, userID string, status domain.UserStatus, audit domain.AuditInfo) error {
+	return nil
+}
+
+func (repo *mockRepository) QueryExistingTransactionIDs(ctx context.Context, transactionIDs []string) ([]string, error) {
+	existing := []string{}
+	for _, th := range repo.transactionHistory {
+		for _, transactionID := range transactionIDs {
+			if th.TransactionID == transactionID {
+				existing = append(existing, transactionID)
+			}
+		}
+	}
+	return existing, nil
+}
+
+func (repo *mockRepository) QueryUserBalancesByUserIDs(ctx context.Context, userIDs []string) ([]domain.UserBalanceModel, error) {
+	userBalances := []domain.UserBalanceModel{}
+	for _, ub := range repo.userBalance {
+		for _, userID := range userIDs {
+			if ub.UserID == userID {
+				userBalances = append(userBalances, ub)
+			}
+		}
+	}
+	return userBalances, nil
+}
+
+func (repo *mockRepository) QueryUserBalances(ctx context.Context, q domain.ListAccountsQuery) ([]domain.UserBalanceModel, error) {
+	userBalances := []domain.UserBalanceModel{}
+	for _, ub := range repo.userBalance {
+		matched := len(q.Statuses) == 0
+		for _, s := range q.Statuses {
+			matched = matched || ub.Status == s
+		}
+		if matched && (q.MerchantID == "" || ub.MerchantID == q.MerchantID) && ub.UserID > q.AfterUserID {
+			userBalances = append(userBalances, ub)
+		}
+	}
+	sort.Slice(userBalances, func(i, j int) bool { return userBalances[i].UserID < userBalances[j].UserID })
+	if len(userBalances) > q.PageSize {
+		userBalances = userBalances[:q.PageSize]
+	}
+	return userBalances, nil
+}
+
+func (repo *mockRepository) ExportSnapshot(ctx context.Context, q domain.ExportQuery, w domain.ExportWriter) error {
+	if q.Includes(domain.ExportDataset_Balances) {
+		for _, ub := range repo.userBalance {
+			if err := w.WriteUserBalance(ub); err != nil {
+				return err
+			}
+		}
+	}
+	if q.Includes(domain.ExportDataset_History) {
+		for _, th := range repo.transactionHistory {
+			if err := w.WriteTransactionHistory(th); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (repo *mockRepository) RefreshDailyTransactionAggregates(ctx context.Context) (time.Time, error) {
+	return time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+func (repo *mockRepository) QueryDailyTransactionAggregates(ctx context.Context, from time.Time, to time.Time) ([]domain.DailyTransactionAggregate, time.Time, error) {
+	aggregates := []domain.DailyTransactionAggregate{}
+	for _, aggregate := range repo.dailyAggregates {
+		if !aggregate.Day.Before(from) && aggregate.Day.Before(to) {
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	return aggregates, time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+func (repo *mockRepository) QueryBalanceStatusTotals(ctx context.Context) ([]domain.BalanceStatusTotal, error) {
+	totals := []domain.BalanceStatusTotal{}
+	for _, ub := range repo.userBalance {
+		found := false
+		for i := range totals {
+			if totals[i].Status == ub.Status {
+				totals[i].Users++
+				totals[i].Balance += int64(ub.Balance)
+				found = true
+			}
+		}
+		if !found {
+			totals = append(totals, domain.BalanceStatusTotal{Status: ub.Status, Users: 1, Balance: int64(ub.Balance)})
+		}
+	}
+	return totals, nil
+}
+
 var repo domain.UserBalanceRepository
 var usecase domain.UserBalanceUsecase
 
 func TestMain(m *testing.M) {
 	repo = NewMockRepository()
-	usecase = NewUserBalanceUsecase(repo)
+	usecase = NewUserBalanceUsecase(repo, 3*time.Second, true)
 	code := m.Run()
 	os.Exit(code)
 }
@@ -128,16 +301,23 @@ func TestAddBalance(t *testing.T) {
 		UserID         string
 		Amount         int
 		TransactionID  string
+		Audit          domain.AuditInfo
 		ExpectedErrMsg string
 	}{
-		{"existent user", "test_user1", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", ""},
-		{"transaction_id must be unique", "test_user5", 50000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique"},
-		{"nonexistent user", "unknown", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user not found"},
+		{"existent user", "test_user1", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{}, ""},
+		{"with audit info", "test_user1", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{Actor: "operator1", ReasonCode: "refund", Source: domain.RequestSource_gRPC}, ""},
+		{"transaction_id must be unique", "test_user5", 50000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", domain.AuditInfo{}, "transaction_id must be unique"},
+		{"nonexistent user", "unknown", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{}, "user not found"},
+		{"too long reason_code", "test_user1", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{ReasonCode: strings.Repeat("a", 65)}, "reason_code is too long"},
+		{"too long note", "test_user1", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{Note: strings.Repeat("a", 1001)}, "note is too long"},
+		{"debit frozen user", "debit_frozen_user", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{}, ""},
+		{"frozen user", "frozen_user", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{}, "user is frozen"},
+		{"closed user", "closed_user", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{}, "user is closed"},
 	}
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			err := usecase.AddBalance(c.UserID, c.Amount, c.TransactionID)
+			err := usecase.AddBalance(context.Background(), c.UserID, c.Amount, c.TransactionID, c.Audit)
 			if err != nil {
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -165,11 +345,14 @@ func TestReduceBalance(t *testing.T) {
 		{"transaction_id must be unique", "test_user5", 50000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique"},
 		{"insufficient balance", "test_user5", 60000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "balance insufficient"},
 		{"nonexistent user", "unknown", 10000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user not found"},
+		{"debit frozen user", "debit_frozen_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is frozen"},
+		{"frozen user", "frozen_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is frozen"},
+		{"closed user", "closed_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is closed"},
 	}
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			err := usecase.ReduceBalance(c.UserID, c.Amount, c.TransactionID)
+			err := usecase.ReduceBalance(context.Background(), c.UserID, c.Amount, c.TransactionID, domain.AuditInfo{})
 			if err != nil {
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -198,7 +381,7 @@ func TestAddAllUserBalance(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			err := usecase.AddAllUserBalance(c.Amount, c.TransactionID)
+			err := usecase.AddAllUserBalance(context.Background(), c.Amount, c.TransactionID, domain.AuditInfo{})
 			if err != nil {
 				if c.ExpectedErrMsg == "" {
 					t.Errorf("expect no error but got [%s]", err)
@@ -214,6 +397,78 @@ func TestAddAllUserBalance(t *testing.T) {
 	}
 }
 
+func TestTransferBalance(t *testing.T) {
+	cases := []struct {
+		Name           string
+		FromUserID     string
+		ToUserID       string
+		Amount         int
+		TransactionID  string
+		ExpectedErrMsg string
+	}{
+		{"existent users", "test_user1", "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", ""},
+		{"to user sorted before from user", "test_user2", "test_user1", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", ""},
+		{"same user", "test_user1", "test_user1", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "can't transfer to the same user"},
+		{"insufficient balance", "test_user1", "test_user2", 100000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "balance insufficient"},
+		{"nonexistent from user", "unknown", "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user not found"},
+		{"nonexistent to user", "test_user1", "unknown", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user not found"},
+		{"transaction_id must be unique", "test_user1", "test_user2", 1000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique"},
+		{"from debit frozen user", "debit_frozen_user", "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is frozen"},
+		{"to debit frozen user", "test_user1", "debit_frozen_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", ""},
+		{"to frozen user", "test_user1", "frozen_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is frozen"},
+		{"to closed user", "test_user1", "closed_user", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "user is closed"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			err := usecase.TransferBalance(context.Background(), c.FromUserID, c.ToUserID, c.Amount, c.TransactionID, domain.AuditInfo{})
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+		})
+	}
+}
+
+func TestTransferBalanceEvents(t *testing.T) {
+	const transactionID = "917cd5c0-0bfc-4283-bc88-b5de8ad13635"
+	var events []domain.BalanceChangeEvent
+	uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true, func(event domain.BalanceChangeEvent) {
+		events = append(events, event)
+	})
+	audit := domain.AuditInfo{Actor: "operator1", Metadata: map[string]string{"order_id": "o-1"}}
+	if err := uc.TransferBalance(context.Background(), "test_user1", "test_user2", 1000, transactionID, audit); err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expect [2] events but got [%d]", len(events))
+	}
+
+	debit, credit := events[0], events[1]
+	if debit.TransactionID != transactionID || debit.UserID != "test_user1" || debit.TransactionType != domain.TransactionType_ReduceUserBalance {
+		t.Errorf("unexpected debit event %+v", debit)
+	}
+	if credit.TransactionID != domain.TransferCreditTransactionID(transactionID) || credit.UserID != "test_user2" || credit.TransactionType != domain.TransactionType_AddUserBalance {
+		t.Errorf("unexpected credit event %+v", credit)
+	}
+	if debit.Metadata[domain.MetadataKey_TransferTo] != "test_user2" || credit.Metadata[domain.MetadataKey_TransferFrom] != "test_user1" {
+		t.Errorf("expect counterparty in metadata but got [%v] [%v]", debit.Metadata, credit.Metadata)
+	}
+	for _, event := range events {
+		if event.Metadata[domain.MetadataKey_TransferID] != transactionID || event.Metadata["order_id"] != "o-1" {
+			t.Errorf("expect transfer_id and caller metadata but got [%v]", event.Metadata)
+		}
+	}
+	if len(audit.Metadata) != 1 {
+		t.Errorf("expect caller metadata not to be modified but got [%v]", audit.Metadata)
+	}
+}
+
 func TestGetBalance(t *testing.T) {
 	cases := []struct {
 		Name            string
@@ -224,11 +479,13 @@ func TestGetBalance(t *testing.T) {
 		{"existent user1", "test_user1", 10000, nil},
 		{"existent user2", "test_user5", 50000, nil},
 		{"nonexistent user", "unknown", 10000, errors.New("user not found")},
+		{"frozen user", "frozen_user", 10000, nil},
+		{"closed user", "closed_user", 0, errors.New("user is closed")},
 	}
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			balance, err := usecase.GetBalance(c.UserID)
+			balance, err := usecase.GetBalance(context.Background(), c.UserID)
 			if err == nil {
 				if balance != c.ExpectedBalance {
 					t.Errorf("expect balance [%d], got [%d]", c.ExpectedBalance, balance)
@@ -240,3 +497,831 @@ func TestGetBalance(t *testing.T) {
 	}
 
 }
+
+func TestGetTransactionHistory(t *testing.T) {
+	cases := []struct {
+		Name               string
+		AfterTransactionID string
+		ExpectedCount      int
+		ExpectedErr        error
+	}{
+		{"all histories", "", 1, nil},
+		{"after existent transaction", "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", 0, nil},
+		{"after nonexistent transaction", "unknown", 0, errors.New("transaction not found")},
+	}
+
+	u := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true)
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			histories, err := u.GetTransactionHistory(context.Background(), "test_user1", c.AfterTransactionID)
+			if c.ExpectedErr != nil {
+				if err == nil || err.Error() != c.ExpectedErr.Error() {
+					t.Errorf("expect error [%s], got [%v]", c.ExpectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if len(histories) != c.ExpectedCount {
+				t.Errorf("expect [%d] histories, got [%d]", c.ExpectedCount, len(histories))
+			}
+		})
+	}
+}
+
+// primaryReadRecorder QueryUserBalanceByUserIDがプライマリでの読み取りを指定されたかを記録するrepository
+type primaryReadRecorder struct {
+	domain.UserBalanceRepository
+	primaryReads []bool
+}
+
+func (r *primaryReadRecorder) QueryUserBalanceByUserID(ctx context.Context, userID string) (domain.UserBalanceModel, error) {
+	r.primaryReads = append(r.primaryReads, domain.PrimaryReadFromContext(ctx))
+	return r.UserBalanceRepository.QueryUserBalanceByUserID(ctx, userID)
+}
+
+func TestPrimaryRead(t *testing.T) {
+	cases := []struct {
+		Name            string
+		Call            func(domain.UserBalanceUsecase) error
+		ExpectedPrimary bool
+	}{
+		{"get balance", func(uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(context.Background(), "test_user1")
+			return err
+		}, false},
+		{"add balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.AddBalance(context.Background(), "test_user1", 100, "0d3e9a4c-5f0b-4b7e-9c43-1b2a3c4d5e6f", domain.AuditInfo{})
+		}, true},
+		{"reduce balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.ReduceBalance(context.Background(), "test_user1", 100, "1e4f0b5d-6a1c-4c8f-8d54-2c3b4d5e6f70", domain.AuditInfo{})
+		}, true},
+		{"freeze user", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "test_user2", domain.FreezeScope_All, domain.AuditInfo{})
+		}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			recorder := &primaryReadRecorder{UserBalanceRepository: NewMockRepository()}
+			if err := c.Call(NewUserBalanceUsecase(recorder, 3*time.Second, true)); err != nil {
+				t.Fatalf("expect no error but got [%s]", err)
+			}
+			if len(recorder.primaryReads) == 0 {
+				t.Fatalf("expect user balance to be queried")
+			}
+			for _, primary := range recorder.primaryReads {
+				if primary != c.ExpectedPrimary {
+					t.Errorf("expect primary read [%t] but got [%t]", c.ExpectedPrimary, primary)
+				}
+			}
+		})
+	}
+}
+
+func TestAfterCommitHook(t *testing.T) {
+	cases := []struct {
+		Name            string
+		Call            func(domain.UserBalanceUsecase) error
+		ExpectedEvents  int
+		ExpectedUserID  string
+		ExpectedTxnType domain.TransactionType
+	}{
+		{"add balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.AddBalance(context.Background(), "test_user1", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{})
+		}, 1, "test_user1", domain.TransactionType_AddUserBalance},
+		{"reduce balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.ReduceBalance(context.Background(), "test_user2", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{})
+		}, 1, "test_user2", domain.TransactionType_ReduceUserBalance},
+		{"add all user balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.AddAllUserBalance(context.Background(), 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{})
+		}, 1, "", domain.TransactionType_AddAllUserBalance},
+		{"failed transaction", func(uc domain.UserBalanceUsecase) error {
+			return uc.AddBalance(context.Background(), "unknown", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", domain.AuditInfo{})
+		}, 0, "", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var events []domain.BalanceChangeEvent
+			uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true, func(event domain.BalanceChangeEvent) {
+				events = append(events, event)
+			})
+			c.Call(uc)
+			if len(events) != c.ExpectedEvents {
+				t.Fatalf("expect [%d] events but got [%d]", c.ExpectedEvents, len(events))
+			}
+			if c.ExpectedEvents == 0 {
+				return
+			}
+			if events[0].UserID != c.ExpectedUserID {
+				t.Errorf("expect user_id [%s] but got [%s]", c.ExpectedUserID, events[0].UserID)
+			}
+			if events[0].TransactionType != c.ExpectedTxnType {
+				t.Errorf("expect transaction type [%d] but got [%d]", c.ExpectedTxnType, events[0].TransactionType)
+			}
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	const transactionID = "917cd5c0-0bfc-4283-bc88-b5de8ad13635"
+	cases := []struct {
+		Name           string
+		Roles          []string
+		Call           func(context.Context, domain.UserBalanceUsecase) error
+		ExpectedErrMsg string
+	}{
+		{"reader can get balance", []string{domain.Role_Reader}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(ctx, "test_user1")
+			return err
+		}, ""},
+		{"reader can't add balance", []string{domain.Role_Reader}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.AddBalance(ctx, "test_user1", 1000, transactionID, domain.AuditInfo{})
+		}, "permission denied"},
+		{"operator can reduce balance", []string{domain.Role_Operator}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.ReduceBalance(ctx, "test_user1", 1000, transactionID, domain.AuditInfo{})
+		}, ""},
+		{"operator can't add all user balance", []string{domain.Role_Operator}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.AddAllUserBalance(ctx, 1000, transactionID, domain.AuditInfo{})
+		}, "permission denied"},
+		{"admin can add all user balance", []string{domain.Role_Admin}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.AddAllUserBalance(ctx, 1000, transactionID, domain.AuditInfo{})
+		}, ""},
+		{"merchant can reduce own user balance", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.ReduceBalance(ctx, "test_user1", 1000, transactionID, domain.AuditInfo{})
+		}, ""},
+		{"merchant can't reduce other user balance", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.ReduceBalance(ctx, "test_user2", 1000, transactionID, domain.AuditInfo{})
+		}, "permission denied"},
+		{"merchant can't find nonexistent user", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(ctx, "unknown")
+			return err
+		}, "permission denied"},
+		{"merchant can't add all user balance", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.AddAllUserBalance(ctx, 1000, transactionID, domain.AuditInfo{})
+		}, "permission denied"},
+		{"operator can create user", []string{domain.Role_Operator}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.CreateUser(ctx, "new_user", "", 0, "", domain.AuditInfo{})
+		}, ""},
+		{"operator can freeze user", []string{domain.Role_Operator}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(ctx, "test_user1", domain.FreezeScope_All, domain.AuditInfo{})
+		}, ""},
+		{"operator can't close user", []string{domain.Role_Operator}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(ctx, "zero_user", domain.AuditInfo{})
+		}, "permission denied"},
+		{"admin can close user", []string{domain.Role_Admin}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(ctx, "zero_user", domain.AuditInfo{})
+		}, ""},
+		{"merchant can't create user", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.CreateUser(ctx, "new_user", "shop1", 0, "", domain.AuditInfo{})
+		}, "permission denied"},
+		{"merchant can't freeze own user", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(ctx, "test_user1", domain.FreezeScope_All, domain.AuditInfo{})
+		}, "permission denied"},
+		{"reader can list accounts", []string{domain.Role_Reader}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, _, err := uc.ListAccounts(ctx, domain.ListAccountsQuery{})
+			return err
+		}, ""},
+		{"merchant can list own accounts", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, _, err := uc.ListAccounts(ctx, domain.ListAccountsQuery{MerchantID: "shop1"})
+			return err
+		}, ""},
+		{"merchant can't list all accounts", []string{"merchant:shop1"}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, _, err := uc.ListAccounts(ctx, domain.ListAccountsQuery{})
+			return err
+		}, "permission denied"},
+		{"no role can't batch get balances", []string{}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.BatchGetBalances(ctx, []string{"test_user1"})
+			return err
+		}, "permission denied"},
+		{"no role", []string{}, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(ctx, "test_user1")
+			return err
+		}, "permission denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := domain.ContextWithPrincipal(context.Background(), domain.Principal{ID: "principal", Roles: c.Roles})
+			err := c.Call(ctx, usecase)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+		})
+	}
+}
+
+func TestAuthorizationWithoutPrincipal(t *testing.T) {
+	cases := []struct {
+		Name           string
+		AuthDisabled   bool
+		Call           func(ctx context.Context, uc domain.UserBalanceUsecase) error
+		ExpectedErrMsg string
+	}{
+		{"get balance", false, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(ctx, "test_user1")
+			return err
+		}, "unauthenticated"},
+		{"batch get balances", false, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.BatchGetBalances(ctx, []string{"test_user1"})
+			return err
+		}, "unauthenticated"},
+		{"list accounts", false, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, _, err := uc.ListAccounts(ctx, domain.ListAccountsQuery{})
+			return err
+		}, "unauthenticated"},
+		{"add all user balance", false, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			return uc.AddAllUserBalance(ctx, 100, "d2e3c4a5-0000-4000-8000-000000000001", domain.AuditInfo{})
+		}, "unauthenticated"},
+		{"auth disabled", true, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, err := uc.GetBalance(ctx, "test_user1")
+			return err
+		}, ""},
+		{"auth disabled list accounts", true, func(ctx context.Context, uc domain.UserBalanceUsecase) error {
+			_, _, err := uc.ListAccounts(ctx, domain.ListAccountsQuery{})
+			return err
+		}, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, c.AuthDisabled)
+			err := c.Call(context.Background(), uc)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+		})
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	cases := []struct {
+		Name           string
+		UserID         string
+		MerchantID     string
+		OpeningBalance int
+		TransactionID  string
+		ExpectedErrMsg string
+		ExpectedEvents int
+	}{
+		{"without opening balance", "new_user", "", 0, "", "", 0},
+		{"with opening balance", "new_user", "shop1", 1000, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "", 1},
+		{"user already exists", "test_user1", "", 0, "", "user already exists", 0},
+		{"transaction_id must be unique", "new_user", "", 1000, "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b", "transaction_id must be unique", 0},
+		{"empty user_id", "", "", 0, "", "user_id is empty", 0},
+		{"too long user_id", strings.Repeat("a", 37), "", 0, "", "user_id is too long", 0},
+		{"too long merchant_id", "new_user", strings.Repeat("a", 37), 0, "", "merchant_id is too long", 0},
+		{"negative opening balance", "new_user", "", -1, "917cd5c0-0bfc-4283-bc88-b5de8ad13635", "opening balance must not be negative", 0},
+		{"opening balance without transaction_id", "new_user", "", 1000, "", "transaction_id is empty", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var events []domain.BalanceChangeEvent
+			uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true, func(event domain.BalanceChangeEvent) {
+				events = append(events, event)
+			})
+			err := uc.CreateUser(context.Background(), c.UserID, c.MerchantID, c.OpeningBalance, c.TransactionID, domain.AuditInfo{})
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if len(events) != c.ExpectedEvents {
+				t.Fatalf("expect [%d] events but got [%d]", c.ExpectedEvents, len(events))
+			}
+			if c.ExpectedEvents > 0 && (events[0].UserID != c.UserID || events[0].Amount != c.OpeningBalance || events[0].TransactionType != domain.TransactionType_AddUserBalance) {
+				t.Errorf("unexpected event %+v", events[0])
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	user, err := usecase.GetUser(context.Background(), "closed_user")
+	if err != nil {
+		t.Fatalf("expect no error but got [%s]", err)
+	}
+	if user.Status != domain.UserStatus_Closed {
+		t.Errorf("expect status [%s] but got [%s]", domain.UserStatus_Closed, user.Status)
+	}
+	if _, err := usecase.GetUser(context.Background(), "unknown"); err == nil || err.Error() != "user not found" {
+		t.Errorf("expect error [user not found] but got [%v]", err)
+	}
+}
+
+func TestChangeUserStatus(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Call           func(domain.UserBalanceUsecase) error
+		ExpectedErrMsg string
+	}{
+		{"freeze debit", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "test_user1", domain.FreezeScope_Debit, domain.AuditInfo{})
+		}, ""},
+		{"freeze all", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "debit_frozen_user", domain.FreezeScope_All, domain.AuditInfo{})
+		}, ""},
+		{"freeze frozen user", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "frozen_user", domain.FreezeScope_All, domain.AuditInfo{})
+		}, ""},
+		{"invalid freeze scope", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "test_user1", domain.FreezeScope("credit"), domain.AuditInfo{})
+		}, "invalid freeze scope"},
+		{"freeze closed user", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "closed_user", domain.FreezeScope_All, domain.AuditInfo{})
+		}, "user is closed"},
+		{"freeze nonexistent user", func(uc domain.UserBalanceUsecase) error {
+			return uc.FreezeUser(context.Background(), "unknown", domain.FreezeScope_All, domain.AuditInfo{})
+		}, "user not found"},
+		{"unfreeze", func(uc domain.UserBalanceUsecase) error {
+			return uc.UnfreezeUser(context.Background(), "frozen_user", domain.AuditInfo{})
+		}, ""},
+		{"unfreeze active user", func(uc domain.UserBalanceUsecase) error {
+			return uc.UnfreezeUser(context.Background(), "test_user1", domain.AuditInfo{})
+		}, "user is not frozen"},
+		{"close", func(uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(context.Background(), "zero_user", domain.AuditInfo{})
+		}, ""},
+		{"close user with balance", func(uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(context.Background(), "test_user1", domain.AuditInfo{})
+		}, "balance is not zero"},
+		{"close closed user", func(uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(context.Background(), "closed_user", domain.AuditInfo{})
+		}, "user is closed"},
+		{"too long reason_code", func(uc domain.UserBalanceUsecase) error {
+			return uc.CloseUser(context.Background(), "zero_user", domain.AuditInfo{ReasonCode: strings.Repeat("a", 65)})
+		}, "reason_code is too long"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			err := c.Call(usecase)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+		})
+	}
+}
+
+func TestBatchGetBalances(t *testing.T) {
+	tooMany := []string{}
+	for i := 0; i <= domain.MaxBatchGetBalancesSize; i++ {
+		tooMany = append(tooMany, "user"+strconv.Itoa(i))
+	}
+	cases := []struct {
+		Name            string
+		Roles           []string
+		UserIDs         []string
+		ExpectedResults []domain.BalanceResult
+		ExpectedErrMsg  string
+	}{
+		{"normal case", nil, []string{"test_user2", "unknown", "closed_user", "test_user2", "test_user1"}, []domain.BalanceResult{
+			{UserID: "test_user2", Balance: 20000, Found: true},
+			{UserID: "unknown"},
+			{UserID: "closed_user"},
+			{UserID: "test_user1", Balance: 10000, Found: true},
+		}, ""},
+		{"merchant can't see other users", []string{"merchant:shop1"}, []string{"test_user1", "test_user2"}, []domain.BalanceResult{
+			{UserID: "test_user1", Balance: 10000, Found: true},
+			{UserID: "test_user2"},
+		}, ""},
+		{"empty user ids", nil, []string{}, nil, "user_ids is empty"},
+		{"empty user id", nil, []string{"test_user1", ""}, nil, "user_id is empty"},
+		{"too many user ids", nil, tooMany, nil, "too many user_ids"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := context.Background()
+			if c.Roles != nil {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: "principal", Roles: c.Roles})
+			}
+			results, err := usecase.BatchGetBalances(ctx, c.UserIDs)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if len(results) != len(c.ExpectedResults) {
+				t.Fatalf("expect [%d] results but got [%d]", len(c.ExpectedResults), len(results))
+			}
+			for i, expected := range c.ExpectedResults {
+				if results[i] != expected {
+					t.Errorf("expect result %+v but got %+v", expected, results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	cases := []struct {
+		Name              string
+		Query             domain.ListAccountsQuery
+		ExpectedUsers     []string
+		ExpectedPageToken string
+		ExpectedErrMsg    string
+	}{
+		{"first page", domain.ListAccountsQuery{PageSize: 2}, []string{"closed_user", "debit_frozen_user"}, "debit_frozen_user", ""},
+		{"next page", domain.ListAccountsQuery{PageSize: 2, AfterUserID: "test_user3"}, []string{"test_user4", "test_user5"}, "test_user5", ""},
+		{"last page", domain.ListAccountsQuery{PageSize: 2, AfterUserID: "test_user5"}, []string{"zero_user"}, "", ""},
+		{"filter by status", domain.ListAccountsQuery{Statuses: []domain.UserStatus{domain.UserStatus_Frozen, domain.UserStatus_DebitFrozen}}, []string{"debit_frozen_user", "frozen_user"}, "", ""},
+		{"invalid status", domain.ListAccountsQuery{Statuses: []domain.UserStatus{"deleted"}}, nil, "", "invalid user status"},
+		{"invalid sort field", domain.ListAccountsQuery{SortBy: "name"}, nil, "", "invalid sort field"},
+		{"invalid balance range", domain.ListAccountsQuery{MinBalance: intPtr(100), MaxBalance: intPtr(10)}, nil, "", "invalid balance range"},
+		{"invalid created_at range", domain.ListAccountsQuery{CreatedAfter: time.Now(), CreatedBefore: time.Now().Add(-time.Hour)}, nil, "", "invalid created_at range"},
+		{"negative page size", domain.ListAccountsQuery{PageSize: -1}, nil, "", "page_size must not be negative"},
+		{"unknown page token", domain.ListAccountsQuery{AfterUserID: "unknown"}, nil, "", "invalid page_token"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			users, nextPageToken, err := usecase.ListAccounts(context.Background(), c.Query)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			got := []string{}
+			for _, user := range users {
+				got = append(got, user.UserID)
+			}
+			if strings.Join(got, ",") != strings.Join(c.ExpectedUsers, ",") {
+				t.Errorf("expect users %v but got %v", c.ExpectedUsers, got)
+			}
+			if nextPageToken != c.ExpectedPageToken {
+				t.Errorf("expect next page token [%s] but got [%s]", c.ExpectedPageToken, nextPageToken)
+			}
+		})
+	}
+}
+
+func TestImportBalanceOperations(t *testing.T) {
+	const appliedTransactionID = "b8eb7ccc-6bc3-4be3-b7f8-e2701bf19a6b"
+	add := func(line int, userID string, amount int, transactionID string) domain.BalanceOperation {
+		return domain.BalanceOperation{Line: line, UserID: userID, TransactionType: domain.TransactionType_AddUserBalance, Amount: amount, TransactionID: transactionID}
+	}
+	reduce := func(line int, userID string, amount int, transactionID string) domain.BalanceOperation {
+		return domain.BalanceOperation{Line: line, UserID: userID, TransactionType: domain.TransactionType_ReduceUserBalance, Amount: amount, TransactionID: transactionID}
+	}
+	tooMany := make([]domain.BalanceOperation, domain.MaxImportOperations+1)
+	cases := []struct {
+		Name             string
+		Mode             domain.ImportMode
+		Roles            []string
+		Ops              []domain.BalanceOperation
+		ExpectedStatuses []domain.ImportLineStatus
+		ExpectedErrors   []string
+		ExpectedEvents   int
+		ExpectedErrMsg   string
+	}{
+		{"atomic", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), reduce(3, "test_user2", 500, "tx2"), add(4, "test_user3", 1000, appliedTransactionID),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_Applied, domain.ImportLineStatus_Applied, domain.ImportLineStatus_Skipped}, []string{"", "", ""}, 2, ""},
+		{"atomic is default", "", nil, []domain.BalanceOperation{add(2, "test_user1", 1000, "tx1")},
+			[]domain.ImportLineStatus{domain.ImportLineStatus_Applied}, []string{""}, 1, ""},
+		{"atomic with invalid line", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "test_user1", 0, "tx2"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed}, []string{"", "amount must be positive"}, 0, ""},
+		{"atomic with duplicate transaction_id", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "test_user2", 1000, "tx1"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed}, []string{"", "duplicate transaction_id in import"}, 0, ""},
+		{"atomic checks balance after preceding lines", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			reduce(2, "test_user2", 15000, "tx1"), reduce(3, "test_user2", 6000, "tx2"), add(4, "test_user3", 1000, "tx3"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed, domain.ImportLineStatus_NotApplied}, []string{"", "balance insufficient", ""}, 0, ""},
+		{"atomic with frozen user", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "frozen_user", 1000, "tx2"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed}, []string{"", "user is frozen"}, 0, ""},
+		{"atomic with nonexistent user", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{
+			add(2, "unknown", 1000, "tx1"), add(3, "test_user1", 1000, "tx2"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_Failed, domain.ImportLineStatus_NotApplied}, []string{"user not found", ""}, 0, ""},
+		{"atomic without permission", domain.ImportMode_Atomic, []string{"merchant:shop1"}, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "test_user2", 1000, "tx2"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_NotApplied, domain.ImportLineStatus_Failed}, []string{"", "permission denied"}, 0, ""},
+		{"best effort", domain.ImportMode_BestEffort, nil, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "unknown", 1000, "tx2"), reduce(4, "test_user2", 500, "tx3"),
+			add(5, "test_user3", 1000, appliedTransactionID), reduce(6, "test_user3", 50000, "tx4"), {Line: 7, UserID: "test_user3", TransactionType: domain.TransactionType_AddAllUserBalance, Amount: 100, TransactionID: "tx5"},
+		}, []domain.ImportLineStatus{
+			domain.ImportLineStatus_Applied, domain.ImportLineStatus_Failed, domain.ImportLineStatus_Applied,
+			domain.ImportLineStatus_Skipped, domain.ImportLineStatus_Failed, domain.ImportLineStatus_Failed,
+		}, []string{"", "user not found", "", "", "balance insufficient", "invalid transaction type"}, 2, ""},
+		{"best effort without permission", domain.ImportMode_BestEffort, []string{"merchant:shop1"}, []domain.BalanceOperation{
+			add(2, "test_user1", 1000, "tx1"), add(3, "test_user2", 1000, "tx2"),
+		}, []domain.ImportLineStatus{domain.ImportLineStatus_Applied, domain.ImportLineStatus_Failed}, []string{"", "permission denied"}, 1, ""},
+		{"too long transaction_id", domain.ImportMode_BestEffort, nil, []domain.BalanceOperation{add(2, "test_user1", 1000, strings.Repeat("a", 37))},
+			[]domain.ImportLineStatus{domain.ImportLineStatus_Failed}, []string{"transaction_id is too long"}, 0, ""},
+		{"invalid mode", "all_or_nothing", nil, []domain.BalanceOperation{add(2, "test_user1", 1000, "tx1")}, nil, nil, 0, "invalid import mode"},
+		{"empty operations", domain.ImportMode_Atomic, nil, []domain.BalanceOperation{}, nil, nil, 0, "operations is empty"},
+		{"too many operations", domain.ImportMode_Atomic, nil, tooMany, nil, nil, 0, "too many operations"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ctx := context.Background()
+			if c.Roles != nil {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: "principal", Roles: c.Roles})
+			}
+			events := 0
+			uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true, func(domain.BalanceChangeEvent) {
+				events++
+			})
+			results, err := uc.ImportBalanceOperations(ctx, c.Ops, c.Mode, domain.AuditInfo{ReasonCode: "import"})
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if len(results) != len(c.ExpectedStatuses) {
+				t.Fatalf("expect [%d] results but got [%d]", len(c.ExpectedStatuses), len(results))
+			}
+			for i, result := range results {
+				if result.Line != c.Ops[i].Line || result.TransactionID != c.Ops[i].TransactionID {
+					t.Errorf("expect result of line [%d] but got %+v", c.Ops[i].Line, result)
+				}
+				if result.Status != c.ExpectedStatuses[i] || result.Error != c.ExpectedErrors[i] {
+					t.Errorf("expect line [%d] to be [%s %s] but got [%s %s]", result.Line, c.ExpectedStatuses[i], c.ExpectedErrors[i], result.Status, result.Error)
+				}
+			}
+			if events != c.ExpectedEvents {
+				t.Errorf("expect [%d] events but got [%d]", c.ExpectedEvents, events)
+			}
+		})
+	}
+}
+
+// failingExportWriter 書き込みに失敗するwriter
+type failingExportWriter struct{}
+
+func (failingExportWriter) WriteUserBalance(domain.UserBalanceModel) error {
+	return errors.New("connection closed")
+}
+
+func (failingExportWriter) WriteTransactionHistory(domain.TransactionHistoryModel) error {
+	return errors.New("connection closed")
+}
+
+// discardExportWriter 書き込んだ行を破棄するwriter
+type discardExportWriter struct{}
+
+func (discardExportWriter) WriteUserBalance(domain.UserBalanceModel) error { return nil }
+
+func (discardExportWriter) WriteTransactionHistory(domain.TransactionHistoryModel) error { return nil }
+
+func TestExport(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		Name            string
+		Query           domain.ExportQuery
+		Roles           []string
+		Writer          domain.ExportWriter
+		ExpectedSummary domain.ExportSummary
+		ExpectedErrMsg  string
+	}{
+		{"all", domain.ExportQuery{}, nil, discardExportWriter{}, domain.ExportSummary{Balances: 9, Transactions: 1, TotalBalance: 170000}, ""},
+		{"history only", domain.ExportQuery{Datasets: []domain.ExportDataset{domain.ExportDataset_History}}, []string{domain.Role_Reader},
+			discardExportWriter{}, domain.ExportSummary{Transactions: 1}, ""},
+		{"invalid dataset", domain.ExportQuery{Datasets: []domain.ExportDataset{"users"}}, nil, discardExportWriter{}, domain.ExportSummary{}, "invalid export dataset"},
+		{"invalid period", domain.ExportQuery{From: now, To: now}, nil, discardExportWriter{}, domain.ExportSummary{}, "invalid export period"},
+		{"invalid transaction type", domain.ExportQuery{TransactionTypes: []domain.TransactionType{3}}, nil, discardExportWriter{}, domain.ExportSummary{}, "invalid transaction type"},
+		{"merchant role", domain.ExportQuery{}, []string{"merchant:shop1"}, discardExportWriter{}, domain.ExportSummary{}, "permission denied"},
+		{"write failed", domain.ExportQuery{}, nil, failingExportWriter{}, domain.ExportSummary{}, "connection closed"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			uc := NewUserBalanceUsecase(NewMockRepository(), 3*time.Second, true)
+			ctx := context.Background()
+			if c.Roles != nil {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: "principal", Roles: c.Roles})
+			}
+			summary, err := uc.Export(ctx, c.Query, c.Writer)
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+			if summary != c.ExpectedSummary {
+				t.Errorf("expect summary %+v but got %+v", c.ExpectedSummary, summary)
+			}
+		})
+	}
+}
+
+func TestGetStatement(t *testing.T) {
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+	balanceAfter := func(balance int) *int { return &balance }
+	total := func(transactionType domain.TransactionType, count int, amount int64) domain.StatementTotal {
+		return domain.StatementTotal{TransactionType: transactionType, Count: count, Amount: amount}
+	}
+	// 初期残高3000は取引履歴がなく、一斉加算と記録を開始する前の取引は取引後の残高を持たない
+	histories := []domain.TransactionHistoryModel{
+		{TransactionID: "tx1", UserID: "test_user1", TransactionType: domain.TransactionType_AddUserBalance, Amount: 5000, BalanceAfter: balanceAfter(8000), CreatedAt: at("2021-05-20T00:00:00Z")},
+		{TransactionID: "tx2", TransactionType: domain.TransactionType_AddAllUserBalance, Amount: 1000, CreatedAt: at("2021-06-01T00:00:00Z")},
+		{TransactionID: "tx3", UserID: "test_user1", TransactionType: domain.TransactionType_ReduceUserBalance, Amount: 500, BalanceAfter: balanceAfter(8500), CreatedAt: at("2021-06-10T00:00:00Z")},
+		{TransactionID: "tx4", UserID: "test_user1", TransactionType: domain.TransactionType_AddUserBalance, Amount: 2000, CreatedAt: at("2021-07-05T00:00:00Z")},
+	}
+	cases := []struct {
+		Name             string
+		UserID           string
+		From             string
+		To               string
+		Roles            []string
+		ExpectedOpening  int
+		ExpectedClosing  int
+		ExpectedBalances map[string]int
+		ExpectedTotals   []domain.StatementTotal
+		ExpectedErrMsg   string
+	}{
+		{"month with bulk credit", "test_user1", "2021-06-01T00:00:00Z", "2021-07-01T00:00:00Z", nil, 8000, 8500, map[string]int{"tx2": 9000, "tx3": 8500},
+			[]domain.StatementTotal{total(domain.TransactionType_AddUserBalance, 0, 0), total(domain.TransactionType_ReduceUserBalance, 1, 500), total(domain.TransactionType_AddAllUserBalance, 1, 1000)}, ""},
+		{"opening without history", "test_user1", "2021-05-01T00:00:00Z", "2021-06-01T00:00:00Z", []string{"merchant:shop1"}, 3000, 8000, map[string]int{"tx1": 8000},
+			[]domain.StatementTotal{total(domain.TransactionType_AddUserBalance, 1, 5000), total(domain.TransactionType_ReduceUserBalance, 0, 0), total(domain.TransactionType_AddAllUserBalance, 0, 0)}, ""},
+		{"latest without balance after", "test_user1", "2021-07-01T00:00:00Z", "2021-08-01T00:00:00Z", nil, 8500, 10500, map[string]int{"tx4": 10500},
+			[]domain.StatementTotal{total(domain.TransactionType_AddUserBalance, 1, 2000), total(domain.TransactionType_ReduceUserBalance, 0, 0), total(domain.TransactionType_AddAllUserBalance, 0, 0)}, ""},
+		{"no transactions", "test_user1", "2021-08-01T00:00:00Z", "2021-09-01T00:00:00Z", nil, 10500, 10500, map[string]int{},
+			[]domain.StatementTotal{total(domain.TransactionType_AddUserBalance, 0, 0), total(domain.TransactionType_ReduceUserBalance, 0, 0), total(domain.TransactionType_AddAllUserBalance, 0, 0)}, ""},
+		{"empty period", "test_user1", "2021-06-01T00:00:00Z", "2021-06-01T00:00:00Z", nil, 0, 0, nil, nil, "invalid statement period"},
+		{"too long period", "test_user1", "2021-01-01T00:00:00Z", "2022-01-03T00:00:00Z", nil, 0, 0, nil, nil, "invalid statement period"},
+		{"user not found", "unknown", "2021-06-01T00:00:00Z", "2021-07-01T00:00:00Z", nil, 0, 0, nil, nil, "user not found"},
+		{"other merchant", "test_user1", "2021-06-01T00:00:00Z", "2021-07-01T00:00:00Z", []string{"merchant:shop2"}, 0, 0, nil, nil, "permission denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			repo := &mockRepository{
+				userBalance:        []domain.UserBalanceModel{{UserID: "test_user1", Balance: 10500, MerchantID: "shop1", Status: domain.UserStatus_Active}},
+				transactionHistory: histories,
+			}
+			uc := NewUserBalanceUsecase(repo, 3*time.Second, true)
+			ctx := context.Background()
+			if c.Roles != nil {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: "principal", Roles: c.Roles})
+			}
+			statement, err := uc.GetStatement(ctx, c.UserID, at(c.From), at(c.To))
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+				return
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+
+			if statement.OpeningBalance != c.ExpectedOpening || statement.ClosingBalance != c.ExpectedClosing {
+				t.Errorf("expect opening [%d] and closing [%d] but got [%d] and [%d]", c.ExpectedOpening, c.ExpectedClosing, statement.OpeningBalance, statement.ClosingBalance)
+			}
+			if len(statement.Transactions) != len(c.ExpectedBalances) {
+				t.Fatalf("expect [%d] transactions but got %+v", len(c.ExpectedBalances), statement.Transactions)
+			}
+			for _, history := range statement.Transactions {
+				if history.BalanceAfter == nil || *history.BalanceAfter != c.ExpectedBalances[history.TransactionID] {
+					t.Errorf("expect balance after [%s] to be [%d] but got %v", history.TransactionID, c.ExpectedBalances[history.TransactionID], history.BalanceAfter)
+				}
+			}
+			if len(statement.Totals) != len(c.ExpectedTotals) {
+				t.Fatalf("expect totals %+v but got %+v", c.ExpectedTotals, statement.Totals)
+			}
+			for i := range statement.Totals {
+				if statement.Totals[i] != c.ExpectedTotals[i] {
+					t.Errorf("expect totals %+v but got %+v", c.ExpectedTotals, statement.Totals)
+				}
+			}
+		})
+	}
+	if histories[1].BalanceAfter != nil {
+		t.Errorf("expect repository histories not to be modified")
+	}
+}
+
+func TestGetReport(t *testing.T) {
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+	aggregates := []domain.DailyTransactionAggregate{
+		{Day: at("2021-06-01T00:00:00Z"), TransactionType: domain.TransactionType_AddUserBalance, Count: 2, Amount: 3000},
+		{Day: at("2021-06-01T00:00:00Z"), TransactionType: domain.TransactionType_ReduceUserBalance, Count: 1, Amount: 500},
+		{Day: at("2021-06-07T00:00:00Z"), TransactionType: domain.TransactionType_AddAllUserBalance, Count: 1, Amount: 100},
+		{Day: at("2021-07-01T00:00:00Z"), TransactionType: domain.TransactionType_AddUserBalance, Count: 1, Amount: 1000},
+	}
+	cases := []struct {
+		Name            string
+		From            string
+		To              string
+		Granularity     domain.ReportGranularity
+		Roles           []string
+		ExpectedFrom    string
+		ExpectedPeriods []string // "開始日:入金:出金"
+		ExpectedTotals  []domain.ReportVolume
+		ExpectedErrMsg  string
+	}{
+		{"daily", "2021-06-01T00:00:00Z", "2021-06-03T00:00:00Z", domain.ReportGranularity_Day, nil, "2021-06-01T00:00:00Z",
+			[]string{"2021-06-01:3000:500", "2021-06-02:0:0"},
+			[]domain.ReportVolume{{TransactionType: domain.TransactionType_AddUserBalance, Count: 2, Amount: 3000}, {TransactionType: domain.TransactionType_ReduceUserBalance, Count: 1, Amount: 500}, {TransactionType: domain.TransactionType_AddAllUserBalance}}, ""},
+		{"weekly", "2021-06-01T00:00:00Z", "2021-06-15T00:00:00Z", domain.ReportGranularity_Week, []string{domain.Role_Reader}, "2021-05-31T00:00:00Z",
+			[]string{"2021-05-31:3000:500", "2021-06-07:100:0", "2021-06-14:0:0"},
+			[]domain.ReportVolume{{TransactionType: domain.TransactionType_AddUserBalance, Count: 2, Amount: 3000}, {TransactionType: domain.TransactionType_ReduceUserBalance, Count: 1, Amount: 500}, {TransactionType: domain.TransactionType_AddAllUserBalance, Count: 1, Amount: 100}}, ""},
+		{"monthly", "2021-06-15T09:00:00+09:00", "2021-07-02T00:00:00Z", domain.ReportGranularity_Month, nil, "2021-06-01T00:00:00Z",
+			[]string{"2021-06-01:3100:500", "2021-07-01:1000:0"},
+			[]domain.ReportVolume{{TransactionType: domain.TransactionType_AddUserBalance, Count: 3, Amount: 4000}, {TransactionType: domain.TransactionType_ReduceUserBalance, Count: 1, Amount: 500}, {TransactionType: domain.TransactionType_AddAllUserBalance, Count: 1, Amount: 100}}, ""},
+		{"invalid granularity", "2021-06-01T00:00:00Z", "2021-07-01T00:00:00Z", "year", nil, "", nil, nil, "invalid report granularity"},
+		{"empty period", "2021-06-01T00:00:00Z", "2021-06-01T00:00:00Z", domain.ReportGranularity_Day, nil, "", nil, nil, "invalid report period"},
+		{"too many periods", "2020-01-01T00:00:00Z", "2021-06-01T00:00:00Z", domain.ReportGranularity_Day, nil, "", nil, nil, "invalid report period"},
+		{"merchant role", "2021-06-01T00:00:00Z", "2021-07-01T00:00:00Z", domain.ReportGranularity_Month, []string{"merchant:shop1"}, "", nil, nil, "permission denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			repo := NewMockRepository().(*mockRepository)
+			repo.dailyAggregates = aggregates
+			uc := NewUserBalanceUsecase(repo, 3*time.Second, true)
+			ctx := context.Background()
+			if c.Roles != nil {
+				ctx = domain.ContextWithPrincipal(ctx, domain.Principal{ID: "principal", Roles: c.Roles})
+			}
+			report, err := uc.GetReport(ctx, domain.ReportQuery{From: at(c.From), To: at(c.To), Granularity: c.Granularity})
+			if err != nil {
+				if c.ExpectedErrMsg == "" {
+					t.Errorf("expect no error but got [%s]", err)
+				} else if err.Error() != c.ExpectedErrMsg {
+					t.Errorf("expect error [%s], got [%s]", c.ExpectedErrMsg, err)
+				}
+				return
+			} else if c.ExpectedErrMsg != "" {
+				t.Errorf("expect error [%s] but got no one", c.ExpectedErrMsg)
+			}
+
+			if !report.From.Equal(at(c.ExpectedFrom)) || !report.To.Equal(report.Periods[len(report.Periods)-1].End) {
+				t.Errorf("expect period from [%s] but got [%s] to [%s]", c.ExpectedFrom, report.From, report.To)
+			}
+			if report.TotalBalance != 170000 || report.TotalUsers != 9 || len(report.Balances) != 4 {
+				t.Errorf("expect total balance [170000] of [9] users in [4] statuses but got %+v", report)
+			}
+			if report.AggregatedUntil.IsZero() {
+				t.Errorf("expect aggregated time but got zero")
+			}
+			periods := make([]string, 0, len(report.Periods))
+			for _, period := range report.Periods {
+				periods = append(periods, period.Start.Format("2006-01-02")+":"+strconv.FormatInt(period.Credit, 10)+":"+strconv.FormatInt(period.Debit, 10))
+			}
+			if strings.Join(periods, ",") != strings.Join(c.ExpectedPeriods, ",") {
+				t.Errorf("expect periods %v but got %v", c.ExpectedPeriods, periods)
+			}
+			if len(report.Totals) != len(c.ExpectedTotals) {
+				t.Fatalf("expect totals %+v but got %+v", c.ExpectedTotals, report.Totals)
+			}
+			for i := range report.Totals {
+				if report.Totals[i] != c.ExpectedTotals[i] {
+					t.Errorf("expect totals %+v but got %+v", c.ExpectedTotals, report.Totals)
+				}
+			}
+		})
+	}
+}